@@ -17,6 +17,7 @@ import (
 	"github.com/baaaaaaaka/claude_code_helper/internal/diskspace"
 	"github.com/baaaaaaaka/claude_code_helper/internal/env"
 	"github.com/baaaaaaaka/claude_code_helper/internal/ids"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
 	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
 	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
 )
@@ -645,14 +646,14 @@ func resolveInstallerProxy(ctx context.Context, opts installProxyOptions) (strin
 
 	hc := manager.HealthClient{}
 	if inst := manager.FindReusableInstance(opts.Instances, opts.Profile.ID, hc); inst != nil {
-		return fmt.Sprintf("http://127.0.0.1:%d", inst.HTTPPort), nil, nil
+		return localproxy.ProxyURL(inst.HTTPPort, inst.ProxyToken), nil, nil
 	}
 
 	instanceID, err := ids.New()
 	if err != nil {
 		return "", nil, err
 	}
-	st, err := claudeInstallStackStart(*opts.Profile, instanceID, stack.Options{})
+	st, err := claudeInstallStackStart(*opts.Profile, instanceID, stack.Options{Version: version})
 	if err != nil {
 		return "", nil, err
 	}
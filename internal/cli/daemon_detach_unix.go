@@ -0,0 +1,15 @@
+//go:build !windows
+
+package cli
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachDaemon starts c in its own session, so Ctrl-C in the terminal of
+// the process that launched it, e.g. a `run` starting a shared daemon,
+// does not reach the daemon.
+func detachDaemon(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
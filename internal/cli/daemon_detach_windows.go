@@ -0,0 +1,14 @@
+//go:build windows
+
+package cli
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachDaemon starts c in its own process group, so Ctrl-C in the console
+// of the process that launched it does not reach the daemon.
+func detachDaemon(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
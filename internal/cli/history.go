@@ -93,7 +93,7 @@ func newHistoryTuiCmd(root *rootOptions, claudeDir *string, claudePath *string,
 		},
 	}
 	cmd.Flags().StringVar(claudePath, "claude-path", "", explicitClaudePathFlagHelp)
-	cmd.Flags().StringVar(profileRef, "profile", "", "Proxy profile id or name")
+	cmd.Flags().StringVar(profileRef, "profile", "", "Proxy profile id or name, or auto for the fastest reachable one")
 	cmd.Flags().DurationVar(&refreshInterval, "refresh-interval", defaultRefreshInterval, "Auto-refresh interval (0 to disable)")
 	addClaudeLaunchFlags(cmd, &root.claudeLaunch)
 	return cmd
@@ -219,7 +219,7 @@ func newHistoryOpenCmd(root *rootOptions, claudeDir *string, claudePath *string,
 				root,
 				store,
 				profile,
-				cfg.Instances,
+				proxyInstances(store),
 				session,
 				project,
 				*claudePath,
@@ -231,7 +231,7 @@ func newHistoryOpenCmd(root *rootOptions, claudeDir *string, claudePath *string,
 		},
 	}
 	cmd.Flags().StringVar(claudePath, "claude-path", "", explicitClaudePathFlagHelp)
-	cmd.Flags().StringVar(profileRef, "profile", "", "Proxy profile id or name")
+	cmd.Flags().StringVar(profileRef, "profile", "", "Proxy profile id or name, or auto for the fastest reachable one")
 	addClaudeLaunchFlags(cmd, &root.claudeLaunch)
 	return cmd
 }
@@ -323,7 +323,7 @@ func runHistoryTui(cmd *cobra.Command, root *rootOptions, profileRef string, cla
 				root,
 				store,
 				profile,
-				cfg.Instances,
+				proxyInstances(store),
 				selection.Cwd,
 				claudePath,
 				claudeDir,
@@ -337,7 +337,7 @@ func runHistoryTui(cmd *cobra.Command, root *rootOptions, profileRef string, cla
 			root,
 			store,
 			profile,
-			cfg.Instances,
+			proxyInstances(store),
 			selection.Session,
 			selection.Project,
 			claudePath,
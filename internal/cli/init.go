@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,6 +19,8 @@ import (
 
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
 	"github.com/baaaaaaaka/claude_code_helper/internal/ids"
+	"github.com/baaaaaaaka/claude_code_helper/internal/ssh"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
 )
 
 func newInitCmd(root *rootOptions) *cobra.Command {
@@ -90,6 +93,10 @@ func initProfileInteractiveWithDeps(
 	if err != nil {
 		return config.Profile{}, err
 	}
+	hops, err := promptJumpHosts(reader, out)
+	if err != nil {
+		return config.Profile{}, err
+	}
 
 	id, err := ids.New()
 	if err != nil {
@@ -103,6 +110,7 @@ func initProfileInteractiveWithDeps(
 		Host:      host,
 		Port:      port,
 		User:      user,
+		JumpHosts: hops,
 		CreatedAt: time.Now(),
 	}
 
@@ -135,10 +143,17 @@ func initProfileInteractiveWithDeps(
 }
 
 func prompt(r *bufio.Reader, label, def string) (string, error) {
-	if def != "" {
-		_, _ = fmt.Fprintf(os.Stderr, "%s [%s]: ", label, def)
-	} else {
-		_, _ = fmt.Fprintf(os.Stderr, "%s: ", label)
+	return promptTo(os.Stderr, r, label, def)
+}
+
+// promptTo is prompt with the label written to out; a nil out writes none.
+func promptTo(out io.Writer, r *bufio.Reader, label, def string) (string, error) {
+	if out != nil {
+		if def != "" {
+			_, _ = fmt.Fprintf(out, "%s [%s]: ", label, def)
+		} else {
+			_, _ = fmt.Fprintf(out, "%s: ", label)
+		}
 	}
 	s, err := r.ReadString('\n')
 	trimmed := strings.TrimSpace(s)
@@ -212,6 +227,60 @@ func promptYesNo(r *bufio.Reader, label string, def bool) (bool, error) {
 	}
 }
 
+// promptJumpHosts asks for bastions in connection order until a blank line
+// (or end of input), with an optional per-hop identity file. Prompts and
+// parse errors go to out.
+func promptJumpHosts(r *bufio.Reader, out io.Writer) ([]config.JumpHost, error) {
+	var hops []config.JumpHost
+	for {
+		spec, err := promptTo(out, r, fmt.Sprintf("Jump host %d (user@host[:port], blank when done)", len(hops)+1), "")
+		if errors.Is(err, io.EOF) || (err == nil && spec == "") {
+			return hops, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hop, err := parseJumpHost(spec)
+		if err != nil {
+			if out != nil {
+				_, _ = fmt.Fprintf(out, "%v\n", err)
+			}
+			continue
+		}
+		identity, err := promptTo(out, r, "Identity file for "+spec+" (optional)", "")
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		hop.IdentityFile = identity
+		hops = append(hops, hop)
+	}
+}
+
+// parseJumpHost parses [user@]host[:port], with IPv6 hosts in brackets.
+func parseJumpHost(spec string) (config.JumpHost, error) {
+	var hop config.JumpHost
+	rest := strings.TrimSpace(spec)
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		hop.User, rest = rest[:i], rest[i+1:]
+	}
+	hop.Host = rest
+	if strings.HasPrefix(rest, "[") || strings.Count(rest, ":") == 1 {
+		host, portStr, err := net.SplitHostPort(rest)
+		if err != nil {
+			return config.JumpHost{}, fmt.Errorf("invalid jump host %q: %v", spec, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return config.JumpHost{}, fmt.Errorf("invalid jump host port in %q", spec)
+		}
+		hop.Host, hop.Port = host, port
+	}
+	if err := ssh.ValidateJumpHosts([]ssh.JumpHost{{Host: hop.Host, Port: hop.Port, User: hop.User}}); err != nil {
+		return config.JumpHost{}, fmt.Errorf("invalid jump host %q", spec)
+	}
+	return hop, nil
+}
+
 func sshProbe(ctx context.Context, prof config.Profile, interactive bool) error {
 	args := []string{
 		"-p", strconv.Itoa(prof.Port),
@@ -222,6 +291,7 @@ func sshProbe(ctx context.Context, prof config.Profile, interactive bool) error
 			"-o", "ConnectTimeout=5",
 		)
 	}
+	args = append(args, ssh.JumpArgs(stack.JumpHosts(prof), !interactive)...)
 	args = append(args, prof.SSHArgs...)
 
 	dest := prof.User + "@" + prof.Host
@@ -293,11 +363,12 @@ func installPublicKey(ctx context.Context, prof config.Profile, pubKeyPath strin
 		pub = append(pub, '\n')
 	}
 
-	args := []string{
-		"-p", strconv.Itoa(prof.Port),
-		prof.User + "@" + prof.Host,
+	args := []string{"-p", strconv.Itoa(prof.Port)}
+	args = append(args, ssh.JumpArgs(stack.JumpHosts(prof), false)...)
+	args = append(args,
+		prof.User+"@"+prof.Host,
 		"umask 077; mkdir -p ~/.ssh; cat >> ~/.ssh/authorized_keys",
-	}
+	)
 	c := exec.CommandContext(ctx, "ssh", args...)
 	c.Stdin = bytes.NewReader(pub)
 	c.Stdout = os.Stdout
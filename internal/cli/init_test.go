@@ -2,11 +2,13 @@ package cli
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -335,3 +337,56 @@ func TestNewInitCmdSuccess(t *testing.T) {
 		t.Fatalf("newInitCmd error: %v", err)
 	}
 }
+
+func TestInitProfileInteractiveRecordsJumpHosts(t *testing.T) {
+	store := newTempStore(t)
+	input := "host.example\n22\nalice\n" +
+		"ops@b1.example\n\n" +
+		"not a host\n" +
+		"b2.example:2222\n/keys/b2\n" +
+		"\n"
+	reader := bufio.NewReader(strings.NewReader(input))
+	ops := &stubSSHOps{}
+	var out bytes.Buffer
+
+	prof, err := initProfileInteractiveWithDeps(context.Background(), store, reader, ops, &out)
+	if err != nil {
+		t.Fatalf("init profile error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Jump host 3 (user@host[:port], blank when done): ") || !strings.Contains(out.String(), `invalid jump host "not a host"`) {
+		t.Fatalf("expected jump host prompts and errors on the init writer, got %q", out.String())
+	}
+	want := []config.JumpHost{
+		{Host: "b1.example", User: "ops"},
+		{Host: "b2.example", Port: 2222, IdentityFile: "/keys/b2"},
+	}
+	if !reflect.DeepEqual(prof.JumpHosts, want) {
+		t.Fatalf("JumpHosts=%+v want %+v", prof.JumpHosts, want)
+	}
+}
+
+func TestParseJumpHost(t *testing.T) {
+	tests := []struct {
+		spec string
+		want config.JumpHost
+		ok   bool
+	}{
+		{spec: "b1", want: config.JumpHost{Host: "b1"}, ok: true},
+		{spec: "ops@b1:2200", want: config.JumpHost{Host: "b1", Port: 2200, User: "ops"}, ok: true},
+		{spec: "ops@[::1]:22", want: config.JumpHost{Host: "::1", Port: 22, User: "ops"}, ok: true},
+		{spec: "fe80::1", want: config.JumpHost{Host: "fe80::1"}, ok: true},
+		{spec: "b1:0", ok: false},
+		{spec: "b1:http", ok: false},
+		{spec: "a b", ok: false},
+		{spec: "ops@", ok: false},
+	}
+	for _, tt := range tests {
+		got, err := parseJumpHost(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Fatalf("parseJumpHost(%q) err=%v want ok=%v", tt.spec, err, tt.ok)
+		}
+		if tt.ok && got != tt.want {
+			t.Fatalf("parseJumpHost(%q)=%+v want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
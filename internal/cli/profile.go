@@ -41,6 +41,11 @@ func ensureProfile(
 		return *created, cfg, nil
 	}
 
+	if _, named := cfg.FindProfile(profileRef); !named && isAutoProfileRef(profileRef) {
+		p, err := selectAutoProfile(ctx, store, cfg)
+		return p, cfg, err
+	}
+
 	p, err := selectProfile(cfg, profileRef)
 	if err != nil {
 		if created != nil {
@@ -0,0 +1,171 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+)
+
+// autoProfileRef selects the fastest reachable profile instead of a named one.
+const autoProfileRef = "auto"
+
+const (
+	// autoProbeTimeout bounds each profile's reachability probe.
+	autoProbeTimeout = 3 * time.Second
+	// autoScoreTTL is how long a reachable profile's score is reused;
+	// unreachable ones are probed again after autoFailureTTL.
+	autoScoreTTL   = 10 * time.Minute
+	autoFailureTTL = 1 * time.Minute
+)
+
+var (
+	probeProfileLatency = dialProfileFirstHop
+	nowForAutoProfile   = time.Now
+	// autoProfileLog receives the auto-selection decision; stdout may carry
+	// JSON (run-json), so it goes to stderr.
+	autoProfileLog io.Writer = os.Stderr
+)
+
+func isAutoProfileRef(ref string) bool {
+	return strings.EqualFold(strings.TrimSpace(ref), autoProfileRef)
+}
+
+// selectAutoProfile probes every profile without a fresh cached score in
+// parallel, stores the new scores and returns the reachable profile with the
+// lowest connect latency, earlier profiles winning ties.
+func selectAutoProfile(ctx context.Context, store *config.Store, cfg config.Config) (config.Profile, error) {
+	if len(cfg.Profiles) == 0 {
+		return config.Profile{}, fmt.Errorf("no profiles found; run `claude-proxy init` (or run `claude-proxy` to create one)")
+	}
+
+	now := nowForAutoProfile()
+	scores := make([]config.ProfileScore, len(cfg.Profiles))
+	cached := make([]bool, len(cfg.Profiles))
+	var wg sync.WaitGroup
+	for i, p := range cfg.Profiles {
+		if s, ok := cfg.FindProfileScore(p.ID); ok && scoreIsFresh(s, now) {
+			scores[i], cached[i] = s, true
+			continue
+		}
+		wg.Add(1)
+		go func(i int, p config.Profile) {
+			defer wg.Done()
+			score := config.ProfileScore{ProfileID: p.ID, ProbedAt: now}
+			latency, err := probeProfileLatency(ctx, p)
+			if err != nil {
+				score.Error = err.Error()
+			} else {
+				score.LatencyMs = float64(latency.Microseconds()) / 1000
+			}
+			scores[i] = score
+		}(i, p)
+	}
+	wg.Wait()
+
+	var probed []config.ProfileScore
+	for i, s := range scores {
+		if !cached[i] {
+			probed = append(probed, s)
+		}
+	}
+	if len(probed) > 0 && store != nil {
+		// The cache only saves probes; failing to write it must not fail
+		// the selection.
+		_ = store.Update(func(c *config.Config) error {
+			for _, s := range probed {
+				c.UpsertProfileScore(s)
+			}
+			return nil
+		})
+	}
+
+	ranked := make([]int, 0, len(scores))
+	for i, s := range scores {
+		if s.Error == "" {
+			ranked = append(ranked, i)
+		}
+	}
+	if len(ranked) == 0 {
+		var reasons []string
+		for i, s := range scores {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", cfg.Profiles[i].Name, s.Error))
+		}
+		return config.Profile{}, fmt.Errorf("auto: no profile is reachable (%s)", strings.Join(reasons, "; "))
+	}
+	sort.SliceStable(ranked, func(a, b int) bool { return scores[ranked[a]].LatencyMs < scores[ranked[b]].LatencyMs })
+
+	describe := func(i int) string {
+		d := fmt.Sprintf("%q (%.1fms", cfg.Profiles[i].Name, scores[i].LatencyMs)
+		if cached[i] {
+			d += ", cached"
+		}
+		return d + ")"
+	}
+	best := ranked[0]
+	runnerUp := "none"
+	if len(ranked) > 1 {
+		runnerUp = describe(ranked[1])
+	}
+	_, _ = fmt.Fprintf(autoProfileLog, "auto: picked profile %s; runner-up %s\n", describe(best), runnerUp)
+	return cfg.Profiles[best], nil
+}
+
+func scoreIsFresh(s config.ProfileScore, now time.Time) bool {
+	ttl := autoScoreTTL
+	if s.Error != "" {
+		ttl = autoFailureTTL
+	}
+	age := now.Sub(s.ProbedAt)
+	return age >= 0 && age < ttl
+}
+
+// dialProfileFirstHop measures how long a TCP connection to the first host
+// the profile's tunnel connects to takes: the first jump host, the upstream
+// proxy, or the SSH host itself.
+func dialProfileFirstHop(ctx context.Context, p config.Profile) (time.Duration, error) {
+	addr, err := profileFirstHop(p)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, autoProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	_ = conn.Close()
+	return elapsed, nil
+}
+
+func profileFirstHop(p config.Profile) (string, error) {
+	if p.IsHTTPProxy() {
+		u, err := localproxy.ParseUpstreamProxyURL(p.UpstreamProxy)
+		if err != nil {
+			return "", err
+		}
+		return u.Host, nil
+	}
+	host, port := p.Host, p.Port
+	if len(p.JumpHosts) > 0 {
+		host, port = p.JumpHosts[0].Host, p.JumpHosts[0].Port
+	}
+	if strings.TrimSpace(host) == "" {
+		return "", fmt.Errorf("profile %q has no host", p.Name)
+	}
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(strings.TrimSpace(host), strconv.Itoa(port)), nil
+}
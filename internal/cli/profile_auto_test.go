@@ -0,0 +1,182 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+)
+
+func withAutoProfileHooks(t *testing.T, probe func(context.Context, config.Profile) (time.Duration, error), now time.Time) (*bytes.Buffer, *time.Time) {
+	t.Helper()
+	prevProbe := probeProfileLatency
+	prevNow := nowForAutoProfile
+	prevLog := autoProfileLog
+	t.Cleanup(func() {
+		probeProfileLatency = prevProbe
+		nowForAutoProfile = prevNow
+		autoProfileLog = prevLog
+	})
+	var log bytes.Buffer
+	clock := now
+	probeProfileLatency = probe
+	nowForAutoProfile = func() time.Time { return clock }
+	autoProfileLog = &log
+	return &log, &clock
+}
+
+func TestSelectAutoProfilePicksFastestAndCaches(t *testing.T) {
+	var mu sync.Mutex
+	probes := map[string]int{}
+	latencies := map[string]time.Duration{"slow": 80 * time.Millisecond, "fast": 12 * time.Millisecond, "second": 30 * time.Millisecond}
+	log, clock := withAutoProfileHooks(t, func(_ context.Context, p config.Profile) (time.Duration, error) {
+		mu.Lock()
+		probes[p.Name]++
+		mu.Unlock()
+		if p.Name == "down" {
+			return 0, errors.New("connection refused")
+		}
+		return latencies[p.Name], nil
+	}, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{
+			{ID: "p1", Name: "slow"}, {ID: "p2", Name: "down"}, {ID: "p3", Name: "fast"}, {ID: "p4", Name: "second"},
+		},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	p, err := selectAutoProfile(context.Background(), store, cfg)
+	if err != nil || p.ID != "p3" {
+		t.Fatalf("selectAutoProfile=%+v, %v; want fast", p, err)
+	}
+	if want := `auto: picked profile "fast" (12.0ms); runner-up "second" (30.0ms)`; strings.TrimSpace(log.String()) != want {
+		t.Fatalf("log %q want %q", log.String(), want)
+	}
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if s, ok := saved.FindProfileScore("p2"); !ok || s.Error != "connection refused" {
+		t.Fatalf("expected the failed probe to be cached, got %+v", saved.ProfileScores)
+	}
+
+	// Within a minute everything comes from the cache.
+	log.Reset()
+	*clock = clock.Add(30 * time.Second)
+	if p, err := selectAutoProfile(context.Background(), store, saved); err != nil || p.ID != "p3" {
+		t.Fatalf("cached selectAutoProfile=%+v, %v", p, err)
+	}
+	if probes["fast"] != 1 || probes["down"] != 1 || !strings.Contains(log.String(), `"fast" (12.0ms, cached)`) {
+		t.Fatalf("expected cached scores, probes=%v log=%q", probes, log.String())
+	}
+
+	// The failure expires first; the latencies are still fresh.
+	*clock = clock.Add(time.Minute)
+	saved, _ = store.Load()
+	if _, err := selectAutoProfile(context.Background(), store, saved); err != nil {
+		t.Fatalf("selectAutoProfile: %v", err)
+	}
+	if probes["fast"] != 1 || probes["down"] != 2 {
+		t.Fatalf("expected only the unreachable profile to be probed again, got %v", probes)
+	}
+}
+
+func TestSelectAutoProfileFailsWhenNothingIsReachable(t *testing.T) {
+	log, _ := withAutoProfileHooks(t, func(_ context.Context, p config.Profile) (time.Duration, error) {
+		return 0, errors.New("timeout")
+	}, time.Now())
+
+	cfg := config.Config{Profiles: []config.Profile{{ID: "p1", Name: "a"}, {ID: "p2", Name: "b"}}}
+	_, err := selectAutoProfile(context.Background(), nil, cfg)
+	if err == nil || err.Error() != "auto: no profile is reachable (a: timeout; b: timeout)" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if log.Len() != 0 {
+		t.Fatalf("expected no decision to be logged, got %q", log.String())
+	}
+	if _, err := selectAutoProfile(context.Background(), nil, config.Config{}); err == nil {
+		t.Fatalf("expected an error without profiles")
+	}
+}
+
+func TestEnsureProfileAuto(t *testing.T) {
+	log, _ := withAutoProfileHooks(t, func(_ context.Context, p config.Profile) (time.Duration, error) {
+		if p.Name == "b" {
+			return time.Millisecond, nil
+		}
+		return time.Second, nil
+	}, time.Now())
+
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version:  config.CurrentVersion,
+		Profiles: []config.Profile{{ID: "p1", Name: "a"}, {ID: "p2", Name: "b"}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	p, _, err := ensureProfile(context.Background(), store, "AUTO", false, nil)
+	if err != nil || p.ID != "p2" {
+		t.Fatalf("ensureProfile(auto)=%+v, %v", p, err)
+	}
+	if !strings.Contains(log.String(), `runner-up "a"`) {
+		t.Fatalf("expected the runner-up to be logged, got %q", log.String())
+	}
+
+	// A profile that is actually called "auto" is still selected by name.
+	cfg.Profiles = append(cfg.Profiles, config.Profile{ID: "p3", Name: "auto"})
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	if p, _, err := ensureProfile(context.Background(), store, "auto", false, nil); err != nil || p.ID != "p3" {
+		t.Fatalf("ensureProfile(auto) with a profile named auto=%+v, %v", p, err)
+	}
+}
+
+func TestDialProfileFirstHop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	if _, err := dialProfileFirstHop(context.Background(), config.Profile{Host: "127.0.0.1", Port: port}); err != nil {
+		t.Fatalf("dial listener: %v", err)
+	}
+	viaJump := config.Profile{Host: "unreachable.invalid", JumpHosts: []config.JumpHost{{Host: "127.0.0.1", Port: port}}}
+	if _, err := dialProfileFirstHop(context.Background(), viaJump); err != nil {
+		t.Fatalf("expected the first jump host to be dialed: %v", err)
+	}
+	_ = ln.Close()
+	if _, err := dialProfileFirstHop(context.Background(), config.Profile{Host: "127.0.0.1", Port: port}); err == nil {
+		t.Fatalf("expected a closed port to be unreachable")
+	}
+
+	for _, tc := range []struct {
+		p    config.Profile
+		want string
+	}{
+		{config.Profile{Host: "h"}, "h:22"},
+		{config.Profile{Host: "h", Port: 2222, JumpHosts: []config.JumpHost{{Host: "bastion"}}}, "bastion:22"},
+		{config.Profile{Type: config.ProfileTypeHTTPProxy, UpstreamProxy: "https://proxy.corp"}, "proxy.corp:443"},
+	} {
+		if got, err := profileFirstHop(tc.p); err != nil || got != tc.want {
+			t.Fatalf("profileFirstHop(%+v)=%q, %v want %q", tc.p, got, err, tc.want)
+		}
+	}
+	if _, err := profileFirstHop(config.Profile{Name: "empty"}); err == nil {
+		t.Fatalf("expected an error for a profile without a host")
+	}
+}
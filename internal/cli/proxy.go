@@ -3,14 +3,18 @@ package cli
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -20,8 +24,10 @@ import (
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
 	"github.com/baaaaaaaka/claude_code_helper/internal/diskspace"
 	"github.com/baaaaaaaka/claude_code_helper/internal/ids"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
 	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
 	"github.com/baaaaaaaka/claude_code_helper/internal/proc"
+	"github.com/baaaaaaaka/claude_code_helper/internal/ssh"
 	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
 )
 
@@ -44,7 +50,12 @@ var (
 	recordProxyInstance    = manager.RecordInstance
 	removeProxyInstance    = manager.RemoveInstance
 	heartbeatProxyInstance = manager.Heartbeat
+	recordProxyFailover    = manager.RecordFailover
 	newProxyTicker         = func(d time.Duration) proxyTicker { return timeTicker{Ticker: time.NewTicker(d)} }
+	runSSHProbe            = execSSHProbe
+	// proxyDaemonLog receives the daemon's lifecycle log; the daemon's
+	// stderr is the instance log.
+	proxyDaemonLog io.Writer = os.Stderr
 )
 
 func newProxyCmd(root *rootOptions) *cobra.Command {
@@ -58,8 +69,15 @@ func newProxyCmd(root *rootOptions) *cobra.Command {
 		newProxyDaemonCmd(root),
 		newProxyListCmd(root),
 		newProxyStopCmd(root),
+		newProxyStatusCmd(root),
+		newProxyReloadCmd(root),
 		newProxyPruneCmd(root),
 		newProxyDoctorCmd(root),
+		newProxyLogsCmd(root),
+		newProxyPACCmd(root),
+		newProxyBenchCmd(root),
+		newProxyInstallServiceCmd(root),
+		newProxyUninstallServiceCmd(root),
 	)
 
 	return cmd
@@ -118,33 +136,11 @@ func newProxyStartCmd(root *rootOptions) *cobra.Command {
 				return runProxyDaemon(cmd.Context(), store, instanceID)
 			}
 
-			exe, err := proxyExecutable()
-			if err != nil {
-				return err
-			}
-
-			args := []string{}
-			if root.configPath != "" {
-				args = append(args, "--config", root.configPath)
-			}
-			args = append(args, "proxy", "daemon", "--instance-id", instanceID)
-
-			logPath := filepath.Join(filepath.Dir(store.Path()), "instances", instanceID+".log")
-			pid, err := proxyDaemonLauncher(exe, args, logPath)
+			pid, logPath, err := launchProxyDaemon(store, root.configPath, instanceID)
 			if err != nil {
 				_ = removeProxyInstance(store, instanceID)
 				return err
 			}
-			_ = store.Update(func(cfg *config.Config) error {
-				for i := range cfg.Instances {
-					if cfg.Instances[i].ID == instanceID {
-						cfg.Instances[i].DaemonPID = pid
-						cfg.Instances[i].LastSeenAt = time.Now()
-						return nil
-					}
-				}
-				return nil
-			})
 
 			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Started instance %s (pid %d). Logs: %s\n", instanceID, pid, logPath)
 			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Use `claude-proxy proxy list` to see assigned ports.")
@@ -158,6 +154,9 @@ func newProxyStartCmd(root *rootOptions) *cobra.Command {
 
 func newProxyDaemonCmd(root *rootOptions) *cobra.Command {
 	var instanceID string
+	var service string
+	var serviceManager string
+	var port int
 
 	cmd := &cobra.Command{
 		Use:    "daemon --instance-id <id>",
@@ -165,98 +164,289 @@ func newProxyDaemonCmd(root *rootOptions) *cobra.Command {
 		Hidden: true,
 		Args:   cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, _ []string) error {
+			if (instanceID == "") == (service == "") {
+				return fmt.Errorf("exactly one of --instance-id or --service is required")
+			}
+			if port != 0 && service == "" {
+				return fmt.Errorf("--port requires --service")
+			}
 			store, err := newProxyStore(root.configPath)
 			if err != nil {
 				return err
 			}
+			if service != "" {
+				return runServiceDaemon(cmd.Context(), store, service, serviceManager, port)
+			}
 			return runProxyDaemon(cmd.Context(), store, instanceID)
 		},
 	}
 
 	cmd.Flags().StringVar(&instanceID, "instance-id", "", "Instance id")
-	_ = cmd.MarkFlagRequired("instance-id")
+	cmd.Flags().StringVar(&service, "service", "", "Run as the user service of this profile")
+	cmd.Flags().StringVar(&serviceManager, "service-manager", serviceManagerSystemd, "Service manager running the daemon")
+	cmd.Flags().IntVar(&port, "port", 0, "HTTP proxy port of the service")
 	return cmd
 }
 
+// launchProxyDaemon starts the daemon of the registered instance
+// instanceID in the background and records its PID.
+func launchProxyDaemon(store *config.Store, configPath, instanceID string) (int, string, error) {
+	exe, err := proxyExecutable()
+	if err != nil {
+		return 0, "", err
+	}
+
+	args := []string{}
+	if configPath != "" {
+		args = append(args, "--config", configPath)
+	}
+	args = append(args, "proxy", "daemon", "--instance-id", instanceID)
+
+	logPath := instanceLogPath(store, instanceID)
+	pid, err := proxyDaemonLauncher(exe, args, logPath)
+	if err != nil {
+		return 0, logPath, err
+	}
+	_ = manager.UpdateInstance(store, instanceID, func(inst *config.Instance) {
+		inst.DaemonPID = pid
+		inst.LastSeenAt = time.Now()
+	})
+	return pid, logPath, nil
+}
+
 func runProxyDaemon(parentCtx context.Context, store *config.Store, instanceID string) error {
 	ctx, stop := signal.NotifyContext(parentCtx, os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	cfg, err := store.Load()
+	inst, found, err := manager.LoadInstance(store, instanceID)
 	if err != nil {
 		return err
 	}
-
-	var inst config.Instance
-	found := false
-	for _, it := range cfg.Instances {
-		if it.ID == instanceID {
-			inst = it
-			found = true
-			break
-		}
-	}
 	if !found {
-		return fmt.Errorf("instance %q not found in config", instanceID)
+		return fmt.Errorf("instance %q not found", instanceID)
 	}
-
-	var prof config.Profile
-	pfound := false
-	for _, p := range cfg.Profiles {
-		if p.ID == inst.ProfileID {
-			prof = p
-			pfound = true
-			break
-		}
-	}
-	if !pfound {
-		return fmt.Errorf("profile %q not found for instance %q", inst.ProfileID, instanceID)
+	cfg, err := store.Load()
+	if err != nil {
+		return err
 	}
 
-	opts := stack.Options{
-		SocksPort: inst.SocksPort,
+	prof, err := instanceProfile(cfg, inst)
+	if err != nil {
+		return err
 	}
-	if inst.HTTPPort > 0 {
-		opts.HTTPListenAddr = fmt.Sprintf("127.0.0.1:%d", inst.HTTPPort)
+
+	// A shared daemon runs until it has had no lease for idle.
+	var idle time.Duration
+	if inst.Shared {
+		if idle, err = cfg.SharedDaemonIdleTimeout(); err != nil {
+			return err
+		}
 	}
 
-	st, err := stackStart(prof, instanceID, opts)
+	d := &proxyDaemon{store: store, inst: inst}
+	opts, err := d.stackOptions(cfg, prof)
 	if err != nil {
 		return err
 	}
-	defer func() { _ = st.Close(context.Background()) }()
-
-	now := time.Now()
-	inst.DaemonPID = os.Getpid()
-	inst.Kind = config.InstanceKindDaemon
-	inst.SocksPort = st.SocksPort
-	inst.HTTPPort = st.HTTPPort
-	if inst.StartedAt.IsZero() {
-		inst.StartedAt = now
+	if err := d.start(prof, opts); err != nil {
+		return err
 	}
-	inst.LastSeenAt = now
-	_ = recordProxyInstance(store, inst)
+	defer d.close()
+
+	ctl, closeControl := d.serveControl()
+	defer closeControl()
 
 	t := newProxyTicker(10 * time.Second)
 	defer t.Stop()
 
 	for {
 		select {
-		case err := <-st.Fatal():
+		case err := <-d.st.Fatal():
 			_ = removeProxyInstance(store, instanceID)
 			return err
 		case <-ctx.Done():
+			res := d.stopStack()
+			_ = writeProxyStopReport(store, instanceID, res)
 			_ = removeProxyInstance(store, instanceID)
 			return nil
 		case <-t.Chan():
 			_ = heartbeatProxyInstance(store, instanceID, time.Now())
+			if d.inst.Shared && d.expireIdle(idle) {
+				// Nobody runs `proxy stop` or prune for an instance that
+				// left the registry on its own, so clean up after it here.
+				d.stopStack()
+				removeInstanceLogs(store, instanceID)
+				return nil
+			}
+		case c := <-ctl:
+			resp, exit, err := d.handleControl(c.req)
+			c.reply <- resp
+			if exit {
+				return err
+			}
+		}
+	}
+}
+
+// instanceProfile returns the profile inst runs, matched by id only.
+func instanceProfile(cfg config.Config, inst config.Instance) (config.Profile, error) {
+	for _, p := range cfg.Profiles {
+		if p.ID == inst.ProfileID {
+			return p, nil
 		}
 	}
+	return config.Profile{}, fmt.Errorf("profile %q not found for instance %q", inst.ProfileID, inst.ID)
+}
+
+// proxyDaemon is a running daemon: its instance and the stack it owns,
+// which a reload replaces.
+type proxyDaemon struct {
+	store *config.Store
+	inst  config.Instance
+
+	prof        config.Profile
+	opts        stack.Options
+	st          *stack.Stack
+	unsubscribe func()
+	logged      <-chan struct{}
+
+	stopProbe func()
+
+	reloads int
+	// failovers counts profile switches over the daemon's life, across
+	// the stacks that reloads replace.
+	failovers atomic.Int64
+}
+
+// stackOptions builds the stack options for prof.
+func (d *proxyDaemon) stackOptions(cfg config.Config, prof config.Profile) (stack.Options, error) {
+	failover, err := cfg.FailoverProfiles(prof)
+	if err != nil {
+		return stack.Options{}, err
+	}
+	restart, err := stack.ProfileRestartPolicy(prof)
+	if err != nil {
+		return stack.Options{}, err
+	}
+
+	opts := stack.Options{
+		AccessLogPath: instanceAccessLogPath(d.store, d.inst.ID),
+		Version:       version,
+		Tunnels:       prof.Tunnels,
+		Restart:       restart,
+		Failover:      failover,
+	}
+	opts.OnFailover = func(e stack.FailoverEvent) {
+		n := d.failovers.Add(1)
+		_ = recordProxyFailover(d.store, d.inst.ID, e.To.ID, int(n))
+	}
+	return opts, nil
+}
+
+// start brings up a stack for prof and records the instance as running it.
+// The stack listens on the instance's ports with its credential, once
+// assigned, so clients are unaffected when a reload restarts it.
+func (d *proxyDaemon) start(prof config.Profile, opts stack.Options) error {
+	opts.SocksPort = d.inst.SocksPort
+	opts.ProxyAuthToken = d.inst.ProxyToken
+	opts.SOCKSAuthToken = d.inst.SOCKSToken
+	opts.HTTPListenAddr = ""
+	if d.inst.HTTPPort > 0 {
+		opts.HTTPListenAddr = fmt.Sprintf("127.0.0.1:%d", d.inst.HTTPPort)
+	}
+	opts.SOCKSListenAddr = ""
+	if d.inst.SOCKSListenPort > 0 {
+		opts.SOCKSListenAddr = fmt.Sprintf("127.0.0.1:%d", d.inst.SOCKSListenPort)
+	}
+
+	st, err := stackStart(prof, d.inst.ID, opts)
+	if err != nil {
+		return err
+	}
+	probe, err := newTunnelProbe(prof, st)
+	if err != nil {
+		_ = st.Close(context.Background())
+		return err
+	}
+	events, unsubscribe := st.Subscribe()
+	d.logged = logStackEvents(proxyDaemonLog, events)
+	d.unsubscribe = unsubscribe
+	d.prof, d.opts, d.st = prof, opts, st
+	d.stopProbe = probe.run()
+
+	now := time.Now()
+	d.inst.DaemonPID = os.Getpid()
+	d.inst.Kind = config.InstanceKindDaemon
+	d.inst.SocksPort = st.SocksPort
+	d.inst.HTTPPort = st.HTTPPort
+	d.inst.ProxyToken = st.ProxyAuthToken
+	d.inst.SOCKSListenPort = st.SOCKSListenPort
+	d.inst.SOCKSToken = st.SOCKSAuthToken
+	d.inst.ActiveProfileID = ""
+	if active := st.ActiveProfile(); active.ID != prof.ID {
+		d.inst.ActiveProfileID = active.ID
+	}
+	d.inst.Failovers = int(d.failovers.Load())
+	if d.inst.StartedAt.IsZero() {
+		d.inst.StartedAt = now
+	}
+	d.inst.LastSeenAt = now
+	if err := manager.UpdateInstance(d.store, d.inst.ID, func(inst *config.Instance) {
+		// Other processes take and release leases meanwhile.
+		d.inst.Leases, d.inst.IdleSince = inst.Leases, inst.IdleSince
+		*inst = d.inst
+	}); err != nil {
+		_ = recordProxyInstance(d.store, d.inst)
+	}
+	return nil
+}
+
+// expireIdle reports whether the shared daemon has had no lease for idle.
+// It is then already out of the registry, so nobody can take a new lease.
+func (d *proxyDaemon) expireIdle(idle time.Duration) bool {
+	removed, err := manager.ExpireIdleInstance(d.store, d.inst.ID, time.Now(), idle)
+	if err != nil || !removed {
+		return false
+	}
+	d.logf("no leases for %s; exiting", idle)
+	return true
+}
+
+// stopStack shuts the stack down, draining open tunnels, and waits for its
+// last events to be logged.
+func (d *proxyDaemon) stopStack() localproxy.DrainResult {
+	if d.st == nil {
+		return localproxy.DrainResult{}
+	}
+	d.stopProbe()
+	res, _ := d.st.Shutdown(context.Background())
+	d.unsubscribe()
+	<-d.logged
+	d.st = nil
+	return res
+}
+
+func (d *proxyDaemon) close() {
+	d.stopStack()
+}
+
+// logStackEvents writes one timestamped line per stack event until events
+// is closed, then closes the returned channel.
+func logStackEvents(w io.Writer, events <-chan stack.Event) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			_, _ = fmt.Fprintf(w, "%s %s\n", e.Time.Format(time.RFC3339), e)
+		}
+	}()
+	return done
 }
 
 func launchProxyDaemonProcess(exe string, args []string, logPath string) (int, error) {
 	c := exec.Command(exe, args...)
 	c.Stdin = nil
+	detachDaemon(c)
 
 	if err := os.MkdirAll(filepath.Dir(logPath), 0o700); err != nil {
 		return 0, err
@@ -285,40 +475,83 @@ func newProxyListCmd(root *rootOptions) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			instances, err := manager.ListInstances(store)
+			if err != nil {
+				return err
+			}
 			cfg, err := store.Load()
 			if err != nil {
 				return err
 			}
 
+			now := time.Now()
 			hc := manager.HealthClient{Timeout: 500 * time.Millisecond}
 			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
-			_, _ = fmt.Fprintln(w, "INSTANCE\tPROFILE\tPID\tHTTP\tSOCKS\tSTATUS\tLAST_SEEN")
-			for _, inst := range cfg.Instances {
+			_, _ = fmt.Fprintln(w, "INSTANCE\tPROFILE\tPID\tHTTP\tSOCKS\tSOCKS5\tFAILOVER\tFORWARDS\tLEASES\tSTATUS\tLAST_SEEN")
+			for _, inst := range instances {
+				// stale: the PID runs but has stopped heartbeating, so it
+				// most likely belongs to another process by now.
 				status := "dead"
 				if inst.DaemonPID > 0 && proc.IsAlive(inst.DaemonPID) {
 					status = "alive"
-					if inst.HTTPPort > 0 {
-						if err := hc.CheckHTTPProxy(inst.HTTPPort, inst.ID); err != nil {
+					if manager.IsInstanceStale(inst, now, manager.StaleAfter) {
+						status = "stale"
+					} else if inst.HTTPPort > 0 {
+						if err := hc.CheckInstance(inst); err != nil {
 							status = "unhealthy"
 						}
 					}
 				}
-				profileName := inst.ProfileID
-				for _, p := range cfg.Profiles {
-					if p.ID == inst.ProfileID {
-						profileName = p.Name
-						break
+				profileName := profileDisplayName(cfg, inst.ProfileID)
+
+				socks5 := "-"
+				if inst.SOCKSListenPort > 0 {
+					socks5 = strconv.Itoa(inst.SOCKSListenPort)
+				}
+
+				// FAILOVER shows the profile carrying traffic and how many
+				// switches it took to get there.
+				failover := "-"
+				if inst.Failovers > 0 {
+					active := profileName
+					if inst.ActiveProfileID != "" {
+						active = profileDisplayName(cfg, inst.ActiveProfileID)
 					}
+					failover = fmt.Sprintf("%s (%d)", active, inst.Failovers)
+				}
+
+				// FORWARDS are the -L forwards of the profile carrying traffic.
+				forwards := "-"
+				activeID := inst.ProfileID
+				if inst.ActiveProfileID != "" {
+					activeID = inst.ActiveProfileID
+				}
+				if p, ok := cfg.FindProfile(activeID); ok && len(p.LocalForwards) > 0 {
+					var specs []string
+					for _, f := range stack.LocalForwards(p) {
+						specs = append(specs, f.String())
+					}
+					forwards = strings.Join(specs, ",")
+				}
+
+				// LEASES counts the processes using a shared daemon.
+				leases := "-"
+				if inst.Shared {
+					leases = strconv.Itoa(len(manager.LiveLeases(inst)))
 				}
 
 				_, _ = fmt.Fprintf(
 					w,
-					"%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+					"%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
 					inst.ID,
 					profileName,
 					inst.DaemonPID,
 					inst.HTTPPort,
 					inst.SocksPort,
+					socks5,
+					failover,
+					forwards,
+					leases,
 					status,
 					inst.LastSeenAt.Format(time.RFC3339),
 				)
@@ -330,6 +563,15 @@ func newProxyListCmd(root *rootOptions) *cobra.Command {
 	return cmd
 }
 
+func profileDisplayName(cfg config.Config, profileID string) string {
+	for _, p := range cfg.Profiles {
+		if p.ID == profileID {
+			return p.Name
+		}
+	}
+	return profileID
+}
+
 func newProxyStopCmd(root *rootOptions) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "stop [instance-id]",
@@ -340,30 +582,50 @@ func newProxyStopCmd(root *rootOptions) *cobra.Command {
 			if err != nil {
 				return err
 			}
-			cfg, err := store.Load()
+			id := args[0]
+			inst, found, err := manager.LoadInstance(store, id)
 			if err != nil {
 				return err
 			}
+			if !found {
+				return fmt.Errorf("instance %q not found", id)
+			}
 
-			id := args[0]
-			var inst config.Instance
-			found := false
-			for _, it := range cfg.Instances {
-				if it.ID == id {
-					inst = it
-					found = true
-					break
+			reportPath := instanceStopReportPath(store, id)
+			if inst.ServiceName != "" {
+				_ = os.Remove(reportPath)
+				if err := stopServiceInstance(inst); err != nil {
+					return err
+				}
+				_ = manager.RemoveInstance(store, id)
+				if res, ok := readProxyStopReport(reportPath); ok {
+					_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Stopped service %s (drained %d, killed %d connections)\n", inst.ServiceName, res.Drained, res.Killed)
+					return nil
 				}
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Stopped service %s\n", inst.ServiceName)
+				return nil
 			}
-			if !found {
-				return fmt.Errorf("instance %q not found", id)
+
+			// A daemon with a control socket drains and reports on its own;
+			// older or wedged ones are signalled.
+			if resp, err := manager.CallControl(manager.ControlSocketPath(store, id), manager.ControlStop, proxyStopTimeout); err == nil && resp.Drain != nil {
+				_ = manager.RemoveInstance(store, id)
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Stopped instance %s (drained %d, killed %d connections)\n", id, resp.Drain.Drained, resp.Drain.Killed)
+				return nil
 			}
 
 			if inst.DaemonPID > 0 && proc.IsAlive(inst.DaemonPID) {
+				_ = os.Remove(reportPath)
 				p, _ := os.FindProcess(inst.DaemonPID)
-				_ = terminateProcess(p, 2*time.Second)
+				// Leave the daemon time to drain open tunnels before killing it.
+				_ = terminateProcess(p, stack.DefaultDrainTimeout+2*time.Second)
 			}
 			_ = manager.RemoveInstance(store, id)
+
+			if res, ok := readProxyStopReport(reportPath); ok {
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Stopped instance %s (drained %d, killed %d connections)\n", id, res.Drained, res.Killed)
+				return nil
+			}
 			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Stopped instance %s\n", id)
 			return nil
 		},
@@ -374,7 +636,7 @@ func newProxyStopCmd(root *rootOptions) *cobra.Command {
 func newProxyPruneCmd(root *rootOptions) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "prune",
-		Short: "Remove dead/unhealthy proxy instances from config",
+		Short: "Remove dead/unhealthy proxy instances from the registry",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			store, err := config.NewStore(root.configPath)
@@ -382,34 +644,222 @@ func newProxyPruneCmd(root *rootOptions) *cobra.Command {
 				return err
 			}
 
+			instances, err := manager.ListInstances(store)
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
 			hc := manager.HealthClient{Timeout: 500 * time.Millisecond}
-			removed := 0
-
-			instancesDir := filepath.Join(filepath.Dir(store.Path()), "instances")
-			if err := store.Update(func(cfg *config.Config) error {
-				out := cfg.Instances[:0]
-				for _, inst := range cfg.Instances {
-					if inst.DaemonPID <= 0 || !proc.IsAlive(inst.DaemonPID) {
-						removed++
-						_ = os.Remove(filepath.Join(instancesDir, inst.ID+".log"))
-						continue
-					}
-					if inst.HTTPPort > 0 {
-						if err := hc.CheckHTTPProxy(inst.HTTPPort, inst.ID); err != nil {
-							removed++
-							_ = os.Remove(filepath.Join(instancesDir, inst.ID+".log"))
-							continue
+			removed, released := 0, 0
+			for _, inst := range instances {
+				// A shared daemon without a PID is still being started by
+				// the process holding its lease.
+				live := manager.LiveLeases(inst)
+				dead := (inst.DaemonPID <= 0 && len(live) == 0) || manager.IsInstanceDead(inst, now)
+				// A running service daemon is left to its service manager,
+				// which restarts it if it fails.
+				if !dead && inst.HTTPPort > 0 && inst.ServiceName == "" {
+					dead = hc.CheckInstance(inst) != nil
+				}
+				if !dead {
+					if len(live) < len(inst.Leases) {
+						n, err := manager.DropDeadLeases(store, inst.ID, now)
+						if err != nil {
+							return err
 						}
+						released += n
 					}
-					out = append(out, inst)
+					continue
 				}
-				cfg.Instances = out
-				return nil
-			}); err != nil {
-				return err
+				if err := manager.RemoveInstance(store, inst.ID); err != nil {
+					return err
+				}
+				// The service's log outlives its restarts.
+				if inst.ServiceName == "" {
+					removeInstanceLogs(store, inst.ID)
+				}
+				removed++
 			}
 
 			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Pruned %d instances\n", removed)
+			if released > 0 {
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Released %d leases of exited processes\n", released)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func instanceLogPath(store *config.Store, instanceID string) string {
+	return filepath.Join(filepath.Dir(store.Path()), "instances", instanceID+".log")
+}
+
+func instanceAccessLogPath(store *config.Store, instanceID string) string {
+	return filepath.Join(filepath.Dir(store.Path()), "instances", instanceID+".access.log")
+}
+
+// instanceStopReportPath is where a daemon records how its shutdown ended
+// open tunnels, for `proxy stop` to report.
+func instanceStopReportPath(store *config.Store, instanceID string) string {
+	return filepath.Join(filepath.Dir(store.Path()), "instances", instanceID+".stop.json")
+}
+
+func writeProxyStopReport(store *config.Store, instanceID string, res localproxy.DrainResult) error {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	path := instanceStopReportPath(store, instanceID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+func readProxyStopReport(path string) (localproxy.DrainResult, bool) {
+	var res localproxy.DrainResult
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return res, false
+	}
+	_ = os.Remove(path)
+	if err := json.Unmarshal(b, &res); err != nil {
+		return res, false
+	}
+	return res, true
+}
+
+func removeInstanceLogs(store *config.Store, instanceID string) {
+	_ = os.Remove(instanceLogPath(store, instanceID))
+	_ = os.Remove(manager.ControlSocketPath(store, instanceID))
+	_ = os.Remove(instanceStopReportPath(store, instanceID))
+	for _, p := range localproxy.AccessLogFiles(instanceAccessLogPath(store, instanceID)) {
+		_ = os.Remove(p)
+	}
+}
+
+func newProxyLogsCmd(root *rootOptions) *cobra.Command {
+	var access bool
+	var raw bool
+	var tail int
+
+	cmd := &cobra.Command{
+		Use:   "logs <instance-id>",
+		Short: "Show daemon or access logs of a proxy instance",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := config.NewStore(root.configPath)
+			if err != nil {
+				return err
+			}
+			id := args[0]
+			out := cmd.OutOrStdout()
+
+			if !access {
+				data, err := os.ReadFile(instanceLogPath(store, id))
+				if err != nil {
+					if os.IsNotExist(err) {
+						return fmt.Errorf("no log for instance %q", id)
+					}
+					return err
+				}
+				lines := strings.SplitAfter(string(data), "\n")
+				if n := len(lines); n > 0 && lines[n-1] == "" {
+					lines = lines[:n-1]
+				}
+				if tail > 0 && len(lines) > tail {
+					lines = lines[len(lines)-tail:]
+				}
+				_, _ = fmt.Fprint(out, strings.Join(lines, ""))
+				return nil
+			}
+
+			files := localproxy.AccessLogFiles(instanceAccessLogPath(store, id))
+			if len(files) == 0 {
+				return fmt.Errorf("no access log for instance %q", id)
+			}
+			var lines []string
+			for _, f := range files {
+				data, err := os.ReadFile(f)
+				if err != nil {
+					return err
+				}
+				for _, line := range strings.Split(string(data), "\n") {
+					if strings.TrimSpace(line) != "" {
+						lines = append(lines, line)
+					}
+				}
+			}
+			if tail > 0 && len(lines) > tail {
+				lines = lines[len(lines)-tail:]
+			}
+
+			if raw {
+				for _, line := range lines {
+					_, _ = fmt.Fprintln(out, line)
+				}
+				return nil
+			}
+			w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "TIME\tMETHOD\tDESTINATION\tSTATUS\tDIAL_MS\tIN\tOUT\tDURATION_MS\tERROR")
+			for _, line := range lines {
+				var e localproxy.AccessLogEntry
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					continue
+				}
+				errClass := e.ErrorClass
+				if errClass == "" {
+					errClass = "-"
+				}
+				_, _ = fmt.Fprintf(
+					w,
+					"%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+					e.Time.Local().Format(time.RFC3339),
+					e.Method,
+					e.Destination,
+					e.Status,
+					e.DialMs,
+					e.BytesIn,
+					e.BytesOut,
+					e.DurationMs,
+					errClass,
+				)
+			}
+			_ = w.Flush()
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&access, "access", false, "Show the per-connection access log instead of the daemon log")
+	cmd.Flags().BoolVar(&raw, "json", false, "Print access log entries as raw JSON lines")
+	cmd.Flags().IntVarP(&tail, "tail", "n", 0, "Only show the last N lines (0 shows all)")
+	return cmd
+}
+
+func newProxyPACCmd(root *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pac <instance-id>",
+		Short: "Print the proxy auto-config (PAC) URL of a proxy instance",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := config.NewStore(root.configPath)
+			if err != nil {
+				return err
+			}
+			id := args[0]
+			inst, found, err := manager.LoadInstance(store, id)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("instance %q not found", id)
+			}
+			if inst.HTTPPort <= 0 {
+				return fmt.Errorf("instance %q has no HTTP listener yet", id)
+			}
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), localproxy.PACURL(inst.HTTPPort))
 			return nil
 		},
 	}
@@ -423,14 +873,7 @@ func newProxyDoctorCmd(root *rootOptions) *cobra.Command {
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			var issues []string
-
-			if _, err := exec.LookPath("ssh"); err != nil {
-				issues = append(issues, "missing `ssh` (OpenSSH client)")
-			}
-			if _, err := exec.LookPath("ssh-keygen"); err != nil {
-				issues = append(issues, "missing `ssh-keygen` (optional, only needed for `init` key creation)")
-			}
-
+			var profiles []config.Profile
 			store, err := config.NewStore(root.configPath)
 			if err != nil {
 				issues = append(issues, "config store error: "+err.Error())
@@ -440,11 +883,47 @@ func newProxyDoctorCmd(root *rootOptions) *cobra.Command {
 				if err := os.MkdirAll(dir, 0o700); err != nil {
 					issues = append(issues, "cannot create config dir: "+err.Error())
 				}
+				if cfg, err := store.Load(); err != nil {
+					issues = append(issues, "cannot load config: "+err.Error())
+				} else {
+					profiles = cfg.Profiles
+				}
+			}
+			for _, p := range profiles {
+				if err := stack.ValidateProfile(p); err != nil {
+					issues = append(issues, fmt.Sprintf("profile %q: %v", p.Name, err))
+				}
+				if _, err := (config.Config{Profiles: profiles}).FailoverProfiles(p); err != nil {
+					issues = append(issues, fmt.Sprintf("profile %q: %v", p.Name, err))
+				}
+			}
+
+			var toolIssues []string
+			if needsOpenSSH(profiles) {
+				if _, err := exec.LookPath("ssh"); err != nil {
+					toolIssues = append(toolIssues, "missing `ssh` (OpenSSH client)")
+				}
+			}
+			if _, err := exec.LookPath("ssh-keygen"); err != nil {
+				toolIssues = append(toolIssues, "missing `ssh-keygen` (optional, only needed for `init` key creation)")
+			}
+			issues = append(toolIssues, issues...)
+
+			var chains []jumpChainReport
+			if _, err := exec.LookPath("ssh"); err == nil {
+				chains = probeJumpChains(cmd.Context(), profiles)
+				for _, c := range chains {
+					if c.broken != "" {
+						issues = append(issues, fmt.Sprintf("profile %q: %s", c.profile, c.broken))
+					}
+				}
 			}
 
 			out := cmd.OutOrStdout()
 			if len(issues) == 0 {
 				_, _ = fmt.Fprintln(out, "OK: environment looks good.")
+				printProxyRouting(out, profiles)
+				printJumpChains(out, chains)
 				return nil
 			}
 
@@ -452,6 +931,8 @@ func newProxyDoctorCmd(root *rootOptions) *cobra.Command {
 			for _, it := range issues {
 				_, _ = fmt.Fprintf(out, " - %s\n", it)
 			}
+			printProxyRouting(out, profiles)
+			printJumpChains(out, chains)
 
 			_, _ = fmt.Fprintln(out, "\nInstall hints:")
 			for _, line := range installHints() {
@@ -465,6 +946,115 @@ func newProxyDoctorCmd(root *rootOptions) *cobra.Command {
 	return cmd
 }
 
+// needsOpenSSH reports whether any profile runs `ssh -D`. With no profiles
+// yet, `init` will create one that does.
+func needsOpenSSH(profiles []config.Profile) bool {
+	if len(profiles) == 0 {
+		return true
+	}
+	for _, p := range profiles {
+		if !p.IsHTTPProxy() && !p.UsesNativeSSH() {
+			return true
+		}
+	}
+	return false
+}
+
+// jumpChainReport is the per-hop outcome of probing one profile's jump
+// hosts; broken names the first hop that failed.
+type jumpChainReport struct {
+	profile string
+	lines   []string
+	broken  string
+}
+
+// probeJumpChains logs into each jump host of every SSH profile in turn,
+// through the hops before it, and then into the profile host, so a broken
+// chain is reported at the hop where it breaks rather than as a single
+// failed tunnel.
+func probeJumpChains(ctx context.Context, profiles []config.Profile) []jumpChainReport {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var reports []jumpChainReport
+	for _, p := range profiles {
+		if p.IsHTTPProxy() || len(p.JumpHosts) == 0 || stack.ValidateProfile(p) != nil {
+			continue
+		}
+		cfg := ssh.TunnelConfig{
+			Host:      p.Host,
+			Port:      p.Port,
+			User:      p.User,
+			JumpHosts: stack.JumpHosts(p),
+			ExtraArgs: p.SSHArgs,
+		}
+		r := jumpChainReport{profile: p.Name}
+		for i := 0; i <= len(cfg.JumpHosts); i++ {
+			label := fmt.Sprintf("host %s@%s:%d", p.User, p.Host, p.Port)
+			if i < len(cfg.JumpHosts) {
+				label = fmt.Sprintf("hop %d %s", i+1, cfg.JumpHosts[i])
+			}
+			if r.broken != "" {
+				r.lines = append(r.lines, label+"\tskipped")
+				continue
+			}
+			args, err := ssh.ProbeArgs(cfg, i)
+			if err == nil {
+				err = runSSHProbe(ctx, args)
+			}
+			if err != nil {
+				r.lines = append(r.lines, label+"\tFAILED: "+err.Error())
+				r.broken = fmt.Sprintf("jump chain breaks at %s: %v", label, err)
+				continue
+			}
+			r.lines = append(r.lines, label+"\tok")
+		}
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+func execSSHProbe(ctx context.Context, args []string) error {
+	out, err := exec.CommandContext(ctx, "ssh", args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// printJumpChains shows the per-hop probe results from probeJumpChains.
+func printJumpChains(out io.Writer, chains []jumpChainReport) {
+	for _, c := range chains {
+		_, _ = fmt.Fprintf(out, "\nJump hosts for profile %q:\n", c.profile)
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, line := range c.lines {
+			_, _ = fmt.Fprintf(w, "  %s\n", line)
+		}
+		_ = w.Flush()
+	}
+}
+
+// printProxyRouting shows the split-routing table of every profile that
+// configures one.
+func printProxyRouting(out io.Writer, profiles []config.Profile) {
+	for _, p := range profiles {
+		table, err := stack.RoutingTable(p)
+		if err != nil || table == nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "\nRouting for profile %q:\n", p.Name)
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, r := range table.Rules() {
+			_, _ = fmt.Fprintf(w, "  %s\t%s\n", r.Pattern, r.Action)
+		}
+		_, _ = fmt.Fprintf(w, "  (default)\t%s\n", table.Default())
+		_ = w.Flush()
+	}
+}
+
 func installHints() []string {
 	switch runtime.GOOS {
 	case "darwin":
@@ -533,3 +1123,10 @@ func parsePort(s string) (int, error) {
 	}
 	return addr.Port, nil
 }
+
+// proxyInstances returns the registered instances to reuse; a registry
+// that cannot be read just means nothing is reused.
+func proxyInstances(store *config.Store) []config.Instance {
+	instances, _ := manager.ListInstances(store)
+	return instances
+}
@@ -0,0 +1,355 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+// proxyBenchResult is one profile's row of `proxy bench`. Durations are in
+// milliseconds; ReadyMs is only known for stacks the bench started itself.
+type proxyBenchResult struct {
+	Profile               string  `json:"profile"`
+	Reused                bool    `json:"reused"`
+	ReadyMs               float64 `json:"readyMs,omitempty"`
+	Connects              int     `json:"connects"`
+	ConnectErrors         int     `json:"connectErrors"`
+	ConnectP50Ms          float64 `json:"connectP50Ms"`
+	ConnectP90Ms          float64 `json:"connectP90Ms"`
+	ConnectP99Ms          float64 `json:"connectP99Ms"`
+	ThroughputBytesPerSec float64 `json:"throughputBytesPerSec"`
+	Error                 string  `json:"error,omitempty"`
+}
+
+type proxyBenchOptions struct {
+	target   string
+	connects int
+	duration time.Duration
+}
+
+// benchStack is the listener a profile is measured through.
+type benchStack struct {
+	port   int
+	token  string
+	reused bool
+	ready  time.Duration
+	close  func()
+}
+
+func newProxyBenchCmd(root *rootOptions) *cobra.Command {
+	opts := proxyBenchOptions{connects: 20, duration: 5 * time.Second}
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "bench --target <host:port> [profile...]",
+		Short: "Measure tunnel latency and throughput of profiles",
+		Long: "Start (or reuse) a proxy stack for each profile and measure how long its SOCKS\n" +
+			"tunnel took to become ready, CONNECT setup latency and sustained throughput.\n" +
+			"The target must echo what it receives; all profiles are measured by default.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.connects <= 0 {
+				return fmt.Errorf("--connects must be positive")
+			}
+			if opts.duration <= 0 {
+				return fmt.Errorf("--duration must be positive")
+			}
+			store, err := newProxyStore(root.configPath)
+			if err != nil {
+				return err
+			}
+			cfg, err := store.Load()
+			if err != nil {
+				return err
+			}
+			profiles, err := benchProfiles(cfg, args)
+			if err != nil {
+				return err
+			}
+
+			instances := proxyInstances(store)
+			results := make([]proxyBenchResult, 0, len(profiles))
+			for _, p := range profiles {
+				results = append(results, benchProfile(cmd.Context(), cfg, instances, p, opts))
+			}
+
+			out := cmd.OutOrStdout()
+			if asJSON {
+				data, err := json.MarshalIndent(results, "", "  ")
+				if err != nil {
+					return err
+				}
+				_, _ = fmt.Fprintln(out, string(data))
+				return nil
+			}
+			printProxyBench(out, results)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.target, "target", "", "Echo server (host:port) reached through each tunnel")
+	cmd.Flags().IntVar(&opts.connects, "connects", opts.connects, "Number of CONNECTs to time")
+	cmd.Flags().DurationVar(&opts.duration, "duration", opts.duration, "How long to measure throughput")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print results as JSON")
+	_ = cmd.MarkFlagRequired("target")
+	return cmd
+}
+
+func benchProfiles(cfg config.Config, refs []string) ([]config.Profile, error) {
+	if len(refs) == 0 {
+		if len(cfg.Profiles) == 0 {
+			return nil, fmt.Errorf("no profiles found; run `claude-proxy init` first")
+		}
+		return cfg.Profiles, nil
+	}
+	profiles := make([]config.Profile, 0, len(refs))
+	for _, ref := range refs {
+		p, ok := cfg.FindProfile(ref)
+		if !ok {
+			return nil, fmt.Errorf("profile %q not found", ref)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// benchProfile measures one profile. Failures are reported in the result so
+// the remaining profiles are still compared.
+func benchProfile(ctx context.Context, cfg config.Config, instances []config.Instance, p config.Profile, opts proxyBenchOptions) proxyBenchResult {
+	res := proxyBenchResult{Profile: p.Name}
+	bs, err := startBenchStack(cfg, instances, p)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer bs.close()
+	res.Reused = bs.reused
+	res.ReadyMs = durationMs(bs.ready)
+
+	hc := manager.HealthClient{}
+	dial := func() (net.Conn, error) { return hc.DialThroughProxy(bs.port, bs.token, opts.target) }
+
+	latencies, errs := measureConnects(ctx, dial, opts.connects)
+	res.Connects = len(latencies) + errs
+	res.ConnectErrors = errs
+	if len(latencies) == 0 {
+		res.Error = "no CONNECT succeeded"
+		return res
+	}
+	res.ConnectP50Ms = durationMs(percentile(latencies, 50))
+	res.ConnectP90Ms = durationMs(percentile(latencies, 90))
+	res.ConnectP99Ms = durationMs(percentile(latencies, 99))
+
+	rate, err := measureThroughput(dial, opts.duration)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.ThroughputBytesPerSec = rate
+	return res
+}
+
+// startBenchStack reuses a healthy daemon of the profile, or starts a stack
+// the bench owns and reads its readiness time from the replayed events.
+func startBenchStack(cfg config.Config, instances []config.Instance, p config.Profile) (benchStack, error) {
+	hc := manager.HealthClient{Timeout: 1 * time.Second}
+	if inst := manager.FindReusableInstance(instances, p.ID, hc); inst != nil {
+		return benchStack{port: inst.HTTPPort, token: inst.ProxyToken, reused: true, close: func() {}}, nil
+	}
+
+	if err := stack.ValidateProfile(p); err != nil {
+		return benchStack{}, err
+	}
+	restart, err := stack.ProfileRestartPolicy(p)
+	if err != nil {
+		return benchStack{}, err
+	}
+	failover, err := cfg.FailoverProfiles(p)
+	if err != nil {
+		return benchStack{}, err
+	}
+	instanceID, err := newProxyInstanceID()
+	if err != nil {
+		return benchStack{}, err
+	}
+
+	started := time.Now()
+	st, err := stackStart(p, instanceID, stack.Options{Version: version, Tunnels: p.Tunnels, Restart: restart, Failover: failover})
+	if err != nil {
+		return benchStack{}, err
+	}
+	bs := benchStack{
+		port:  st.HTTPPort,
+		token: st.ProxyAuthToken,
+		ready: time.Since(started),
+		close: func() { _ = st.Close(context.Background()) },
+	}
+	// Start has returned, so the start-up events are already in the replay.
+	events, unsubscribe := st.Subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == stack.EventTunnelReady {
+				bs.ready = e.Elapsed
+				return bs, nil
+			}
+		default:
+			return bs, nil
+		}
+	}
+}
+
+// measureConnects times n sequential CONNECTs and returns the successful
+// setup latencies, sorted, and the number of failures.
+func measureConnects(ctx context.Context, dial func() (net.Conn, error), n int) ([]time.Duration, int) {
+	var latencies []time.Duration
+	errs := 0
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		start := time.Now()
+		conn, err := dial()
+		if err != nil {
+			errs++
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+		_ = conn.Close()
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies, errs
+}
+
+// percentile returns the nearest-rank percentile of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+const benchChunkSize = 32 * 1024
+
+// measureThroughput streams data to the echo target for d and returns how
+// many bytes per second came back.
+func measureThroughput(dial func() (net.Conn, error), d time.Duration) (float64, error) {
+	conn, err := dial()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	start := time.Now()
+	_ = conn.SetDeadline(start.Add(d))
+
+	var echoed atomic.Int64
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		buf := make([]byte, benchChunkSize)
+		for {
+			n, err := conn.Read(buf)
+			echoed.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	chunk := make([]byte, benchChunkSize)
+	var writeErr error
+	for {
+		if _, err := conn.Write(chunk); err != nil {
+			writeErr = err
+			break
+		}
+	}
+	<-readDone
+	elapsed := time.Since(start)
+
+	var netErr net.Error
+	if errors.As(writeErr, &netErr) && netErr.Timeout() {
+		writeErr = nil
+	}
+	if echoed.Load() == 0 {
+		if writeErr != nil {
+			return 0, writeErr
+		}
+		return 0, fmt.Errorf("target echoed nothing in %s", d)
+	}
+	return float64(echoed.Load()) / elapsed.Seconds(), nil
+}
+
+func printProxyBench(out io.Writer, results []proxyBenchResult) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "PROFILE\tSTACK\tREADY\tCONNECT_P50\tCONNECT_P90\tCONNECT_P99\tERRORS\tTHROUGHPUT\tERROR")
+	for _, r := range results {
+		source, ready := "new", "-"
+		if r.Reused {
+			source = "reused"
+		} else if r.ReadyMs > 0 {
+			ready = formatMs(r.ReadyMs)
+		}
+		p50, p90, p99, errs, throughput := "-", "-", "-", "-", "-"
+		if r.ConnectP50Ms > 0 {
+			p50, p90, p99 = formatMs(r.ConnectP50Ms), formatMs(r.ConnectP90Ms), formatMs(r.ConnectP99Ms)
+		}
+		if r.Connects > 0 {
+			errs = fmt.Sprintf("%d/%d", r.ConnectErrors, r.Connects)
+		}
+		if r.ThroughputBytesPerSec > 0 {
+			throughput = formatRate(r.ThroughputBytesPerSec)
+		}
+		errText := r.Error
+		if errText == "" {
+			errText = "-"
+		}
+		_, _ = fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Profile,
+			source,
+			ready,
+			p50,
+			p90,
+			p99,
+			errs,
+			throughput,
+			errText,
+		)
+	}
+	_ = w.Flush()
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func formatMs(ms float64) string {
+	return fmt.Sprintf("%.1fms", ms)
+}
+
+func formatRate(bytesPerSec float64) string {
+	const unit = 1024
+	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
+	i := 0
+	for bytesPerSec >= unit && i < len(units)-1 {
+		bytesPerSec /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bytesPerSec, units[i])
+}
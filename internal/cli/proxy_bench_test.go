@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+// startEchoServer echoes every connection back to itself.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProxyBenchCmdMeasuresThroughEchoServer(t *testing.T) {
+	withProxyTestHooks(t)
+	echo := startEchoServer(t)
+
+	proxy := localproxy.NewHTTPProxy(localproxy.NewDirectDialer(time.Second), localproxy.Options{})
+	addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("start proxy: %v", err)
+	}
+	defer func() { _ = proxy.Close(context.Background()) }()
+	_, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{
+			{ID: "p1", Name: "fast", Host: "h", Port: 22, User: "u"},
+			{ID: "p2", Name: "broken", Host: "h", Port: 22, User: "u"},
+		},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	var started []string
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		started = append(started, profile.Name)
+		if profile.Name == "broken" {
+			return nil, errors.New("ssh: connection refused")
+		}
+		st := stack.NewStackForTest(port, 0)
+		st.PublishForTest(stack.Event{Kind: stack.EventTunnelReady, Elapsed: 250 * time.Millisecond})
+		return st, nil
+	}
+
+	run := func(args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		cmd := newProxyBenchCmd(&rootOptions{configPath: store.Path()})
+		cmd.SetOut(&out)
+		cmd.SetArgs(append([]string{"--target", echo, "--connects", "5", "--duration", "100ms"}, args...))
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("bench error: %v", err)
+		}
+		return out.String()
+	}
+
+	var results []proxyBenchResult
+	if err := json.Unmarshal([]byte(run("--json")), &results); err != nil {
+		t.Fatalf("decode json: %v", err)
+	}
+	if len(results) != 2 || strings.Join(started, ",") != "fast,broken" {
+		t.Fatalf("expected every profile to be measured, got %+v (started %q)", results, started)
+	}
+	fast := results[0]
+	if fast.Reused || fast.ReadyMs != 250 || fast.Connects != 5 || fast.ConnectErrors != 0 || fast.Error != "" {
+		t.Fatalf("unexpected result %+v", fast)
+	}
+	if fast.ConnectP50Ms <= 0 || fast.ConnectP50Ms > fast.ConnectP99Ms || fast.ThroughputBytesPerSec <= 0 {
+		t.Fatalf("expected latencies and throughput, got %+v", fast)
+	}
+	if results[1].Error != "ssh: connection refused" {
+		t.Fatalf("expected the start error, got %+v", results[1])
+	}
+
+	table := run("fast")
+	lines := strings.Split(strings.TrimSpace(table), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "PROFILE") {
+		t.Fatalf("unexpected table:\n%s", table)
+	}
+	if fields := strings.Fields(lines[1]); fields[0] != "fast" || fields[1] != "new" || fields[2] != "250.0ms" || fields[6] != "0/5" {
+		t.Fatalf("unexpected row %q", lines[1])
+	}
+}
+
+func TestProxyBenchCmdRequiresTarget(t *testing.T) {
+	store := newTempStore(t)
+	cmd := newProxyBenchCmd(&rootOptions{configPath: store.Path()})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{})
+	if err := cmd.Execute(); err == nil {
+		t.Fatalf("expected a missing --target error")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 10; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for _, tc := range []struct {
+		p    int
+		want time.Duration
+	}{
+		{50, 5 * time.Millisecond},
+		{90, 9 * time.Millisecond},
+		{99, 10 * time.Millisecond},
+	} {
+		if got := percentile(sorted, tc.p); got != tc.want {
+			t.Fatalf("p%d=%s want %s", tc.p, got, tc.want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Fatalf("empty percentile=%s", got)
+	}
+}
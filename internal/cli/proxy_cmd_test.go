@@ -10,8 +10,10 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
 )
 
 func TestRunProxyDaemonErrors(t *testing.T) {
@@ -78,12 +80,12 @@ func TestProxyStopCmd(t *testing.T) {
 			t.Fatalf("unexpected output: %s", out.String())
 		}
 
-		loaded, err := store.Load()
+		instances, err := manager.ListInstances(store)
 		if err != nil {
-			t.Fatalf("load config: %v", err)
+			t.Fatalf("list instances: %v", err)
 		}
-		if len(loaded.Instances) != 0 {
-			t.Fatalf("expected instances to be removed, got %#v", loaded.Instances)
+		if len(instances) != 0 {
+			t.Fatalf("expected instances to be removed, got %#v", instances)
 		}
 	})
 }
@@ -112,12 +114,12 @@ func TestProxyPruneCmdRemovesDead(t *testing.T) {
 		t.Fatalf("unexpected output: %s", out.String())
 	}
 
-	loaded, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
 	}
-	if len(loaded.Instances) != 0 {
-		t.Fatalf("expected instances to be pruned, got %#v", loaded.Instances)
+	if len(instances) != 0 {
+		t.Fatalf("expected instances to be pruned, got %#v", instances)
 	}
 }
 
@@ -131,7 +133,8 @@ func TestProxyListCmdStatuses(t *testing.T) {
 		}},
 		Instances: []config.Instance{
 			{ID: "dead-1", ProfileID: "profile-1", DaemonPID: 0},
-			{ID: "alive-1", ProfileID: "profile-1", DaemonPID: os.Getpid()},
+			{ID: "alive-1", ProfileID: "profile-1", DaemonPID: os.Getpid(), SOCKSListenPort: 31080},
+			{ID: "stale-1", ProfileID: "profile-1", DaemonPID: os.Getpid(), LastSeenAt: time.Now().Add(-time.Hour)},
 		},
 	}
 	if err := store.Save(cfg); err != nil {
@@ -154,9 +157,59 @@ func TestProxyListCmdStatuses(t *testing.T) {
 	if !strings.Contains(text, "alive-1") || !strings.Contains(text, "alive") {
 		t.Fatalf("expected alive instance row, got %s", text)
 	}
+	if !strings.Contains(text, "stale-1") || !strings.Contains(text, "stale ") {
+		t.Fatalf("expected stale instance row, got %s", text)
+	}
 	if !strings.Contains(text, "Profile One") {
 		t.Fatalf("expected profile name mapping, got %s", text)
 	}
+	if !strings.Contains(text, "SOCKS5") || !strings.Contains(text, "31080") {
+		t.Fatalf("expected local SOCKS5 port column, got %s", text)
+	}
+}
+
+func TestProxyListCmdShowsFailover(t *testing.T) {
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{
+			{ID: "p1", Name: "primary", Failover: []string{"p2"}},
+			{ID: "p2", Name: "backup", LocalForwards: []config.LocalForward{
+				{LocalPort: 5432, RemoteHost: "db.internal", RemotePort: 5432},
+				{LocalPort: 8443, RemoteHost: "mcp.internal", RemotePort: 443},
+			}},
+		},
+		Instances: []config.Instance{
+			{ID: "steady", ProfileID: "p1"},
+			{ID: "moved", ProfileID: "p1", ActiveProfileID: "p2", Failovers: 1},
+			{ID: "back", ProfileID: "p1", Failovers: 2},
+		},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	cmd := newProxyListCmd(&rootOptions{configPath: store.Path()})
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	rows := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if f := strings.Fields(line); len(f) > 0 {
+			rows[f[0]] = line
+		}
+	}
+	if !strings.Contains(rows["INSTANCE"], "FAILOVER") {
+		t.Fatalf("expected FAILOVER column, got %s", out.String())
+	}
+	if !strings.Contains(rows["moved"], "backup (1)") || !strings.Contains(rows["back"], "primary (2)") || strings.Contains(rows["steady"], "(") {
+		t.Fatalf("unexpected failover cells:\n%s", out.String())
+	}
+	if !strings.Contains(rows["moved"], "5432->db.internal:5432,8443->mcp.internal:443") || strings.Contains(rows["steady"], "->") {
+		t.Fatalf("expected the active profile's forwards, got:\n%s", out.String())
+	}
 }
 
 func TestProxyDoctorCmdReportsIssues(t *testing.T) {
@@ -180,6 +233,132 @@ func TestProxyDoctorCmdReportsIssues(t *testing.T) {
 	}
 }
 
+func TestProxyDoctorCmdSkipsOpenSSHForNativeProfiles(t *testing.T) {
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{
+			{ID: "p1", Name: "native", Host: "host", Port: 22, User: "user", SSHBackend: config.SSHBackendNative},
+		},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	t.Setenv("PATH", "")
+
+	cmd := newProxyDoctorCmd(&rootOptions{configPath: store.Path()})
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if strings.Contains(out.String(), "missing `ssh` (OpenSSH client)") {
+		t.Fatalf("native-only profiles should not require OpenSSH, got %s", out.String())
+	}
+}
+
+func TestProxyDoctorCmdReportsWhereJumpChainBreaks(t *testing.T) {
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{
+			{
+				ID: "p1", Name: "egress", Host: "egress.example", Port: 22, User: "me",
+				JumpHosts: []config.JumpHost{
+					{Host: "b1.example", User: "ops"},
+					{Host: "b2.example", Port: 2222, IdentityFile: "/keys/b2"},
+				},
+			},
+		},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	dir := t.TempDir()
+	writeStub(t, dir, "ssh", "#!/bin/sh\nexit 0\n", "@echo off\r\nexit /b 0\r\n")
+	setStubPath(t, dir)
+
+	var probed [][]string
+	prev := runSSHProbe
+	runSSHProbe = func(_ context.Context, args []string) error {
+		probed = append(probed, args)
+		if len(probed) == 2 {
+			return errors.New("Permission denied (publickey)")
+		}
+		return nil
+	}
+	t.Cleanup(func() { runSSHProbe = prev })
+
+	cmd := newProxyDoctorCmd(&rootOptions{configPath: store.Path()})
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if len(probed) != 2 {
+		t.Fatalf("expected probing to stop at the broken hop, got %d probes: %q", len(probed), probed)
+	}
+	if got := strings.Join(probed[1], " "); !strings.Contains(got, "-J ops@b1.example:22") || !strings.Contains(got, "-i /keys/b2 me@b2.example exit") {
+		t.Fatalf("hop 2 probe args=%q", got)
+	}
+	text := out.String()
+	for _, want := range []string{
+		"profile \"egress\": jump chain breaks at hop 2 me@b2.example:2222: Permission denied (publickey)",
+		"hop 1 ops@b1.example:22    ok",
+		"hop 2 me@b2.example:2222   FAILED: Permission denied (publickey)",
+		"host me@egress.example:22  skipped",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("doctor output missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestProxyDoctorCmdShowsRoutingTable(t *testing.T) {
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{
+			{
+				ID: "p1", Name: "work", Host: "host", Port: 22, User: "user",
+				Routes: []config.Route{
+					{Match: "*.anthropic.com:443", Via: "tunnel"},
+					{Match: "registry.npmjs.org", Via: "direct"},
+					{Match: "10.0.0.0/8", Via: "reject"},
+				},
+				DefaultRoute: "direct",
+			},
+			{ID: "p2", Name: "plain", Host: "host", Port: 22, User: "user"},
+			{ID: "p3", Name: "broken", Host: "host", Port: 22, User: "user", Routes: []config.Route{{Match: "x.example", Via: "sideways"}}},
+		},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	cmd := newProxyDoctorCmd(&rootOptions{configPath: store.Path()})
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	text := out.String()
+	if !strings.Contains(text, `Routing for profile "work":`) {
+		t.Fatalf("expected routing section, got %s", text)
+	}
+	for _, want := range []string{"*.anthropic.com:443  tunnel", "registry.npmjs.org   direct", "10.0.0.0/8           reject", "(default)            direct"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected routing line %q, got %s", want, text)
+		}
+	}
+	if strings.Contains(text, `Routing for profile "plain"`) {
+		t.Fatalf("profiles without routes should not be listed, got %s", text)
+	}
+	if !strings.Contains(text, `profile "broken": route "x.example": unknown route action`) {
+		t.Fatalf("expected invalid route issue, got %s", text)
+	}
+}
+
 func TestProxyListCmdMarksUnhealthy(t *testing.T) {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -368,12 +547,12 @@ func TestProxyStartCmdBackgroundLauncherFailureCleansInstance(t *testing.T) {
 		t.Fatalf("expected launcher error, got %v", err)
 	}
 
-	loaded, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
 	}
-	if len(loaded.Instances) != 0 {
-		t.Fatalf("expected launcher failure to clean recorded instance, got %#v", loaded.Instances)
+	if len(instances) != 0 {
+		t.Fatalf("expected launcher failure to clean recorded instance, got %#v", instances)
 	}
 }
 
@@ -414,12 +593,12 @@ func TestProxyStartRejectsIncompleteProfile(t *testing.T) {
 		t.Fatalf("expected host is required error, got: %v", err)
 	}
 
-	loaded, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
 	}
-	if len(loaded.Instances) != 0 {
-		t.Fatalf("expected no instances to be recorded, got %#v", loaded.Instances)
+	if len(instances) != 0 {
+		t.Fatalf("expected no instances to be recorded, got %#v", instances)
 	}
 
 	instancesDir := filepath.Join(filepath.Dir(store.Path()), "instances")
@@ -450,6 +629,12 @@ func TestProxyPruneRemovesDeadLogs(t *testing.T) {
 	if err := os.WriteFile(logPath, []byte("failed to validate\n"), 0o600); err != nil {
 		t.Fatalf("write log: %v", err)
 	}
+	accessPath := filepath.Join(instancesDir, "inst-dead.access.log")
+	for _, p := range []string{accessPath, accessPath + ".1"} {
+		if err := os.WriteFile(p, []byte("{}\n"), 0o600); err != nil {
+			t.Fatalf("write access log: %v", err)
+		}
+	}
 
 	cmd := newProxyPruneCmd(&rootOptions{configPath: store.Path()})
 	var out bytes.Buffer
@@ -464,12 +649,106 @@ func TestProxyPruneRemovesDeadLogs(t *testing.T) {
 	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
 		t.Fatalf("expected log %s removed, stat err: %v", logPath, err)
 	}
+	for _, p := range []string{accessPath, accessPath + ".1"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("expected access log %s removed, stat err: %v", p, err)
+		}
+	}
 
-	loaded, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("expected instances to be pruned, got %#v", instances)
+	}
+}
+
+func TestProxyLogsAccessShowsRotatedEntries(t *testing.T) {
+	store := newTempStore(t)
+	instancesDir := filepath.Join(filepath.Dir(store.Path()), "instances")
+	if err := os.MkdirAll(instancesDir, 0o700); err != nil {
+		t.Fatalf("mkdir instances dir: %v", err)
+	}
+	accessPath := filepath.Join(instancesDir, "inst-1.access.log")
+	older := `{"ts":"2026-01-02T03:04:05Z","instanceId":"inst-1","method":"CONNECT","destination":"old.example:443","status":200,"dialMs":5,"bytesIn":10,"bytesOut":20,"durationMs":30}` + "\n"
+	newer := `{"ts":"2026-01-02T03:04:06Z","instanceId":"inst-1","method":"CONNECT","destination":"new.example:443","status":502,"dialMs":7,"bytesIn":0,"bytesOut":0,"durationMs":7,"errorClass":"target"}` + "\n"
+	if err := os.WriteFile(accessPath+".1", []byte(older), 0o600); err != nil {
+		t.Fatalf("write rotated log: %v", err)
+	}
+	if err := os.WriteFile(accessPath, []byte(newer), 0o600); err != nil {
+		t.Fatalf("write access log: %v", err)
+	}
+
+	run := func(args ...string) string {
+		t.Helper()
+		cmd := newProxyLogsCmd(&rootOptions{configPath: store.Path()})
+		var out bytes.Buffer
+		cmd.SetOut(&out)
+		cmd.SetArgs(args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("Execute error: %v", err)
+		}
+		return out.String()
+	}
+
+	text := run("--access", "inst-1")
+	oldIdx := strings.Index(text, "old.example:443")
+	newIdx := strings.Index(text, "new.example:443")
+	if !strings.Contains(text, "DESTINATION") || oldIdx < 0 || newIdx < oldIdx {
+		t.Fatalf("expected rotated entries oldest first, got %s", text)
+	}
+	if !strings.Contains(text, "target") {
+		t.Fatalf("expected error class column, got %s", text)
+	}
+
+	raw := run("--access", "--json", "-n", "1", "inst-1")
+	if strings.TrimSpace(raw) != strings.TrimSpace(newer) {
+		t.Fatalf("expected last raw entry, got %q", raw)
+	}
+
+	cmd := newProxyLogsCmd(&rootOptions{configPath: store.Path()})
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"--access", "missing"})
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "no access log") {
+		t.Fatalf("expected missing access log error, got %v", err)
+	}
+}
+
+func TestProxyPACCmdPrintsURL(t *testing.T) {
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Instances: []config.Instance{
+			{ID: "inst-1", ProfileID: "p1", HTTPPort: 18080},
+			{ID: "inst-starting", ProfileID: "p1"},
+		},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	run := func(id string) (string, error) {
+		cmd := newProxyPACCmd(&rootOptions{configPath: store.Path()})
+		var out bytes.Buffer
+		cmd.SetOut(&out)
+		cmd.SetErr(&bytes.Buffer{})
+		cmd.SetArgs([]string{id})
+		err := cmd.Execute()
+		return out.String(), err
+	}
+
+	out, err := run("inst-1")
+	if err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if strings.TrimSpace(out) != "http://127.0.0.1:18080/proxy.pac" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if _, err := run("inst-starting"); err == nil || !strings.Contains(err.Error(), "no HTTP listener") {
+		t.Fatalf("expected missing listener error, got %v", err)
 	}
-	if len(loaded.Instances) != 0 {
-		t.Fatalf("expected instances to be pruned, got %#v", loaded.Instances)
+	if _, err := run("missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected not found error, got %v", err)
 	}
 }
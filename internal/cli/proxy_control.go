@@ -0,0 +1,293 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+var listenProxyControl = manager.ListenControl
+
+const (
+	// proxyControlTimeout bounds status and restart-tunnel requests.
+	proxyControlTimeout = 5 * time.Second
+	// proxyReloadTimeout leaves a reload time to drain the old stack and
+	// bring up the new one.
+	proxyReloadTimeout = stack.DefaultDrainTimeout + time.Minute
+	// proxyStopTimeout leaves a stop time to drain open tunnels.
+	proxyStopTimeout = stack.DefaultDrainTimeout + 5*time.Second
+)
+
+// proxyControlCall hands one control request to the daemon's main loop,
+// which owns the stack, and carries its answer back.
+type proxyControlCall struct {
+	req   manager.ControlRequest
+	reply chan manager.ControlResponse
+}
+
+// serveControl opens the daemon's control socket. Requests are passed to
+// the main loop on the returned channel; the returned func closes the
+// socket once the loop is done. A daemon whose socket cannot be opened
+// keeps running, only without remote control.
+func (d *proxyDaemon) serveControl() (<-chan proxyControlCall, func()) {
+	ctl := make(chan proxyControlCall)
+	ln, err := listenProxyControl(manager.ControlSocketPath(d.store, d.inst.ID))
+	if err != nil {
+		d.logf("control socket disabled: %v", err)
+		return ctl, func() {}
+	}
+
+	exited := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		manager.ServeControl(ln, func(req manager.ControlRequest) manager.ControlResponse {
+			c := proxyControlCall{req: req, reply: make(chan manager.ControlResponse, 1)}
+			select {
+			case ctl <- c:
+				return <-c.reply
+			case <-exited:
+				return manager.ControlResponse{Error: "daemon is shutting down"}
+			}
+		})
+	}()
+	return ctl, func() {
+		close(exited)
+		_ = ln.Close()
+		<-served
+	}
+}
+
+// handleControl runs one control command on the main loop. It reports
+// whether the daemon exits afterwards, and with which error.
+func (d *proxyDaemon) handleControl(req manager.ControlRequest) (manager.ControlResponse, bool, error) {
+	switch req.Command {
+	case manager.ControlStatus:
+		return manager.ControlResponse{OK: true, Status: d.status()}, false, nil
+	case manager.ControlReload:
+		if err := d.reload(); err != nil {
+			if d.st == nil {
+				_ = removeProxyInstance(d.store, d.inst.ID)
+				return manager.ControlResponse{Error: err.Error()}, true, err
+			}
+			return manager.ControlResponse{Error: err.Error()}, false, nil
+		}
+		return manager.ControlResponse{OK: true, Status: d.status()}, false, nil
+	case manager.ControlRestartTunnel:
+		d.st.RestartTunnels(errors.New("restart requested over the control socket"))
+		return manager.ControlResponse{OK: true}, false, nil
+	case manager.ControlStop:
+		res := d.stopStack()
+		_ = removeProxyInstance(d.store, d.inst.ID)
+		return manager.ControlResponse{OK: true, Drain: &res}, true, nil
+	default:
+		return manager.ControlResponse{Error: fmt.Sprintf("unknown control command %q", req.Command)}, false, nil
+	}
+}
+
+func (d *proxyDaemon) status() *manager.DaemonStatus {
+	st := &manager.DaemonStatus{
+		InstanceID:      d.inst.ID,
+		Profile:         d.prof.Name,
+		PID:             os.Getpid(),
+		HTTPPort:        d.st.HTTPPort,
+		SOCKSListenPort: d.st.SOCKSListenPort,
+		StartedAt:       d.inst.StartedAt,
+		Failovers:       int(d.failovers.Load()),
+		Reloads:         d.reloads,
+		ActiveConnects:  d.st.ActiveConnects(),
+		Tunnels:         d.st.Tunnels(),
+	}
+	if active := d.st.ActiveProfile(); active.ID != d.prof.ID {
+		st.ActiveProfile = active.Name
+	}
+	return st
+}
+
+// reload re-reads the instance's profile and restarts the stack with it on
+// the same ports. The new profile is checked before the running stack is
+// touched; if it still fails to start, the previous profile is brought
+// back. Only when that fails too is the daemon left without a stack. Open
+// connections do not survive: the old stack drains and closes them before
+// the new one binds the ports.
+func (d *proxyDaemon) reload() error {
+	cfg, err := d.store.Load()
+	if err != nil {
+		return err
+	}
+	prof, err := instanceProfile(cfg, d.inst)
+	if err != nil {
+		return err
+	}
+	if err := stack.ValidateProfile(prof); err != nil {
+		return fmt.Errorf("profile %q: %w", prof.Name, err)
+	}
+	opts, err := d.stackOptions(cfg, prof)
+	if err != nil {
+		return err
+	}
+	for _, p := range opts.Failover {
+		if err := stack.ValidateProfile(p); err != nil {
+			return fmt.Errorf("failover profile %q: %w", p.Name, err)
+		}
+	}
+
+	prevProf, prevOpts := d.prof, d.opts
+	d.stopStack()
+	if err := d.start(prof, opts); err != nil {
+		d.logf("reload of profile %q failed: %v; restoring profile %q", prof.Name, err, prevProf.Name)
+		if rerr := d.start(prevProf, prevOpts); rerr != nil {
+			return fmt.Errorf("reload of profile %q failed: %w; restoring profile %q failed: %w", prof.Name, err, prevProf.Name, rerr)
+		}
+		return fmt.Errorf("reload of profile %q failed, kept profile %q: %w", prof.Name, prevProf.Name, err)
+	}
+	d.reloads++
+	d.logf("reloaded profile %q", prof.Name)
+	return nil
+}
+
+// logf writes a timestamped line to the daemon log, like the stack events.
+func (d *proxyDaemon) logf(format string, args ...any) {
+	_, _ = fmt.Fprintf(proxyDaemonLog, "%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
+// callProxyControl sends command to the daemon of instance id.
+func callProxyControl(store *config.Store, id, command string, timeout time.Duration) (manager.ControlResponse, error) {
+	_, found, err := manager.LoadInstance(store, id)
+	if err != nil {
+		return manager.ControlResponse{}, err
+	}
+	if !found {
+		return manager.ControlResponse{}, fmt.Errorf("instance %q not found", id)
+	}
+	resp, err := manager.CallControl(manager.ControlSocketPath(store, id), command, timeout)
+	if err != nil {
+		return resp, fmt.Errorf("instance %q: %w", id, err)
+	}
+	return resp, nil
+}
+
+func newProxyStatusCmd(root *rootOptions) *cobra.Command {
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "status <instance-id>",
+		Short: "Show the live state of a proxy daemon",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := config.NewStore(root.configPath)
+			if err != nil {
+				return err
+			}
+			resp, err := callProxyControl(store, args[0], manager.ControlStatus, proxyControlTimeout)
+			if err != nil {
+				return err
+			}
+			if resp.Status == nil {
+				return fmt.Errorf("instance %q returned no status", args[0])
+			}
+			if asJSON {
+				b, err := json.MarshalIndent(resp.Status, "", "  ")
+				if err != nil {
+					return err
+				}
+				_, _ = fmt.Fprintln(cmd.OutOrStdout(), string(b))
+				return nil
+			}
+			printProxyStatus(cmd.OutOrStdout(), *resp.Status)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the status as JSON")
+	return cmd
+}
+
+func newProxyReloadCmd(root *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reload <instance-id>",
+		Short: "Restart a proxy daemon's tunnels with its profile re-read from the config",
+		Long: "Restart a proxy daemon's tunnels with its profile re-read from the config.\n" +
+			"The new profile runs on the same ports with the same credential, but open\n" +
+			"connections are dropped: they get the drain timeout to finish and are then\n" +
+			"closed before the new tunnels start.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := config.NewStore(root.configPath)
+			if err != nil {
+				return err
+			}
+			resp, err := callProxyControl(store, args[0], manager.ControlReload, proxyReloadTimeout)
+			if err != nil {
+				return err
+			}
+			profile := ""
+			if resp.Status != nil {
+				profile = resp.Status.Profile
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Reloaded instance %s (profile %q)\n", args[0], profile)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func printProxyStatus(out io.Writer, st manager.DaemonStatus) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	profile := st.Profile
+	if st.ActiveProfile != "" {
+		profile = fmt.Sprintf("%s (active: %s)", st.Profile, st.ActiveProfile)
+	}
+	_, _ = fmt.Fprintf(w, "Instance:\t%s\n", st.InstanceID)
+	_, _ = fmt.Fprintf(w, "Profile:\t%s\n", profile)
+	_, _ = fmt.Fprintf(w, "PID:\t%d\n", st.PID)
+	_, _ = fmt.Fprintf(w, "HTTP:\t127.0.0.1:%d\n", st.HTTPPort)
+	if st.SOCKSListenPort > 0 {
+		_, _ = fmt.Fprintf(w, "SOCKS5:\t127.0.0.1:%d\n", st.SOCKSListenPort)
+	}
+	_, _ = fmt.Fprintf(w, "Started:\t%s\n", st.StartedAt.Local().Format(time.RFC3339))
+	_, _ = fmt.Fprintf(w, "Connections:\t%d\n", st.ActiveConnects)
+	_, _ = fmt.Fprintf(w, "Failovers:\t%d\n", st.Failovers)
+	_, _ = fmt.Fprintf(w, "Reloads:\t%d\n", st.Reloads)
+	_ = w.Flush()
+
+	_, _ = fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TUNNEL\tPROFILE\tSTATE\tCONNS\tDIALS\tRESTARTS\tLAST_ERROR")
+	for _, t := range st.Tunnels {
+		state := "down"
+		if t.Healthy {
+			state = "up"
+		}
+		profile := t.Profile
+		if profile == "" {
+			profile = "-"
+		}
+		lastErr := "-"
+		if t.LastError != "" {
+			lastErr = fmt.Sprintf("%s (%s)", t.LastError, t.LastErrorAt.Local().Format(time.RFC3339))
+		}
+		_, _ = fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			t.ID,
+			profile,
+			state,
+			t.Conns,
+			t.Dials,
+			t.Restarts,
+			lastErr,
+		)
+	}
+	_ = w.Flush()
+}
@@ -0,0 +1,273 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+// startControlledDaemon runs the daemon of inst-1 in the background and
+// waits until its control socket answers.
+func startControlledDaemon(t *testing.T, store *config.Store) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- runProxyDaemon(context.Background(), store, "inst-1") }()
+
+	path := manager.ControlSocketPath(store, "inst-1")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := manager.CallControl(path, manager.ControlStatus, time.Second); err == nil {
+			return done
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("daemon exited early: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for the control socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lockedBuffer is a daemon log that tests read while the daemon writes.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func runProxyCmd(t *testing.T, store *config.Store, args ...string) (string, error) {
+	t.Helper()
+	cmd := newProxyCmd(&rootOptions{configPath: store.Path()})
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestProxyDaemonControlStatusReloadStop(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version:   config.CurrentVersion,
+		Profiles:  []config.Profile{{ID: "p1", Name: "work", Host: "h", Port: 22, User: "u"}},
+		Instances: []config.Instance{{ID: "inst-1", ProfileID: "p1"}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	log := &lockedBuffer{}
+	proxyDaemonLog = log
+	var mu sync.Mutex
+	var starts []stack.Options
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		starts = append(starts, opts)
+		// Each stack fails over once while it starts.
+		opts.OnFailover(stack.FailoverEvent{From: profile, To: profile, Err: errors.New("down")})
+		return stack.NewStackForTest(18080, 23456), nil
+	}
+
+	done := startControlledDaemon(t, store)
+
+	out, err := runProxyCmd(t, store, "status", "inst-1", "--json")
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var st manager.DaemonStatus
+	if err := json.Unmarshal([]byte(out), &st); err != nil {
+		t.Fatalf("decode status %q: %v", out, err)
+	}
+	if st.InstanceID != "inst-1" || st.Profile != "work" || st.HTTPPort != 18080 || st.Reloads != 0 || st.PID == 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	path := manager.ControlSocketPath(store, "inst-1")
+	if _, err := manager.CallControl(path, manager.ControlRestartTunnel, time.Second); err != nil {
+		t.Fatalf("restart-tunnel: %v", err)
+	}
+	if _, err := manager.CallControl(path, "dance", time.Second); err == nil || err.Error() != `unknown control command "dance"` {
+		t.Fatalf("expected an unknown command error, got %v", err)
+	}
+
+	// A broken profile is rejected without touching the running stack.
+	cfg.Profiles[0].Host = ""
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	if _, err := runProxyCmd(t, store, "reload", "inst-1"); err == nil || !strings.Contains(err.Error(), "profile host is required") {
+		t.Fatalf("expected the invalid profile to be rejected, got %v", err)
+	}
+
+	cfg.Profiles[0].Host = "h2"
+	cfg.Profiles[0].Tunnels = 3
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	out, err = runProxyCmd(t, store, "reload", "inst-1")
+	if err != nil || !strings.Contains(out, `Reloaded instance inst-1 (profile "work")`) {
+		t.Fatalf("reload: %q, %v", out, err)
+	}
+	mu.Lock()
+	if len(starts) != 2 || starts[1].Tunnels != 3 || starts[1].HTTPListenAddr != "127.0.0.1:18080" {
+		t.Fatalf("expected one restart with the new profile on the same port, got %+v", starts)
+	}
+	mu.Unlock()
+
+	out, err = runProxyCmd(t, store, "status", "inst-1")
+	if err != nil || !strings.Contains(out, "Reloads:      1") || !strings.Contains(out, "Failovers:    2") || !strings.Contains(out, "TUNNEL  PROFILE") {
+		t.Fatalf("status after reload: %q, %v", out, err)
+	}
+	if inst, ok, err := manager.LoadInstance(store, "inst-1"); err != nil || !ok || inst.Failovers != 2 {
+		t.Fatalf("expected the failovers to be counted across the reload, got %+v, %v, %v", inst, ok, err)
+	}
+
+	out, err = runProxyCmd(t, store, "stop", "inst-1")
+	if err != nil || !strings.Contains(out, "Stopped instance inst-1 (drained 0, killed 0 connections)") {
+		t.Fatalf("stop: %q, %v", out, err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("daemon exited with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for the daemon to stop")
+	}
+	if _, ok, err := manager.LoadInstance(store, "inst-1"); err != nil || ok {
+		t.Fatalf("expected the instance to be removed, got %v, %v", ok, err)
+	}
+	if !strings.Contains(log.String(), `reloaded profile "work"`) {
+		t.Fatalf("expected the reload to be logged, got %q", log.String())
+	}
+}
+
+func TestProxyDaemonReloadRestoresPreviousProfile(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version:   config.CurrentVersion,
+		Profiles:  []config.Profile{{ID: "p1", Name: "work", Host: "good", Port: 22, User: "u"}},
+		Instances: []config.Instance{{ID: "inst-1", ProfileID: "p1"}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	var mu sync.Mutex
+	var hosts []string
+	failAll := false
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		hosts = append(hosts, profile.Host)
+		if profile.Host != "good" || failAll {
+			return nil, errors.New("tunnel down")
+		}
+		return stack.NewStackForTest(18080, 23456), nil
+	}
+
+	done := startControlledDaemon(t, store)
+	path := manager.ControlSocketPath(store, "inst-1")
+
+	cfg.Profiles[0].Host = "bad"
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	if _, err := manager.CallControl(path, manager.ControlReload, 2*time.Second); err == nil || !strings.Contains(err.Error(), `kept profile "work"`) {
+		t.Fatalf("expected the previous profile to be kept, got %v", err)
+	}
+	mu.Lock()
+	if strings.Join(hosts, ",") != "good,bad,good" {
+		t.Fatalf("starts %q, want the old profile restored", hosts)
+	}
+	failAll = true
+	mu.Unlock()
+
+	// With nothing left to run, the daemon exits.
+	if _, err := manager.CallControl(path, manager.ControlReload, 2*time.Second); err == nil || !strings.Contains(err.Error(), "restoring profile") {
+		t.Fatalf("expected the reload to fail for good, got %v", err)
+	}
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "tunnel down") {
+			t.Fatalf("daemon exited with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for the daemon to exit")
+	}
+}
+
+func TestPrintProxyStatus(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	var out bytes.Buffer
+	printProxyStatus(&out, manager.DaemonStatus{
+		InstanceID:      "inst-1",
+		Profile:         "work",
+		ActiveProfile:   "backup",
+		PID:             42,
+		HTTPPort:        18080,
+		SOCKSListenPort: 1080,
+		StartedAt:       at,
+		Failovers:       1,
+		ActiveConnects:  3,
+		Tunnels: []localproxy.UpstreamStatus{
+			{ID: 0, Profile: "backup", Healthy: true, Conns: 3, Dials: 9, Restarts: 1, LastError: "reset", LastErrorAt: at},
+			{ID: 1},
+		},
+	})
+	stamp := at.Format(time.RFC3339)
+	want := "Instance:     inst-1\n" +
+		"Profile:      work (active: backup)\n" +
+		"PID:          42\n" +
+		"HTTP:         127.0.0.1:18080\n" +
+		"SOCKS5:       127.0.0.1:1080\n" +
+		"Started:      " + stamp + "\n" +
+		"Connections:  3\n" +
+		"Failovers:    1\n" +
+		"Reloads:      0\n" +
+		"\n" +
+		"TUNNEL  PROFILE  STATE  CONNS  DIALS  RESTARTS  LAST_ERROR\n" +
+		"0       backup   up     3      9      1         reset (" + stamp + ")\n" +
+		"1       -        down   0      0      0         -\n"
+	if got := out.String(); got != want {
+		t.Fatalf("status output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestProxyStatusCmdUnknownInstance(t *testing.T) {
+	store := newTempStore(t)
+	if err := store.Save(config.Config{Version: config.CurrentVersion}); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	if _, err := runProxyCmd(t, store, "status", "nope"); err == nil || err.Error() != `instance "nope" not found` {
+		t.Fatalf("expected an unknown instance error, got %v", err)
+	}
+}
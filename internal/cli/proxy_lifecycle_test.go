@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
 	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
 	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
 )
@@ -34,7 +36,11 @@ func withProxyTestHooks(t *testing.T) {
 	prevHeartbeat := heartbeatProxyInstance
 	prevTicker := newProxyTicker
 	prevStackStart := stackStart
+	prevFailover := recordProxyFailover
+	prevLog := proxyDaemonLog
 	t.Cleanup(func() {
+		recordProxyFailover = prevFailover
+		proxyDaemonLog = prevLog
 		newProxyStore = prevStore
 		newProxyInstanceID = prevID
 		proxyExecutable = prevExe
@@ -99,14 +105,14 @@ func TestProxyStartCmdBackgroundSuccess(t *testing.T) {
 		t.Fatalf("unexpected output: %s", out.String())
 	}
 
-	loaded, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
 	}
-	if len(loaded.Instances) != 1 {
-		t.Fatalf("expected one instance, got %d", len(loaded.Instances))
+	if len(instances) != 1 {
+		t.Fatalf("expected one instance, got %d", len(instances))
 	}
-	inst := loaded.Instances[0]
+	inst := instances[0]
 	if inst.ID != "inst-fixed" || inst.DaemonPID != 4242 || inst.ProfileID != "p1" || inst.Kind != config.InstanceKindDaemon {
 		t.Fatalf("unexpected instance: %#v", inst)
 	}
@@ -152,12 +158,12 @@ func TestProxyStartCmdForegroundSuccess(t *testing.T) {
 		t.Fatalf("Execute error: %v", err)
 	}
 
-	loaded, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
 	}
-	if len(loaded.Instances) != 0 {
-		t.Fatalf("expected foreground daemon to clean up instance, got %#v", loaded.Instances)
+	if len(instances) != 0 {
+		t.Fatalf("expected foreground daemon to clean up instance, got %#v", instances)
 	}
 }
 
@@ -196,12 +202,159 @@ func TestRunProxyDaemonRemovesInstanceOnFatal(t *testing.T) {
 		t.Fatalf("expected fatal tunnel error, got %v", err)
 	}
 
-	loaded, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
 	}
-	if len(loaded.Instances) != 0 {
-		t.Fatalf("expected instance to be removed on fatal, got %#v", loaded.Instances)
+	if len(instances) != 0 {
+		t.Fatalf("expected instance to be removed on fatal, got %#v", instances)
+	}
+}
+
+func TestRunProxyDaemonPassesFailoverGroup(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{
+			{ID: "p1", Name: "primary", Host: "a", Port: 22, User: "u", Failover: []string{"backup"}, Tunnels: 2, Restart: &config.RestartPolicy{Budget: 7}},
+			{ID: "p2", Name: "backup", Host: "b", Port: 22, User: "u"},
+		},
+		Instances: []config.Instance{{ID: "inst-1", ProfileID: "p1"}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	var recorded []string
+	recordProxyFailover = func(_ *config.Store, instanceID, activeProfileID string, failovers int) error {
+		recorded = append(recorded, fmt.Sprintf("%s:%s:%d", instanceID, activeProfileID, failovers))
+		return nil
+	}
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		if len(opts.Failover) != 1 || opts.Failover[0].ID != "p2" {
+			t.Fatalf("expected the backup profile as failover, got %#v", opts.Failover)
+		}
+		if opts.Tunnels != 2 || opts.Restart.Budget != 7 {
+			t.Fatalf("Tunnels=%d Restart=%+v want 2 tunnels and a budget of 7", opts.Tunnels, opts.Restart)
+		}
+		opts.OnFailover(stack.FailoverEvent{From: profile, To: opts.Failover[0], Err: errors.New("down")})
+		return stack.NewStackForTest(12345, 23456), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runProxyDaemon(ctx, store, "inst-1"); err != nil {
+		t.Fatalf("runProxyDaemon error: %v", err)
+	}
+	if len(recorded) != 1 || recorded[0] != "inst-1:p2:1" {
+		t.Fatalf("recorded failovers %q", recorded)
+	}
+
+	// The stopped daemon unregistered its instance; a new process migrates
+	// the legacy entry again.
+	cfg.Profiles[0].Failover = []string{"nope"}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	store, err := config.NewStore(store.Path())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if err := runProxyDaemon(ctx, store, "inst-1"); err == nil || !strings.Contains(err.Error(), `failover profile "nope" not found`) {
+		t.Fatalf("expected unknown failover profile error, got %v", err)
+	}
+}
+
+func TestRunProxyDaemonLogsStackEvents(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version:   config.CurrentVersion,
+		Profiles:  []config.Profile{{ID: "p1", Name: "work", Host: "h", Port: 22, User: "u"}},
+		Instances: []config.Instance{{ID: "inst-1", ProfileID: "p1"}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	var log bytes.Buffer
+	proxyDaemonLog = &log
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		st := stack.NewStackForTest(12345, 23456)
+		st.PublishForTest(stack.Event{Kind: stack.EventProxyListening, Time: at, Listener: "http", Addr: "127.0.0.1:12345"})
+		st.PublishForTest(stack.Event{Kind: stack.EventTunnelExited, Time: at, Profile: "work", Err: errors.New("reset")})
+		return st, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runProxyDaemon(ctx, store, "inst-1"); err != nil {
+		t.Fatalf("runProxyDaemon error: %v", err)
+	}
+	want := "2026-01-02T03:04:05Z http proxy listening on 127.0.0.1:12345\n" +
+		"2026-01-02T03:04:05Z tunnel 0: profile \"work\" exited: reset\n"
+	if got := log.String(); got != want {
+		t.Fatalf("daemon log %q want %q", got, want)
+	}
+}
+
+func TestProxyStopReportsDrainedConnections(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{{
+			ID:   "p1",
+			Name: "profile",
+			Host: "host",
+			Port: 22,
+			User: "user",
+		}},
+		Instances: []config.Instance{{
+			ID:        "inst-1",
+			ProfileID: "p1",
+		}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		return stack.NewStackForTest(12345, 23456), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runProxyDaemon(ctx, store, "inst-1"); err != nil {
+		t.Fatalf("runProxyDaemon error: %v", err)
+	}
+	reportPath := instanceStopReportPath(store, "inst-1")
+	if _, err := os.Stat(reportPath); err != nil {
+		t.Fatalf("expected stop report: %v", err)
+	}
+
+	// The daemon removed its own entry; stop still needs one to look up.
+	if err := recordProxyInstance(store, config.Instance{ID: "inst-1", ProfileID: "p1"}); err != nil {
+		t.Fatalf("record instance: %v", err)
+	}
+	if err := writeProxyStopReport(store, "inst-1", localproxy.DrainResult{Drained: 3, Killed: 1}); err != nil {
+		t.Fatalf("write report: %v", err)
+	}
+
+	cmd := newProxyStopCmd(&rootOptions{configPath: store.Path()})
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"inst-1"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Stopped instance inst-1 (drained 3, killed 1 connections)") {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+	if _, err := os.Stat(reportPath); !os.IsNotExist(err) {
+		t.Fatalf("expected stop report to be consumed, stat err=%v", err)
 	}
 }
 
@@ -272,12 +425,12 @@ func TestRunProxyDaemonHeartbeatsAndUsesConfiguredHTTPPort(t *testing.T) {
 		t.Fatalf("expected one heartbeat, got %d", heartbeatCalls)
 	}
 
-	loaded, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
 	}
-	if len(loaded.Instances) != 0 {
-		t.Fatalf("expected instance to be removed on shutdown, got %#v", loaded.Instances)
+	if len(instances) != 0 {
+		t.Fatalf("expected instance to be removed on shutdown, got %#v", instances)
 	}
 }
 
@@ -312,3 +465,103 @@ func TestLaunchProxyDaemonProcessWritesLogs(t *testing.T) {
 	}
 	t.Fatalf("expected log file to contain child output, got %q err=%v", string(data), err)
 }
+
+func TestRunProxyDaemonPersistsProxyAuthToken(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{{
+			ID:          "p1",
+			Name:        "profile",
+			Host:        "host",
+			Port:        22,
+			User:        "user",
+			ProxyAuth:   true,
+			ExposeSOCKS: true,
+		}},
+		Instances: []config.Instance{{
+			ID:         "inst-1",
+			ProfileID:  "p1",
+			ProxyToken: "previous-token",
+			SOCKSToken: "previous-socks-token",
+		}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ticker := &fakeProxyTicker{ch: make(chan time.Time, 1)}
+	newProxyTicker = func(time.Duration) proxyTicker { return ticker }
+
+	var gotOpts stack.Options
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		gotOpts = opts
+		st := stack.NewStackForTest(18080, 23456)
+		st.ProxyAuthToken = opts.ProxyAuthToken
+		st.SOCKSAuthToken = opts.SOCKSAuthToken
+		return st, nil
+	}
+
+	var recorded config.Instance
+	heartbeatProxyInstance = func(store *config.Store, instanceID string, now time.Time) error {
+		recorded, _, _ = manager.LoadInstance(store, instanceID)
+		cancel()
+		return nil
+	}
+
+	ticker.ch <- time.Now()
+	if err := runProxyDaemon(ctx, store, "inst-1"); err != nil {
+		t.Fatalf("runProxyDaemon: %v", err)
+	}
+	if gotOpts.ProxyAuthToken != "previous-token" || gotOpts.SOCKSAuthToken != "previous-socks-token" {
+		t.Fatalf("expected stored tokens to be reused, got %q and %q", gotOpts.ProxyAuthToken, gotOpts.SOCKSAuthToken)
+	}
+	if recorded.ProxyToken != "previous-token" || recorded.SOCKSToken != "previous-socks-token" || recorded.HTTPPort != 18080 {
+		t.Fatalf("unexpected recorded instance: %#v", recorded)
+	}
+}
+
+func TestProxyStartCmdForegroundHTTPProxyProfile(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version: config.CurrentVersion,
+		Profiles: []config.Profile{{
+			ID:            "p1",
+			Name:          "corp",
+			Type:          config.ProfileTypeHTTPProxy,
+			UpstreamProxy: "http://user:pw@proxy.corp:3128",
+		}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ticker := &fakeProxyTicker{ch: make(chan time.Time, 1)}
+	newProxyTicker = func(time.Duration) proxyTicker { return ticker }
+	var gotProfile config.Profile
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		gotProfile = profile
+		return stack.NewStackForTest(12345, 0), nil
+	}
+	heartbeatProxyInstance = func(store *config.Store, instanceID string, now time.Time) error {
+		cancel()
+		return manager.Heartbeat(store, instanceID, now)
+	}
+
+	cmd := newProxyStartCmd(&rootOptions{configPath: store.Path()})
+	cmd.SetContext(ctx)
+	cmd.SetArgs([]string{"--foreground", "corp"})
+	go func() {
+		ticker.ch <- time.Now()
+	}()
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if !gotProfile.IsHTTPProxy() || gotProfile.UpstreamProxy != "http://user:pw@proxy.corp:3128" {
+		t.Fatalf("unexpected profile passed to stack: %#v", gotProfile)
+	}
+}
@@ -0,0 +1,464 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/spf13/cobra"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+// Service managers a daemon can be installed under.
+const (
+	serviceManagerSystemd = "systemd"
+	serviceManagerLaunchd = "launchd"
+)
+
+const launchdLabelPrefix = "com.github.baaaaaaaka.claude-proxy."
+
+var (
+	serviceHomeDir    = os.UserHomeDir
+	serviceUID        = os.Getuid
+	runServiceCommand = execServiceCommand
+)
+
+// systemdUnitTemplate runs the daemon in the foreground; a clean exit, as
+// after `systemctl --user stop`, is not restarted.
+var systemdUnitTemplate = template.Must(template.New("systemd").Funcs(template.FuncMap{
+	"escape": systemdEscape,
+	"label":  systemdLabel,
+}).Parse(`# Generated by claude-proxy; remove with:
+#   claude-proxy proxy uninstall-service {{.ProfileID}}
+[Unit]
+Description=claude-proxy daemon for profile {{label .ProfileName}}
+
+[Service]
+Type=simple
+ExecStart={{.ExecStart}}
+Restart=on-failure
+RestartSec=5s
+StandardOutput=append:{{escape .LogPath}}
+StandardError=append:{{escape .LogPath}}
+
+[Install]
+WantedBy=default.target
+`))
+
+// launchdPlistTemplate starts the daemon at login and restarts it unless
+// it exited cleanly.
+var launchdPlistTemplate = template.Must(template.New("launchd").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<!-- Generated by claude-proxy; remove with: claude-proxy proxy uninstall-service {{xml .ProfileID}} -->
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Name}}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{- range .Args}}
+		<string>{{xml .}}</string>
+{{- end}}
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>5</integer>
+	<key>StandardOutPath</key>
+	<string>{{xml .LogPath}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{xml .LogPath}}</string>
+</dict>
+</plist>
+`))
+
+// proxyService is the user service running the daemon of one profile.
+type proxyService struct {
+	Manager     string
+	Name        string // systemd unit or launchd label
+	Path        string // unit or plist file
+	ProfileID   string
+	ProfileName string
+	Args        []string
+	LogPath     string
+}
+
+// ExecStart is Args quoted for a systemd unit.
+func (s proxyService) ExecStart() string {
+	quoted := make([]string, len(s.Args))
+	for i, a := range s.Args {
+		quoted[i] = systemdQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// serviceInstanceID is the fixed instance id of a profile's service
+// daemon, so every restart registers as the same instance.
+func serviceInstanceID(profileID string) string {
+	return "service-" + profileID
+}
+
+func defaultServiceManager() (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return serviceManagerSystemd, nil
+	case "darwin":
+		return serviceManagerLaunchd, nil
+	default:
+		return "", fmt.Errorf("services are supported with systemd (Linux) and launchd (macOS), not on %s", runtime.GOOS)
+	}
+}
+
+// newProxyService describes the service of profile under serviceManager,
+// running exe with the config at configPath. A non-zero httpPort is passed
+// to the daemon as --port.
+func newProxyService(serviceManager string, profile config.Profile, exe, configPath string, httpPort int) (proxyService, error) {
+	home, err := serviceHomeDir()
+	if err != nil {
+		return proxyService{}, err
+	}
+	svc := proxyService{
+		Manager:     serviceManager,
+		ProfileID:   profile.ID,
+		ProfileName: profile.Name,
+		Args: []string{
+			exe, "--config", configPath,
+			"proxy", "daemon", "--service", profile.ID, "--service-manager", serviceManager,
+		},
+		LogPath: filepath.Join(filepath.Dir(configPath), "instances", serviceInstanceID(profile.ID)+".log"),
+	}
+	if httpPort > 0 {
+		svc.Args = append(svc.Args, "--port", strconv.Itoa(httpPort))
+	}
+	switch serviceManager {
+	case serviceManagerSystemd:
+		dir := filepath.Join(home, ".config", "systemd", "user")
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(xdg) {
+			dir = filepath.Join(xdg, "systemd", "user")
+		}
+		svc.Name = "claude-proxy-" + profile.ID + ".service"
+		svc.Path = filepath.Join(dir, svc.Name)
+		if err := svc.checkSystemdUnit(); err != nil {
+			return proxyService{}, err
+		}
+	case serviceManagerLaunchd:
+		svc.Name = launchdLabelPrefix + profile.ID
+		svc.Path = filepath.Join(home, "Library", "LaunchAgents", svc.Name+".plist")
+	default:
+		return proxyService{}, fmt.Errorf("unknown service manager %q (want %s or %s)", serviceManager, serviceManagerSystemd, serviceManagerLaunchd)
+	}
+	return svc, nil
+}
+
+// render returns the unit or plist file of s.
+func (s proxyService) render() ([]byte, error) {
+	tmpl := systemdUnitTemplate
+	if s.Manager == serviceManagerLaunchd {
+		tmpl = launchdPlistTemplate
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Service manager commands. The launchd domain is the login session's.
+func (s proxyService) startCommands() [][]string {
+	if s.Manager == serviceManagerLaunchd {
+		return [][]string{{"launchctl", "bootstrap", s.launchdDomain(), s.Path}}
+	}
+	return [][]string{
+		{"systemctl", "--user", "daemon-reload"},
+		{"systemctl", "--user", "enable", "--now", s.Name},
+	}
+}
+
+func (s proxyService) stopCommand() []string {
+	if s.Manager == serviceManagerLaunchd {
+		return []string{"launchctl", "kill", "SIGTERM", s.launchdDomain() + "/" + s.Name}
+	}
+	return []string{"systemctl", "--user", "stop", s.Name}
+}
+
+func (s proxyService) removeCommands() [][]string {
+	if s.Manager == serviceManagerLaunchd {
+		return [][]string{{"launchctl", "bootout", s.launchdDomain() + "/" + s.Name}}
+	}
+	return [][]string{{"systemctl", "--user", "disable", "--now", s.Name}}
+}
+
+func (s proxyService) launchdDomain() string {
+	return "gui/" + strconv.Itoa(serviceUID())
+}
+
+func execServiceCommand(args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stack.DefaultDrainTimeout+time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %w: %s", strings.Join(args, " "), err, msg)
+		}
+		return fmt.Errorf("%s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// runServiceDaemon registers and runs the daemon of a service installed
+// for profileRef, in the foreground, listening on httpPort when it is set.
+func runServiceDaemon(ctx context.Context, store *config.Store, profileRef, serviceManager string, httpPort int) error {
+	cfg, err := store.Load()
+	if err != nil {
+		return err
+	}
+	profile, err := selectProfile(cfg, profileRef)
+	if err != nil {
+		return err
+	}
+	svc, err := newProxyService(serviceManager, profile, "", store.Path(), 0)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	inst := config.Instance{
+		ID:             serviceInstanceID(profile.ID),
+		ProfileID:      profile.ID,
+		Kind:           config.InstanceKindDaemon,
+		HTTPPort:       httpPort,
+		DaemonPID:      os.Getpid(),
+		StartedAt:      now,
+		LastSeenAt:     now,
+		ServiceManager: svc.Manager,
+		ServiceName:    svc.Name,
+	}
+	if err := recordProxyInstance(store, inst); err != nil {
+		return err
+	}
+	return runProxyDaemon(ctx, store, inst.ID)
+}
+
+// stopServiceInstance stops a service-managed daemon through its service
+// manager; signalled directly, it would just be restarted.
+func stopServiceInstance(inst config.Instance) error {
+	svc := proxyService{Manager: inst.ServiceManager, Name: inst.ServiceName}
+	return runServiceCommand(svc.stopCommand()...)
+}
+
+func newProxyInstallServiceCmd(root *rootOptions) *cobra.Command {
+	var serviceManager string
+	var printOnly bool
+	var noStart bool
+	var port int
+
+	cmd := &cobra.Command{
+		Use:   "install-service <profile>",
+		Short: "Run a profile's proxy daemon as a user service started at login",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := newProxyStore(root.configPath)
+			if err != nil {
+				return err
+			}
+			cfg, err := store.Load()
+			if err != nil {
+				return err
+			}
+			profile, err := selectProfile(cfg, args[0])
+			if err != nil {
+				return err
+			}
+			if err := stack.ValidateProfile(profile); err != nil {
+				return err
+			}
+			// The unit pins the port, so clients configured once keep
+			// working when the service restarts.
+			if port < 0 || port > 65535 {
+				return fmt.Errorf("invalid --port %d", port)
+			}
+			if port == 0 {
+				if port, err = pickFreePort(); err != nil {
+					return err
+				}
+			}
+			if serviceManager == "" {
+				if serviceManager, err = defaultServiceManager(); err != nil {
+					return err
+				}
+			}
+
+			exe, err := proxyExecutable()
+			if err != nil {
+				return err
+			}
+			configPath, err := filepath.Abs(store.Path())
+			if err != nil {
+				return err
+			}
+			svc, err := newProxyService(serviceManager, profile, exe, configPath, port)
+			if err != nil {
+				return err
+			}
+			content, err := svc.render()
+			if err != nil {
+				return err
+			}
+			if printOnly {
+				_, _ = cmd.OutOrStdout().Write(content)
+				return nil
+			}
+
+			if err := os.MkdirAll(filepath.Dir(svc.Path), 0o755); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(svc.LogPath), 0o700); err != nil {
+				return err
+			}
+			if err := config.WriteFileAtomic(svc.Path, content, 0o644); err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Wrote %s\n", svc.Path)
+			if noStart {
+				return nil
+			}
+			for _, c := range svc.startCommands() {
+				if err := runServiceCommand(c...); err != nil {
+					return err
+				}
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Started %s (instance %s). Logs: %s\n", svc.Name, serviceInstanceID(profile.ID), svc.LogPath)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&serviceManager, "manager", "", "Service manager: systemd or launchd (default: this OS's)")
+	cmd.Flags().BoolVar(&printOnly, "print", false, "Print the unit or plist instead of installing it")
+	cmd.Flags().BoolVar(&noStart, "no-start", false, "Write the unit or plist without enabling and starting it")
+	cmd.Flags().IntVar(&port, "port", 0, "HTTP proxy port of the service (default: a free port chosen now)")
+	return cmd
+}
+
+func newProxyUninstallServiceCmd(root *rootOptions) *cobra.Command {
+	var serviceManager string
+
+	cmd := &cobra.Command{
+		Use:   "uninstall-service <profile>",
+		Short: "Stop and remove a profile's proxy daemon user service",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := newProxyStore(root.configPath)
+			if err != nil {
+				return err
+			}
+			cfg, err := store.Load()
+			if err != nil {
+				return err
+			}
+			profile, err := selectProfile(cfg, args[0])
+			if err != nil {
+				return err
+			}
+			if serviceManager == "" {
+				if serviceManager, err = defaultServiceManager(); err != nil {
+					return err
+				}
+			}
+			svc, err := newProxyService(serviceManager, profile, "", store.Path(), 0)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(svc.Path); errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("no service installed for profile %q (%s)", profile.Name, svc.Path)
+			}
+
+			for _, c := range svc.removeCommands() {
+				if err := runServiceCommand(c...); err != nil {
+					_, _ = fmt.Fprintf(cmd.ErrOrStderr(), "warning: %v\n", err)
+				}
+			}
+			if err := os.Remove(svc.Path); err != nil {
+				return err
+			}
+			if svc.Manager == serviceManagerSystemd {
+				_ = runServiceCommand("systemctl", "--user", "daemon-reload")
+			}
+			_ = manager.RemoveInstance(store, serviceInstanceID(profile.ID))
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Removed %s\n", svc.Path)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&serviceManager, "manager", "", "Service manager: systemd or launchd (default: this OS's)")
+	return cmd
+}
+
+// checkSystemdUnit rejects values the unit file cannot carry: control
+// characters, which would end the line and start new directives, and
+// whitespace in the log path, which StandardOutput=append: takes unquoted.
+func (s proxyService) checkSystemdUnit() error {
+	values := append([]string{s.ProfileID, s.LogPath}, s.Args...)
+	for _, v := range values {
+		if strings.ContainsFunc(v, unicode.IsControl) {
+			return fmt.Errorf("cannot write a systemd unit for %q: control character in %q", s.ProfileID, v)
+		}
+	}
+	if strings.ContainsFunc(s.LogPath, unicode.IsSpace) {
+		return fmt.Errorf("cannot write a systemd unit for %q: systemd cannot append to a log path with spaces (%s); move the config dir", s.ProfileID, s.LogPath)
+	}
+	return nil
+}
+
+// systemdEscape escapes systemd's % specifiers.
+func systemdEscape(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// systemdLabel is s for a free-text setting such as Description, without
+// the control characters that would break the unit's line structure.
+func systemdLabel(s string) string {
+	return systemdEscape(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s))
+}
+
+// systemdQuote quotes one ExecStart argument; $ and % are escaped so that
+// systemd does not expand them.
+func systemdQuote(arg string) string {
+	arg = strings.ReplaceAll(systemdEscape(arg), "$", "$$")
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+func xmlEscape(s string) (string, error) {
+	var buf bytes.Buffer
+	if err := xml.EscapeText(&buf, []byte(s)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
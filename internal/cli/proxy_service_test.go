@@ -0,0 +1,384 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func withServiceTestHooks(t *testing.T) (home string, calls *[][]string) {
+	t.Helper()
+	withProxyTestHooks(t)
+	prevHome := serviceHomeDir
+	prevUID := serviceUID
+	prevRun := runServiceCommand
+	t.Cleanup(func() {
+		serviceHomeDir = prevHome
+		serviceUID = prevUID
+		runServiceCommand = prevRun
+	})
+
+	home = t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", "")
+	serviceHomeDir = func() (string, error) { return home, nil }
+	serviceUID = func() int { return 501 }
+	calls = &[][]string{}
+	runServiceCommand = func(args ...string) error {
+		*calls = append(*calls, args)
+		return nil
+	}
+	proxyExecutable = func() (string, error) { return "/usr/local/bin/claude-proxy", nil }
+	return home, calls
+}
+
+func saveServiceProfile(t *testing.T, store *config.Store) {
+	t.Helper()
+	cfg := config.Config{
+		Version:  config.CurrentVersion,
+		Profiles: []config.Profile{{ID: "p1", Name: "work", Host: "h", Port: 22, User: "u"}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "service", name)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("write golden: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden (run with -update to create it): %v", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("%s mismatch (run with -update to accept)\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestProxyServiceTemplatesGolden(t *testing.T) {
+	for _, tc := range []struct {
+		manager string
+		name    string
+		golden  string
+	}{
+		{serviceManagerSystemd, "claude-proxy-p1.service", "systemd.service.golden"},
+		{serviceManagerLaunchd, launchdLabelPrefix + "p1", "launchd.plist.golden"},
+	} {
+		t.Run(tc.manager, func(t *testing.T) {
+			// Spaces, specifiers and markup must survive quoting.
+			svc := proxyService{
+				Manager:     tc.manager,
+				Name:        tc.name,
+				ProfileID:   "p1",
+				ProfileName: "work <100%>",
+				Args: []string{
+					"/opt/claude proxy/bin/claude-proxy", "--config", "/home/u/.config/claude-proxy/config.json",
+					"proxy", "daemon", "--service", "p1", "--service-manager", tc.manager,
+				},
+				LogPath: "/home/u/.config/claude-proxy/instances/service-p1.log",
+			}
+			got, err := svc.render()
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			checkGolden(t, tc.golden, got)
+		})
+	}
+}
+
+func TestProxyServiceWithPortGolden(t *testing.T) {
+	withServiceTestHooks(t)
+	for _, tc := range []struct {
+		manager string
+		golden  string
+	}{
+		{serviceManagerSystemd, "systemd-port.service.golden"},
+		{serviceManagerLaunchd, "launchd-port.plist.golden"},
+	} {
+		t.Run(tc.manager, func(t *testing.T) {
+			svc, err := newProxyService(tc.manager, config.Profile{ID: "p1", Name: "work"}, "/usr/local/bin/claude-proxy", "/home/u/.config/claude-proxy/config.json", 18080)
+			if err != nil {
+				t.Fatalf("newProxyService: %v", err)
+			}
+			got, err := svc.render()
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			checkGolden(t, tc.golden, got)
+		})
+	}
+}
+
+func TestSystemdQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":      "plain",
+		"":           `""`,
+		"a b":        `"a b"`,
+		`say "hi"`:   `"say \"hi\""`,
+		`C:\dir`:     `"C:\\dir"`,
+		"$HOME/50%":  "$$HOME/50%%",
+		"x;y":        `"x;y"`,
+		"--config=a": "--config=a",
+	} {
+		if got := systemdQuote(in); got != want {
+			t.Fatalf("systemdQuote(%q)=%q want %q", in, got, want)
+		}
+	}
+}
+
+func TestNewProxyServicePaths(t *testing.T) {
+	home, _ := withServiceTestHooks(t)
+	profile := config.Profile{ID: "p1", Name: "work"}
+
+	svc, err := newProxyService(serviceManagerSystemd, profile, "/bin/cp", "/cfg/config.json", 0)
+	if err != nil {
+		t.Fatalf("newProxyService: %v", err)
+	}
+	if want := filepath.Join(home, ".config", "systemd", "user", "claude-proxy-p1.service"); svc.Path != want {
+		t.Fatalf("systemd path=%q want %q", svc.Path, want)
+	}
+	if want := filepath.Join("/cfg", "instances", "service-p1.log"); svc.LogPath != want {
+		t.Fatalf("log path=%q want %q", svc.LogPath, want)
+	}
+	wantArgs := []string{"/bin/cp", "--config", "/cfg/config.json", "proxy", "daemon", "--service", "p1", "--service-manager", "systemd"}
+	if !reflect.DeepEqual(svc.Args, wantArgs) {
+		t.Fatalf("args=%q want %q", svc.Args, wantArgs)
+	}
+
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	svc, _ = newProxyService(serviceManagerSystemd, profile, "/bin/cp", "/cfg/config.json", 0)
+	if want := filepath.Join(xdg, "systemd", "user", "claude-proxy-p1.service"); svc.Path != want {
+		t.Fatalf("systemd path with XDG_CONFIG_HOME=%q want %q", svc.Path, want)
+	}
+
+	svc, err = newProxyService(serviceManagerLaunchd, profile, "/bin/cp", "/cfg/config.json", 0)
+	if err != nil {
+		t.Fatalf("newProxyService: %v", err)
+	}
+	if want := filepath.Join(home, "Library", "LaunchAgents", launchdLabelPrefix+"p1.plist"); svc.Path != want {
+		t.Fatalf("launchd path=%q want %q", svc.Path, want)
+	}
+	if got := svc.stopCommand(); !reflect.DeepEqual(got, []string{"launchctl", "kill", "SIGTERM", "gui/501/" + launchdLabelPrefix + "p1"}) {
+		t.Fatalf("launchd stop command=%q", got)
+	}
+
+	if _, err := newProxyService("upstart", profile, "/bin/cp", "/cfg/config.json", 0); err == nil {
+		t.Fatalf("expected an unknown service manager to be rejected")
+	}
+}
+
+func TestSystemdUnitRejectsInjection(t *testing.T) {
+	withServiceTestHooks(t)
+
+	svc, err := newProxyService(serviceManagerSystemd, config.Profile{ID: "p1", Name: "work\nExecStartPre=/bin/evil"}, "/bin/cp", "/cfg/config.json", 0)
+	if err != nil {
+		t.Fatalf("newProxyService: %v", err)
+	}
+	unit, err := svc.render()
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.Contains(string(unit), "Description=claude-proxy daemon for profile workExecStartPre=/bin/evil\n") {
+		t.Fatalf("expected the control characters to be dropped from the description:\n%s", unit)
+	}
+
+	for _, configPath := range []string{"/cfg\nExecStartPre=/bin/evil/config.json", "/my cfg/config.json"} {
+		if _, err := newProxyService(serviceManagerSystemd, config.Profile{ID: "p1", Name: "work"}, "/bin/cp", configPath, 0); err == nil {
+			t.Fatalf("expected config path %q to be rejected", configPath)
+		}
+	}
+	if _, err := newProxyService(serviceManagerLaunchd, config.Profile{ID: "p1", Name: "work"}, "/bin/cp", "/my cfg/config.json", 0); err != nil {
+		t.Fatalf("expected launchd to take a path with spaces: %v", err)
+	}
+}
+
+func TestProxyInstallAndUninstallService(t *testing.T) {
+	home, calls := withServiceTestHooks(t)
+	store := newTempStore(t)
+	saveServiceProfile(t, store)
+	unit := filepath.Join(home, ".config", "systemd", "user", "claude-proxy-p1.service")
+
+	out, err := runProxyCmd(t, store, "install-service", "work", "--manager", "systemd", "--print")
+	if err != nil {
+		t.Fatalf("install-service --print: %v", err)
+	}
+	if !strings.Contains(out, "ExecStart=/usr/local/bin/claude-proxy --config ") || !strings.Contains(out, " --port ") || len(*calls) != 0 {
+		t.Fatalf("unexpected --print output %q or commands %q", out, *calls)
+	}
+	if _, err := os.Stat(unit); !os.IsNotExist(err) {
+		t.Fatalf("expected --print not to write the unit, stat err=%v", err)
+	}
+
+	if _, err := runProxyCmd(t, store, "install-service", "work", "--manager", "systemd"); err != nil {
+		t.Fatalf("install-service: %v", err)
+	}
+	b, err := os.ReadFile(unit)
+	if err != nil {
+		t.Fatalf("read unit: %v", err)
+	}
+	if !strings.Contains(string(b), "proxy daemon --service p1 --service-manager systemd") {
+		t.Fatalf("unit does not run the service daemon:\n%s", b)
+	}
+	wantStart := [][]string{
+		{"systemctl", "--user", "daemon-reload"},
+		{"systemctl", "--user", "enable", "--now", "claude-proxy-p1.service"},
+	}
+	if !reflect.DeepEqual(*calls, wantStart) {
+		t.Fatalf("install commands=%q want %q", *calls, wantStart)
+	}
+
+	if err := manager.RecordInstance(store, config.Instance{ID: "service-p1", ProfileID: "p1", ServiceManager: "systemd", ServiceName: "claude-proxy-p1.service"}); err != nil {
+		t.Fatalf("RecordInstance: %v", err)
+	}
+	*calls = nil
+	if _, err := runProxyCmd(t, store, "uninstall-service", "work", "--manager", "systemd"); err != nil {
+		t.Fatalf("uninstall-service: %v", err)
+	}
+	if _, err := os.Stat(unit); !os.IsNotExist(err) {
+		t.Fatalf("expected the unit to be removed, stat err=%v", err)
+	}
+	wantRemove := [][]string{
+		{"systemctl", "--user", "disable", "--now", "claude-proxy-p1.service"},
+		{"systemctl", "--user", "daemon-reload"},
+	}
+	if !reflect.DeepEqual(*calls, wantRemove) {
+		t.Fatalf("uninstall commands=%q want %q", *calls, wantRemove)
+	}
+	if _, ok, _ := manager.LoadInstance(store, "service-p1"); ok {
+		t.Fatalf("expected the service instance to be unregistered")
+	}
+
+	if _, err := runProxyCmd(t, store, "uninstall-service", "work", "--manager", "systemd"); err == nil {
+		t.Fatalf("expected an error uninstalling a service that is not installed")
+	}
+}
+
+func TestProxyInstallServicePort(t *testing.T) {
+	withServiceTestHooks(t)
+	store := newTempStore(t)
+	saveServiceProfile(t, store)
+
+	out, err := runProxyCmd(t, store, "install-service", "work", "--manager", "systemd", "--print", "--port", "18080")
+	if err != nil {
+		t.Fatalf("install-service --port: %v", err)
+	}
+	if !strings.Contains(out, "--service p1 --service-manager systemd --port 18080\n") {
+		t.Fatalf("expected the unit to pin the port:\n%s", out)
+	}
+	if _, err := runProxyCmd(t, store, "install-service", "work", "--manager", "systemd", "--print", "--port", "70000"); err == nil {
+		t.Fatalf("expected an invalid port to be rejected")
+	}
+}
+
+func TestRunServiceDaemonListensOnItsPort(t *testing.T) {
+	withServiceTestHooks(t)
+	store := newTempStore(t)
+	saveServiceProfile(t, store)
+
+	var listenAddrs []string
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		listenAddrs = append(listenAddrs, opts.HTTPListenAddr)
+		return stack.NewStackForTest(18080, 0), nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, port := range []int{19090, 0} {
+		if err := runServiceDaemon(ctx, store, "p1", serviceManagerSystemd, port); err != nil {
+			t.Fatalf("runServiceDaemon: %v", err)
+		}
+	}
+	if want := []string{"127.0.0.1:19090", ""}; !reflect.DeepEqual(listenAddrs, want) {
+		t.Fatalf("listen addrs=%q want %q", listenAddrs, want)
+	}
+}
+
+func TestProxyStopServiceInstance(t *testing.T) {
+	_, calls := withServiceTestHooks(t)
+	store := newTempStore(t)
+	saveServiceProfile(t, store)
+	inst := config.Instance{
+		ID:             "service-p1",
+		ProfileID:      "p1",
+		Kind:           config.InstanceKindDaemon,
+		DaemonPID:      os.Getpid(),
+		LastSeenAt:     time.Now(),
+		ServiceManager: serviceManagerSystemd,
+		ServiceName:    "claude-proxy-p1.service",
+	}
+	if err := manager.RecordInstance(store, inst); err != nil {
+		t.Fatalf("RecordInstance: %v", err)
+	}
+
+	out, err := runProxyCmd(t, store, "stop", "service-p1")
+	if err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if want := [][]string{{"systemctl", "--user", "stop", "claude-proxy-p1.service"}}; !reflect.DeepEqual(*calls, want) {
+		t.Fatalf("stop commands=%q want %q", *calls, want)
+	}
+	if !strings.Contains(out, "Stopped service claude-proxy-p1.service") {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if _, ok, _ := manager.LoadInstance(store, "service-p1"); ok {
+		t.Fatalf("expected the stopped instance to be unregistered")
+	}
+}
+
+func TestProxyPruneServiceInstances(t *testing.T) {
+	withServiceTestHooks(t)
+	store := newTempStore(t)
+	now := time.Now()
+	// The running daemon fails its health check but belongs to its service
+	// manager; the exited one is pruned, keeping the service's log.
+	for _, inst := range []config.Instance{
+		{ID: "service-p1", ProfileID: "p1", HTTPPort: 1, DaemonPID: os.Getpid(), LastSeenAt: now, ServiceManager: "systemd", ServiceName: "claude-proxy-p1.service"},
+		{ID: "service-p2", ProfileID: "p2", HTTPPort: 1, DaemonPID: 0, LastSeenAt: now.Add(-time.Hour), ServiceManager: "systemd", ServiceName: "claude-proxy-p2.service"},
+	} {
+		if err := manager.RecordInstance(store, inst); err != nil {
+			t.Fatalf("RecordInstance: %v", err)
+		}
+	}
+	logPath := instanceLogPath(store, "service-p2")
+	if err := os.MkdirAll(filepath.Dir(logPath), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(logPath, []byte("log\n"), 0o600); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+
+	out, err := runProxyCmd(t, store, "prune")
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if !strings.Contains(out, "Pruned 1 instances") {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if _, ok, _ := manager.LoadInstance(store, "service-p1"); !ok {
+		t.Fatalf("expected the running service instance to be kept")
+	}
+	if _, ok, _ := manager.LoadInstance(store, "service-p2"); ok {
+		t.Fatalf("expected the exited service instance to be pruned")
+	}
+	if _, err := os.Stat(logPath); err != nil {
+		t.Fatalf("expected the service log to be kept: %v", err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
 	"github.com/baaaaaaaka/claude_code_helper/internal/env"
 	"github.com/baaaaaaaka/claude_code_helper/internal/ids"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
 	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
 	"github.com/baaaaaaaka/claude_code_helper/internal/proc"
 	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
@@ -105,31 +106,28 @@ func runLike(cmd *cobra.Command, root *rootOptions, autoInit bool) error {
 		}
 	}
 	if profileRef != "" {
-		profile, cfg, err := ensureProfile(ctx, store, profileRef, autoInit, cmd.OutOrStdout())
+		profile, _, err := ensureProfile(ctx, store, profileRef, autoInit, cmd.OutOrStdout())
 		if err != nil {
 			return err
 		}
-		return runWithProfileOptions(ctx, store, profile, cfg.Instances, after, patchState, runOpts)
+		return runWithProfileOptions(ctx, store, profile, proxyInstances(store), after, patchState, runOpts)
 	}
 
 	pref, err := ensureProxyPreference(ctx, store, "", cmd.ErrOrStderr())
 	if err != nil {
 		return err
 	}
-	useProxy, cfg := pref.Enabled, pref.Cfg
-
-	if useProxy {
-		profile, cfgWithProfile, err := ensureProfile(ctx, store, "", autoInit, cmd.OutOrStdout())
+	if pref.Enabled {
+		profile, _, err := ensureProfile(ctx, store, "", autoInit, cmd.OutOrStdout())
 		if err != nil {
 			return err
 		}
-		cfg = cfgWithProfile
 		if pref.NeedsPersist {
 			if err := persistProxyPreference(store, true); err != nil {
 				return err
 			}
 		}
-		return runWithProfileOptions(ctx, store, profile, cfg.Instances, after, patchState, runOpts)
+		return runWithProfileOptions(ctx, store, profile, proxyInstances(store), after, patchState, runOpts)
 	}
 
 	if pref.NeedsPersist {
@@ -219,7 +217,7 @@ func selectProfile(cfg config.Config, ref string) (config.Profile, error) {
 	if len(cfg.Profiles) == 1 {
 		return cfg.Profiles[0], nil
 	}
-	return config.Profile{}, fmt.Errorf("multiple profiles exist; specify one: `claude-proxy <profile>` or `claude-proxy run <profile> -- ...`")
+	return config.Profile{}, fmt.Errorf("multiple profiles exist; specify one: `claude-proxy <profile>` or `claude-proxy run <profile> -- ...`, or use `auto` to pick the fastest")
 }
 
 func runWithExistingInstance(ctx context.Context, hc manager.HealthClient, inst config.Instance, cmdArgs []string, patchOutcome *patchOutcome) error {
@@ -234,9 +232,12 @@ func runWithExistingInstanceOptions(
 	patchOutcome *patchOutcome,
 	opts runTargetOptions,
 ) error {
-	proxyURL := fmt.Sprintf("http://127.0.0.1:%d", inst.HTTPPort)
+	proxyURL := localproxy.ProxyURL(inst.HTTPPort, inst.ProxyToken)
+	if inst.SOCKSListenPort > 0 {
+		opts.SOCKSProxyURL = localproxy.SOCKSProxyURL(inst.SOCKSListenPort, inst.SOCKSToken)
+	}
 	return runTargetSupervisedWithOptions(ctx, cmdArgs, proxyURL, func() error {
-		return hc.CheckHTTPProxy(inst.HTTPPort, inst.ID)
+		return hc.CheckInstance(inst)
 	}, patchOutcome, nil, opts)
 }
 
@@ -257,24 +258,92 @@ func runWithNewStackOptions(
 		return err
 	}
 
-	st, err := stackStart(profile, instanceID, stack.Options{})
+	restart, err := stack.ProfileRestartPolicy(profile)
+	if err != nil {
+		return err
+	}
+	stackOpts := stack.Options{Version: version, Tunnels: profile.Tunnels, Restart: restart}
+	if len(profile.Failover) > 0 {
+		cfg, err := store.Load()
+		if err != nil {
+			return err
+		}
+		if stackOpts.Failover, err = cfg.FailoverProfiles(profile); err != nil {
+			return err
+		}
+	}
+
+	st, err := stackStart(profile, instanceID, stackOpts)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = st.Close(context.Background()) }()
 
+	events, unsubscribe := st.Subscribe()
+	noticed := printTunnelNotices(opts.statusWriter(), events, profile.Tunnels > 1)
+	defer func() {
+		unsubscribe()
+		<-noticed
+	}()
+
 	proxyURL := st.HTTPProxyURL()
 
 	if len(cmdArgs) == 0 {
 		return fmt.Errorf("missing command")
 	}
 
+	opts.SOCKSProxyURL = st.SOCKSProxyURL()
+
+	probe, err := newTunnelProbe(profile, st)
+	if err != nil {
+		return err
+	}
+	// A failing probe restarts its tunnel; the target is only stopped once
+	// the stack gives up.
+	stopProbe := probe.run()
+	defer stopProbe()
 	hc := manager.HealthClient{Timeout: 1 * time.Second}
 	return runTargetSupervisedWithOptions(ctx, cmdArgs, proxyURL, func() error {
-		return hc.CheckHTTPProxy(st.HTTPPort, instanceID)
+		return hc.CheckHTTPProxyWithToken(st.HTTPPort, instanceID, st.ProxyAuthToken)
 	}, patchOutcome, st.Fatal(), opts)
 }
 
+// printTunnelNotices reports reconnects and failovers of a stack started
+// for `run` until events is closed, then closes the returned channel.
+// Start-up events are left to the daemon log.
+func printTunnelNotices(w io.Writer, events <-chan stack.Event, numbered bool) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			if msg := tunnelNotice(e, numbered); msg != "" {
+				_, _ = fmt.Fprintln(w, "proxy: "+msg)
+			}
+		}
+	}()
+	return done
+}
+
+func tunnelNotice(e stack.Event, numbered bool) string {
+	name := "tunnel"
+	if numbered {
+		name = fmt.Sprintf("tunnel %d", e.Tunnel)
+	}
+	switch e.Kind {
+	case stack.EventRestartScheduled:
+		return fmt.Sprintf("%s lost (%v); reconnecting in %s", name, e.Err, e.Delay)
+	case stack.EventTunnelReady:
+		if e.Attempt > 0 {
+			return name + " reconnected"
+		}
+	case stack.EventFailover:
+		return fmt.Sprintf("%s switched from profile %q to %q", name, e.From, e.Profile)
+	case stack.EventGaveUp:
+		return fmt.Sprintf("%s could not reconnect: %v", name, e.Err)
+	}
+	return ""
+}
+
 func runWithProfile(
 	ctx context.Context,
 	store *config.Store,
@@ -297,7 +366,22 @@ func runWithProfileOptions(
 ) error {
 	hc := manager.HealthClient{Timeout: 1 * time.Second}
 	if inst := manager.FindReusableInstance(instances, profile.ID, hc); inst != nil {
-		return runWithExistingInstanceOptions(ctx, hc, *inst, cmdArgs, patchOutcome, opts)
+		if !inst.Shared {
+			return runWithExistingInstanceOptions(ctx, hc, *inst, cmdArgs, patchOutcome, opts)
+		}
+		// A shared daemon only stays up while someone holds a lease on it;
+		// if it is just shutting down, look further.
+		if err := manager.AcquireLease(store, inst.ID, os.Getpid(), time.Now()); err == nil {
+			defer releaseSharedDaemon(store, inst.ID)
+			return runWithExistingInstanceOptions(ctx, hc, *inst, cmdArgs, patchOutcome, opts)
+		}
+	}
+	cfg, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if cfg.SharedDaemonEnabled() {
+		return runWithSharedDaemon(ctx, store, cfg, profile, cmdArgs, patchOutcome, opts)
 	}
 	return runWithNewStackOptions(ctx, store, profile, cmdArgs, patchOutcome, opts)
 }
@@ -306,6 +390,9 @@ type runTargetOptions struct {
 	Cwd      string
 	ExtraEnv []string
 	UseProxy bool
+	// SOCKSProxyURL is exported as ALL_PROXY when the instance has a local
+	// SOCKS5 listener.
+	SOCKSProxyURL string
 	// PreserveTTY keeps stdout/stderr attached to the terminal for interactive CLIs.
 	PreserveTTY        bool
 	CaptureTTYOutput   bool
@@ -604,6 +691,9 @@ func runTargetOnceWithOptions(
 	envVars := os.Environ()
 	if opts.UseProxy {
 		envVars = env.WithProxy(envVars, proxyURL)
+		if opts.SOCKSProxyURL != "" {
+			envVars = env.WithSOCKSProxy(envVars, opts.SOCKSProxyURL)
+		}
 	}
 	if len(opts.ExtraEnv) > 0 {
 		envVars = appendEnvOverrides(envVars, opts.ExtraEnv)
@@ -306,11 +306,57 @@ func TestRunWithNewStackOptionsSuccess(t *testing.T) {
 	if err := runWithNewStackOptions(context.Background(), store, profile, []string{shell, "-c", "exit 0"}, nil, runTargetOptions{UseProxy: false}); err != nil {
 		t.Fatalf("runWithNewStackOptions error: %v", err)
 	}
-	cfg, err := store.Load()
+	instances, err := manager.ListInstances(store)
 	if err != nil {
-		t.Fatalf("load config: %v", err)
+		t.Fatalf("list instances: %v", err)
 	}
-	if len(cfg.Instances) != 0 {
-		t.Fatalf("expected instances to be removed, got %d", len(cfg.Instances))
+	if len(instances) != 0 {
+		t.Fatalf("expected instances to be removed, got %#v", instances)
+	}
+}
+
+func TestRunWithNewStackOptionsPrintsTunnelNotices(t *testing.T) {
+	shell := requireShell(t)
+	store := newTempStore(t)
+	profile := config.Profile{ID: "p1", Host: "host", Port: 22, User: "user"}
+
+	prevStart := stackStart
+	t.Cleanup(func() { stackStart = prevStart })
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		st := stack.NewStackForTest(12345, 23456)
+		st.PublishForTest(stack.Event{Kind: stack.EventTunnelReady, Profile: "p"})
+		st.PublishForTest(stack.Event{Kind: stack.EventRestartScheduled, Attempt: 1, Delay: time.Second, Err: errors.New("reset")})
+		st.PublishForTest(stack.Event{Kind: stack.EventTunnelReady, Attempt: 1})
+		return st, nil
+	}
+
+	var status bytes.Buffer
+	opts := runTargetOptions{UseProxy: false, StatusWriter: &status}
+	if err := runWithNewStackOptions(context.Background(), store, profile, []string{shell, "-c", "exit 0"}, nil, opts); err != nil {
+		t.Fatalf("runWithNewStackOptions error: %v", err)
+	}
+	want := "proxy: tunnel lost (reset); reconnecting in 1s\nproxy: tunnel reconnected\n"
+	if got := status.String(); got != want {
+		t.Fatalf("status output %q want %q", got, want)
+	}
+}
+
+func TestTunnelNotice(t *testing.T) {
+	tests := []struct {
+		e        stack.Event
+		numbered bool
+		want     string
+	}{
+		{e: stack.Event{Kind: stack.EventTunnelStarting}, want: ""},
+		{e: stack.Event{Kind: stack.EventTunnelReady}, want: ""},
+		{e: stack.Event{Kind: stack.EventTunnelReady, Tunnel: 2, Attempt: 1}, numbered: true, want: "tunnel 2 reconnected"},
+		{e: stack.Event{Kind: stack.EventTunnelExited, Err: errors.New("x")}, want: ""},
+		{e: stack.Event{Kind: stack.EventFailover, From: "a", Profile: "b"}, want: `tunnel switched from profile "a" to "b"`},
+		{e: stack.Event{Kind: stack.EventGaveUp, Err: errors.New("down")}, want: "tunnel could not reconnect: down"},
+	}
+	for _, tt := range tests {
+		if got := tunnelNotice(tt.e, tt.numbered); got != tt.want {
+			t.Errorf("tunnelNotice(%s)=%q want %q", tt.e.Kind, got, tt.want)
+		}
 	}
 }
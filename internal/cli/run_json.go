@@ -96,7 +96,7 @@ func newRunJSONCmd(root *rootOptions) *cobra.Command {
 				root,
 				store,
 				profile,
-				cfg.Instances,
+				proxyInstances(store),
 				spec,
 				claudePath,
 				claudeDir,
@@ -109,7 +109,7 @@ func newRunJSONCmd(root *rootOptions) *cobra.Command {
 
 	cmd.Flags().StringVar(&claudeDir, "claude-dir", "", "Override Claude Code data dir (default: ~/.claude)")
 	cmd.Flags().StringVar(&claudePath, "claude-path", "", explicitClaudePathFlagHelp)
-	cmd.Flags().StringVar(&profileRef, "profile", "", "Proxy profile id or name")
+	cmd.Flags().StringVar(&profileRef, "profile", "", "Proxy profile id or name, or auto for the fastest reachable one")
 	addClaudeLaunchFlags(cmd, &root.claudeLaunch)
 	return cmd
 }
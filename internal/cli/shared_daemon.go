@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/proc"
+)
+
+var (
+	// sharedDaemonStartTimeout bounds the wait for a shared daemon to come
+	// up, SSH login included.
+	sharedDaemonStartTimeout = time.Minute
+	sharedDaemonPollInterval = 200 * time.Millisecond
+)
+
+// runWithSharedDaemon runs cmdArgs through the profile's shared daemon,
+// starting one when none is running, and holds a lease on it until the
+// command exits. When no shared daemon can be brought up, the command gets
+// its own tunnels as without SharedDaemon.
+func runWithSharedDaemon(
+	ctx context.Context,
+	store *config.Store,
+	cfg config.Config,
+	profile config.Profile,
+	cmdArgs []string,
+	patchOutcome *patchOutcome,
+	opts runTargetOptions,
+) error {
+	if _, err := cfg.SharedDaemonIdleTimeout(); err != nil {
+		return err
+	}
+	inst, err := leaseSharedDaemon(ctx, store, profile)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(opts.statusWriter(), "proxy: shared daemon unavailable (%v); using a private tunnel\n", err)
+		return runWithNewStackOptions(ctx, store, profile, cmdArgs, patchOutcome, opts)
+	}
+	defer releaseSharedDaemon(store, inst.ID)
+
+	hc := manager.HealthClient{Timeout: 1 * time.Second}
+	return runWithExistingInstanceOptions(ctx, hc, inst, cmdArgs, patchOutcome, opts)
+}
+
+// leaseSharedDaemon takes a lease on the profile's shared daemon, starting
+// it if this process is the first to need it, and waits until it serves.
+func leaseSharedDaemon(ctx context.Context, store *config.Store, profile config.Profile) (config.Instance, error) {
+	instanceID, err := newProxyInstanceID()
+	if err != nil {
+		return config.Instance{}, err
+	}
+	now := time.Now()
+	inst, created, err := manager.LeaseSharedInstance(store, profile.ID, os.Getpid(), now, config.Instance{
+		ID:         instanceID,
+		ProfileID:  profile.ID,
+		Kind:       config.InstanceKindDaemon,
+		StartedAt:  now,
+		LastSeenAt: now,
+	})
+	if err != nil {
+		return config.Instance{}, err
+	}
+	if created {
+		if _, _, err := launchProxyDaemon(store, store.Path(), inst.ID); err != nil {
+			_ = removeProxyInstance(store, inst.ID)
+			return config.Instance{}, err
+		}
+	}
+
+	ready, err := waitSharedDaemon(ctx, store, inst.ID)
+	if err != nil {
+		releaseSharedDaemon(store, inst.ID)
+		return config.Instance{}, err
+	}
+	return ready, nil
+}
+
+// waitSharedDaemon waits until the shared daemon instanceID answers health
+// checks, or has exited.
+func waitSharedDaemon(ctx context.Context, store *config.Store, instanceID string) (config.Instance, error) {
+	hc := manager.HealthClient{Timeout: 1 * time.Second}
+	deadline := time.Now().Add(sharedDaemonStartTimeout)
+	for {
+		inst, found, err := manager.LoadInstance(store, instanceID)
+		if err != nil {
+			return config.Instance{}, err
+		}
+		if !found || (inst.DaemonPID > 0 && !proc.IsAlive(inst.DaemonPID)) {
+			return config.Instance{}, fmt.Errorf("shared daemon %s exited; see %s", instanceID, instanceLogPath(store, instanceID))
+		}
+		if inst.DaemonPID > 0 && inst.HTTPPort > 0 && hc.CheckInstance(inst) == nil {
+			return inst, nil
+		}
+		if time.Now().After(deadline) {
+			return config.Instance{}, fmt.Errorf("shared daemon %s did not come up within %s; see %s", instanceID, sharedDaemonStartTimeout, instanceLogPath(store, instanceID))
+		}
+		select {
+		case <-ctx.Done():
+			return config.Instance{}, ctx.Err()
+		case <-time.After(sharedDaemonPollInterval):
+		}
+	}
+}
+
+func releaseSharedDaemon(store *config.Store, instanceID string) {
+	_ = manager.ReleaseLease(store, instanceID, os.Getpid(), time.Now())
+}
@@ -0,0 +1,241 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+func TestRunWithProfileStartsAndReusesSharedDaemon(t *testing.T) {
+	shell := requireShell(t)
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	profile := config.Profile{ID: "p1", Name: "work", Host: "h", Port: 22, User: "u"}
+	if err := store.Save(config.Config{
+		Version:      config.CurrentVersion,
+		Profiles:     []config.Profile{profile},
+		SharedDaemon: &config.SharedDaemon{Enabled: true, IdleTimeout: "0s"},
+	}); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	port := startRunHealthServer(t, "shared-1")
+	ticker := &fakeProxyTicker{ch: make(chan time.Time)}
+	newProxyTicker = func(time.Duration) proxyTicker { return ticker }
+	newProxyInstanceID = func() (string, error) { return "shared-1", nil }
+	proxyExecutable = func() (string, error) { return "/tmp/claude-proxy", nil }
+	stackStart = func(config.Profile, string, stack.Options) (*stack.Stack, error) {
+		return stack.NewStackForTest(port, 23456), nil
+	}
+
+	// The "daemon process" runs in this test process.
+	var mu sync.Mutex
+	var launches [][]string
+	done := make(chan error, 1)
+	proxyDaemonLauncher = func(exe string, args []string, logPath string) (int, error) {
+		mu.Lock()
+		launches = append(launches, args)
+		mu.Unlock()
+		go func() { done <- runProxyDaemon(context.Background(), store, "shared-1") }()
+		return os.Getpid(), nil
+	}
+
+	run := func() {
+		t.Helper()
+		var status bytes.Buffer
+		opts := defaultRunTargetOptions()
+		opts.StatusWriter = &status
+		if err := runWithProfileOptions(context.Background(), store, profile, proxyInstances(store), []string{shell, "-c", "exit 0"}, nil, opts); err != nil {
+			t.Fatalf("run: %v (%s)", err, status.String())
+		}
+		if status.Len() > 0 {
+			t.Fatalf("unexpected status output %q", status.String())
+		}
+	}
+
+	run()
+	inst, ok, err := manager.LoadInstance(store, "shared-1")
+	if err != nil || !ok {
+		t.Fatalf("expected the shared daemon to stay registered: %v, %v", ok, err)
+	}
+	if !inst.Shared || len(inst.Leases) != 0 || inst.IdleSince.IsZero() || inst.HTTPPort != port {
+		t.Fatalf("after the first run: %#v", inst)
+	}
+
+	run()
+	mu.Lock()
+	if len(launches) != 1 || strings.Join(launches[0], " ") != "--config "+store.Path()+" proxy daemon --instance-id shared-1" {
+		t.Fatalf("expected one daemon launch, got %q", launches)
+	}
+	mu.Unlock()
+
+	// The launcher would have sent the daemon's output here.
+	if err := os.WriteFile(instanceLogPath(store, "shared-1"), []byte("log\n"), 0o600); err != nil {
+		t.Fatalf("write daemon log: %v", err)
+	}
+
+	// Without leases for the idle time, the daemon leaves on its next tick.
+	tickSharedDaemon(t, ticker, done)
+	waitSharedDaemonExit(t, done)
+	if _, ok, _ := manager.LoadInstance(store, "shared-1"); ok {
+		t.Fatalf("expected the idle daemon to be unregistered")
+	}
+	for _, path := range []string{instanceLogPath(store, "shared-1"), instanceStopReportPath(store, "shared-1")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", path, err)
+		}
+	}
+}
+
+// tickSharedDaemon delivers one tick to a daemon started in the test, unless
+// it has already exited, which it then reports through done again.
+func tickSharedDaemon(t *testing.T, ticker *fakeProxyTicker, done chan error) {
+	t.Helper()
+	select {
+	case ticker.ch <- time.Now():
+	case err := <-done:
+		done <- err
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout delivering a tick to the daemon")
+	}
+}
+
+func waitSharedDaemonExit(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("daemon exited with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for the daemon to exit")
+	}
+}
+
+func TestSharedDaemonStaysWhileLeased(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	if err := store.Save(config.Config{
+		Version:      config.CurrentVersion,
+		Profiles:     []config.Profile{{ID: "p1", Name: "work", Host: "h", Port: 22, User: "u"}},
+		SharedDaemon: &config.SharedDaemon{Enabled: true, IdleTimeout: "0s"},
+	}); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	now := time.Now()
+	if err := manager.RecordInstance(store, config.Instance{
+		ID:        "shared-1",
+		ProfileID: "p1",
+		Kind:      config.InstanceKindDaemon,
+		Shared:    true,
+		Leases:    []config.Lease{{PID: os.Getpid(), AcquiredAt: now}},
+	}); err != nil {
+		t.Fatalf("record instance: %v", err)
+	}
+
+	ticker := &fakeProxyTicker{ch: make(chan time.Time)}
+	newProxyTicker = func(time.Duration) proxyTicker { return ticker }
+	stackStart = func(config.Profile, string, stack.Options) (*stack.Stack, error) {
+		return stack.NewStackForTest(18080, 23456), nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- runProxyDaemon(context.Background(), store, "shared-1") }()
+
+	tickSharedDaemon(t, ticker, done)
+	tickSharedDaemon(t, ticker, done)
+	inst, ok, err := manager.LoadInstance(store, "shared-1")
+	if err != nil || !ok || len(inst.Leases) != 1 || inst.HTTPPort != 18080 {
+		t.Fatalf("expected the leased daemon to keep running: %#v, %v, %v", inst, ok, err)
+	}
+
+	if err := manager.ReleaseLease(store, "shared-1", os.Getpid(), time.Now()); err != nil {
+		t.Fatalf("ReleaseLease: %v", err)
+	}
+	// The daemon may already leave on the tick it was handling.
+	tickSharedDaemon(t, ticker, done)
+	waitSharedDaemonExit(t, done)
+}
+
+func TestSharedDaemonFallsBackToPrivateTunnel(t *testing.T) {
+	shell := requireShell(t)
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	profile := config.Profile{ID: "p1", Name: "work", Host: "h", Port: 22, User: "u"}
+	if err := store.Save(config.Config{
+		Version:      config.CurrentVersion,
+		Profiles:     []config.Profile{profile},
+		SharedDaemon: &config.SharedDaemon{Enabled: true},
+	}); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	newProxyInstanceID = func() (string, error) { return "shared-1", nil }
+	proxyExecutable = func() (string, error) { return "/tmp/claude-proxy", nil }
+	proxyDaemonLauncher = func(string, []string, string) (int, error) {
+		return 0, os.ErrPermission
+	}
+	private := 0
+	stackStart = func(config.Profile, string, stack.Options) (*stack.Stack, error) {
+		private++
+		return stack.NewStackForTest(startRunHealthServer(t, "private"), 23456), nil
+	}
+
+	var status bytes.Buffer
+	opts := runTargetOptions{UseProxy: false, StatusWriter: &status}
+	if err := runWithProfileOptions(context.Background(), store, profile, nil, []string{shell, "-c", "exit 0"}, nil, opts); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if private != 1 || !strings.Contains(status.String(), "shared daemon unavailable") {
+		t.Fatalf("expected a private tunnel after a failed launch, got %d starts, status %q", private, status.String())
+	}
+	if instances, _ := manager.ListInstances(store); len(instances) != 0 {
+		t.Fatalf("expected the failed shared daemon to be unregistered, got %#v", instances)
+	}
+}
+
+func TestProxyPruneReleasesDeadLeases(t *testing.T) {
+	store := newTempStore(t)
+	now := time.Now()
+	// PIDs this large are never in use.
+	const gone = 1 << 30
+	for _, inst := range []config.Instance{
+		{ID: "serving", ProfileID: "p1", Kind: config.InstanceKindDaemon, Shared: true, DaemonPID: os.Getpid(), LastSeenAt: now,
+			Leases: []config.Lease{{PID: os.Getpid()}, {PID: gone}}},
+		{ID: "starting", ProfileID: "p1", Shared: true, LastSeenAt: now, Leases: []config.Lease{{PID: os.Getpid()}}},
+		{ID: "abandoned", ProfileID: "p1", Shared: true, LastSeenAt: now, Leases: []config.Lease{{PID: gone}}},
+	} {
+		if err := manager.RecordInstance(store, inst); err != nil {
+			t.Fatalf("record instance: %v", err)
+		}
+	}
+
+	out, err := runProxyCmd(t, store, "prune")
+	if err != nil || !strings.Contains(out, "Pruned 1 instances") || !strings.Contains(out, "Released 1 leases of exited processes") {
+		t.Fatalf("prune: %q, %v", out, err)
+	}
+	instances, err := manager.ListInstances(store)
+	if err != nil {
+		t.Fatalf("list instances: %v", err)
+	}
+	if len(instances) != 2 || instances[0].ID == "abandoned" || instances[1].ID == "abandoned" {
+		t.Fatalf("expected only the abandoned daemon to be pruned, got %#v", instances)
+	}
+	for _, inst := range instances {
+		if len(inst.Leases) != 1 {
+			t.Fatalf("expected one live lease on %s, got %#v", inst.ID, inst.Leases)
+		}
+	}
+
+	out, err = runProxyCmd(t, store, "list")
+	if err != nil || !strings.Contains(out, "LEASES") {
+		t.Fatalf("list: %q, %v", out, err)
+	}
+}
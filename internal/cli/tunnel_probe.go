@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+const (
+	// tunnelProbeInterval matches the supervision loop in run.
+	tunnelProbeInterval = 5 * time.Second
+	// tunnelProbeFailures is how many probes in a row must fail before a
+	// tunnel is restarted, like the listener check that stops the target.
+	tunnelProbeFailures = 3
+)
+
+// tunnelProbe runs a profile's end-to-end health probe through each tunnel
+// of a stack this process owns. Repeated failures restart that tunnel, so a
+// half-dead tunnel goes through the same restart budget, failover and,
+// finally, giving up as one that exited.
+type tunnelProbe struct {
+	target  manager.ProbeTarget
+	tunnels func() []localproxy.UpstreamStatus
+	probe   func(tunnel int) error
+	restart func(tunnel int, cause error)
+
+	failures map[int]int
+}
+
+// newTunnelProbe returns nil when the profile has no health probe.
+func newTunnelProbe(p config.Profile, st *stack.Stack) (*tunnelProbe, error) {
+	if p.HealthProbe == "" {
+		return nil, nil
+	}
+	target, err := manager.ParseProbeTarget(p.HealthProbe)
+	if err != nil {
+		return nil, err
+	}
+	hc := manager.HealthClient{}
+	return &tunnelProbe{
+		target:  target,
+		tunnels: st.Tunnels,
+		probe: func(tunnel int) error {
+			return hc.Probe(func(addr string) (net.Conn, error) {
+				return st.DialTunnel(tunnel, "tcp", addr)
+			}, target)
+		},
+		restart: st.RestartTunnel,
+	}, nil
+}
+
+// check probes each tunnel in rotation once. The restart cause names the
+// probe, so it shows up in the stack's tunnel-exited event.
+func (p *tunnelProbe) check() {
+	if p == nil {
+		return
+	}
+	if p.failures == nil {
+		p.failures = map[int]int{}
+	}
+	for _, t := range p.tunnels() {
+		if !t.Healthy {
+			delete(p.failures, t.ID)
+			continue
+		}
+		err := p.probe(t.ID)
+		if err == nil {
+			delete(p.failures, t.ID)
+			continue
+		}
+		p.failures[t.ID]++
+		if p.failures[t.ID] < tunnelProbeFailures {
+			continue
+		}
+		delete(p.failures, t.ID)
+		p.restart(t.ID, fmt.Errorf("health probe %s failed %d times: %w", p.target, tunnelProbeFailures, err))
+	}
+}
+
+// run checks every tunnelProbeInterval in a goroutine of its own, so that a
+// slow probe holds up neither the caller's loop nor its health checks. stop
+// ends it without waiting for a check in flight.
+func (p *tunnelProbe) run() (stop func()) {
+	if p == nil {
+		return func() {}
+	}
+	t := newProxyTicker(tunnelProbeInterval)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.Chan():
+				p.check()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.Stop()
+			close(quit)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
+	"github.com/baaaaaaaka/claude_code_helper/internal/stack"
+)
+
+func TestTunnelProbeRestartsTheTunnelThatFails(t *testing.T) {
+	results := []error{
+		errors.New("hang"), errors.New("hang"), nil,
+		errors.New("hang"), errors.New("hang"), errors.New("black hole"),
+		errors.New("hang"),
+	}
+	var restarts []string
+	p := &tunnelProbe{
+		target: manager.ProbeTarget{Addr: "example.com:443", TLS: true},
+		tunnels: func() []localproxy.UpstreamStatus {
+			return []localproxy.UpstreamStatus{{ID: 0, Healthy: true}, {ID: 1, Healthy: true}, {ID: 2}}
+		},
+		probe: func(tunnel int) error {
+			if tunnel != 1 {
+				return nil
+			}
+			err := results[0]
+			results = results[1:]
+			return err
+		},
+		restart: func(tunnel int, err error) { restarts = append(restarts, fmt.Sprintf("%d: %v", tunnel, err)) },
+	}
+	for i := 0; i < 7; i++ {
+		p.check()
+	}
+	if want := []string{"1: health probe tls://example.com:443 failed 3 times: black hole"}; !reflect.DeepEqual(restarts, want) {
+		t.Fatalf("restarts=%q want %q", restarts, want)
+	}
+	if p.failures[1] != 1 || p.failures[0] != 0 {
+		t.Fatalf("expected the count to start over after a restart, got %v", p.failures)
+	}
+
+	var none *tunnelProbe
+	none.check()
+	none.run()()
+}
+
+func TestNewTunnelProbe(t *testing.T) {
+	st := stack.NewStackForTest(12345, 0)
+	if p, err := newTunnelProbe(config.Profile{}, st); p != nil || err != nil {
+		t.Fatalf("expected no probe without healthProbe, got %v, %v", p, err)
+	}
+	if _, err := newTunnelProbe(config.Profile{HealthProbe: "ftp://x:21"}, st); err == nil {
+		t.Fatalf("expected an invalid probe error")
+	}
+	p, err := newTunnelProbe(config.Profile{HealthProbe: "tls://api.example.com:443"}, st)
+	if err != nil || p.target != (manager.ProbeTarget{Addr: "api.example.com:443", TLS: true}) {
+		t.Fatalf("newTunnelProbe=%+v, %v", p, err)
+	}
+}
+
+func TestRunProxyDaemonProbesItsTunnels(t *testing.T) {
+	withProxyTestHooks(t)
+	store := newTempStore(t)
+	cfg := config.Config{
+		Version:   config.CurrentVersion,
+		Profiles:  []config.Profile{{ID: "p1", Name: "work", Host: "h", Port: 22, User: "u", HealthProbe: "tcp://api.example.com:443"}},
+		Instances: []config.Instance{{ID: "inst-1", ProfileID: "p1"}},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+
+	probeTicks := &fakeProxyTicker{ch: make(chan time.Time)}
+	newProxyTicker = func(d time.Duration) proxyTicker {
+		if d == tunnelProbeInterval {
+			return probeTicks
+		}
+		return &fakeProxyTicker{}
+	}
+	var dials atomic.Int32
+	stackStart = func(profile config.Profile, instanceID string, opts stack.Options) (*stack.Stack, error) {
+		st := stack.NewStackForTest(18080, 0)
+		st.SetTunnelDialerForTest(probeDialer(func(addr string) (net.Conn, error) {
+			if addr == "api.example.com:443" {
+				dials.Add(1)
+			}
+			return nil, errors.New("black hole")
+		}))
+		return st, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runProxyDaemon(ctx, store, "inst-1") }()
+	for i := 0; i < tunnelProbeFailures; i++ {
+		probeTicks.ch <- time.Now()
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("runProxyDaemon error: %v", err)
+	}
+	if got := dials.Load(); got < tunnelProbeFailures-1 {
+		t.Fatalf("expected the daemon to probe through its tunnel, got %d dials", got)
+	}
+}
+
+type probeDialer func(addr string) (net.Conn, error)
+
+func (d probeDialer) Dial(_, addr string) (net.Conn, error) { return d(addr) }
@@ -71,6 +71,9 @@ func runUpgradeClaude(cmd *cobra.Command, root *rootOptions, profileRef string,
 	if err != nil {
 		return err
 	}
+	if opts.UseProxy {
+		opts.Instances = proxyInstances(store)
+	}
 	targetVersion, err := normalizeClaudeInstallTarget(claudeVersion)
 	if err != nil {
 		return err
@@ -843,8 +846,7 @@ func upgradeClaudeInstallOpts(cfg config.Config, profileRef string) (installProx
 	}
 
 	return installProxyOptions{
-		UseProxy:  true,
-		Profile:   &profile,
-		Instances: cfg.Instances,
+		UseProxy: true,
+		Profile:  &profile,
 	}, nil
 }
@@ -3,6 +3,7 @@ package cli
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,8 +14,10 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
 )
 
 func TestUpgradeClaudeInstallOptsNoProxy(t *testing.T) {
@@ -52,8 +55,49 @@ func TestUpgradeClaudeInstallOptsWithProxy(t *testing.T) {
 	if opts.Profile == nil || opts.Profile.ID != "p1" {
 		t.Fatalf("expected profile p1, got %v", opts.Profile)
 	}
-	if len(opts.Instances) != 1 || opts.Instances[0].ID != "inst-1" {
-		t.Fatalf("expected instances to be passed through")
+}
+
+func TestRunUpgradeClaudePassesRegistryInstances(t *testing.T) {
+	store := newTempStore(t)
+	enabled := true
+	if err := store.Save(config.Config{
+		Version:      config.CurrentVersion,
+		ProxyEnabled: &enabled,
+		Profiles:     []config.Profile{{ID: "p1", Name: "p1"}},
+	}); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	if err := manager.RecordInstance(store, config.Instance{
+		ID:         "inst-1",
+		ProfileID:  "p1",
+		HTTPPort:   18080,
+		DaemonPID:  os.Getpid(),
+		LastSeenAt: time.Now(),
+	}); err != nil {
+		t.Fatalf("record instance: %v", err)
+	}
+
+	var got installProxyOptions
+	prevInstaller := runClaudeInstallerFn
+	runClaudeInstallerFn = func(ctx context.Context, out io.Writer, opts installProxyOptions) error {
+		got = opts
+		return errors.New("stop after install options")
+	}
+	t.Cleanup(func() {
+		runClaudeInstallerFn = prevInstaller
+	})
+
+	root := &rootOptions{configPath: store.Path()}
+	cmd := newUpgradeClaudeCmd(root)
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetContext(context.Background())
+
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "stop after install options") {
+		t.Fatalf("expected the stubbed installer error, got %v", err)
+	}
+	if !got.UseProxy || len(got.Instances) != 1 || got.Instances[0].ID != "inst-1" || got.Instances[0].HTTPPort != 18080 {
+		t.Fatalf("expected the running instance to reach the installer, got %#v", got.Instances)
 	}
 }
 
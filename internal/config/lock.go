@@ -0,0 +1,86 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// LockTimeout bounds how long a store waits for another process to finish
+// its read-modify-write of the same file.
+var LockTimeout = 30 * time.Second
+
+// ErrLockTimeout is returned when a store's file lock could not be taken
+// within LockTimeout.
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+const lockRetryDelay = 10 * time.Millisecond
+
+// fileLock is an advisory lock on a store's "<file>.lock", shared by every
+// process that reads or writes the file. The holder writes its PID into
+// the lock file, so a waiter that times out can name it.
+type fileLock struct {
+	path string
+	lock *flock.Flock
+}
+
+func newFileLock(path string) *fileLock {
+	lockPath := path + ".lock"
+	return &fileLock{path: lockPath, lock: flock.New(lockPath)}
+}
+
+// acquire takes the lock, polling until LockTimeout. The lock is never
+// broken: whatever PID the file records, a process holding the flock may
+// still be writing.
+func (l *fileLock) acquire() error {
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		ok, err := l.lock.TryLock()
+		if err != nil {
+			return err
+		}
+		if ok {
+			_ = os.WriteFile(l.path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o600)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if holder := readLockHolder(l.path); holder > 0 {
+				return fmt.Errorf("%w %s held by pid %d", ErrLockTimeout, l.path, holder)
+			}
+			return fmt.Errorf("%w %s", ErrLockTimeout, l.path)
+		}
+		time.Sleep(lockRetryDelay)
+	}
+}
+
+func (l *fileLock) release() {
+	_ = l.lock.Unlock()
+}
+
+// LockFile takes the advisory lock on "<path>.lock" with the same timeout
+// as the stores, for files kept outside of them.
+func LockFile(path string) (release func(), err error) {
+	l := newFileLock(path)
+	if err := l.acquire(); err != nil {
+		return nil, err
+	}
+	return l.release, nil
+}
+
+// readLockHolder returns the PID recorded in a lock file, or 0.
+func readLockHolder(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,164 @@
+//go:build !windows
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+const lockHelperUpdates = 25
+
+// TestStoreLockHelperProcess is the body of the subprocesses started by
+// TestStoresUpdateAcrossProcesses.
+func TestStoreLockHelperProcess(t *testing.T) {
+	path := os.Getenv("CLAUDE_PROXY_LOCK_HELPER_CONFIG")
+	if path == "" {
+		t.Skip("helper process")
+	}
+	worker := os.Getenv("CLAUDE_PROXY_LOCK_HELPER_WORKER")
+
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	history, err := NewPatchHistoryStore(path)
+	if err != nil {
+		t.Fatalf("NewPatchHistoryStore: %v", err)
+	}
+	for i := 0; i < lockHelperUpdates; i++ {
+		id := fmt.Sprintf("%s-%02d", worker, i)
+		if err := store.Update(func(cfg *Config) error {
+			cfg.Profiles = append(cfg.Profiles, Profile{ID: id, Name: id})
+			return nil
+		}); err != nil {
+			t.Fatalf("Update config: %v", err)
+		}
+		if err := history.Update(func(h *PatchHistory) error {
+			h.Upsert(PatchHistoryEntry{Path: "/bin/" + id, SpecsSHA256: "specs"})
+			return nil
+		}); err != nil {
+			t.Fatalf("Update patch history: %v", err)
+		}
+	}
+}
+
+func TestStoresUpdateAcrossProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	const workers = 4
+	cmds := make([]*exec.Cmd, workers)
+	outs := make([]*strings.Builder, workers)
+	for i := range cmds {
+		outs[i] = &strings.Builder{}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestStoreLockHelperProcess$")
+		cmd.Env = append(os.Environ(),
+			"CLAUDE_PROXY_LOCK_HELPER_CONFIG="+path,
+			"CLAUDE_PROXY_LOCK_HELPER_WORKER=w"+strconv.Itoa(i),
+		)
+		cmd.Stdout = outs[i]
+		cmd.Stderr = outs[i]
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("start helper: %v", err)
+		}
+		cmds[i] = cmd
+	}
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("helper %d: %v\n%s", i, err, outs[i])
+		}
+	}
+
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	cfg, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cfg.Profiles) != workers*lockHelperUpdates {
+		t.Fatalf("Profiles len=%d want %d: updates were lost", len(cfg.Profiles), workers*lockHelperUpdates)
+	}
+	history, err := NewPatchHistoryStore(path)
+	if err != nil {
+		t.Fatalf("NewPatchHistoryStore: %v", err)
+	}
+	h, err := history.Load()
+	if err != nil {
+		t.Fatalf("Load patch history: %v", err)
+	}
+	if len(h.Entries) != workers*lockHelperUpdates {
+		t.Fatalf("Entries len=%d want %d: updates were lost", len(h.Entries), workers*lockHelperUpdates)
+	}
+}
+
+func withLockTimeout(t *testing.T, d time.Duration) {
+	t.Helper()
+	prev := LockTimeout
+	t.Cleanup(func() { LockTimeout = prev })
+	LockTimeout = d
+}
+
+func TestStoreLockTimeout(t *testing.T) {
+	withLockTimeout(t, 50*time.Millisecond)
+	path := filepath.Join(t.TempDir(), "config.json")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	// Another process holds the lock.
+	held := flock.New(path + ".lock")
+	if err := held.Lock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	defer func() { _ = held.Unlock() }()
+	if err := os.WriteFile(path+".lock", []byte("4242\n"), 0o600); err != nil {
+		t.Fatalf("write holder: %v", err)
+	}
+
+	err = store.Update(func(*Config) error { return nil })
+	if !errors.Is(err, ErrLockTimeout) || !strings.Contains(err.Error(), "held by pid 4242") {
+		t.Fatalf("expected a lock timeout naming the holder, got %v", err)
+	}
+}
+
+func TestStoreLockIsNotBrokenForAnExitedHolder(t *testing.T) {
+	withLockTimeout(t, 50*time.Millisecond)
+	path := filepath.Join(t.TempDir(), "config.json")
+	history, err := NewPatchHistoryStore(path)
+	if err != nil {
+		t.Fatalf("NewPatchHistoryStore: %v", err)
+	}
+	lockPath := filepath.Join(filepath.Dir(path), "patch_history.json.lock")
+
+	// The recorded PID no longer runs, but whoever holds the flock may
+	// still be writing: a waiter must not take over.
+	held := flock.New(lockPath)
+	if err := held.Lock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	defer func() { _ = held.Unlock() }()
+	const gone = 1 << 30
+	if err := os.WriteFile(lockPath, []byte(strconv.Itoa(gone)+"\n"), 0o600); err != nil {
+		t.Fatalf("write holder: %v", err)
+	}
+
+	err = history.Update(func(*PatchHistory) error { return nil })
+	if !errors.Is(err, ErrLockTimeout) || !strings.Contains(err.Error(), fmt.Sprintf("held by pid %d", gone)) {
+		t.Fatalf("expected a lock timeout naming the recorded holder, got %v", err)
+	}
+	if got := readLockHolder(lockPath); got != gone {
+		t.Fatalf("expected the lock file to be left alone, holder=%d", got)
+	}
+}
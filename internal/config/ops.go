@@ -1,6 +1,24 @@
 package config
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultSharedDaemonIdleTimeout is how long a shared daemon outlives its
+// last lease when SharedDaemon.IdleTimeout is empty.
+const DefaultSharedDaemonIdleTimeout = 10 * time.Minute
+
+// IsHTTPProxy reports whether the profile chains to an upstream HTTP proxy
+// instead of an SSH tunnel.
+func (p Profile) IsHTTPProxy() bool { return p.Type == ProfileTypeHTTPProxy }
+
+// UsesNativeSSH reports whether the profile tunnels through the built-in SSH
+// client instead of an `ssh -D` process.
+func (p Profile) UsesNativeSSH() bool {
+	return !p.IsHTTPProxy() && p.SSHBackend == SSHBackendNative
+}
 
 func (c Config) FindProfile(ref string) (Profile, bool) {
 	ref = strings.TrimSpace(ref)
@@ -15,6 +33,49 @@ func (c Config) FindProfile(ref string) (Profile, bool) {
 	return Profile{}, false
 }
 
+// FailoverProfiles resolves p.Failover to profiles, in order. A profile
+// cannot fail over to itself or list the same profile twice.
+func (c Config) FailoverProfiles(p Profile) ([]Profile, error) {
+	if len(p.Failover) == 0 {
+		return nil, nil
+	}
+	seen := map[string]bool{p.ID: true}
+	out := make([]Profile, 0, len(p.Failover))
+	for _, ref := range p.Failover {
+		fp, ok := c.FindProfile(ref)
+		if !ok {
+			return nil, fmt.Errorf("failover profile %q not found", ref)
+		}
+		if seen[fp.ID] {
+			return nil, fmt.Errorf("failover profile %q listed twice or refers to itself", ref)
+		}
+		seen[fp.ID] = true
+		out = append(out, fp)
+	}
+	return out, nil
+}
+
+// SharedDaemonEnabled reports whether runs share an auto-started daemon.
+func (c Config) SharedDaemonEnabled() bool {
+	return c.SharedDaemon != nil && c.SharedDaemon.Enabled
+}
+
+// SharedDaemonIdleTimeout returns how long a shared daemon keeps running
+// without leases.
+func (c Config) SharedDaemonIdleTimeout() (time.Duration, error) {
+	if c.SharedDaemon == nil || strings.TrimSpace(c.SharedDaemon.IdleTimeout) == "" {
+		return DefaultSharedDaemonIdleTimeout, nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(c.SharedDaemon.IdleTimeout))
+	if err != nil {
+		return 0, fmt.Errorf("sharedDaemon.idleTimeout: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("sharedDaemon.idleTimeout must not be negative")
+	}
+	return d, nil
+}
+
 func (c *Config) UpsertProfile(p Profile) {
 	for i := range c.Profiles {
 		if c.Profiles[i].ID == p.ID {
@@ -25,6 +86,39 @@ func (c *Config) UpsertProfile(p Profile) {
 	c.Profiles = append(c.Profiles, p)
 }
 
+func (c Config) FindProfileScore(profileID string) (ProfileScore, bool) {
+	for _, s := range c.ProfileScores {
+		if s.ProfileID == profileID {
+			return s, true
+		}
+	}
+	return ProfileScore{}, false
+}
+
+// UpsertProfileScore records score and drops scores of profiles that no
+// longer exist.
+func (c *Config) UpsertProfileScore(score ProfileScore) {
+	kept := c.ProfileScores[:0]
+	for _, s := range c.ProfileScores {
+		if s.ProfileID == score.ProfileID {
+			continue
+		}
+		if _, ok := c.findProfileByID(s.ProfileID); ok {
+			kept = append(kept, s)
+		}
+	}
+	c.ProfileScores = append(kept, score)
+}
+
+func (c Config) findProfileByID(id string) (Profile, bool) {
+	for _, p := range c.Profiles {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
 func (c Config) InstancesForProfile(profileID string) []Instance {
 	var out []Instance
 	for _, inst := range c.Instances {
@@ -27,6 +27,55 @@ func TestConfigProfileOps(t *testing.T) {
 	}
 }
 
+func TestConfigFailoverProfiles(t *testing.T) {
+	cfg := Config{Profiles: []Profile{
+		{ID: "p1", Name: "primary", Failover: []string{"Backup", "p3"}},
+		{ID: "p2", Name: "backup"},
+		{ID: "p3", Name: "last"},
+	}}
+
+	got, err := cfg.FailoverProfiles(cfg.Profiles[0])
+	if err != nil {
+		t.Fatalf("FailoverProfiles: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != "p2" || got[1].ID != "p3" {
+		t.Fatalf("FailoverProfiles=%#v", got)
+	}
+	if got, err := cfg.FailoverProfiles(cfg.Profiles[1]); err != nil || got != nil {
+		t.Fatalf("expected no failover profiles, got %#v err=%v", got, err)
+	}
+
+	for _, refs := range [][]string{{"missing"}, {"primary"}, {"p2", "backup"}} {
+		p := cfg.Profiles[0]
+		p.Failover = refs
+		if _, err := cfg.FailoverProfiles(p); err == nil {
+			t.Fatalf("expected error for failover %q", refs)
+		}
+	}
+}
+
+func TestConfigProfileScoreOps(t *testing.T) {
+	cfg := Config{
+		Profiles:      []Profile{{ID: "p1"}, {ID: "p2"}},
+		ProfileScores: []ProfileScore{{ProfileID: "gone", LatencyMs: 1}, {ProfileID: "p2", LatencyMs: 9}},
+	}
+	cfg.UpsertProfileScore(ProfileScore{ProfileID: "p1", LatencyMs: 3})
+	cfg.UpsertProfileScore(ProfileScore{ProfileID: "p2", Error: "refused"})
+
+	if len(cfg.ProfileScores) != 2 {
+		t.Fatalf("expected the deleted profile's score to be dropped, got %#v", cfg.ProfileScores)
+	}
+	if got, ok := cfg.FindProfileScore("p2"); !ok || got.Error != "refused" || got.LatencyMs != 0 {
+		t.Fatalf("FindProfileScore(p2)=%#v ok=%v", got, ok)
+	}
+	if got, ok := cfg.FindProfileScore("p1"); !ok || got.LatencyMs != 3 {
+		t.Fatalf("FindProfileScore(p1)=%#v ok=%v", got, ok)
+	}
+	if _, ok := cfg.FindProfileScore("gone"); ok {
+		t.Fatalf("expected no score for a deleted profile")
+	}
+}
+
 func TestConfigInstanceOps(t *testing.T) {
 	cfg := Config{Version: CurrentVersion}
 
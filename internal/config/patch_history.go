@@ -10,8 +10,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/gofrs/flock"
 )
 
 const PatchHistoryVersion = 2
@@ -107,7 +105,7 @@ func PathsEqual(a, b string) bool {
 type PatchHistoryStore struct {
 	mu   sync.Mutex
 	path string
-	lock *flock.Flock
+	lock *fileLock
 }
 
 func PatchHistoryPath(configPathOverride string) (string, error) {
@@ -135,7 +133,7 @@ func NewPatchHistoryStore(configPathOverride string) (*PatchHistoryStore, error)
 
 	return &PatchHistoryStore{
 		path: path,
-		lock: flock.New(path + ".lock"),
+		lock: newFileLock(path),
 	}, nil
 }
 
@@ -143,10 +141,10 @@ func (s *PatchHistoryStore) Load() (PatchHistory, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := s.lock.Lock(); err != nil {
+	if err := s.lock.acquire(); err != nil {
 		return PatchHistory{}, fmt.Errorf("lock patch history: %w", err)
 	}
-	defer func() { _ = s.lock.Unlock() }()
+	defer s.lock.release()
 
 	return s.loadUnlocked()
 }
@@ -155,10 +153,10 @@ func (s *PatchHistoryStore) Update(fn func(*PatchHistory) error) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := s.lock.Lock(); err != nil {
+	if err := s.lock.acquire(); err != nil {
 		return fmt.Errorf("lock patch history: %w", err)
 	}
-	defer func() { _ = s.lock.Unlock() }()
+	defer s.lock.release()
 
 	history, err := s.loadUnlocked()
 	if err != nil {
@@ -9,15 +9,18 @@ import (
 	"runtime"
 	"strings"
 	"sync"
-
-	"github.com/gofrs/flock"
 )
 
+// Store reads and writes config.json. Writers serialize on a mutex per
+// path within this process and on a file lock with other processes.
 type Store struct {
 	mu     sync.Mutex
 	path   string
 	pathMu *sync.Mutex
-	lock   *flock.Flock
+	lock   *fileLock
+
+	legacyMu       sync.Mutex
+	legacyMigrated bool
 }
 
 var storePathLocks sync.Map
@@ -48,7 +51,7 @@ func NewStore(pathOverride string) (*Store, error) {
 	return &Store{
 		path:   path,
 		pathMu: storePathMutex(path),
-		lock:   flock.New(path + ".lock"),
+		lock:   newFileLock(path),
 	}, nil
 }
 
@@ -60,10 +63,10 @@ func (s *Store) Load() (Config, error) {
 	s.pathMu.Lock()
 	defer s.pathMu.Unlock()
 
-	if err := s.lock.Lock(); err != nil {
+	if err := s.lock.acquire(); err != nil {
 		return Config{}, fmt.Errorf("lock config: %w", err)
 	}
-	defer func() { _ = s.lock.Unlock() }()
+	defer s.lock.release()
 
 	return s.loadUnlocked()
 }
@@ -74,10 +77,10 @@ func (s *Store) Save(cfg Config) error {
 	s.pathMu.Lock()
 	defer s.pathMu.Unlock()
 
-	if err := s.lock.Lock(); err != nil {
+	if err := s.lock.acquire(); err != nil {
 		return fmt.Errorf("lock config: %w", err)
 	}
-	defer func() { _ = s.lock.Unlock() }()
+	defer s.lock.release()
 
 	return s.saveUnlocked(cfg)
 }
@@ -88,10 +91,10 @@ func (s *Store) Update(fn func(*Config) error) error {
 	s.pathMu.Lock()
 	defer s.pathMu.Unlock()
 
-	if err := s.lock.Lock(); err != nil {
+	if err := s.lock.acquire(); err != nil {
 		return fmt.Errorf("lock config: %w", err)
 	}
-	defer func() { _ = s.lock.Unlock() }()
+	defer s.lock.release()
 
 	cfg, err := s.loadUnlocked()
 	if err != nil {
@@ -105,6 +108,36 @@ func (s *Store) Update(fn func(*Config) error) error {
 	return s.saveUnlocked(cfg)
 }
 
+// MigrateLegacyInstances runs migrate, which moves the config's legacy
+// Instances list out of it, the first time it is called on this store.
+// The list is read without the config lock, which atomic writes allow,
+// and migrate only runs when it is not empty. A failed migration is
+// retried on the next call.
+func (s *Store) MigrateLegacyInstances(migrate func() error) error {
+	s.legacyMu.Lock()
+	defer s.legacyMu.Unlock()
+	if s.legacyMigrated {
+		return nil
+	}
+	cfg, err := s.loadUnlocked()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Instances) > 0 {
+		if err := migrate(); err != nil {
+			return err
+		}
+	}
+	s.legacyMigrated = true
+	return nil
+}
+
+// WriteFileAtomic replaces path with data through a temp file in the same
+// directory, so readers never see a partial file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return atomicWriteFile(path, data, perm)
+}
+
 func storePathMutex(path string) *sync.Mutex {
 	key := path
 	if abs, err := filepath.Abs(path); err == nil {
@@ -5,6 +5,19 @@ import "time"
 const CurrentVersion = 1
 const InstanceKindDaemon = "daemon"
 
+// Profile types. An empty Profile.Type means ProfileTypeSSH.
+const (
+	ProfileTypeSSH       = "ssh"
+	ProfileTypeHTTPProxy = "http-proxy"
+)
+
+// SSH backends for ProfileTypeSSH profiles. An empty Profile.SSHBackend
+// means SSHBackendOpenSSH.
+const (
+	SSHBackendOpenSSH = "openssh"
+	SSHBackendNative  = "native"
+)
+
 type YoloMode string
 
 const (
@@ -19,9 +32,20 @@ type Config struct {
 	YoloEnabled      *bool             `json:"yoloEnabled,omitempty"`
 	YoloMode         *string           `json:"yoloMode,omitempty"`
 	Profiles         []Profile         `json:"profiles"`
-	Instances        []Instance        `json:"instances"`
+	Instances        []Instance        `json:"instances,omitempty"` // legacy; migrated to the manager's runtime registry
 	PatchFailures    []PatchFailure    `json:"patchFailures,omitempty"`
 	YoloBypassProbes []YoloBypassProbe `json:"yoloBypassProbes,omitempty"`
+	ProfileScores    []ProfileScore    `json:"profileScores,omitempty"`
+	SharedDaemon     *SharedDaemon     `json:"sharedDaemon,omitempty"`
+}
+
+// SharedDaemon makes `run`, the TUI and `run-json` share one daemon per
+// profile, started on demand, instead of each opening its own tunnels.
+// Each of them holds a lease on the daemon while it runs; the daemon exits
+// once it has had no lease for IdleTimeout (Go syntax, default 10m).
+type SharedDaemon struct {
+	Enabled     bool   `json:"enabled"`
+	IdleTimeout string `json:"idleTimeout,omitempty"`
 }
 
 type PatchFailure struct {
@@ -42,14 +66,121 @@ type YoloBypassProbe struct {
 	ProbedAt      time.Time `json:"probedAt"`
 }
 
+// ProfileScore caches one probe made to auto-select a profile: the connect
+// latency to its first hop, or the error when it was unreachable.
+type ProfileScore struct {
+	ProfileID string    `json:"profileId"`
+	LatencyMs float64   `json:"latencyMs,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ProbedAt  time.Time `json:"probedAt"`
+}
+
 type Profile struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Type selects the upstream: ProfileTypeSSH (default) tunnels through
+	// `ssh -D`, ProfileTypeHTTPProxy chains to UpstreamProxy via CONNECT.
+	Type      string    `json:"type,omitempty"`
 	Host      string    `json:"host"`
 	Port      int       `json:"port"`
 	User      string    `json:"user"`
 	SSHArgs   []string  `json:"sshArgs,omitempty"`
 	CreatedAt time.Time `json:"createdAt"`
+
+	// SSHBackend selects how SSH profiles connect: SSHBackendOpenSSH runs
+	// `ssh -D`, SSHBackendNative uses the built-in client, which reads key
+	// files and known_hosts options from SSHArgs and uses ssh-agent.
+	SSHBackend string `json:"sshBackend,omitempty"`
+
+	// JumpHosts are bastions between this machine and Host, in connection
+	// order. They replace hand-written -J/ProxyJump entries in SSHArgs.
+	JumpHosts []JumpHost `json:"jumpHosts,omitempty"`
+
+	// LocalForwards are ssh -L forwards opened with the tunnel, for services
+	// only reachable from behind the SSH host. SSH profiles only.
+	LocalForwards []LocalForward `json:"localForwards,omitempty"`
+
+	// Failover names other profiles (by ID or name), in order, whose tunnels
+	// take over when this profile's cannot be kept up. The listener and its
+	// settings stay this profile's.
+	Failover []string `json:"failover,omitempty"`
+
+	// Tunnels is how many SSH tunnels each instance keeps open in parallel
+	// and spreads connections across; 0 means one.
+	Tunnels int `json:"tunnels,omitempty"`
+
+	// Restart tunes how a dropped tunnel is restarted.
+	Restart *RestartPolicy `json:"restart,omitempty"`
+
+	// TunnelIdleTimeout closes CONNECT and SOCKS5 tunnels with no traffic in
+	// either direction for this long (Go syntax, e.g. "15m"). Empty keeps
+	// idle tunnels open.
+	TunnelIdleTimeout string `json:"tunnelIdleTimeout,omitempty"`
+
+	// HealthProbe is an end-to-end check through the tunnel, run every few
+	// seconds: "tls://host:port" completes a TLS handshake, "host:port" (or
+	// "tcp://host:port") only connects. Empty disables it.
+	HealthProbe string `json:"healthProbe,omitempty"`
+
+	// UpstreamProxy is the http:// or https:// URL of the upstream proxy for
+	// ProfileTypeHTTPProxy profiles; userinfo is sent as basic auth.
+	UpstreamProxy string `json:"upstreamProxy,omitempty"`
+
+	// AllowDestinations and DenyDestinations restrict which host[:port]
+	// targets the local proxy forwards. Patterns accept "*.domain" wildcards
+	// and CIDRs; deny wins, and an empty allow list allows everything.
+	// CIDRs only match IP-literal targets; hostnames need host patterns.
+	AllowDestinations []string `json:"allowDestinations,omitempty"`
+	DenyDestinations  []string `json:"denyDestinations,omitempty"`
+
+	// Routes pick, per destination, whether the local proxy dials through
+	// the tunnel, directly, or rejects the connection. The first matching
+	// route wins; DefaultRoute (tunnel when empty) covers the rest.
+	Routes       []Route `json:"routes,omitempty"`
+	DefaultRoute string  `json:"defaultRoute,omitempty"`
+
+	// ProxyAuth makes each instance of this profile require a random
+	// Proxy-Authorization credential on its local listener.
+	ProxyAuth bool `json:"proxyAuth,omitempty"`
+	// ExposeSOCKS starts an authenticated local SOCKS5 listener next to the
+	// HTTP proxy for tools that only honor ALL_PROXY=socks5h://. It has its
+	// own random credential and does not turn on ProxyAuth.
+	ExposeSOCKS bool `json:"exposeSocks,omitempty"`
+}
+
+// Route maps a destination pattern (same syntax as AllowDestinations) to
+// "tunnel", "direct" or "reject".
+type Route struct {
+	Match string `json:"match"`
+	Via   string `json:"via"`
+}
+
+// RestartPolicy tunes tunnel restarts. Durations use Go syntax ("500ms",
+// "10m"); zero fields keep the defaults. A negative Jitter disables it.
+type RestartPolicy struct {
+	InitialDelay string  `json:"initialDelay,omitempty"`
+	MaxDelay     string  `json:"maxDelay,omitempty"`
+	Multiplier   float64 `json:"multiplier,omitempty"`
+	Jitter       float64 `json:"jitter,omitempty"`
+	Budget       int     `json:"budget,omitempty"`
+	Window       string  `json:"window,omitempty"`
+}
+
+// JumpHost is one hop of Profile.JumpHosts. Port defaults to 22 and User
+// to the profile's User; IdentityFile applies to this hop only.
+type JumpHost struct {
+	Host         string `json:"host"`
+	Port         int    `json:"port,omitempty"`
+	User         string `json:"user,omitempty"`
+	IdentityFile string `json:"identityFile,omitempty"`
+}
+
+// LocalForward listens on 127.0.0.1:LocalPort and connects, from the SSH
+// host, to RemoteHost:RemotePort.
+type LocalForward struct {
+	LocalPort  int    `json:"localPort"`
+	RemoteHost string `json:"remoteHost"`
+	RemotePort int    `json:"remotePort"`
 }
 
 type Instance struct {
@@ -61,4 +192,33 @@ type Instance struct {
 	DaemonPID  int       `json:"daemonPid"`
 	StartedAt  time.Time `json:"startedAt"`
 	LastSeenAt time.Time `json:"lastSeenAt"`
+	// ProxyToken is the listener's basic-auth password when the profile
+	// enables ProxyAuth.
+	ProxyToken string `json:"proxyToken,omitempty"`
+	// SOCKSListenPort is the instance's local SOCKS5 listener (not the ssh -D
+	// port in SocksPort); 0 when the listener is disabled. SOCKSToken is its
+	// password, separate from ProxyToken.
+	SOCKSListenPort int    `json:"socksListenPort,omitempty"`
+	SOCKSToken      string `json:"socksToken,omitempty"`
+	// ActiveProfileID is the failover profile currently carrying traffic,
+	// empty while it is ProfileID itself; Failovers counts the switches.
+	ActiveProfileID string `json:"activeProfileId,omitempty"`
+	Failovers       int    `json:"failovers,omitempty"`
+	// Shared marks a daemon started on demand for SharedDaemon. It runs
+	// while processes hold Leases on it; IdleSince is when the last lease
+	// was released.
+	Shared    bool      `json:"shared,omitempty"`
+	Leases    []Lease   `json:"leases,omitempty"`
+	IdleSince time.Time `json:"idleSince,omitzero"`
+	// ServiceManager ("systemd" or "launchd") and ServiceName, its unit or
+	// label, are set for daemons installed as a user service; the service
+	// manager starts, restarts and stops them.
+	ServiceManager string `json:"serviceManager,omitempty"`
+	ServiceName    string `json:"serviceName,omitempty"`
+}
+
+// Lease is a process's claim on a shared daemon, released when it exits.
+type Lease struct {
+	PID        int       `json:"pid"`
+	AcquiredAt time.Time `json:"acquiredAt"`
 }
@@ -19,6 +19,21 @@ func WithProxy(base []string, proxyURL string) []string {
 	return fromMap(m)
 }
 
+// NoProxyEntries returns the NO_PROXY entries WithProxy would set for base:
+// any existing NO_PROXY/no_proxy entries plus the loopback list.
+func NoProxyEntries(base []string) []string {
+	m := toMap(base)
+	merged := mergeNoProxy(firstNonEmpty(m["NO_PROXY"], m["no_proxy"]), loopbackNoProxy)
+	return strings.Split(merged, ",")
+}
+
+// WithSOCKSProxy sets ALL_PROXY (both cases) for tools that only speak SOCKS.
+func WithSOCKSProxy(base []string, socksURL string) []string {
+	m := toMap(base)
+	setBoth(m, "ALL_PROXY", socksURL)
+	return fromMap(m)
+}
+
 func mergeNoProxy(existing string, required []string) string {
 	set := map[string]bool{}
 	var out []string
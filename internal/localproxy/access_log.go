@@ -0,0 +1,211 @@
+package localproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error classes recorded in AccessLogEntry.ErrorClass.
+const (
+	ErrorClassAuth     = "auth"     // client failed proxy authentication
+	ErrorClassBlocked  = "blocked"  // destination rejected by proxy rules
+	ErrorClassTunnel   = "tunnel"   // SSH tunnel or upstream proxy unreachable
+	ErrorClassTarget   = "target"   // tunnel reachable, target refused/unreachable
+	ErrorClassUpstream = "upstream" // connected, but the upstream exchange failed
+	ErrorClassClient   = "client"   // malformed request or client-side failure
+)
+
+// AccessLogEntry is one line of the JSONL access log.
+type AccessLogEntry struct {
+	Time        time.Time `json:"ts"`
+	InstanceID  string    `json:"instanceId"`
+	Method      string    `json:"method"`
+	Destination string    `json:"destination"`
+	Status      int       `json:"status,omitempty"`
+	DialMs      int64     `json:"dialMs"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+	DurationMs  int64     `json:"durationMs"`
+	ErrorClass  string    `json:"errorClass,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// SOCKSAccessMethod is the Method of SOCKS5 tunnels in the access log. They
+// have no HTTP status.
+const SOCKSAccessMethod = "SOCKS5"
+
+// AccessLogger receives one entry per proxied request or tunnel.
+type AccessLogger interface {
+	Log(AccessLogEntry)
+}
+
+const (
+	DefaultAccessLogMaxBytes = 10 << 20
+	DefaultAccessLogBackups  = 3
+)
+
+// AccessLog appends JSONL entries to a file, rotating it to path.1 .. path.N
+// once it grows past maxBytes.
+type AccessLog struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenAccessLog opens (or creates) the access log at path. Non-positive
+// limits fall back to the defaults.
+func OpenAccessLog(path string, maxBytes int64, backups int) (*AccessLog, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultAccessLogMaxBytes
+	}
+	if backups <= 0 {
+		backups = DefaultAccessLogBackups
+	}
+	l := &AccessLog{path: path, maxBytes: maxBytes, backups: backups}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AccessLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.f = f
+	l.size = st.Size()
+	return nil
+}
+
+// Log writes e as a single JSON line. Write errors are dropped so logging
+// never interferes with proxying.
+func (l *AccessLog) Log(e AccessLogEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	if l.size > 0 && l.size+int64(len(b)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return
+		}
+	}
+	n, _ := l.f.Write(b)
+	l.size += int64(n)
+}
+
+func (l *AccessLog) rotate() error {
+	_ = l.f.Close()
+	l.f = nil
+	for i := l.backups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return l.open()
+}
+
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// AccessLogFiles returns the access log at path and its rotated backups,
+// oldest first, skipping files that do not exist.
+func AccessLogFiles(path string) []string {
+	var backups []string
+	for i := 1; ; i++ {
+		p := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(p); err != nil {
+			break
+		}
+		backups = append(backups, p)
+	}
+	out := make([]string, 0, len(backups)+1)
+	for i := len(backups) - 1; i >= 0; i-- {
+		out = append(out, backups[i])
+	}
+	if _, err := os.Stat(path); err == nil {
+		out = append(out, path)
+	}
+	return out
+}
+
+// TargetDialError marks a dial the tunnel carried out but the target
+// refused, e.g. an SSH server rejecting a direct-tcpip channel.
+type TargetDialError struct {
+	Addr string
+	Err  error
+}
+
+func (e *TargetDialError) Error() string { return e.Addr + ": " + e.Err.Error() }
+func (e *TargetDialError) Unwrap() error { return e.Err }
+
+// classifyDialError tells apart failures reaching the tunnel (SSH SOCKS port
+// or upstream HTTP proxy) from failures it reported for the target itself.
+func classifyDialError(err error) string {
+	if errors.Is(err, ErrRouteRejected) {
+		return ErrorClassBlocked
+	}
+	var target *TargetDialError
+	if errors.As(err, &target) {
+		return ErrorClassTarget
+	}
+	var status *UpstreamStatusError
+	if errors.As(err, &status) {
+		if status.StatusCode == http.StatusProxyAuthRequired {
+			// The upstream proxy rejected our credentials.
+			return ErrorClassTunnel
+		}
+		// An upstream HTTP proxy answered but refused the target.
+		return ErrorClassTarget
+	}
+	var op *net.OpError
+	if !errors.As(err, &op) || !strings.HasPrefix(op.Op, "socks") {
+		return ErrorClassTunnel
+	}
+	var inner *net.OpError
+	if errors.As(op.Err, &inner) {
+		// Dialing the local SOCKS port itself failed.
+		return ErrorClassTunnel
+	}
+	if op.Err != nil && strings.HasPrefix(op.Err.Error(), "unknown error") {
+		// The tunnel answered with a SOCKS failure reply for the target.
+		return ErrorClassTarget
+	}
+	return ErrorClassTunnel
+}
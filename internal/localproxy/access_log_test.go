@@ -0,0 +1,207 @@
+package localproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingAccessLog struct {
+	mu      sync.Mutex
+	entries []AccessLogEntry
+}
+
+func (r *recordingAccessLog) Log(e AccessLogEntry) {
+	r.mu.Lock()
+	r.entries = append(r.entries, e)
+	r.mu.Unlock()
+}
+
+func (r *recordingAccessLog) Entries() []AccessLogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]AccessLogEntry(nil), r.entries...)
+}
+
+func TestAccessLogWritesJSONLAndRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instances", "inst-1.access.log")
+	l, err := OpenAccessLog(path, 200, 2)
+	if err != nil {
+		t.Fatalf("OpenAccessLog: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Log(AccessLogEntry{InstanceID: "inst-1", Method: http.MethodConnect, Destination: fmt.Sprintf("host-%d:443", i)})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	files := AccessLogFiles(path)
+	if len(files) != 3 {
+		t.Fatalf("expected current log plus 2 backups, got %v", files)
+	}
+	if files[0] != path+".2" || files[1] != path+".1" || files[2] != path {
+		t.Fatalf("unexpected file order: %v", files)
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected backups beyond the limit to be dropped, stat err=%v", err)
+	}
+
+	var last string
+	for _, f := range files {
+		st, err := os.Stat(f)
+		if err != nil {
+			t.Fatalf("stat %s: %v", f, err)
+		}
+		if st.Size() > 200 {
+			t.Fatalf("%s exceeds max size: %d", f, st.Size())
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		s := bufio.NewScanner(strings.NewReader(string(data)))
+		for s.Scan() {
+			var e AccessLogEntry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				t.Fatalf("invalid JSONL line %q: %v", s.Text(), err)
+			}
+			last = e.Destination
+		}
+	}
+	if last != "host-9:443" {
+		t.Fatalf("expected newest entry last, got %q", last)
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "tunnel port refused",
+			err:  &net.OpError{Op: "socks connect", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			want: ErrorClassTunnel,
+		},
+		{
+			name: "target unreachable",
+			err:  &net.OpError{Op: "socks connect", Err: errors.New("unknown error host unreachable")},
+			want: ErrorClassTarget,
+		},
+		{
+			name: "tunnel closed mid-handshake",
+			err:  &net.OpError{Op: "socks connect", Err: io.EOF},
+			want: ErrorClassTunnel,
+		},
+		{
+			name: "plain error",
+			err:  errors.New("boom"),
+			want: ErrorClassTunnel,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyDialError(tc.err); got != tc.want {
+				t.Fatalf("classifyDialError=%q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHTTPProxy_AccessLogPlainHTTP(t *testing.T) {
+	originAddr, closeOrigin := startHTTPOrigin(t)
+	defer closeOrigin()
+
+	log := &recordingAccessLog{}
+	p := NewHTTPProxy(&recordingDialer{}, Options{InstanceID: "inst-log", AccessLog: log})
+	httpAddr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() { _ = p.Close(context.Background()) }()
+
+	proxyURL, _ := url.Parse("http://" + httpAddr)
+	client := &http.Client{Timeout: 3 * time.Second, Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post("http://"+originAddr+"/hello", "text/plain", strings.NewReader("abc"))
+	if err != nil {
+		t.Fatalf("POST via proxy: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	entries := log.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %#v", entries)
+	}
+	e := entries[0]
+	if e.InstanceID != "inst-log" || e.Method != http.MethodPost || e.Destination != originAddr {
+		t.Fatalf("unexpected entry: %#v", e)
+	}
+	if e.Status != http.StatusOK || e.BytesIn != 3 || e.BytesOut != int64(len("hello")) || e.ErrorClass != "" {
+		t.Fatalf("unexpected counters: %#v", e)
+	}
+	if e.Time.IsZero() {
+		t.Fatalf("expected timestamp, got %#v", e)
+	}
+}
+
+func TestHTTPProxy_AccessLogErrorClasses(t *testing.T) {
+	rules, err := ParseDestinationRules(nil, []string{"blocked.example:443"})
+	if err != nil {
+		t.Fatalf("ParseDestinationRules: %v", err)
+	}
+	log := &recordingAccessLog{}
+	dialer := dialerFunc(func(network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "socks connect", Err: errors.New("unknown error host unreachable")}
+	})
+	p := NewHTTPProxy(dialer, Options{InstanceID: "inst-log", Rules: rules, AuthToken: "tok", AccessLog: log})
+
+	connect := func(host string, auth bool) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodConnect, "http://"+host, nil)
+		req.Host = host
+		if auth {
+			req.Header.Set("Proxy-Authorization", AuthorizationHeader("tok"))
+		}
+		p.serveHTTP(w, req)
+		return w.Code
+	}
+	if code := connect("blocked.example:443", false); code != http.StatusProxyAuthRequired {
+		t.Fatalf("status=%d want 407", code)
+	}
+	if code := connect("blocked.example:443", true); code != http.StatusForbidden {
+		t.Fatalf("status=%d want 403", code)
+	}
+	if code := connect("down.example:443", true); code != http.StatusBadGateway {
+		t.Fatalf("status=%d want 502", code)
+	}
+
+	entries := log.Entries()
+	want := []string{ErrorClassAuth, ErrorClassBlocked, ErrorClassTarget}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %#v", len(want), entries)
+	}
+	for i, class := range want {
+		if entries[i].ErrorClass != class {
+			t.Fatalf("entry %d class=%q want %q (%#v)", i, entries[i].ErrorClass, class, entries[i])
+		}
+	}
+	if entries[2].Destination != "down.example:443" || entries[2].Error == "" {
+		t.Fatalf("expected dial error details, got %#v", entries[2])
+	}
+}
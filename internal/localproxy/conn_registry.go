@@ -0,0 +1,234 @@
+package localproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes one tracked tunnel.
+type ConnInfo struct {
+	ID          uint64    `json:"id"`
+	Destination string    `json:"destination"`
+	StartedAt   time.Time `json:"startedAt"`
+	LastActive  time.Time `json:"lastActive"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+}
+
+// DrainResult reports how a shutdown ended the open tunnels: Drained ones
+// finished on their own before the deadline, Killed ones were force-closed.
+type DrainResult struct {
+	Drained int `json:"drained"`
+	Killed  int `json:"killed"`
+}
+
+// ConnRegistry tracks hijacked CONNECT tunnels, which http.Server.Shutdown
+// does not see, and SOCKS5 tunnels, so they can be counted, listed, drained
+// and force-closed.
+type ConnRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	conns    map[uint64]*trackedConn
+	changed  chan struct{}
+	draining bool
+	drained  int
+
+	idleClosed atomic.Int64
+}
+
+type trackedConn struct {
+	id       uint64
+	dest     string
+	started  time.Time
+	client   net.Conn
+	upstream net.Conn
+	killed   bool // guarded by ConnRegistry.mu
+
+	lastActive atomic.Int64 // unix nanos
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+}
+
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: map[uint64]*trackedConn{}, changed: make(chan struct{})}
+}
+
+func (r *ConnRegistry) add(dest string, client, upstream net.Conn) *trackedConn {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	c := &trackedConn{id: r.nextID, dest: dest, started: now, client: client, upstream: upstream}
+	c.lastActive.Store(now.UnixNano())
+	r.conns[c.id] = c
+	return c
+}
+
+func (r *ConnRegistry) remove(c *trackedConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.conns[c.id]; !ok {
+		return
+	}
+	delete(r.conns, c.id)
+	if r.draining && !c.killed {
+		r.drained++
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// relay copies between client and upstream until both directions are done,
+// tracking the tunnel meanwhile, and closes both. Bytes are added to m as
+// they are copied, so long-lived tunnels show up before they close. It
+// returns the bytes read from the client and from the upstream.
+func (r *ConnRegistry) relay(dest string, client, upstream net.Conn, m *Metrics) (in, out int64) {
+	tc := r.add(dest, client, upstream)
+	defer r.remove(tc)
+
+	inDone := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(upstream, tc.clientReader(m))
+		_ = upstream.Close()
+		inDone <- n
+	}()
+
+	out, _ = io.Copy(client, tc.upstreamReader(m))
+	_ = client.Close()
+	return <-inDone, out
+}
+
+// Count returns the number of open tunnels.
+func (r *ConnRegistry) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// List returns the open tunnels, oldest first.
+func (r *ConnRegistry) List() []ConnInfo {
+	r.mu.Lock()
+	out := make([]ConnInfo, 0, len(r.conns))
+	for _, c := range r.conns {
+		out = append(out, ConnInfo{
+			ID:          c.id,
+			Destination: c.dest,
+			StartedAt:   c.started,
+			LastActive:  time.Unix(0, c.lastActive.Load()),
+			BytesIn:     c.bytesIn.Load(),
+			BytesOut:    c.bytesOut.Load(),
+		})
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Drain waits for open tunnels to finish until ctx is done, then force-closes
+// the rest.
+func (r *ConnRegistry) Drain(ctx context.Context) DrainResult {
+	r.mu.Lock()
+	r.draining = true
+	r.drained = 0
+	r.mu.Unlock()
+
+wait:
+	for {
+		r.mu.Lock()
+		n := len(r.conns)
+		changed := r.changed
+		r.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	killed := r.CloseAll()
+	r.mu.Lock()
+	drained := r.drained
+	r.draining = false
+	r.mu.Unlock()
+	return DrainResult{Drained: drained, Killed: killed}
+}
+
+// CloseAll force-closes every open tunnel and returns how many it closed.
+func (r *ConnRegistry) CloseAll() int {
+	r.mu.Lock()
+	victims := make([]*trackedConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		if !c.killed {
+			c.killed = true
+			victims = append(victims, c)
+		}
+	}
+	r.mu.Unlock()
+	for _, c := range victims {
+		c.close()
+	}
+	return len(victims)
+}
+
+// CloseIdle force-closes tunnels with no traffic in either direction for
+// longer than idle and returns how many it closed.
+func (r *ConnRegistry) CloseIdle(idle time.Duration, now time.Time) int {
+	cutoff := now.Add(-idle).UnixNano()
+	r.mu.Lock()
+	var victims []*trackedConn
+	for _, c := range r.conns {
+		if !c.killed && c.lastActive.Load() < cutoff {
+			c.killed = true
+			victims = append(victims, c)
+		}
+	}
+	r.mu.Unlock()
+	for _, c := range victims {
+		c.close()
+	}
+	r.idleClosed.Add(int64(len(victims)))
+	return len(victims)
+}
+
+// IdleClosed returns how many tunnels were closed for being idle.
+func (r *ConnRegistry) IdleClosed() int64 { return r.idleClosed.Load() }
+
+func (c *trackedConn) close() {
+	_ = c.client.Close()
+	_ = c.upstream.Close()
+}
+
+// clientReader and upstreamReader count traffic, for the tunnel and in m,
+// and refresh the idle timer.
+func (c *trackedConn) clientReader(m *Metrics) io.Reader {
+	return &activityReader{r: c.client, c: c, n: &c.bytesIn, total: &m.bytesIn}
+}
+
+func (c *trackedConn) upstreamReader(m *Metrics) io.Reader {
+	return &activityReader{r: c.upstream, c: c, n: &c.bytesOut, total: &m.bytesOut}
+}
+
+type activityReader struct {
+	r     io.Reader
+	c     *trackedConn
+	n     *atomic.Int64
+	total *atomic.Int64
+}
+
+func (a *activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.n.Add(int64(n))
+		a.total.Add(int64(n))
+		a.c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
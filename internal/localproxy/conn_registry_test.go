@@ -0,0 +1,141 @@
+package localproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPipePair(t *testing.T) (client, upstream net.Conn) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	u1, u2 := net.Pipe()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+		_ = u1.Close()
+		_ = u2.Close()
+	})
+	return c1, u1
+}
+
+func TestConnRegistryDrainCountsDrainedAndKilled(t *testing.T) {
+	r := NewConnRegistry()
+	c1, u1 := newPipePair(t)
+	c2, u2 := newPipePair(t)
+	finishing := r.add("a.example:443", c1, u1)
+	stuck := r.add("b.example:443", c2, u2)
+
+	if got := r.Count(); got != 2 {
+		t.Fatalf("Count=%d want 2", got)
+	}
+	list := r.List()
+	if len(list) != 2 || list[0].Destination != "a.example:443" || list[1].Destination != "b.example:443" {
+		t.Fatalf("unexpected list: %#v", list)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		r.remove(finishing)
+	}()
+	go func() {
+		// The force-closed tunnel unwinds like handleConnect would.
+		buf := make([]byte, 1)
+		_, _ = stuck.client.Read(buf)
+		r.remove(stuck)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	res := r.Drain(ctx)
+	if res.Drained != 1 || res.Killed != 1 {
+		t.Fatalf("Drain=%+v want drained=1 killed=1", res)
+	}
+}
+
+func TestConnRegistryDrainWithoutConnsReturnsImmediately(t *testing.T) {
+	r := NewConnRegistry()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if res := r.Drain(ctx); res != (DrainResult{}) {
+		t.Fatalf("Drain=%+v want zero", res)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("Drain waited with no open tunnels")
+	}
+}
+
+func TestConnRegistryCloseIdle(t *testing.T) {
+	r := NewConnRegistry()
+	c1, u1 := newPipePair(t)
+	c2, u2 := newPipePair(t)
+	idle := r.add("idle.example:443", c1, u1)
+	busy := r.add("busy.example:443", c2, u2)
+
+	now := time.Now()
+	idle.lastActive.Store(now.Add(-time.Hour).UnixNano())
+	busy.lastActive.Store(now.UnixNano())
+
+	if got := r.CloseIdle(time.Minute, now); got != 1 {
+		t.Fatalf("CloseIdle=%d want 1", got)
+	}
+	if _, err := idle.client.Write([]byte("x")); err == nil {
+		t.Fatalf("expected idle tunnel to be closed")
+	}
+	if got := r.IdleClosed(); got != 1 {
+		t.Fatalf("IdleClosed=%d want 1", got)
+	}
+	// Already-killed tunnels are not closed twice.
+	if got := r.CloseIdle(time.Minute, now); got != 0 {
+		t.Fatalf("second CloseIdle=%d want 0", got)
+	}
+}
+
+func TestHTTPProxyDrainKillsOpenTunnels(t *testing.T) {
+	echoAddr, closeEcho := startTCPEchoServer(t)
+	defer closeEcho()
+
+	p := NewHTTPProxy(NewDirectDialer(time.Second), Options{InstanceID: "test-instance"})
+	httpAddr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start HTTP proxy: %v", err)
+	}
+	defer func() { _ = p.Close(context.Background()) }()
+
+	c, err := net.DialTimeout("tcp", httpAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial http proxy: %v", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr, echoAddr)
+	br := bufio.NewReader(c)
+	statusLine, err := br.ReadString('\n')
+	if err != nil || !strings.Contains(statusLine, "200") {
+		t.Fatalf("unexpected status line %q: %v", statusLine, err)
+	}
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("read header end: %v", err)
+	}
+
+	if got := p.Conns().Count(); got != 1 {
+		t.Fatalf("open tunnels=%d want 1", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res := p.Drain(ctx)
+	if res.Drained != 0 || res.Killed != 1 {
+		t.Fatalf("Drain=%+v want drained=0 killed=1", res)
+	}
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatalf("expected killed tunnel to reach EOF, got %v", err)
+	}
+}
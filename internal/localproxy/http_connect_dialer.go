@@ -0,0 +1,144 @@
+package localproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UpstreamStatusError is returned when the upstream HTTP proxy answers a
+// CONNECT with a non-2xx status, i.e. it was reachable but refused or could
+// not reach the target.
+type UpstreamStatusError struct {
+	Addr       string
+	StatusCode int
+	Status     string
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream proxy CONNECT %s: %s", e.Addr, e.Status)
+}
+
+// ParseUpstreamProxyURL validates an upstream proxy URL and returns it with a
+// default port filled in (80 for http, 443 for https).
+func ParseUpstreamProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy URL: %w", err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("upstream proxy URL must use http:// or https://, got %q", raw)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("upstream proxy URL is missing a host")
+	}
+	if u.Port() == "" {
+		port := "80"
+		if strings.EqualFold(u.Scheme, "https") {
+			port = "443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// NewHTTPConnectDialer returns a Dialer that tunnels every connection
+// through an upstream HTTP(S) proxy using CONNECT. Credentials in the URL's
+// userinfo are sent as Proxy-Authorization basic auth.
+func NewHTTPConnectDialer(proxyURL string, timeout time.Duration) (Dialer, error) {
+	u, err := ParseUpstreamProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	d := &httpConnectDialer{
+		proxyAddr: u.Host,
+		useTLS:    strings.EqualFold(u.Scheme, "https"),
+		timeout:   timeout,
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass))
+	}
+	if d.useTLS {
+		d.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+	return d, nil
+}
+
+type httpConnectDialer struct {
+	proxyAddr string
+	useTLS    bool
+	tlsConfig *tls.Config
+	auth      string
+	timeout   time.Duration
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	c, err := net.DialTimeout(network, d.proxyAddr, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if d.useTLS {
+		tc := tls.Client(c, d.tlsConfig)
+		_ = tc.SetDeadline(time.Now().Add(d.timeout))
+		if err := tc.Handshake(); err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("upstream proxy TLS handshake: %w", err)
+		}
+		c = tc
+	}
+
+	_ = c.SetDeadline(time.Now().Add(d.timeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(c); err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("upstream proxy CONNECT %s: %w", addr, err)
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("upstream proxy CONNECT %s: %w", addr, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_ = c.Close()
+		return nil, &UpstreamStatusError{Addr: addr, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// bufferedConn replays bytes the CONNECT response reader buffered past the
+// header before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
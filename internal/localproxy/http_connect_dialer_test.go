@@ -0,0 +1,154 @@
+package localproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startUpstreamHTTPProxy runs a minimal CONNECT-only proxy that requires
+// basic auth when auth is non-empty.
+func startUpstreamHTTPProxy(t *testing.T, auth string) (addr string, closeFn func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen upstream proxy: %v", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+					_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				target, err := net.DialTimeout("tcp", req.Host, 2*time.Second)
+				if err != nil {
+					_, _ = io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				_, _ = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(target, br) }()
+				_, _ = io.Copy(c, target)
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() {
+		_ = ln.Close()
+	}
+}
+
+func TestHTTPConnectDialer_TunnelsWithBasicAuth(t *testing.T) {
+	echoAddr, closeEcho := startTCPEchoServer(t)
+	defer closeEcho()
+	proxyAddr, closeProxy := startUpstreamHTTPProxy(t, basicAuthHeader("alice", "s3cret"))
+	defer closeProxy()
+
+	d, err := NewHTTPConnectDialer("http://alice:s3cret@"+proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewHTTPConnectDialer: %v", err)
+	}
+	c, err := d.Dial("tcp", echoAddr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echo=%q", got)
+	}
+}
+
+func TestHTTPConnectDialer_ReportsUpstreamStatus(t *testing.T) {
+	proxyAddr, closeProxy := startUpstreamHTTPProxy(t, basicAuthHeader("alice", "s3cret"))
+	defer closeProxy()
+
+	d, err := NewHTTPConnectDialer("http://alice:wrong@"+proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewHTTPConnectDialer: %v", err)
+	}
+	_, err = d.Dial("tcp", "example.com:443")
+	var status *UpstreamStatusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected 407 UpstreamStatusError, got %v", err)
+	}
+	if got := classifyDialError(err); got != ErrorClassTunnel {
+		t.Fatalf("407 class=%q want %q", got, ErrorClassTunnel)
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+	d, _ = NewHTTPConnectDialer("http://alice:s3cret@"+proxyAddr, 2*time.Second)
+	_, err = d.Dial("tcp", closedAddr)
+	if !errors.As(err, &status) || status.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 UpstreamStatusError, got %v", err)
+	}
+	if got := classifyDialError(err); got != ErrorClassTarget {
+		t.Fatalf("502 class=%q want %q", got, ErrorClassTarget)
+	}
+}
+
+func TestParseUpstreamProxyURL(t *testing.T) {
+	cases := []struct {
+		raw      string
+		wantHost string
+		wantErr  string
+	}{
+		{raw: "http://proxy.corp", wantHost: "proxy.corp:80"},
+		{raw: "https://proxy.corp", wantHost: "proxy.corp:443"},
+		{raw: " http://u:p@proxy.corp:3128 ", wantHost: "proxy.corp:3128"},
+		{raw: "http://[::1]", wantHost: "[::1]:80"},
+		{raw: "socks5://proxy.corp", wantErr: "http:// or https://"},
+		{raw: "proxy.corp:3128", wantErr: "http:// or https://"},
+		{raw: "http://", wantErr: "missing a host"},
+	}
+	for _, tc := range cases {
+		u, err := ParseUpstreamProxyURL(tc.raw)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("%q: expected error containing %q, got %v", tc.raw, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tc.raw, err)
+		}
+		if u.Host != tc.wantHost {
+			t.Fatalf("%q: host=%q want %q", tc.raw, u.Host, tc.wantHost)
+		}
+	}
+}
+
+func basicAuthHeader(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
@@ -2,13 +2,18 @@ package localproxy
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	xproxy "golang.org/x/net/proxy"
@@ -21,23 +26,133 @@ type Dialer interface {
 type HTTPProxy struct {
 	instanceID string
 	dialer     Dialer
-
-	mu       sync.Mutex
-	listener net.Listener
-	server   *http.Server
+	rules      *DestinationRules
+	authToken  string
+	accessLog  AccessLogger
+	metrics    *Metrics
+	version    string
+	pacBypass  []string
+	upstreams  func() []UpstreamStatus
+
+	conns       *ConnRegistry
+	idleTimeout time.Duration
+	transport   *http.Transport
+
+	blocked atomic.Int64
+
+	mu         sync.Mutex
+	listener   net.Listener
+	server     *http.Server
+	stopReaper chan struct{}
 }
 
 type Options struct {
 	InstanceID string
+	// Rules restricts which destinations may be dialed. Nil allows everything.
+	Rules *DestinationRules
+	// AuthToken, when set, requires clients to send Proxy-Authorization basic
+	// credentials for AuthUsername with this token as the password.
+	AuthToken string
+	// AccessLog, when set, receives one entry per proxied request or tunnel.
+	AccessLog AccessLogger
+	// Metrics collects the counters served on /_claude_proxy/metrics. When
+	// nil, the proxy keeps its own.
+	Metrics *Metrics
+	// Conns tracks the proxy's CONNECT tunnels. Share one with a SOCKSServer
+	// so that Drain also waits for its tunnels. When nil, the proxy keeps
+	// its own.
+	Conns *ConnRegistry
+	// Version is reported as claude_proxy_build_info on the metrics path.
+	Version string
+	// PACBypass lists NO_PROXY-style entries that /proxy.pac sends DIRECT.
+	PACBypass []string
+	// TunnelIdleTimeout closes CONNECT tunnels with no traffic in either
+	// direction for this long. Zero disables the check.
+	TunnelIdleTimeout time.Duration
+
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout bound the
+	// keep-alive pool used for plain-HTTP forwarding, and MaxConnsPerHost
+	// the connections to one host in use at once; requests beyond it wait.
+	// Zero values use the Default* constants.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	// Upstreams, when set, reports the state of the tunnels behind the
+	// dialer on the health endpoint.
+	Upstreams func() []UpstreamStatus
+}
+
+// UpstreamStatus is the health-endpoint view of one upstream tunnel.
+type UpstreamStatus struct {
+	ID      int    `json:"id"`
+	Profile string `json:"profile,omitempty"`
+	// Healthy is false while the tunnel is out of rotation.
+	Healthy  bool `json:"healthy"`
+	Restarts int  `json:"restarts"`
+	// Conns counts open connections through the tunnel; Dials all of them.
+	Conns int64  `json:"conns"`
+	Dials uint64 `json:"dials"`
+	// LastError is why the tunnel last exited or failed to start.
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// AuthUsername is the fixed basic-auth user name for authenticated listeners.
+const AuthUsername = "claude-proxy"
+
+// ProxyURL returns the loopback proxy URL for port, embedding credentials
+// when token is set.
+func ProxyURL(port int, token string) string {
+	if token == "" {
+		return fmt.Sprintf("http://127.0.0.1:%d", port)
+	}
+	u := url.URL{
+		Scheme: "http",
+		User:   url.UserPassword(AuthUsername, token),
+		Host:   fmt.Sprintf("127.0.0.1:%d", port),
+	}
+	return u.String()
+}
+
+// AuthorizationHeader returns the Proxy-Authorization value for token.
+func AuthorizationHeader(token string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(AuthUsername+":"+token))
 }
 
 func NewHTTPProxy(d Dialer, opts Options) *HTTPProxy {
+	m := opts.Metrics
+	if m == nil {
+		m = NewMetrics()
+	}
+	conns := opts.Conns
+	if conns == nil {
+		conns = NewConnRegistry()
+	}
 	return &HTTPProxy{
 		instanceID: opts.InstanceID,
 		dialer:     d,
+		rules:      opts.Rules,
+		authToken:  opts.AuthToken,
+		accessLog:  opts.AccessLog,
+		metrics:    m,
+		version:    opts.Version,
+		pacBypass:  opts.PACBypass,
+		upstreams:  opts.Upstreams,
+
+		conns:       conns,
+		idleTimeout: opts.TunnelIdleTimeout,
+		transport:   newForwardTransport(d, opts),
 	}
 }
 
+// Conns returns the registry of open CONNECT tunnels.
+func (p *HTTPProxy) Conns() *ConnRegistry { return p.conns }
+
+// BlockedCount returns how many requests were rejected by destination rules.
+func (p *HTTPProxy) BlockedCount() int64 { return p.blocked.Load() }
+
 func NewSOCKS5Dialer(socksAddr string, timeout time.Duration) (Dialer, error) {
 	if timeout <= 0 {
 		timeout = 10 * time.Second
@@ -84,9 +199,43 @@ func (p *HTTPProxy) Start(listenAddr string) (actualAddr string, err error) {
 		_ = srv.Serve(ln)
 	}()
 
+	if p.idleTimeout > 0 {
+		p.stopReaper = make(chan struct{})
+		go p.reapIdle(p.stopReaper)
+	}
+
 	return ln.Addr().String(), nil
 }
 
+func (p *HTTPProxy) reapIdle(stop <-chan struct{}) {
+	interval := p.idleTimeout / 2
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			p.conns.CloseIdle(p.idleTimeout, now)
+		}
+	}
+}
+
+// Drain stops accepting new connections, then waits for open CONNECT
+// tunnels to finish until ctx is done and force-closes the rest.
+func (p *HTTPProxy) Drain(ctx context.Context) DrainResult {
+	p.mu.Lock()
+	srv := p.server
+	p.mu.Unlock()
+	if srv != nil {
+		_ = srv.Shutdown(ctx)
+	}
+	return p.conns.Drain(ctx)
+}
+
 func (p *HTTPProxy) Close(ctx context.Context) error {
 	p.mu.Lock()
 	srv := p.server
@@ -103,24 +252,67 @@ func (p *HTTPProxy) Close(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	// Shutdown does not see hijacked tunnels; do not leak them.
+	p.conns.CloseAll()
+	p.transport.CloseIdleConnections()
 
 	p.mu.Lock()
 	if p.server == srv {
 		p.server = nil
 		p.listener = nil
+		if p.stopReaper != nil {
+			close(p.stopReaper)
+			p.stopReaper = nil
+		}
 	}
 	p.mu.Unlock()
 	return nil
 }
 
 func (p *HTTPProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// PAC file (not proxied, loopback clients only). Browsers fetch it
+	// directly and cannot present proxy credentials, and it holds none.
+	if r.Method == http.MethodGet && r.URL.Path == PACPath && !r.URL.IsAbs() {
+		p.servePAC(w, r)
+		return
+	}
+
+	if !p.authorized(r) {
+		p.logAccess(AccessLogEntry{
+			Method:      r.Method,
+			Destination: accessDestination(r),
+			Status:      http.StatusProxyAuthRequired,
+			ErrorClass:  ErrorClassAuth,
+		}, time.Now())
+		w.Header().Set("Proxy-Authenticate", `Basic realm="claude-proxy"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
 	// Local health check (not proxied).
 	if r.Method == http.MethodGet && r.URL.Path == "/_claude_proxy/health" {
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
+		health := map[string]any{
 			"ok":         true,
 			"instanceId": p.instanceID,
-		})
+			"blocked":    p.blocked.Load(),
+			"tunnels":    p.conns.Count(),
+		}
+		if p.upstreams != nil {
+			health["upstreams"] = p.upstreams()
+		}
+		_ = json.NewEncoder(w).Encode(health)
+		return
+	}
+
+	// Local metrics (not proxied, loopback clients only).
+	if r.Method == http.MethodGet && r.URL.Path == "/_claude_proxy/metrics" {
+		if !isLoopbackRequest(r) {
+			http.Error(w, "metrics are only served to loopback clients", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		p.metrics.WritePrometheus(w, p.instanceID, p.version)
 		return
 	}
 
@@ -133,15 +325,34 @@ func (p *HTTPProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	dest := r.Host
+	entry := AccessLogEntry{Method: http.MethodConnect, Destination: dest}
 	if dest == "" {
 		http.Error(w, "missing host", http.StatusBadRequest)
+		entry.Status, entry.ErrorClass = http.StatusBadRequest, ErrorClassClient
+		p.logAccess(entry, start)
+		return
+	}
+	if !p.allowDestination(w, dest) {
+		entry.Status, entry.ErrorClass = http.StatusForbidden, ErrorClassBlocked
+		p.logAccess(entry, start)
 		return
 	}
 
 	upstream, err := p.dialer.Dial("tcp", dest)
+	entry.DialMs = time.Since(start).Milliseconds()
+	if errors.Is(err, ErrRouteRejected) {
+		p.rejectRoute(w, dest)
+		entry.Status, entry.ErrorClass = http.StatusForbidden, ErrorClassBlocked
+		p.logAccess(entry, start)
+		return
+	}
 	if err != nil {
 		http.Error(w, "dial upstream: "+err.Error(), http.StatusBadGateway)
+		entry.Status, entry.ErrorClass, entry.Error = http.StatusBadGateway, classifyDialError(err), err.Error()
+		p.metrics.dialFailed(entry.ErrorClass)
+		p.logAccess(entry, start)
 		return
 	}
 
@@ -149,6 +360,8 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		_ = upstream.Close()
 		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		entry.Status, entry.ErrorClass = http.StatusInternalServerError, ErrorClassClient
+		p.logAccess(entry, start)
 		return
 	}
 
@@ -156,47 +369,191 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		_ = upstream.Close()
 		http.Error(w, "hijack: "+err.Error(), http.StatusInternalServerError)
+		entry.Status, entry.ErrorClass, entry.Error = http.StatusInternalServerError, ErrorClassClient, err.Error()
+		p.logAccess(entry, start)
 		return
 	}
 
 	_, _ = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	entry.Status = http.StatusOK
+	p.metrics.connectStarted()
+	defer p.metrics.connectFinished()
 
-	go func() {
-		_, _ = io.Copy(upstream, clientConn)
-		_ = upstream.Close()
-	}()
-
-	_, _ = io.Copy(clientConn, upstream)
-	_ = clientConn.Close()
+	entry.BytesIn, entry.BytesOut = p.conns.relay(dest, clientConn, upstream, p.metrics)
+	p.logAccess(entry, start)
 }
 
 func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	// Minimal forward-proxy support for absolute-form requests.
 	// Many clients will only use CONNECT for HTTPS; this covers plain HTTP too.
 
-	outReq := r.Clone(r.Context())
-	outReq.RequestURI = ""
-	outReq.Header.Del("Proxy-Connection")
+	start := time.Now()
+	entry := AccessLogEntry{Method: r.Method, Destination: requestDestination(r)}
+	if !p.allowDestination(w, entry.Destination) {
+		entry.Status, entry.ErrorClass = http.StatusForbidden, ErrorClassBlocked
+		p.logAccess(entry, start)
+		return
+	}
 
-	tr := &http.Transport{
-		Proxy:                 nil,
-		ForceAttemptHTTP2:     false,
-		ResponseHeaderTimeout: 30 * time.Second,
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return p.dialer.Dial(network, addr)
-		},
+	ctx, trace := withDialTrace(r.Context())
+	outReq := r.Clone(ctx)
+	outReq.RequestURI = ""
+	// The client's connection handling is not the upstream's: keep the
+	// pooled connection alive regardless of what the client asked for.
+	outReq.Close = false
+	removeHopHeaders(outReq.Header)
+	addVia(outReq.Header, r.ProtoMajor, r.ProtoMinor)
+	var body *countingReader
+	if outReq.Body != nil && outReq.Body != http.NoBody {
+		body = &countingReader{r: outReq.Body}
+		outReq.Body = body
 	}
 
-	resp, err := tr.RoundTrip(outReq)
+	resp, err := p.transport.RoundTrip(outReq)
+	dialMs, lastDialErr := trace.result()
+	entry.DialMs = dialMs
+	if body != nil {
+		entry.BytesIn = body.n.Load()
+	}
+	if err != nil && errors.Is(lastDialErr, ErrRouteRejected) {
+		p.rejectRoute(w, entry.Destination)
+		entry.Status, entry.ErrorClass = http.StatusForbidden, ErrorClassBlocked
+		p.logAccess(entry, start)
+		return
+	}
 	if err != nil {
 		http.Error(w, "round trip: "+err.Error(), http.StatusBadGateway)
+		entry.Status, entry.ErrorClass, entry.Error = http.StatusBadGateway, ErrorClassUpstream, err.Error()
+		if lastDialErr != nil {
+			entry.ErrorClass = classifyDialError(lastDialErr)
+			p.metrics.dialFailed(entry.ErrorClass)
+		}
+		p.logAccess(entry, start)
 		return
 	}
 	defer resp.Body.Close()
 
+	removeHopHeaders(resp.Header)
 	copyHeader(w.Header(), resp.Header)
+	addVia(w.Header(), resp.ProtoMajor, resp.ProtoMinor)
 	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	entry.Status = resp.StatusCode
+	entry.BytesOut, err = io.Copy(w, resp.Body)
+	if body != nil {
+		entry.BytesIn = body.n.Load()
+	}
+	if err != nil {
+		entry.ErrorClass, entry.Error = ErrorClassUpstream, err.Error()
+	}
+	p.metrics.addBytes(entry.BytesIn, entry.BytesOut)
+	p.logAccess(entry, start)
+}
+
+func (p *HTTPProxy) servePAC(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		http.Error(w, "the PAC file is only served to loopback clients", http.StatusForbidden)
+		return
+	}
+	p.mu.Lock()
+	ln := p.listener
+	p.mu.Unlock()
+	if ln == nil {
+		http.Error(w, "proxy not started", http.StatusServiceUnavailable)
+		return
+	}
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	_, _ = io.WriteString(w, GeneratePAC(net.JoinHostPort("127.0.0.1", port), p.pacBypass))
+}
+
+// logAccess stamps and records e when an access log is configured.
+func (p *HTTPProxy) logAccess(e AccessLogEntry, start time.Time) {
+	if p.accessLog == nil {
+		return
+	}
+	e.Time = start.UTC()
+	e.InstanceID = p.instanceID
+	e.DurationMs = time.Since(start).Milliseconds()
+	p.accessLog.Log(e)
+}
+
+type countingReader struct {
+	r io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingReader) Close() error { return c.r.Close() }
+
+func (p *HTTPProxy) authorized(r *http.Request) bool {
+	if p.authToken == "" {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(r.Header.Get("Proxy-Authorization")), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || user != AuthUsername {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(p.authToken)) == 1
+}
+
+// allowDestination writes a 403 and counts the request when dest is blocked.
+func (p *HTTPProxy) allowDestination(w http.ResponseWriter, dest string) bool {
+	if p.rules.Allowed(dest) {
+		return true
+	}
+	p.blocked.Add(1)
+	p.metrics.requestBlocked()
+	http.Error(w, "destination "+dest+" blocked by proxy rules", http.StatusForbidden)
+	return false
+}
+
+// accessDestination returns the destination a request targets, for logging.
+func accessDestination(r *http.Request) string {
+	if strings.EqualFold(r.Method, http.MethodConnect) {
+		return r.Host
+	}
+	return requestDestination(r)
+}
+
+// rejectRoute writes a 403 and counts the request when the routing table
+// rejected dest.
+func (p *HTTPProxy) rejectRoute(w http.ResponseWriter, dest string) {
+	p.blocked.Add(1)
+	p.metrics.requestBlocked()
+	http.Error(w, "destination "+dest+" rejected by routing table", http.StatusForbidden)
+}
+
+// requestDestination returns the host:port an absolute-form request targets.
+func requestDestination(r *http.Request) string {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if strings.EqualFold(r.URL.Scheme, "https") {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
 }
 
 func copyHeader(dst, src http.Header) {
@@ -119,7 +119,7 @@ type socks5Server struct {
 	wg sync.WaitGroup
 }
 
-func startSOCKS5Server(t *testing.T) *socks5Server {
+func startSOCKS5Server(t testing.TB) *socks5Server {
 	t.Helper()
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -0,0 +1,124 @@
+package localproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics holds the counters exported on /_claude_proxy/metrics. A single
+// Metrics may be shared between the HTTP proxy and its owning stack so that
+// tunnel restarts show up next to the traffic counters.
+type Metrics struct {
+	start time.Time
+
+	activeConnects atomic.Int64
+	totalConnects  atomic.Int64
+	bytesIn        atomic.Int64
+	bytesOut       atomic.Int64
+	blocked        atomic.Int64
+	tunnelRestarts atomic.Int64
+
+	mu         sync.Mutex
+	dialErrors map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{start: time.Now(), dialErrors: map[string]int64{}}
+}
+
+// TunnelRestarted records one restart of the SSH tunnel. It is a no-op on a
+// nil Metrics.
+func (m *Metrics) TunnelRestarted() {
+	if m != nil {
+		m.tunnelRestarts.Add(1)
+	}
+}
+
+// TunnelRestarts returns how many times the SSH tunnel was restarted.
+func (m *Metrics) TunnelRestarts() int64 { return m.tunnelRestarts.Load() }
+
+// ActiveConnects returns how many CONNECT tunnels are open. It is 0 on a nil
+// Metrics.
+func (m *Metrics) ActiveConnects() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.activeConnects.Load()
+}
+
+func (m *Metrics) connectStarted() {
+	m.activeConnects.Add(1)
+	m.totalConnects.Add(1)
+}
+
+func (m *Metrics) connectFinished() { m.activeConnects.Add(-1) }
+
+func (m *Metrics) addBytes(in, out int64) {
+	m.bytesIn.Add(in)
+	m.bytesOut.Add(out)
+}
+
+func (m *Metrics) requestBlocked() { m.blocked.Add(1) }
+
+func (m *Metrics) dialFailed(class string) {
+	m.mu.Lock()
+	m.dialErrors[class]++
+	m.mu.Unlock()
+}
+
+// WritePrometheus renders the metrics in the Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer, instanceID, version string) {
+	label := fmt.Sprintf(`instance=%q`, instanceID)
+
+	gauge := func(name, help string, v any) {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s{%s} %v\n", name, help, name, name, label, v)
+	}
+	counter := func(name, help string, v int64) {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s{%s} %d\n", name, help, name, name, label, v)
+	}
+
+	_, _ = fmt.Fprintf(w, "# HELP claude_proxy_build_info Build version of the running proxy.\n# TYPE claude_proxy_build_info gauge\nclaude_proxy_build_info{%s,version=%q} 1\n", label, version)
+	gauge("claude_proxy_uptime_seconds", "Seconds since the proxy started.", int64(time.Since(m.start).Seconds()))
+	gauge("claude_proxy_connects_active", "CONNECT tunnels currently open.", m.activeConnects.Load())
+	counter("claude_proxy_connects_total", "CONNECT tunnels established.", m.totalConnects.Load())
+	counter("claude_proxy_blocked_total", "Requests rejected by destination rules.", m.blocked.Load())
+	counter("claude_proxy_tunnel_restarts_total", "SSH tunnel restarts.", m.tunnelRestarts.Load())
+
+	_, _ = fmt.Fprintf(w, "# HELP claude_proxy_bytes_total Bytes proxied, by direction.\n# TYPE claude_proxy_bytes_total counter\n")
+	_, _ = fmt.Fprintf(w, "claude_proxy_bytes_total{%s,direction=\"in\"} %d\n", label, m.bytesIn.Load())
+	_, _ = fmt.Fprintf(w, "claude_proxy_bytes_total{%s,direction=\"out\"} %d\n", label, m.bytesOut.Load())
+
+	m.mu.Lock()
+	classes := make([]string, 0, len(m.dialErrors))
+	for c := range m.dialErrors {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	counts := make([]int64, len(classes))
+	for i, c := range classes {
+		counts[i] = m.dialErrors[c]
+	}
+	m.mu.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP claude_proxy_dial_errors_total Failed upstream dials, by error class.\n# TYPE claude_proxy_dial_errors_total counter\n")
+	for i, c := range classes {
+		_, _ = fmt.Fprintf(w, "claude_proxy_dial_errors_total{%s,class=%q} %d\n", label, c, counts[i])
+	}
+}
+
+// isLoopbackRequest reports whether r came from a loopback address.
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,124 @@
+package localproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxy_MetricsLoopbackOnly(t *testing.T) {
+	p := NewHTTPProxy(&recordingDialer{}, Options{InstanceID: "m-1"})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/_claude_proxy/metrics", nil)
+	req.RemoteAddr = "192.0.2.10:5555"
+	p.serveHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("non-loopback status=%d want 403", w.Code)
+	}
+
+	for _, remote := range []string{"127.0.0.1:5555", "[::1]:5555"} {
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/_claude_proxy/metrics", nil)
+		req.RemoteAddr = remote
+		p.serveHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s status=%d want 200", remote, w.Code)
+		}
+	}
+}
+
+func TestHTTPProxy_MetricsCountConnectsBytesAndDialErrors(t *testing.T) {
+	echoAddr, closeEcho := startTCPEchoServer(t)
+	defer closeEcho()
+
+	metrics := NewMetrics()
+	metrics.TunnelRestarted()
+	failing := "down.example:443"
+	dialer := dialerFunc(func(network, addr string) (net.Conn, error) {
+		if addr == failing {
+			return nil, &net.OpError{Op: "socks connect", Err: errors.New("unknown error host unreachable")}
+		}
+		return net.DialTimeout(network, addr, 2*time.Second)
+	})
+	p := NewHTTPProxy(dialer, Options{InstanceID: "m-1", Metrics: metrics, Version: "1.2.3"})
+	httpAddr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() { _ = p.Close(context.Background()) }()
+
+	c, err := net.DialTimeout("tcp", httpAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr, echoAddr)
+	br := bufio.NewReader(c)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(br, make([]byte, 4)); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if got := metrics.activeConnects.Load(); got != 1 {
+		t.Fatalf("active connects=%d want 1", got)
+	}
+	// Bytes count while the tunnel is still open, not only when it closes.
+	if in, out := metrics.bytesIn.Load(), metrics.bytesOut.Load(); in != 4 || out != 4 {
+		t.Fatalf("bytes of the open tunnel in=%d out=%d want 4 and 4", in, out)
+	}
+	_ = c.Close()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if metrics.activeConnects.Load() == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodConnect, "http://"+failing, nil)
+	req.Host = failing
+	p.serveHTTP(w, req)
+
+	resp, err := http.Get("http://" + httpAddr + "/_claude_proxy/metrics")
+	if err != nil {
+		t.Fatalf("GET metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	text := string(body)
+
+	for _, want := range []string{
+		`claude_proxy_build_info{instance="m-1",version="1.2.3"} 1`,
+		`claude_proxy_connects_active{instance="m-1"} 0`,
+		`claude_proxy_connects_total{instance="m-1"} 1`,
+		`claude_proxy_bytes_total{instance="m-1",direction="in"} 4`,
+		`claude_proxy_bytes_total{instance="m-1",direction="out"} 4`,
+		`claude_proxy_dial_errors_total{instance="m-1",class="target"} 1`,
+		`claude_proxy_tunnel_restarts_total{instance="m-1"} 1`,
+		`# TYPE claude_proxy_uptime_seconds gauge`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, text)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package localproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// PACPath is where HTTPProxy serves its proxy auto-config file.
+const PACPath = "/proxy.pac"
+
+// PACURL returns the URL of the PAC file served by a loopback listener.
+func PACURL(port int) string {
+	return fmt.Sprintf("http://127.0.0.1:%d%s", port, PACPath)
+}
+
+// GeneratePAC renders a proxy auto-config script that sends everything to
+// proxyAddr except destinations matching bypass. Bypass entries use
+// NO_PROXY syntax: "host" and ".host" match the host and its subdomains,
+// "*.host" only subdomains, "*" everything; IPv4 literals and CIDRs match
+// IP hosts. Port suffixes are ignored since PAC only sees host names.
+func GeneratePAC(proxyAddr string, bypass []string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  var h = host.toLowerCase();\n")
+	b.WriteString("  var ip = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(h);\n")
+
+	seen := map[string]bool{}
+	for _, raw := range bypass {
+		cond := pacCondition(raw)
+		if cond == "" || seen[cond] {
+			continue
+		}
+		seen[cond] = true
+		fmt.Fprintf(&b, "  if (%s) return \"DIRECT\";\n", cond)
+	}
+
+	fmt.Fprintf(&b, "  return \"PROXY %s\";\n", proxyAddr)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func pacCondition(raw string) string {
+	entry := strings.ToLower(strings.TrimSpace(raw))
+	if entry == "" {
+		return ""
+	}
+	if entry == "*" {
+		return "true"
+	}
+
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil || network.IP.To4() == nil {
+			return ""
+		}
+		return fmt.Sprintf("ip && isInNet(h, %q, %q)", network.IP.String(), net.IP(network.Mask).String())
+	}
+
+	host, _, err := splitRulePort(entry)
+	if err != nil || host == "" {
+		return ""
+	}
+	host = strings.TrimSuffix(host, ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return fmt.Sprintf("h == %q", ip.String())
+	}
+	switch {
+	case strings.HasPrefix(host, "*."):
+		return fmt.Sprintf("dnsDomainIs(h, %q)", host[1:])
+	case strings.HasPrefix(host, "."):
+		return fmt.Sprintf("(h == %q || dnsDomainIs(h, %q))", host[1:], host)
+	default:
+		return fmt.Sprintf("(h == %q || dnsDomainIs(h, %q))", host, "."+host)
+	}
+}
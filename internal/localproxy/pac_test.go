@@ -0,0 +1,102 @@
+package localproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	pac := GeneratePAC("127.0.0.1:18080", []string{
+		"localhost",
+		"127.0.0.1",
+		"::1",
+		".corp.example",
+		"*.npmjs.org",
+		"git.internal:22",
+		"10.0.0.0/8",
+		"fd00::/8",
+		"LOCALHOST",
+		"",
+	})
+
+	for _, want := range []string{
+		"function FindProxyForURL(url, host) {",
+		`if ((h == "localhost" || dnsDomainIs(h, ".localhost"))) return "DIRECT";`,
+		`if (h == "127.0.0.1") return "DIRECT";`,
+		`if (h == "::1") return "DIRECT";`,
+		`if ((h == "corp.example" || dnsDomainIs(h, ".corp.example"))) return "DIRECT";`,
+		`if (dnsDomainIs(h, ".npmjs.org")) return "DIRECT";`,
+		`if ((h == "git.internal" || dnsDomainIs(h, ".git.internal"))) return "DIRECT";`,
+		`if (ip && isInNet(h, "10.0.0.0", "255.0.0.0")) return "DIRECT";`,
+		`return "PROXY 127.0.0.1:18080";`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Fatalf("PAC missing %q:\n%s", want, pac)
+		}
+	}
+	if strings.Contains(pac, "fd00") {
+		t.Fatalf("IPv6 CIDRs cannot be expressed in PAC, got:\n%s", pac)
+	}
+	if strings.Count(pac, `"localhost"`) != 1 {
+		t.Fatalf("expected duplicate entries to collapse:\n%s", pac)
+	}
+	if got := GeneratePAC("127.0.0.1:1", []string{"*"}); !strings.Contains(got, `if (true) return "DIRECT";`) {
+		t.Fatalf("expected wildcard bypass, got:\n%s", got)
+	}
+}
+
+func TestHTTPProxy_ServesPAC(t *testing.T) {
+	rec := &recordingDialer{}
+	p := NewHTTPProxy(rec, Options{AuthToken: "tok", PACBypass: []string{"localhost"}})
+	httpAddr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() { _ = p.Close(context.Background()) }()
+
+	// Served without proxy credentials.
+	resp, err := http.Get("http://" + httpAddr + PACPath)
+	if err != nil {
+		t.Fatalf("GET pac: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d body=%s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+		t.Fatalf("Content-Type=%q", ct)
+	}
+	if !strings.Contains(string(body), `return "PROXY `+httpAddr+`";`) || !strings.Contains(string(body), `"localhost"`) {
+		t.Fatalf("unexpected PAC:\n%s", body)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, PACPath, nil)
+	req.RemoteAddr = "192.0.2.10:5555"
+	p.serveHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("non-loopback status=%d want 403", w.Code)
+	}
+
+	// Absolute-form requests for someone else's /proxy.pac still need auth.
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://example.com"+PACPath, nil)
+	p.serveHTTP(w, req)
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("proxied PAC request status=%d want 407", w.Code)
+	}
+	if len(rec.Addrs()) != 0 {
+		t.Fatalf("unexpected dials: %v", rec.Addrs())
+	}
+}
+
+func TestPACURL(t *testing.T) {
+	if got := PACURL(18080); got != "http://127.0.0.1:18080/proxy.pac" {
+		t.Fatalf("PACURL=%q", got)
+	}
+}
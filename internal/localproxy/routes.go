@@ -0,0 +1,142 @@
+package localproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Route actions.
+const (
+	RouteTunnel = "tunnel" // dial through the SSH tunnel / upstream proxy
+	RouteDirect = "direct" // dial the destination from this machine
+	RouteReject = "reject" // refuse the connection
+)
+
+// ErrRouteRejected is returned by a routing Dialer for destinations routed to
+// RouteReject.
+var ErrRouteRejected = errors.New("destination rejected by routing table")
+
+// RouteRule maps a destination pattern (same syntax as DestinationRules) to a
+// route action.
+type RouteRule struct {
+	Pattern string
+	Action  string
+}
+
+// RoutingTable picks a route action per destination. Rules are evaluated in
+// order and the first match wins; unmatched destinations use the default.
+type RoutingTable struct {
+	rules  []route
+	def    string
+	source []RouteRule
+}
+
+type route struct {
+	match  destinationRule
+	action string
+}
+
+// ParseRoutingTable compiles rules. An empty defaultAction means RouteTunnel.
+func ParseRoutingTable(rules []RouteRule, defaultAction string) (*RoutingTable, error) {
+	def, err := normalizeRouteAction(defaultAction)
+	if err != nil {
+		return nil, fmt.Errorf("default route: %w", err)
+	}
+	t := &RoutingTable{def: def}
+	for _, r := range rules {
+		action, err := normalizeRouteAction(r.Action)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", r.Pattern, err)
+		}
+		match, err := parseDestinationRule(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", r.Pattern, err)
+		}
+		t.rules = append(t.rules, route{match: match, action: action})
+		t.source = append(t.source, RouteRule{Pattern: strings.TrimSpace(r.Pattern), Action: action})
+	}
+	return t, nil
+}
+
+func normalizeRouteAction(a string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(a)) {
+	case "", RouteTunnel:
+		return RouteTunnel, nil
+	case RouteDirect:
+		return RouteDirect, nil
+	case RouteReject:
+		return RouteReject, nil
+	default:
+		return "", fmt.Errorf("unknown route action %q (want tunnel, direct or reject)", a)
+	}
+}
+
+// Route returns the action for addr ("host:port"). A nil table routes
+// everything through the tunnel.
+func (t *RoutingTable) Route(addr string) string {
+	if t == nil {
+		return RouteTunnel
+	}
+	host, port, ok := splitDestination(addr)
+	if !ok {
+		return t.def
+	}
+	for _, r := range t.rules {
+		if r.match.matches(host, port) {
+			return r.action
+		}
+	}
+	return t.def
+}
+
+// Rules returns the normalized rules in evaluation order.
+func (t *RoutingTable) Rules() []RouteRule {
+	if t == nil {
+		return nil
+	}
+	return append([]RouteRule(nil), t.source...)
+}
+
+// Default returns the action for destinations no rule matches.
+func (t *RoutingTable) Default() string {
+	if t == nil {
+		return RouteTunnel
+	}
+	return t.def
+}
+
+// NewRoutingDialer returns a Dialer that sends each destination to tunnel or
+// direct according to table, and fails with ErrRouteRejected for rejected
+// ones.
+func NewRoutingDialer(table *RoutingTable, tunnel, direct Dialer) Dialer {
+	return &routingDialer{table: table, tunnel: tunnel, direct: direct}
+}
+
+// NewDirectDialer dials destinations from this machine without any proxy.
+func NewDirectDialer(timeout time.Duration) Dialer {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	d := &net.Dialer{Timeout: timeout}
+	return dialerFunc(d.Dial)
+}
+
+type routingDialer struct {
+	table  *RoutingTable
+	tunnel Dialer
+	direct Dialer
+}
+
+func (d *routingDialer) Dial(network, addr string) (net.Conn, error) {
+	switch d.table.Route(addr) {
+	case RouteDirect:
+		return d.direct.Dial(network, addr)
+	case RouteReject:
+		return nil, fmt.Errorf("%s: %w", addr, ErrRouteRejected)
+	default:
+		return d.tunnel.Dial(network, addr)
+	}
+}
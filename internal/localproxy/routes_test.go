@@ -0,0 +1,120 @@
+package localproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutingTableRoute(t *testing.T) {
+	table, err := ParseRoutingTable([]RouteRule{
+		{Pattern: "api.anthropic.com:443", Action: "tunnel"},
+		{Pattern: "*.anthropic.com", Action: "reject"},
+		{Pattern: "registry.npmjs.org", Action: "DIRECT"},
+		{Pattern: "10.0.0.0/8", Action: "direct"},
+	}, "reject")
+	if err != nil {
+		t.Fatalf("ParseRoutingTable: %v", err)
+	}
+
+	cases := []struct {
+		addr string
+		want string
+	}{
+		{"api.anthropic.com:443", RouteTunnel},
+		{"statsig.anthropic.com:443", RouteReject},
+		{"registry.npmjs.org:443", RouteDirect},
+		{"10.1.2.3:22", RouteDirect},
+		{"example.com:443", RouteReject},
+		{"not-an-addr", RouteReject},
+	}
+	for _, tc := range cases {
+		if got := table.Route(tc.addr); got != tc.want {
+			t.Fatalf("Route(%q)=%q want %q", tc.addr, got, tc.want)
+		}
+	}
+
+	if got := table.Rules()[2]; got.Pattern != "registry.npmjs.org" || got.Action != RouteDirect {
+		t.Fatalf("expected normalized rule, got %#v", got)
+	}
+	if table.Default() != RouteReject {
+		t.Fatalf("Default=%q", table.Default())
+	}
+
+	var nilTable *RoutingTable
+	if nilTable.Route("example.com:443") != RouteTunnel || nilTable.Default() != RouteTunnel || nilTable.Rules() != nil {
+		t.Fatalf("nil table should route everything through the tunnel")
+	}
+}
+
+func TestParseRoutingTableRejectsInvalidRules(t *testing.T) {
+	if _, err := ParseRoutingTable([]RouteRule{{Pattern: "example.com", Action: "sideways"}}, ""); err == nil || !strings.Contains(err.Error(), "unknown route action") {
+		t.Fatalf("expected unknown action error, got %v", err)
+	}
+	if _, err := ParseRoutingTable([]RouteRule{{Pattern: "*bad*", Action: "direct"}}, ""); err == nil {
+		t.Fatalf("expected invalid pattern error")
+	}
+	if _, err := ParseRoutingTable(nil, "elsewhere"); err == nil || !strings.Contains(err.Error(), "default route") {
+		t.Fatalf("expected invalid default error, got %v", err)
+	}
+}
+
+func TestRoutingDialerPicksDialer(t *testing.T) {
+	table, err := ParseRoutingTable([]RouteRule{
+		{Pattern: "direct.example", Action: RouteDirect},
+		{Pattern: "reject.example", Action: RouteReject},
+	}, "")
+	if err != nil {
+		t.Fatalf("ParseRoutingTable: %v", err)
+	}
+	var used []string
+	mk := func(name string) Dialer {
+		return dialerFunc(func(network, addr string) (net.Conn, error) {
+			used = append(used, name+":"+addr)
+			return nil, errors.New("unused")
+		})
+	}
+	d := NewRoutingDialer(table, mk("tunnel"), mk("direct"))
+
+	_, _ = d.Dial("tcp", "direct.example:443")
+	_, _ = d.Dial("tcp", "other.example:443")
+	_, err = d.Dial("tcp", "reject.example:443")
+	if !errors.Is(err, ErrRouteRejected) {
+		t.Fatalf("expected ErrRouteRejected, got %v", err)
+	}
+	if strings.Join(used, ",") != "direct:direct.example:443,tunnel:other.example:443" {
+		t.Fatalf("unexpected dials: %v", used)
+	}
+	if got := classifyDialError(err); got != ErrorClassBlocked {
+		t.Fatalf("rejected route class=%q want %q", got, ErrorClassBlocked)
+	}
+}
+
+func TestHTTPProxy_RejectedRouteReturnsForbidden(t *testing.T) {
+	table, err := ParseRoutingTable(nil, RouteReject)
+	if err != nil {
+		t.Fatalf("ParseRoutingTable: %v", err)
+	}
+	p := NewHTTPProxy(NewRoutingDialer(table, &recordingDialer{}, &recordingDialer{}), Options{})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	req.Host = "example.com:443"
+	p.handleConnect(w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "rejected by routing table") {
+		t.Fatalf("CONNECT status=%d body=%q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	p.handleHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("HTTP status=%d want 403", w.Code)
+	}
+	if got := p.BlockedCount(); got != 2 {
+		t.Fatalf("BlockedCount=%d want 2", got)
+	}
+}
@@ -0,0 +1,186 @@
+package localproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DestinationRules decides which destinations the proxy may forward to.
+// Deny rules always win; when any allow rule is configured, a destination
+// must also match one of them.
+//
+// CIDR rules only match IP-literal destinations. Hostnames are not resolved
+// here: that would leak them to the local resolver, and the remote side
+// may resolve them differently; they need host or wildcard rules.
+type DestinationRules struct {
+	allow []destinationRule
+	deny  []destinationRule
+}
+
+type destinationRule struct {
+	host    string // lower-case hostname, "*.suffix" wildcard, or "*" for any host
+	network *net.IPNet
+	port    int // 0 matches any port
+}
+
+// ParseDestinationRules compiles allow/deny patterns.
+//
+// Supported patterns (each optionally followed by ":port" or ":*"):
+//
+//	api.anthropic.com   exact host
+//	*.anthropic.com     any subdomain (not the apex)
+//	*                   any host
+//	10.0.0.0/8          IPv4/IPv6 CIDR
+//	[::1]:443           bracketed IPv6 literal with port
+func ParseDestinationRules(allow, deny []string) (*DestinationRules, error) {
+	r := &DestinationRules{}
+	for _, raw := range allow {
+		rule, err := parseDestinationRule(raw)
+		if err != nil {
+			return nil, fmt.Errorf("allow rule %q: %w", raw, err)
+		}
+		r.allow = append(r.allow, rule)
+	}
+	for _, raw := range deny {
+		rule, err := parseDestinationRule(raw)
+		if err != nil {
+			return nil, fmt.Errorf("deny rule %q: %w", raw, err)
+		}
+		r.deny = append(r.deny, rule)
+	}
+	return r, nil
+}
+
+// Empty reports whether no rules are configured.
+func (r *DestinationRules) Empty() bool {
+	return r == nil || (len(r.allow) == 0 && len(r.deny) == 0)
+}
+
+// Allowed reports whether addr ("host:port") may be dialed.
+func (r *DestinationRules) Allowed(addr string) bool {
+	if r.Empty() {
+		return true
+	}
+	host, port, ok := splitDestination(addr)
+	if !ok {
+		return false
+	}
+	for _, rule := range r.deny {
+		if rule.matches(host, port) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, rule := range r.allow {
+		if rule.matches(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDestinationRule(raw string) (destinationRule, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return destinationRule{}, errors.New("empty pattern")
+	}
+	rule := destinationRule{}
+
+	hostPart, portPart, err := splitRulePort(s)
+	if err != nil {
+		return destinationRule{}, err
+	}
+	if portPart != "" && portPart != "*" {
+		port, err := strconv.Atoi(portPart)
+		if err != nil || port <= 0 || port > 65535 {
+			return destinationRule{}, fmt.Errorf("invalid port %q", portPart)
+		}
+		rule.port = port
+	}
+
+	if strings.Contains(hostPart, "/") {
+		_, network, err := net.ParseCIDR(hostPart)
+		if err != nil {
+			return destinationRule{}, fmt.Errorf("invalid CIDR: %w", err)
+		}
+		rule.network = network
+		return rule, nil
+	}
+
+	host := strings.ToLower(hostPart)
+	if strings.Contains(host, "*") && host != "*" {
+		if !strings.HasPrefix(host, "*.") || strings.Contains(host[2:], "*") || len(strings.TrimSuffix(host, ".")) <= 2 {
+			return destinationRule{}, errors.New("wildcard must be a leading \"*.\" label")
+		}
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" {
+		return destinationRule{}, errors.New("missing host")
+	}
+	rule.host = host
+	return rule, nil
+}
+
+// splitRulePort separates an optional ":port" suffix from a rule pattern
+// while leaving bare IPv6 literals and CIDRs intact.
+func splitRulePort(s string) (host, port string, err error) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return "", "", errors.New("missing closing bracket")
+		}
+		host = s[1:end]
+		rest := s[end+1:]
+		if rest == "" {
+			return host, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", errors.New("unexpected text after bracketed host")
+		}
+		return host, rest[1:], nil
+	}
+	if strings.Count(s, ":") == 1 {
+		host, port, _ = strings.Cut(s, ":")
+		return host, port, nil
+	}
+	return s, "", nil
+}
+
+func splitDestination(addr string) (string, int, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.ToLower(strings.TrimSuffix(host, ".")), port, true
+}
+
+func (r destinationRule) matches(host string, port int) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	}
+	switch {
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	default:
+		if ip := net.ParseIP(r.host); ip != nil {
+			other := net.ParseIP(host)
+			return other != nil && ip.Equal(other)
+		}
+		return host == r.host
+	}
+}
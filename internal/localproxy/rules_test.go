@@ -0,0 +1,61 @@
+package localproxy
+
+import "testing"
+
+func TestDestinationRulesAllowed(t *testing.T) {
+	cases := []struct {
+		name  string
+		allow []string
+		deny  []string
+		addr  string
+		want  bool
+	}{
+		{name: "no rules allow everything", addr: "example.com:443", want: true},
+		{name: "exact host", allow: []string{"api.anthropic.com"}, addr: "api.anthropic.com:443", want: true},
+		{name: "exact host is case insensitive", allow: []string{"API.Anthropic.com"}, addr: "api.anthropic.com:443", want: true},
+		{name: "not in allow list", allow: []string{"api.anthropic.com"}, addr: "example.com:443", want: false},
+		{name: "wildcard subdomain", allow: []string{"*.anthropic.com"}, addr: "statsig.anthropic.com:443", want: true},
+		{name: "wildcard excludes apex", allow: []string{"*.anthropic.com"}, addr: "anthropic.com:443", want: false},
+		{name: "wildcard excludes lookalike", allow: []string{"*.anthropic.com"}, addr: "evilanthropic.com:443", want: false},
+		{name: "port restriction matches", allow: []string{"*.anthropic.com:443"}, addr: "api.anthropic.com:443", want: true},
+		{name: "port restriction rejects", allow: []string{"*.anthropic.com:443"}, addr: "api.anthropic.com:80", want: false},
+		{name: "any host on port", allow: []string{"*:443"}, addr: "example.com:443", want: true},
+		{name: "any port wildcard", allow: []string{"example.com:*"}, addr: "example.com:8443", want: true},
+		{name: "cidr", allow: []string{"10.0.0.0/8"}, addr: "10.1.2.3:22", want: true},
+		{name: "cidr rejects hostnames", allow: []string{"10.0.0.0/8"}, addr: "ten.example:22", want: false},
+		{name: "deny cidr ignores hostnames", deny: []string{"10.0.0.0/8"}, addr: "localhost:443", want: true},
+		{name: "cidr with port", allow: []string{"10.0.0.0/8:22"}, addr: "10.1.2.3:80", want: false},
+		{name: "ipv6 cidr", allow: []string{"fd00::/8"}, addr: "[fd00::1]:443", want: true},
+		{name: "bracketed ipv6 with port", allow: []string{"[::1]:443"}, addr: "[::1]:443", want: true},
+		{name: "deny wins over allow", allow: []string{"*"}, deny: []string{"*.internal.example"}, addr: "git.internal.example:443", want: false},
+		{name: "deny only allows others", deny: []string{"169.254.0.0/16"}, addr: "example.com:443", want: true},
+		{name: "deny only blocks match", deny: []string{"169.254.0.0/16"}, addr: "169.254.169.254:80", want: false},
+		{name: "invalid destination is blocked", allow: []string{"*"}, addr: "no-port", want: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := ParseDestinationRules(tc.allow, tc.deny)
+			if err != nil {
+				t.Fatalf("ParseDestinationRules: %v", err)
+			}
+			if got := rules.Allowed(tc.addr); got != tc.want {
+				t.Fatalf("Allowed(%q)=%v want %v", tc.addr, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseDestinationRulesRejectsInvalidPatterns(t *testing.T) {
+	for _, raw := range []string{"", "  ", "host:0", "host:99999", "host:abc", "10.0.0.0/33", "a.*.com", "*.", "[::1", "[::1]x"} {
+		if _, err := ParseDestinationRules([]string{raw}, nil); err == nil {
+			t.Fatalf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestNilDestinationRulesAllowEverything(t *testing.T) {
+	var rules *DestinationRules
+	if !rules.Empty() || !rules.Allowed("example.com:443") {
+		t.Fatalf("expected nil rules to allow everything")
+	}
+}
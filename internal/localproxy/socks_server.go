@@ -0,0 +1,396 @@
+package localproxy
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	socksVersion5         = 0x05
+	socksAuthVersion      = 0x01
+	socksMethodNoAuth     = 0x00
+	socksMethodUserPass   = 0x02
+	socksMethodNoAccept   = 0xff
+	socksCmdConnect       = 0x01
+	socksAtypIPv4         = 0x01
+	socksAtypDomain       = 0x03
+	socksAtypIPv6         = 0x04
+	socksReplySucceeded   = 0x00
+	socksReplyNotAllowed  = 0x02
+	socksReplyHostUnreach = 0x04
+	socksReplyCmdUnsupp   = 0x07
+	socksReplyAtypUnsupp  = 0x08
+)
+
+// SOCKSServer is a local SOCKS5 (RFC 1928) front-end that forwards CONNECT
+// requests through the same Dialer as HTTPProxy. When an auth token is set,
+// clients must use username/password auth (RFC 1929) with AuthUsername.
+type SOCKSServer struct {
+	instanceID string
+	dialer     Dialer
+	rules      *DestinationRules
+	authToken  string
+	accessLog  AccessLogger
+	metrics    *Metrics
+	registry   *ConnRegistry
+
+	blocked atomic.Int64
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+type SOCKSOptions struct {
+	InstanceID string
+	// AuthToken is the password clients must present; empty disables auth.
+	AuthToken string
+	// Rules restricts which destinations may be dialed. Nil allows everything.
+	Rules *DestinationRules
+	// AccessLog, when set, receives one entry per tunnel.
+	AccessLog AccessLogger
+	// Metrics counts tunnels and bytes next to the HTTP proxy's. When nil,
+	// the server keeps its own.
+	Metrics *Metrics
+	// Conns tracks established tunnels; pass the HTTP proxy's registry so
+	// that its Drain covers them. When nil, the server keeps its own.
+	Conns *ConnRegistry
+}
+
+func NewSOCKSServer(d Dialer, opts SOCKSOptions) *SOCKSServer {
+	m := opts.Metrics
+	if m == nil {
+		m = NewMetrics()
+	}
+	registry := opts.Conns
+	if registry == nil {
+		registry = NewConnRegistry()
+	}
+	return &SOCKSServer{
+		instanceID: opts.InstanceID,
+		dialer:     d,
+		rules:      opts.Rules,
+		authToken:  opts.AuthToken,
+		accessLog:  opts.AccessLog,
+		metrics:    m,
+		registry:   registry,
+		conns:      map[net.Conn]struct{}{},
+	}
+}
+
+// SOCKSProxyURL returns the socks5h:// URL for a loopback SOCKS listener.
+func SOCKSProxyURL(port int, token string) string {
+	if token == "" {
+		return fmt.Sprintf("socks5h://127.0.0.1:%d", port)
+	}
+	u := ProxyURL(port, token)
+	return "socks5h" + u[len("http"):]
+}
+
+// BlockedCount returns how many requests were rejected by destination rules.
+func (s *SOCKSServer) BlockedCount() int64 { return s.blocked.Load() }
+
+func (s *SOCKSServer) Start(listenAddr string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return "", errors.New("socks server already started")
+	}
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return "", err
+	}
+	s.listener = ln
+
+	s.wg.Add(1)
+	go s.serve(ln)
+	return ln.Addr().String(), nil
+}
+
+// Conns returns the registry of established tunnels.
+func (s *SOCKSServer) Conns() *ConnRegistry { return s.registry }
+
+// CloseListener stops accepting connections and leaves open ones running,
+// for the connection registry to drain before Close.
+func (s *SOCKSServer) CloseListener() error {
+	s.mu.Lock()
+	ln := s.listener
+	s.mu.Unlock()
+	if ln == nil {
+		return nil
+	}
+	if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Close stops accepting connections and closes any that are still open.
+func (s *SOCKSServer) Close() error {
+	s.mu.Lock()
+	ln := s.listener
+	s.listener = nil
+	conns := make([]net.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	if ln == nil {
+		return nil
+	}
+	err := ln.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *SOCKSServer) serve(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(c) {
+			_ = c.Close()
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(c)
+			s.handleConn(c)
+		}()
+	}
+}
+
+func (s *SOCKSServer) track(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *SOCKSServer) untrack(c net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	_ = c.Close()
+}
+
+func (s *SOCKSServer) handleConn(c net.Conn) {
+	start := time.Now()
+	entry := AccessLogEntry{Method: SOCKSAccessMethod}
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := s.negotiate(c); err != nil {
+		if errors.Is(err, errSOCKSAuth) {
+			entry.ErrorClass = ErrorClassAuth
+			s.logAccess(entry, start)
+		}
+		return
+	}
+	dest, err := readSOCKSRequest(c)
+	if err != nil {
+		var re socksReplyError
+		if errors.As(err, &re) {
+			_ = writeSOCKSReply(c, byte(re))
+			entry.ErrorClass, entry.Error = ErrorClassClient, err.Error()
+			s.logAccess(entry, start)
+		}
+		return
+	}
+	entry.Destination = dest
+	if !s.rules.Allowed(dest) {
+		s.reject(c, entry, start)
+		return
+	}
+
+	upstream, err := s.dialer.Dial("tcp", dest)
+	entry.DialMs = time.Since(start).Milliseconds()
+	if errors.Is(err, ErrRouteRejected) {
+		s.reject(c, entry, start)
+		return
+	}
+	if err != nil {
+		_ = writeSOCKSReply(c, socksReplyHostUnreach)
+		entry.ErrorClass, entry.Error = classifyDialError(err), err.Error()
+		s.metrics.dialFailed(entry.ErrorClass)
+		s.logAccess(entry, start)
+		return
+	}
+	if err := writeSOCKSReply(c, socksReplySucceeded); err != nil {
+		_ = upstream.Close()
+		entry.ErrorClass, entry.Error = ErrorClassClient, err.Error()
+		s.logAccess(entry, start)
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	s.metrics.connectStarted()
+	defer s.metrics.connectFinished()
+	entry.BytesIn, entry.BytesOut = s.registry.relay(dest, c, upstream, s.metrics)
+	s.logAccess(entry, start)
+}
+
+// reject refuses a destination blocked by rules or the routing table.
+func (s *SOCKSServer) reject(c net.Conn, entry AccessLogEntry, start time.Time) {
+	s.blocked.Add(1)
+	s.metrics.requestBlocked()
+	_ = writeSOCKSReply(c, socksReplyNotAllowed)
+	entry.ErrorClass = ErrorClassBlocked
+	s.logAccess(entry, start)
+}
+
+// logAccess stamps and records e when an access log is configured.
+func (s *SOCKSServer) logAccess(e AccessLogEntry, start time.Time) {
+	if s.accessLog == nil {
+		return
+	}
+	e.Time = start.UTC()
+	e.InstanceID = s.instanceID
+	e.DurationMs = time.Since(start).Milliseconds()
+	s.accessLog.Log(e)
+}
+
+func (s *SOCKSServer) negotiate(c net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion5 {
+		return fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+
+	want := byte(socksMethodNoAuth)
+	if s.authToken != "" {
+		want = socksMethodUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		_, _ = c.Write([]byte{socksVersion5, socksMethodNoAccept})
+		return fmt.Errorf("%w: no acceptable auth method", errSOCKSAuth)
+	}
+	if _, err := c.Write([]byte{socksVersion5, want}); err != nil {
+		return err
+	}
+	if want == socksMethodNoAuth {
+		return nil
+	}
+
+	// RFC 1929 username/password sub-negotiation.
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksAuthVersion {
+		return fmt.Errorf("unsupported auth version %d", hdr[0])
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(c, plen[:]); err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return err
+	}
+	ok := string(user) == AuthUsername && subtle.ConstantTimeCompare(pass, []byte(s.authToken)) == 1
+	if !ok {
+		_, _ = c.Write([]byte{socksAuthVersion, 0x01})
+		return errSOCKSAuth
+	}
+	_, err := c.Write([]byte{socksAuthVersion, 0x00})
+	return err
+}
+
+var errSOCKSAuth = errors.New("socks authentication failed")
+
+type socksReplyError byte
+
+func (e socksReplyError) Error() string {
+	return "socks request rejected: code " + strconv.Itoa(int(e))
+}
+
+func readSOCKSRequest(c net.Conn) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion5 {
+		return "", fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	if hdr[1] != socksCmdConnect {
+		return "", socksReplyError(socksReplyCmdUnsupp)
+	}
+
+	var host string
+	switch hdr[3] {
+	case socksAtypIPv4:
+		var b [4]byte
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(b[:]).String()
+	case socksAtypIPv6:
+		var b [16]byte
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(b[:]).String()
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", socksReplyError(socksReplyAtypUnsupp)
+	}
+
+	var portBuf [2]byte
+	if _, err := io.ReadFull(c, portBuf[:]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(portBuf[:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func writeSOCKSReply(c net.Conn, code byte) error {
+	_, err := c.Write([]byte{socksVersion5, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,132 @@
+package localproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection pool defaults for plain-HTTP forwarding.
+const (
+	DefaultMaxIdleConns        = 64
+	DefaultMaxIdleConnsPerHost = 8
+	DefaultMaxConnsPerHost     = 32
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// viaPseudonym identifies this proxy in Via headers.
+const viaPseudonym = "claude-proxy"
+
+// newForwardTransport returns the keep-alive transport shared by all
+// plain-HTTP requests of one proxy, so repeated requests to a host reuse an
+// upstream connection instead of paying a fresh tunnel handshake each time.
+func newForwardTransport(d Dialer, opts Options) *http.Transport {
+	maxIdle := opts.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdleConns
+	}
+	perHost := opts.MaxIdleConnsPerHost
+	if perHost <= 0 {
+		perHost = DefaultMaxIdleConnsPerHost
+	}
+	if perHost > maxIdle {
+		perHost = maxIdle
+	}
+	// Each connection is a channel over the tunnel, so bursts queue for
+	// one instead of opening without bound.
+	maxPerHost := opts.MaxConnsPerHost
+	if maxPerHost <= 0 {
+		maxPerHost = DefaultMaxConnsPerHost
+	}
+	if perHost > maxPerHost {
+		perHost = maxPerHost
+	}
+	idle := opts.IdleConnTimeout
+	if idle <= 0 {
+		idle = DefaultIdleConnTimeout
+	}
+	return &http.Transport{
+		Proxy:                 nil,
+		ForceAttemptHTTP2:     false,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   perHost,
+		MaxConnsPerHost:       maxPerHost,
+		IdleConnTimeout:       idle,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			start := time.Now()
+			c, err := d.Dial(network, addr)
+			if t, ok := ctx.Value(dialTraceKey{}).(*dialTrace); ok {
+				t.record(time.Since(start), err)
+			}
+			return c, err
+		},
+	}
+}
+
+type dialTraceKey struct{}
+
+// dialTrace captures the dial a request triggered, if any. The transport
+// dials on its own goroutine and reused connections do not dial at all.
+type dialTrace struct {
+	mu  sync.Mutex
+	ms  int64
+	err error
+}
+
+func withDialTrace(ctx context.Context) (context.Context, *dialTrace) {
+	t := &dialTrace{}
+	return context.WithValue(ctx, dialTraceKey{}, t), t
+}
+
+func (t *dialTrace) record(d time.Duration, err error) {
+	t.mu.Lock()
+	t.ms, t.err = d.Milliseconds(), err
+	t.mu.Unlock()
+}
+
+func (t *dialTrace) result() (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ms, t.err
+}
+
+// hopHeaders are the connection-specific headers of RFC 7230 section 6.1,
+// plus the non-standard Proxy-Connection, which a proxy must not forward.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes hop-by-hop headers from h, including any header
+// the Connection header names.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// addVia appends this proxy to h's Via header for a message received with
+// the given protocol version.
+func addVia(h http.Header, major, minor int) {
+	h.Add("Via", fmt.Sprintf("%d.%d %s", major, minor, viaPseudonym))
+}
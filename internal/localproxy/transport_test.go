@@ -0,0 +1,233 @@
+package localproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Hop-Custom")
+	h.Set("X-Hop-Custom", "drop")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Proxy-Authorization", "Basic x")
+	h.Set("Te", "trailers")
+	h.Set("Upgrade", "websocket")
+	h.Set("X-End-To-End", "keep")
+
+	removeHopHeaders(h)
+
+	for _, name := range []string{"Connection", "X-Hop-Custom", "Keep-Alive", "Proxy-Authorization", "Te", "Upgrade"} {
+		if got := h.Get(name); got != "" {
+			t.Fatalf("%s=%q should be removed", name, got)
+		}
+	}
+	if got := h.Get("X-End-To-End"); got != "keep" {
+		t.Fatalf("X-End-To-End=%q want keep", got)
+	}
+}
+
+func TestHTTPProxy_HopByHopHeadersAndVia(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Hop"); got != "" {
+			t.Errorf("X-Hop named in Connection should be stripped, got %q", got)
+		}
+		if got := r.Header.Get("Keep-Alive"); got != "" {
+			t.Errorf("Keep-Alive should be stripped, got %q", got)
+		}
+		if got := r.Header.Get("X-Keep"); got != "yes" {
+			t.Errorf("X-Keep=%q want yes", got)
+		}
+		if got := r.Header.Values("Via"); len(got) != 2 || got[1] != "1.1 claude-proxy" {
+			t.Errorf("request Via=%q want previous hop plus 1.1 claude-proxy", got)
+		}
+		w.Header().Set("Connection", "X-Origin-Hop")
+		w.Header().Set("X-Origin-Hop", "drop")
+		w.Header().Set("X-Origin", "kept")
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	p := NewHTTPProxy(NewDirectDialer(time.Second), Options{})
+	defer func() { _ = p.Close(context.Background()) }()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "drop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("X-Keep", "yes")
+	req.Header.Set("Via", "1.0 upstream-cache")
+	p.handleHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Origin-Hop"); got != "" {
+		t.Fatalf("X-Origin-Hop should be stripped from the response, got %q", got)
+	}
+	if got := rec.Header().Get("X-Origin"); got != "kept" {
+		t.Fatalf("X-Origin=%q want kept", got)
+	}
+	if got := rec.Header().Get("Via"); got != "1.1 claude-proxy" {
+		t.Fatalf("response Via=%q want 1.1 claude-proxy", got)
+	}
+}
+
+func TestHTTPProxy_ReusesUpstreamConnections(t *testing.T) {
+	originAddr, closeOrigin := startHTTPOrigin(t)
+	defer closeOrigin()
+
+	socks := startSOCKS5Server(t)
+	defer socks.Close()
+	dialer, err := NewSOCKS5Dialer(socks.Addr(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewSOCKS5Dialer: %v", err)
+	}
+
+	p := NewHTTPProxy(dialer, Options{})
+	httpAddr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() { _ = p.Close(context.Background()) }()
+
+	// A fresh client connection per request: only the upstream side pools.
+	proxyURL, _ := url.Parse("http://" + httpAddr)
+	client := &http.Client{
+		Timeout:   3 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+	}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get("http://" + originAddr + "/hello")
+		if err != nil {
+			t.Fatalf("GET %d via proxy: %v", i, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if strings.TrimSpace(string(b)) != "hello" {
+			t.Fatalf("body=%q", string(b))
+		}
+	}
+
+	if got := socks.ConnectCount(); got != 1 {
+		t.Fatalf("expected 1 SOCKS handshake for 5 requests, got %d", got)
+	}
+}
+
+func TestHTTPProxy_CapsConnectionsPerHost(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 3)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		_, _ = io.WriteString(w, "hello\n")
+	}))
+	defer origin.Close()
+
+	var dials atomic.Int64
+	dialer := dialerFunc(func(network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return net.DialTimeout(network, addr, 2*time.Second)
+	})
+	p := NewHTTPProxy(dialer, Options{MaxConnsPerHost: 1})
+	httpAddr, err := p.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() { _ = p.Close(context.Background()) }()
+
+	proxyURL, _ := url.Parse("http://" + httpAddr)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(origin.URL + "/slow")
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}()
+	}
+
+	<-arrived
+	// The other requests wait for the one upstream connection.
+	time.Sleep(100 * time.Millisecond)
+	if got := dials.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream connection while one is busy, got %d", got)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("GET via proxy: %v", err)
+	}
+	if got := dials.Load(); got != 1 {
+		t.Fatalf("expected the queued requests to reuse the connection, got %d dials", got)
+	}
+}
+
+// BenchmarkHTTPProxyPlainHTTP compares plain-HTTP forwarding through an
+// in-process SOCKS stand-in with the pooled transport against one that
+// dials (and handshakes) per request, reporting handshakes per request.
+func BenchmarkHTTPProxyPlainHTTP(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		pooled bool
+	}{
+		{name: "pooled", pooled: true},
+		{name: "per-request", pooled: false},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			originAddr, closeOrigin := startHTTPOrigin(b)
+			defer closeOrigin()
+			socks := startSOCKS5Server(b)
+			defer socks.Close()
+			dialer, err := NewSOCKS5Dialer(socks.Addr(), 2*time.Second)
+			if err != nil {
+				b.Fatalf("NewSOCKS5Dialer: %v", err)
+			}
+
+			p := NewHTTPProxy(dialer, Options{})
+			p.transport.DisableKeepAlives = !bc.pooled
+			httpAddr, err := p.Start("127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("Start: %v", err)
+			}
+			defer func() { _ = p.Close(context.Background()) }()
+
+			proxyURL, _ := url.Parse("http://" + httpAddr)
+			client := &http.Client{Timeout: 3 * time.Second, Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			target := "http://" + originAddr + "/hello"
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get(target)
+				if err != nil {
+					b.Fatalf("GET via proxy: %v", err)
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(socks.ConnectCount())/float64(b.N), "handshakes/op")
+		})
+	}
+}
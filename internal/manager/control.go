@@ -0,0 +1,149 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+)
+
+// Commands understood by a daemon's control socket.
+const (
+	ControlStatus        = "status"
+	ControlReload        = "reload"
+	ControlRestartTunnel = "restart-tunnel"
+	ControlStop          = "stop"
+)
+
+// ControlRequest is one command sent to a daemon. Each connection carries a
+// single JSON request and a single JSON response.
+type ControlRequest struct {
+	Command string `json:"command"`
+}
+
+// ControlResponse answers a ControlRequest. Status is set for status and
+// reload, Drain for stop.
+type ControlResponse struct {
+	OK     bool                    `json:"ok"`
+	Error  string                  `json:"error,omitempty"`
+	Status *DaemonStatus           `json:"status,omitempty"`
+	Drain  *localproxy.DrainResult `json:"drain,omitempty"`
+}
+
+// DaemonStatus is what a daemon reports about itself.
+type DaemonStatus struct {
+	InstanceID string `json:"instanceId"`
+	Profile    string `json:"profile"`
+	// ActiveProfile is the failover profile carrying traffic of the first
+	// tunnel, empty while it is Profile itself.
+	ActiveProfile   string    `json:"activeProfile,omitempty"`
+	PID             int       `json:"pid"`
+	HTTPPort        int       `json:"httpPort"`
+	SOCKSListenPort int       `json:"socksListenPort,omitempty"`
+	StartedAt       time.Time `json:"startedAt"`
+	Failovers       int       `json:"failovers"`
+	Reloads         int       `json:"reloads"`
+	// ActiveConnects counts CONNECT tunnels open through the listener.
+	ActiveConnects int64                       `json:"activeConnects"`
+	Tunnels        []localproxy.UpstreamStatus `json:"tunnels"`
+}
+
+// maxControlSocketPath keeps socket paths within the smallest sun_path
+// (104 bytes on macOS, including the terminating NUL).
+const maxControlSocketPath = 100
+
+// ControlSocketPath is where the daemon of instanceID listens: next to its
+// log under the config dir, or, when that path is too long for a unix
+// socket, in a private directory under the temp dir with a name derived
+// from it.
+func ControlSocketPath(store *config.Store, instanceID string) string {
+	p := filepath.Join(filepath.Dir(store.Path()), "instances", instanceID+".sock")
+	if len(p) <= maxControlSocketPath {
+		return p
+	}
+	sum := sha256.Sum256([]byte(p))
+	return filepath.Join(controlTempDir(), hex.EncodeToString(sum[:8])+".sock")
+}
+
+// ListenControl creates the control socket at path, replacing a stale one
+// left by a daemon that died. It fails when another daemon still answers
+// on it. The socket's directory is made private to the current user first.
+func ListenControl(path string) (net.Listener, error) {
+	if err := privateSocketDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.DialTimeout("unix", path, 500*time.Millisecond); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("control socket %s is in use", path)
+		}
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Chmod(path, 0o600)
+	return ln, nil
+}
+
+// ServeControl answers requests on ln with handle until ln is closed, then
+// waits for the answers in flight so that a daemon exiting on stop still
+// replies. Requests are served concurrently; handle must be safe for that.
+func ServeControl(ln net.Listener, handle func(ControlRequest) ControlResponse) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.Close()
+			var req ControlRequest
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := json.NewDecoder(c).Decode(&req); err != nil {
+				_ = json.NewEncoder(c).Encode(ControlResponse{Error: "invalid request: " + err.Error()})
+				return
+			}
+			_ = c.SetReadDeadline(time.Time{})
+			_ = json.NewEncoder(c).Encode(handle(req))
+		}()
+	}
+}
+
+// CallControl sends command to the daemon listening on path and waits up to
+// timeout for its answer. A daemon-side failure is returned as an error.
+func CallControl(path, command string, timeout time.Duration) (ControlResponse, error) {
+	var resp ControlResponse
+	c, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return resp, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(timeout))
+	if err := json.NewEncoder(c).Encode(ControlRequest{Command: command}); err != nil {
+		return resp, err
+	}
+	if err := json.NewDecoder(c).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("read control response: %w", err)
+	}
+	if !resp.OK {
+		if resp.Error == "" {
+			return resp, errors.New("control command failed")
+		}
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+)
+
+// shortSocketDir keeps test socket paths within the unix socket limit.
+func shortSocketDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatalf("mkdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	path := filepath.Join(shortSocketDir(t), "inst.sock")
+	ln, err := ListenControl(path)
+	if err != nil {
+		t.Fatalf("ListenControl: %v", err)
+	}
+	defer ln.Close()
+	go ServeControl(ln, func(req ControlRequest) ControlResponse {
+		switch req.Command {
+		case ControlStatus:
+			return ControlResponse{OK: true, Status: &DaemonStatus{InstanceID: "inst-1", Profile: "work"}}
+		default:
+			return ControlResponse{Error: "unknown command " + req.Command}
+		}
+	})
+
+	resp, err := CallControl(path, ControlStatus, time.Second)
+	if err != nil || resp.Status == nil || resp.Status.Profile != "work" {
+		t.Fatalf("CallControl(status)=%+v, %v", resp, err)
+	}
+	if _, err := CallControl(path, "dance", time.Second); err == nil || err.Error() != "unknown command dance" {
+		t.Fatalf("expected the daemon's error, got %v", err)
+	}
+
+	// A second daemon cannot take over a socket that still answers.
+	if _, err := ListenControl(path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expected an in-use error, got %v", err)
+	}
+}
+
+func TestListenControlReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(shortSocketDir(t), "inst.sock")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatalf("write stale socket: %v", err)
+	}
+	ln, err := ListenControl(path)
+	if err != nil {
+		t.Fatalf("ListenControl over a stale socket: %v", err)
+	}
+	_ = ln.Close()
+
+	if _, err := CallControl(filepath.Join(filepath.Dir(path), "missing.sock"), ControlStatus, time.Second); err == nil {
+		t.Fatalf("expected an error without a daemon")
+	}
+}
+
+func TestControlSocketPath(t *testing.T) {
+	store, err := config.NewStore(filepath.Join("/cfg", "config.json"))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if got := ControlSocketPath(store, "abc"); got != filepath.Join("/cfg", "instances", "abc.sock") {
+		t.Fatalf("ControlSocketPath=%q", got)
+	}
+
+	long, err := config.NewStore(filepath.Join("/"+strings.Repeat("d", 120), "config.json"))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	got := ControlSocketPath(long, "abc")
+	if len(got) > maxControlSocketPath || filepath.Dir(got) != controlTempDir() {
+		t.Fatalf("expected a short temp-dir socket, got %q", got)
+	}
+	if again := ControlSocketPath(long, "abc"); again != got {
+		t.Fatalf("ControlSocketPath is not stable: %q vs %q", got, again)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// controlTempDir holds the control sockets whose path under the config dir
+// is too long, in a directory of the current user's own.
+func controlTempDir() string {
+	return filepath.Join(os.TempDir(), "claude-proxy-"+strconv.Itoa(os.Getuid()))
+}
+
+// privateSocketDir makes sure dir is a directory that only the current user
+// can enter, so that nobody else reaches a socket created in it before its
+// mode is tightened.
+func privateSocketDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("control socket dir %s is not a directory owned by the current user", dir)
+	}
+	if fi.Mode().Perm()&0o077 != 0 {
+		return os.Chmod(dir, 0o700)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlMakesTheSocketDirPrivate(t *testing.T) {
+	dir := filepath.Join(shortSocketDir(t), "instances")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	ln, err := ListenControl(filepath.Join(dir, "inst.sock"))
+	if err != nil {
+		t.Fatalf("ListenControl: %v", err)
+	}
+	_ = ln.Close()
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o700 {
+		t.Fatalf("socket dir mode=%o want 700", perm)
+	}
+
+	link := filepath.Join(filepath.Dir(dir), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if _, err := ListenControl(filepath.Join(link, "inst.sock")); err == nil {
+		t.Fatalf("expected a symlinked socket dir to be refused")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package manager
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// controlTempDir holds the control sockets whose path under the config dir
+// is too long; the temp dir is already per user on Windows.
+func controlTempDir() string {
+	return filepath.Join(os.TempDir(), "claude-proxy")
+}
+
+func privateSocketDir(dir string) error {
+	return os.MkdirAll(dir, 0o700)
+}
@@ -1,16 +1,30 @@
 package manager
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
 )
 
 type HealthClient struct {
 	Timeout time.Duration
+
+	// ProbeTimeout bounds ProbeThroughProxy (default 5s), which crosses the
+	// tunnel and so takes longer than a local check.
+	ProbeTimeout time.Duration
+	// TLSConfig overrides the TLS settings of TLS probes; the ServerName
+	// defaults to the target host.
+	TLSConfig *tls.Config
 }
 
 type healthResponse struct {
@@ -19,6 +33,18 @@ type healthResponse struct {
 }
 
 func (c HealthClient) CheckHTTPProxy(port int, expectedInstanceID string) error {
+	return c.CheckHTTPProxyWithToken(port, expectedInstanceID, "")
+}
+
+// CheckInstance checks a recorded instance, authenticating when it has a
+// listener token.
+func (c HealthClient) CheckInstance(inst config.Instance) error {
+	return c.CheckHTTPProxyWithToken(inst.HTTPPort, inst.ID, inst.ProxyToken)
+}
+
+// CheckHTTPProxyWithToken is CheckHTTPProxy for listeners that require
+// Proxy-Authorization; an empty token sends no credentials.
+func (c HealthClient) CheckHTTPProxyWithToken(port int, expectedInstanceID, token string) error {
 	if port <= 0 || port > 65535 {
 		return fmt.Errorf("invalid http port %d", port)
 	}
@@ -37,7 +63,14 @@ func (c HealthClient) CheckHTTPProxy(port int, expectedInstanceID string) error
 		},
 	}
 
-	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/_claude_proxy/health", port))
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/_claude_proxy/health", port), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Proxy-Authorization", localproxy.AuthorizationHeader(token))
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -59,3 +92,126 @@ func (c HealthClient) CheckHTTPProxy(port int, expectedInstanceID string) error
 	}
 	return nil
 }
+
+// ProbeTarget is where an end-to-end probe connects through the proxy.
+type ProbeTarget struct {
+	// Addr is host:port.
+	Addr string
+	// TLS completes a TLS handshake after connecting.
+	TLS bool
+}
+
+// ParseProbeTarget parses "tls://host:port", "tcp://host:port" or a bare
+// "host:port" (TCP).
+func ParseProbeTarget(s string) (ProbeTarget, error) {
+	raw := strings.TrimSpace(s)
+	scheme, addr, ok := strings.Cut(raw, "://")
+	if !ok {
+		scheme, addr = "tcp", raw
+	}
+	var t ProbeTarget
+	switch strings.ToLower(scheme) {
+	case "tcp":
+	case "tls":
+		t.TLS = true
+	default:
+		return t, fmt.Errorf("invalid health probe %q: scheme must be tcp or tls", s)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return t, fmt.Errorf("invalid health probe %q: want host:port", s)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return t, fmt.Errorf("invalid health probe %q: bad port", s)
+	}
+	t.Addr = addr
+	return t, nil
+}
+
+func (t ProbeTarget) String() string {
+	if t.TLS {
+		return "tls://" + t.Addr
+	}
+	return "tcp://" + t.Addr
+}
+
+// DialThroughProxy opens a CONNECT tunnel to addr through the local
+// listener on port, bounding the handshake by ProbeTimeout.
+func (c HealthClient) DialThroughProxy(port int, token, addr string) (net.Conn, error) {
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid http port %d", port)
+	}
+	timeout := c.probeTimeout()
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if token != "" {
+		req += "Proxy-Authorization: " + localproxy.AuthorizationHeader(token) + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// The target does not speak before the client, so nothing past the
+	// response is buffered.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %w", addr, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (c HealthClient) probeTimeout() time.Duration {
+	if c.ProbeTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return c.ProbeTimeout
+}
+
+// ProbeThroughProxy opens a CONNECT tunnel to target through the local
+// listener on port and, for TLS targets, completes a TLS handshake. Unlike
+// the health endpoint it fails when the listener is up but the tunnel
+// behind it no longer forwards traffic.
+func (c HealthClient) ProbeThroughProxy(port int, token string, target ProbeTarget) error {
+	return c.Probe(func(addr string) (net.Conn, error) {
+		return c.DialThroughProxy(port, token, addr)
+	}, target)
+}
+
+// Probe connects to target with dial and, for TLS targets, completes a TLS
+// handshake within ProbeTimeout.
+func (c HealthClient) Probe(dial func(addr string) (net.Conn, error), target ProbeTarget) error {
+	deadline := time.Now().Add(c.probeTimeout())
+	conn, err := dial(target.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !target.TLS {
+		return nil
+	}
+
+	_ = conn.SetDeadline(deadline)
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(target.Addr)
+	}
+	if err := tls.Client(conn, cfg).Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake with %s: %w", target.Addr, err)
+	}
+	return nil
+}
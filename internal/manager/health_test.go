@@ -2,11 +2,20 @@ package manager
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
 )
 
 func TestHealthClient_CheckHTTPProxy(t *testing.T) {
@@ -115,3 +124,114 @@ func startCustomHealthServer(t *testing.T, status int, body string) (port int, c
 		_ = ln.Close()
 	}
 }
+
+func TestHealthClient_CheckInstanceSendsProxyAuthorization(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_claude_proxy/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != localproxy.AuthorizationHeader("tok") {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "instanceId": "inst-auth"})
+	})
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	hc := HealthClient{Timeout: time.Second}
+	if err := hc.CheckHTTPProxy(port, "inst-auth"); err == nil {
+		t.Fatalf("expected unauthenticated check to fail")
+	}
+	inst := config.Instance{ID: "inst-auth", HTTPPort: port, ProxyToken: "tok"}
+	if err := hc.CheckInstance(inst); err != nil {
+		t.Fatalf("CheckInstance: %v", err)
+	}
+}
+
+// blackHoleDialer never reaches the target, like a tunnel whose SSH side
+// hangs while the local listener still answers.
+type blackHoleDialer struct{ release chan struct{} }
+
+func (d blackHoleDialer) Dial(string, string) (net.Conn, error) {
+	<-d.release
+	return nil, errors.New("released")
+}
+
+func startProbeProxy(t *testing.T, d localproxy.Dialer, token string) int {
+	t.Helper()
+	hp := localproxy.NewHTTPProxy(d, localproxy.Options{InstanceID: "inst-1", AuthToken: token})
+	addr, err := hp.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = hp.Close(context.Background()) })
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func TestHealthClient_ProbeThroughProxy(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer target.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+	targetAddr := strings.TrimPrefix(target.URL, "https://")
+
+	port := startProbeProxy(t, localproxy.NewDirectDialer(time.Second), "tok")
+	hc := HealthClient{ProbeTimeout: 2 * time.Second, TLSConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+
+	if err := hc.ProbeThroughProxy(port, "tok", ProbeTarget{Addr: targetAddr}); err != nil {
+		t.Fatalf("TCP probe: %v", err)
+	}
+	if err := hc.ProbeThroughProxy(port, "tok", ProbeTarget{Addr: targetAddr, TLS: true}); err != nil {
+		t.Fatalf("TLS probe: %v", err)
+	}
+	if err := hc.ProbeThroughProxy(port, "", ProbeTarget{Addr: targetAddr}); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected the listener to reject the probe without credentials, got %v", err)
+	}
+	if err := (HealthClient{ProbeTimeout: 2 * time.Second}).ProbeThroughProxy(port, "tok", ProbeTarget{Addr: targetAddr, TLS: true}); err == nil || !strings.Contains(err.Error(), "TLS handshake") {
+		t.Fatalf("expected an untrusted certificate to fail the TLS probe, got %v", err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	hung := startProbeProxy(t, blackHoleDialer{release: release}, "")
+	start := time.Now()
+	err := HealthClient{ProbeTimeout: 200 * time.Millisecond}.ProbeThroughProxy(hung, "", ProbeTarget{Addr: targetAddr})
+	if err == nil {
+		t.Fatalf("expected the probe through a hung tunnel to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("probe took %s despite its timeout", elapsed)
+	}
+}
+
+func TestParseProbeTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ProbeTarget
+		ok   bool
+	}{
+		{in: "api.anthropic.com:443", want: ProbeTarget{Addr: "api.anthropic.com:443"}, ok: true},
+		{in: "tcp://10.0.0.1:22", want: ProbeTarget{Addr: "10.0.0.1:22"}, ok: true},
+		{in: "TLS://[::1]:8443", want: ProbeTarget{Addr: "[::1]:8443", TLS: true}, ok: true},
+		{in: "https://example.com:443"},
+		{in: "example.com"},
+		{in: ":443"},
+		{in: "example.com:0"},
+	}
+	for _, tt := range tests {
+		got, err := ParseProbeTarget(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("ParseProbeTarget(%q)=%+v, %v want %+v ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+	if s := (ProbeTarget{Addr: "h:1", TLS: true}).String(); s != "tls://h:1" {
+		t.Errorf("String()=%q", s)
+	}
+}
@@ -1,34 +1,214 @@
 package manager
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
 )
 
+// The runtime registry keeps one JSON state file per running instance in
+// RuntimeDir, so daemons heartbeat without rewriting the user's config.
+// Writes are atomic renames, so readers need no lock; writers serialize
+// on a lock file in the directory.
+
+// StaleAfter is how long an instance may go without a heartbeat (sent
+// every 10 seconds) before it is considered stale even if its PID is alive,
+// which then most likely belongs to another process.
+const StaleAfter = 2 * time.Minute
+
+// registryMu serializes this process's writers before they take the
+// cross-process lock.
+var registryMu sync.Mutex
+
+// RuntimeDir is the registry directory of store's config.
+func RuntimeDir(store *config.Store) string {
+	return filepath.Join(filepath.Dir(store.Path()), "run")
+}
+
+func instanceStatePath(store *config.Store, instanceID string) string {
+	return filepath.Join(RuntimeDir(store), instanceID+".json")
+}
+
 func RecordInstance(store *config.Store, inst config.Instance) error {
-	return store.Update(func(cfg *config.Config) error {
-		cfg.UpsertInstance(inst)
-		return nil
+	return updateRegistry(store, func() error {
+		return writeInstanceState(store, inst)
 	})
 }
 
 func RemoveInstance(store *config.Store, instanceID string) error {
-	return store.Update(func(cfg *config.Config) error {
-		cfg.RemoveInstance(instanceID)
+	if err := migrateLegacyInstances(store); err != nil {
+		return err
+	}
+	return updateRegistry(store, func() error {
+		if err := os.Remove(instanceStatePath(store, instanceID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 		return nil
 	})
 }
 
 func Heartbeat(store *config.Store, instanceID string, now time.Time) error {
-	return store.Update(func(cfg *config.Config) error {
-		for i := range cfg.Instances {
-			if cfg.Instances[i].ID == instanceID {
-				cfg.Instances[i].LastSeenAt = now
+	return UpdateInstance(store, instanceID, func(inst *config.Instance) {
+		inst.LastSeenAt = now
+	})
+}
+
+// RecordFailover stores which profile of the instance's failover group is
+// active and how many switches happened so far.
+func RecordFailover(store *config.Store, instanceID, activeProfileID string, failovers int) error {
+	return UpdateInstance(store, instanceID, func(inst *config.Instance) {
+		inst.ActiveProfileID = activeProfileID
+		if activeProfileID == inst.ProfileID {
+			inst.ActiveProfileID = ""
+		}
+		inst.Failovers = failovers
+	})
+}
+
+// LoadInstance returns the registered instance with the given id.
+func LoadInstance(store *config.Store, instanceID string) (config.Instance, bool, error) {
+	if err := migrateLegacyInstances(store); err != nil {
+		return config.Instance{}, false, err
+	}
+	inst, err := readInstanceState(instanceStatePath(store, instanceID))
+	if errors.Is(err, os.ErrNotExist) {
+		return config.Instance{}, false, nil
+	}
+	if err != nil {
+		return config.Instance{}, false, err
+	}
+	return inst, true, nil
+}
+
+// ListInstances returns every registered instance, oldest first, after
+// moving any left in the config's legacy Instances list into the registry.
+// Unreadable state files are skipped. Stale instances are included; see
+// IsInstanceDead.
+func ListInstances(store *config.Store) ([]config.Instance, error) {
+	if err := migrateLegacyInstances(store); err != nil {
+		return nil, err
+	}
+	return readInstances(store)
+}
+
+// readInstances reads every state file of the registry, oldest first.
+func readInstances(store *config.Store) ([]config.Instance, error) {
+	paths, err := filepath.Glob(filepath.Join(RuntimeDir(store), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]config.Instance, 0, len(paths))
+	for _, p := range paths {
+		inst, err := readInstanceState(p)
+		if err != nil {
+			continue
+		}
+		out = append(out, inst)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if !out[i].StartedAt.Equal(out[j].StartedAt) {
+			return out[i].StartedAt.Before(out[j].StartedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// IsInstanceDead reports whether inst's daemon is gone: its PID is not
+// running, or it has not sent a heartbeat for StaleAfter. Instances that
+// have not recorded a PID yet are still starting.
+func IsInstanceDead(inst config.Instance, now time.Time) bool {
+	if inst.DaemonPID <= 0 {
+		return IsInstanceStale(inst, now, StaleAfter)
+	}
+	return !procIsAlive(inst.DaemonPID) || IsInstanceStale(inst, now, StaleAfter)
+}
+
+// migrateLegacyInstances moves instances from the config's Instances list
+// into the registry, keeping state files that already exist, and clears
+// the list. It runs once per store; see config.Store.MigrateLegacyInstances.
+func migrateLegacyInstances(store *config.Store) error {
+	return store.MigrateLegacyInstances(func() error {
+		return updateRegistry(store, func() error {
+			return store.Update(func(cfg *config.Config) error {
+				for _, inst := range cfg.Instances {
+					if strings.TrimSpace(inst.ID) == "" {
+						continue
+					}
+					if _, err := os.Stat(instanceStatePath(store, inst.ID)); err == nil {
+						continue
+					}
+					if err := writeInstanceState(store, inst); err != nil {
+						return fmt.Errorf("migrate instance %q: %w", inst.ID, err)
+					}
+				}
+				cfg.Instances = nil
 				return nil
-			}
+			})
+		})
+	})
+}
+
+// UpdateInstance applies fn to the registered instance under the registry
+// lock, so concurrent updates from the daemon and the CLI do not overwrite
+// each other.
+func UpdateInstance(store *config.Store, instanceID string, fn func(*config.Instance)) error {
+	return updateRegistry(store, func() error {
+		inst, err := readInstanceState(instanceStatePath(store, instanceID))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("instance %q not found", instanceID)
+		}
+		if err != nil {
+			return err
 		}
-		return fmt.Errorf("instance %q not found", instanceID)
+		fn(&inst)
+		return writeInstanceState(store, inst)
 	})
 }
+
+// updateRegistry runs fn holding the registry's write lock.
+func updateRegistry(store *config.Store, fn func() error) error {
+	dir := RuntimeDir(store)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create runtime dir: %w", err)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	release, err := config.LockFile(filepath.Join(dir, "registry"))
+	if err != nil {
+		return fmt.Errorf("lock instance registry: %w", err)
+	}
+	defer release()
+	return fn()
+}
+
+func readInstanceState(path string) (config.Instance, error) {
+	var inst config.Instance
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return inst, err
+	}
+	if err := json.Unmarshal(b, &inst); err != nil {
+		return inst, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return inst, nil
+}
+
+func writeInstanceState(store *config.Store, inst config.Instance) error {
+	if strings.TrimSpace(inst.ID) == "" || strings.ContainsAny(inst.ID, `/\`) {
+		return fmt.Errorf("invalid instance id %q", inst.ID)
+	}
+	b, err := json.MarshalIndent(inst, "", "  ")
+	if err != nil {
+		return err
+	}
+	return config.WriteFileAtomic(instanceStatePath(store, inst.ID), append(b, '\n'), 0o600)
+}
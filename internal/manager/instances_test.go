@@ -1,6 +1,8 @@
 package manager
 
 import (
+	"encoding/json"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -8,12 +10,17 @@ import (
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
 )
 
-func TestInstanceRecordHeartbeatRemove(t *testing.T) {
-	dir := t.TempDir()
-	store, err := config.NewStore(filepath.Join(dir, "config.json"))
+func newRegistryStore(t *testing.T) *config.Store {
+	t.Helper()
+	store, err := config.NewStore(filepath.Join(t.TempDir(), "config.json"))
 	if err != nil {
 		t.Fatalf("NewStore: %v", err)
 	}
+	return store
+}
+
+func TestInstanceRecordHeartbeatRemove(t *testing.T) {
+	store := newRegistryStore(t)
 
 	inst := config.Instance{
 		ID:         "i1",
@@ -29,39 +36,47 @@ func TestInstanceRecordHeartbeatRemove(t *testing.T) {
 		t.Fatalf("RecordInstance: %v", err)
 	}
 
-	cfg, err := store.Load()
+	got, err := ListInstances(store)
 	if err != nil {
-		t.Fatalf("Load: %v", err)
+		t.Fatalf("ListInstances: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != "i1" || got[0].HTTPPort != 8080 {
+		t.Fatalf("Instances=%#v", got)
 	}
-	if len(cfg.Instances) != 1 || cfg.Instances[0].ID != "i1" {
-		t.Fatalf("Instances=%#v", cfg.Instances)
+	if _, err := os.Stat(filepath.Join(RuntimeDir(store), "i1.json")); err != nil {
+		t.Fatalf("expected a state file: %v", err)
 	}
 
+	// Heartbeats never touch the user's config.
 	now := time.Now()
 	if err := Heartbeat(store, "i1", now); err != nil {
 		t.Fatalf("Heartbeat: %v", err)
 	}
+	if _, err := os.Stat(store.Path()); !os.IsNotExist(err) {
+		t.Fatalf("expected no config file to be written, stat err=%v", err)
+	}
 
-	cfg, _ = store.Load()
-	if !cfg.Instances[0].LastSeenAt.Equal(now) {
-		t.Fatalf("LastSeenAt=%s want %s", cfg.Instances[0].LastSeenAt, now)
+	loaded, ok, err := LoadInstance(store, "i1")
+	if err != nil || !ok {
+		t.Fatalf("LoadInstance=%v, %v", ok, err)
+	}
+	if !loaded.LastSeenAt.Equal(now) {
+		t.Fatalf("LastSeenAt=%s want %s", loaded.LastSeenAt, now)
 	}
 
 	if err := RemoveInstance(store, "i1"); err != nil {
 		t.Fatalf("RemoveInstance: %v", err)
 	}
-	cfg, _ = store.Load()
-	if len(cfg.Instances) != 0 {
-		t.Fatalf("expected empty instances, got %#v", cfg.Instances)
+	if got, _ := ListInstances(store); len(got) != 0 {
+		t.Fatalf("expected empty instances, got %#v", got)
+	}
+	if _, ok, _ := LoadInstance(store, "i1"); ok {
+		t.Fatalf("expected the removed instance to be gone")
 	}
 }
 
 func TestInstanceOpsErrorPaths(t *testing.T) {
-	dir := t.TempDir()
-	store, err := config.NewStore(filepath.Join(dir, "config.json"))
-	if err != nil {
-		t.Fatalf("NewStore: %v", err)
-	}
+	store := newRegistryStore(t)
 
 	t.Run("Heartbeat missing instance", func(t *testing.T) {
 		if err := Heartbeat(store, "missing", time.Now()); err == nil {
@@ -77,12 +92,147 @@ func TestInstanceOpsErrorPaths(t *testing.T) {
 		if err := RemoveInstance(store, "missing"); err != nil {
 			t.Fatalf("RemoveInstance error: %v", err)
 		}
-		cfg, err := store.Load()
+		got, err := ListInstances(store)
 		if err != nil {
-			t.Fatalf("Load: %v", err)
+			t.Fatalf("ListInstances: %v", err)
+		}
+		if len(got) != 1 || got[0].ID != "i1" {
+			t.Fatalf("expected instance to remain, got %#v", got)
+		}
+	})
+
+	t.Run("invalid ids and state files", func(t *testing.T) {
+		if err := RecordInstance(store, config.Instance{ID: "../escape"}); err == nil {
+			t.Fatalf("expected an invalid id to be rejected")
 		}
-		if len(cfg.Instances) != 1 || cfg.Instances[0].ID != "i1" {
-			t.Fatalf("expected instance to remain, got %#v", cfg.Instances)
+		if err := os.WriteFile(filepath.Join(RuntimeDir(store), "broken.json"), []byte("{"), 0o600); err != nil {
+			t.Fatalf("write broken state: %v", err)
+		}
+		got, err := ListInstances(store)
+		if err != nil || len(got) != 1 {
+			t.Fatalf("expected the broken state file to be skipped, got %#v, %v", got, err)
 		}
 	})
 }
+
+func TestRecordFailover(t *testing.T) {
+	store := newRegistryStore(t)
+	if err := RecordInstance(store, config.Instance{ID: "i1", ProfileID: "p1"}); err != nil {
+		t.Fatalf("RecordInstance: %v", err)
+	}
+
+	if err := RecordFailover(store, "i1", "p2", 1); err != nil {
+		t.Fatalf("RecordFailover: %v", err)
+	}
+	got, _, _ := LoadInstance(store, "i1")
+	if got.ActiveProfileID != "p2" || got.Failovers != 1 {
+		t.Fatalf("after failover: %#v", got)
+	}
+
+	// Returning to the primary clears the active profile but keeps the count.
+	if err := RecordFailover(store, "i1", "p1", 2); err != nil {
+		t.Fatalf("RecordFailover: %v", err)
+	}
+	got, _, _ = LoadInstance(store, "i1")
+	if got.ActiveProfileID != "" || got.Failovers != 2 {
+		t.Fatalf("after failing back: %#v", got)
+	}
+
+	if err := RecordFailover(store, "missing", "p2", 1); err == nil {
+		t.Fatalf("expected error for unknown instance")
+	}
+}
+
+func TestListInstancesMigratesLegacyConfig(t *testing.T) {
+	store := newRegistryStore(t)
+	started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	cfg := config.Config{
+		Version:  config.CurrentVersion,
+		Profiles: []config.Profile{{ID: "p1", Name: "work"}},
+		Instances: []config.Instance{
+			{ID: "new", ProfileID: "p1", HTTPPort: 2, StartedAt: started.Add(time.Minute)},
+			{ID: "old", ProfileID: "p1", HTTPPort: 1, StartedAt: started},
+			{ID: "kept", ProfileID: "p1", HTTPPort: 3, StartedAt: started.Add(2 * time.Minute)},
+		},
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	// A state file written since wins over the legacy entry.
+	if err := RecordInstance(store, config.Instance{ID: "kept", ProfileID: "p1", HTTPPort: 30, StartedAt: started.Add(2 * time.Minute)}); err != nil {
+		t.Fatalf("RecordInstance: %v", err)
+	}
+
+	got, err := ListInstances(store)
+	if err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	}
+	if len(got) != 3 || got[0].ID != "old" || got[1].ID != "new" || got[2].HTTPPort != 30 {
+		t.Fatalf("migrated instances %#v", got)
+	}
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(saved.Instances) != 0 || len(saved.Profiles) != 1 {
+		t.Fatalf("expected the legacy list to be cleared and the rest kept, got %#v", saved)
+	}
+	b, err := os.ReadFile(store.Path())
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	if _, ok := raw["instances"]; ok {
+		t.Fatalf("expected no instances key in the config, got %s", b)
+	}
+}
+
+func TestLegacyInstancesMigrateOncePerStore(t *testing.T) {
+	store := newRegistryStore(t)
+	if _, err := ListInstances(store); err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	}
+	// Entries that show up later, as from an older binary, are left for
+	// the next process to migrate instead of costing every call a config
+	// load under the lock.
+	if err := store.Save(config.Config{Version: config.CurrentVersion, Instances: []config.Instance{{ID: "late"}}}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, ok, err := LoadInstance(store, "late"); err != nil || ok {
+		t.Fatalf("expected no second migration, got ok=%v err=%v", ok, err)
+	}
+
+	fresh, err := config.NewStore(store.Path())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if _, ok, err := LoadInstance(fresh, "late"); err != nil || !ok {
+		t.Fatalf("expected a new store to migrate, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestIsInstanceDead(t *testing.T) {
+	prev := procIsAlive
+	t.Cleanup(func() { procIsAlive = prev })
+	procIsAlive = func(pid int) bool { return pid == 42 }
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name string
+		inst config.Instance
+		want bool
+	}{
+		{"alive and heartbeating", config.Instance{DaemonPID: 42, LastSeenAt: now}, false},
+		{"exited", config.Instance{DaemonPID: 7, LastSeenAt: now}, true},
+		{"missed heartbeats", config.Instance{DaemonPID: 42, LastSeenAt: now.Add(-StaleAfter - time.Second)}, true},
+		{"still starting", config.Instance{LastSeenAt: now}, false},
+		{"never started", config.Instance{LastSeenAt: now.Add(-time.Hour)}, true},
+	} {
+		if got := IsInstanceDead(tc.inst, now); got != tc.want {
+			t.Fatalf("%s: IsInstanceDead=%v want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+)
+
+// Leases keep a shared daemon running: each process using it holds one,
+// and the daemon exits once it has had none for its idle timeout. Leases
+// change under the registry lock, so a daemon deciding to exit and a
+// process taking a lease on it never both succeed.
+
+// LeaseSharedInstance takes a lease for pid on a running or starting
+// shared daemon of profileID, preferring one that is already up. When
+// there is none, newInst is registered as shared, holding the lease, and
+// created is true: the caller is then expected to start its daemon.
+func LeaseSharedInstance(store *config.Store, profileID string, pid int, now time.Time, newInst config.Instance) (inst config.Instance, created bool, err error) {
+	if err := migrateLegacyInstances(store); err != nil {
+		return config.Instance{}, false, err
+	}
+	err = updateRegistry(store, func() error {
+		instances, err := readInstances(store)
+		if err != nil {
+			return err
+		}
+		var pick *config.Instance
+		for i := range instances {
+			c := &instances[i]
+			if !c.Shared || c.ProfileID != profileID || IsInstanceDead(*c, now) {
+				continue
+			}
+			// A daemon that never recorded its PID is only coming up while
+			// the process that registered it still holds its lease.
+			if c.DaemonPID <= 0 && len(LiveLeases(*c)) == 0 {
+				continue
+			}
+			if pick == nil || (pick.HTTPPort <= 0 && c.HTTPPort > 0) {
+				pick = c
+			}
+		}
+		if pick == nil {
+			inst, created = newInst, true
+			inst.Shared = true
+		} else {
+			inst = *pick
+		}
+		addLease(&inst, pid, now)
+		return writeInstanceState(store, inst)
+	})
+	if err != nil {
+		return config.Instance{}, false, err
+	}
+	return inst, created, nil
+}
+
+// AcquireLease adds a lease for pid on the shared instance instanceID. A
+// process may hold several, one per use.
+func AcquireLease(store *config.Store, instanceID string, pid int, now time.Time) error {
+	return updateRegistry(store, func() error {
+		inst, err := readInstanceState(instanceStatePath(store, instanceID))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("instance %q not found", instanceID)
+		}
+		if err != nil {
+			return err
+		}
+		if !inst.Shared {
+			return fmt.Errorf("instance %q is not a shared daemon", instanceID)
+		}
+		addLease(&inst, pid, now)
+		return writeInstanceState(store, inst)
+	})
+}
+
+// ReleaseLease drops one of pid's leases on instanceID; releasing the last
+// lease starts the idle timer. An instance that is gone has nothing to
+// release.
+func ReleaseLease(store *config.Store, instanceID string, pid int, now time.Time) error {
+	return updateRegistry(store, func() error {
+		inst, err := readInstanceState(instanceStatePath(store, instanceID))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, l := range inst.Leases {
+			if l.PID == pid {
+				inst.Leases = append(inst.Leases[:i], inst.Leases[i+1:]...)
+				break
+			}
+		}
+		if len(inst.Leases) == 0 && inst.IdleSince.IsZero() {
+			inst.IdleSince = now
+		}
+		return writeInstanceState(store, inst)
+	})
+}
+
+// LiveLeases returns inst's leases whose process is still running.
+func LiveLeases(inst config.Instance) []config.Lease {
+	var out []config.Lease
+	for _, l := range inst.Leases {
+		if procIsAlive(l.PID) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// DropDeadLeases removes the leases of exited processes from instanceID
+// and returns how many it removed.
+func DropDeadLeases(store *config.Store, instanceID string, now time.Time) (int, error) {
+	dropped := 0
+	err := UpdateInstance(store, instanceID, func(inst *config.Instance) {
+		dropped = dropDeadLeases(inst, now)
+	})
+	return dropped, err
+}
+
+// ExpireIdleInstance drops the leases of exited processes from the shared
+// instance instanceID and, once it has had no lease for idle, removes it
+// from the registry so that no new lease can be taken. It reports whether
+// the instance was removed; the daemon should then exit.
+func ExpireIdleInstance(store *config.Store, instanceID string, now time.Time, idle time.Duration) (bool, error) {
+	removed := false
+	err := updateRegistry(store, func() error {
+		path := instanceStatePath(store, instanceID)
+		inst, err := readInstanceState(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("instance %q not found", instanceID)
+		}
+		if err != nil {
+			return err
+		}
+		changed := dropDeadLeases(&inst, now) > 0
+		if len(inst.Leases) == 0 && inst.IdleSince.IsZero() {
+			inst.IdleSince, changed = now, true
+		}
+		if len(inst.Leases) == 0 && now.Sub(inst.IdleSince) >= idle {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			removed = true
+			return nil
+		}
+		if !changed {
+			return nil
+		}
+		return writeInstanceState(store, inst)
+	})
+	return removed, err
+}
+
+func addLease(inst *config.Instance, pid int, now time.Time) {
+	inst.Leases = append(inst.Leases, config.Lease{PID: pid, AcquiredAt: now})
+	inst.IdleSince = time.Time{}
+}
+
+// dropDeadLeases removes the leases of exited processes from inst; losing
+// the last one starts the idle timer.
+func dropDeadLeases(inst *config.Instance, now time.Time) int {
+	live := LiveLeases(*inst)
+	dropped := len(inst.Leases) - len(live)
+	if dropped == 0 {
+		return 0
+	}
+	inst.Leases = live
+	if len(live) == 0 {
+		inst.IdleSince = now
+	}
+	return dropped
+}
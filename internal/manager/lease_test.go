@@ -0,0 +1,149 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+)
+
+func withAlivePIDs(t *testing.T, pids ...int) {
+	t.Helper()
+	prev := procIsAlive
+	t.Cleanup(func() { procIsAlive = prev })
+	alive := map[int]bool{}
+	for _, pid := range pids {
+		alive[pid] = true
+	}
+	procIsAlive = func(pid int) bool { return alive[pid] }
+}
+
+func TestLeaseSharedInstance(t *testing.T) {
+	withAlivePIDs(t, 10, 11, 12, 99)
+	store := newRegistryStore(t)
+	now := time.Now()
+
+	first, created, err := LeaseSharedInstance(store, "p1", 10, now, config.Instance{ID: "s1", ProfileID: "p1", LastSeenAt: now})
+	if err != nil || !created {
+		t.Fatalf("first lease: created=%v err=%v", created, err)
+	}
+	if !first.Shared || len(first.Leases) != 1 || first.Leases[0].PID != 10 {
+		t.Fatalf("registered %#v", first)
+	}
+
+	// A daemon still starting is joined rather than started twice.
+	second, created, err := LeaseSharedInstance(store, "p1", 11, now, config.Instance{ID: "s2", ProfileID: "p1", LastSeenAt: now})
+	if err != nil || created || second.ID != "s1" || len(second.Leases) != 2 {
+		t.Fatalf("second lease: %#v created=%v err=%v", second, created, err)
+	}
+
+	// Daemons of other profiles and unshared ones are not leased.
+	if err := RecordInstance(store, config.Instance{ID: "manual", ProfileID: "p2", DaemonPID: 99, HTTPPort: 1, LastSeenAt: now}); err != nil {
+		t.Fatalf("RecordInstance: %v", err)
+	}
+	other, created, err := LeaseSharedInstance(store, "p2", 12, now, config.Instance{ID: "s3", ProfileID: "p2", LastSeenAt: now})
+	if err != nil || !created || other.ID != "s3" {
+		t.Fatalf("other profile: %#v created=%v err=%v", other, created, err)
+	}
+
+	// A starting daemon whose starter exited is given up on.
+	withAlivePIDs(t, 12)
+	again, created, err := LeaseSharedInstance(store, "p1", 12, now, config.Instance{ID: "s4", ProfileID: "p1", LastSeenAt: now})
+	if err != nil || !created || again.ID != "s4" {
+		t.Fatalf("abandoned start: %#v created=%v err=%v", again, created, err)
+	}
+}
+
+func TestLeaseReleaseAndIdleExpiry(t *testing.T) {
+	withAlivePIDs(t, 10, 11)
+	store := newRegistryStore(t)
+	now := time.Now()
+	idle := time.Minute
+
+	if err := RecordInstance(store, config.Instance{ID: "s1", ProfileID: "p1", Shared: true, DaemonPID: 10, LastSeenAt: now}); err != nil {
+		t.Fatalf("RecordInstance: %v", err)
+	}
+	if err := AcquireLease(store, "s1", 11, now); err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	if err := AcquireLease(store, "s1", 11, now); err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	if err := AcquireLease(store, "s1", 42, now); err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+
+	// pid 42 has exited; its lease no longer counts.
+	if removed, err := ExpireIdleInstance(store, "s1", now.Add(time.Hour), idle); err != nil || removed {
+		t.Fatalf("expire with leases: removed=%v err=%v", removed, err)
+	}
+	inst, _, _ := LoadInstance(store, "s1")
+	if len(inst.Leases) != 2 || !inst.IdleSince.IsZero() {
+		t.Fatalf("after dropping the dead lease: %#v", inst)
+	}
+
+	// Each use holds its own lease.
+	if err := ReleaseLease(store, "s1", 11, now); err != nil {
+		t.Fatalf("ReleaseLease: %v", err)
+	}
+	inst, _, _ = LoadInstance(store, "s1")
+	if len(inst.Leases) != 1 || !inst.IdleSince.IsZero() {
+		t.Fatalf("after the first release: %#v", inst)
+	}
+	if err := ReleaseLease(store, "s1", 11, now); err != nil {
+		t.Fatalf("ReleaseLease: %v", err)
+	}
+	inst, _, _ = LoadInstance(store, "s1")
+	if len(inst.Leases) != 0 || !inst.IdleSince.Equal(now) {
+		t.Fatalf("after the last release: %#v", inst)
+	}
+
+	if removed, err := ExpireIdleInstance(store, "s1", now.Add(idle/2), idle); err != nil || removed {
+		t.Fatalf("expire before the idle time: removed=%v err=%v", removed, err)
+	}
+	if removed, err := ExpireIdleInstance(store, "s1", now.Add(idle), idle); err != nil || !removed {
+		t.Fatalf("expire after the idle time: removed=%v err=%v", removed, err)
+	}
+	if _, ok, _ := LoadInstance(store, "s1"); ok {
+		t.Fatalf("expected the expired instance to be removed")
+	}
+
+	if err := AcquireLease(store, "s1", 11, now); err == nil {
+		t.Fatalf("expected no lease on an expired daemon")
+	}
+	if err := ReleaseLease(store, "s1", 11, now); err != nil {
+		t.Fatalf("release on a gone daemon: %v", err)
+	}
+}
+
+func TestLeaseErrors(t *testing.T) {
+	withAlivePIDs(t, 10)
+	store := newRegistryStore(t)
+	now := time.Now()
+	if err := RecordInstance(store, config.Instance{ID: "manual", ProfileID: "p1", DaemonPID: 10}); err != nil {
+		t.Fatalf("RecordInstance: %v", err)
+	}
+	if err := AcquireLease(store, "manual", 10, now); err == nil {
+		t.Fatalf("expected unshared instances to refuse leases")
+	}
+	if _, err := ExpireIdleInstance(store, "missing", now, time.Minute); err == nil {
+		t.Fatalf("expected an error for a missing instance")
+	}
+}
+
+func TestDropDeadLeases(t *testing.T) {
+	withAlivePIDs(t, 10)
+	store := newRegistryStore(t)
+	now := time.Now()
+	inst := config.Instance{ID: "s1", ProfileID: "p1", Shared: true, Leases: []config.Lease{{PID: 10}, {PID: 42}, {PID: 43}}}
+	if err := RecordInstance(store, inst); err != nil {
+		t.Fatalf("RecordInstance: %v", err)
+	}
+	if n, err := DropDeadLeases(store, "s1", now); err != nil || n != 2 {
+		t.Fatalf("DropDeadLeases=%d, %v", n, err)
+	}
+	got, _, _ := LoadInstance(store, "s1")
+	if len(got.Leases) != 1 || got.Leases[0].PID != 10 {
+		t.Fatalf("leases %#v", got.Leases)
+	}
+}
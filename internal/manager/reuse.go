@@ -19,13 +19,13 @@ func FindReusableInstance(instances []config.Instance, profileID string, hc Heal
 		if inst.ProfileID != profileID {
 			continue
 		}
-		if inst.DaemonPID <= 0 || !procIsAlive(inst.DaemonPID) {
+		if inst.DaemonPID <= 0 || IsInstanceDead(*inst, time.Now()) {
 			continue
 		}
 		if !isReusableDaemonInstance(*inst) {
 			continue
 		}
-		if err := hc.CheckHTTPProxy(inst.HTTPPort, inst.ID); err != nil {
+		if err := hc.CheckInstance(*inst); err != nil {
 			continue
 		}
 
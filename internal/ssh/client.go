@@ -0,0 +1,606 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ClientConfig configures the in-process SSH backend, an alternative to
+// running `ssh -D` that forwards each connection over a direct-tcpip channel.
+type ClientConfig struct {
+	Host string
+	Port int
+	User string
+
+	// JumpHosts are bastions to pass through, in connection order. Each hop
+	// is verified against known_hosts and authenticated like the final host,
+	// plus its own IdentityFile.
+	JumpHosts []JumpHost
+
+	// LocalForwards are served by the client itself: it listens on each
+	// local port while connected and opens a direct-tcpip channel per
+	// connection.
+	LocalForwards []LocalForward
+
+	// ExtraArgs are the profile's ssh arguments. The options listed in
+	// ParseClientArgs are honored; everything else is ignored.
+	ExtraArgs []string
+
+	// HomeDir locates ~/.ssh; empty uses the current user's home directory.
+	HomeDir string
+	// AgentSocket is the ssh-agent socket; empty uses $SSH_AUTH_SOCK.
+	AgentSocket string
+
+	DialTimeout       time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCountMax int
+}
+
+// ClientOptions are the ssh options the built-in client understands.
+type ClientOptions struct {
+	IdentityFiles   []string
+	KnownHostsFiles []string
+	// StrictHostKeyChecking is "yes" (default), "accept-new" or "no".
+	StrictHostKeyChecking string
+	// IdentitiesOnly skips ssh-agent keys.
+	IdentitiesOnly bool
+}
+
+// sshFlagsWithValue are ssh(1) flags that take a separate argument.
+const sshFlagsWithValue = "BbcDEeFIiJLlmOopQRSWw"
+
+// ParseClientArgs extracts the options the built-in client supports from
+// ssh arguments: -i, and -o IdentityFile, UserKnownHostsFile,
+// StrictHostKeyChecking and IdentitiesOnly. Other arguments are skipped.
+func ParseClientArgs(args []string) (ClientOptions, error) {
+	var opts ClientOptions
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' {
+			continue
+		}
+		flag := arg[1]
+		if !strings.ContainsRune(sshFlagsWithValue, rune(flag)) {
+			continue
+		}
+		value := arg[2:]
+		if value == "" {
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("ssh option -%c requires an argument", flag)
+			}
+			i++
+			value = args[i]
+		}
+		switch flag {
+		case 'i':
+			opts.IdentityFiles = append(opts.IdentityFiles, value)
+		case 'o':
+			if err := opts.setOption(value); err != nil {
+				return opts, err
+			}
+		}
+	}
+	return opts, nil
+}
+
+func (o *ClientOptions) setOption(kv string) error {
+	key, value, ok := strings.Cut(kv, "=")
+	if !ok {
+		key, value, _ = strings.Cut(strings.TrimSpace(kv), " ")
+	}
+	key = strings.ToLower(strings.TrimSpace(key))
+	value = strings.TrimSpace(value)
+	switch key {
+	case "identityfile":
+		o.IdentityFiles = append(o.IdentityFiles, value)
+	case "userknownhostsfile":
+		o.KnownHostsFiles = append(o.KnownHostsFiles, strings.Fields(value)...)
+	case "stricthostkeychecking":
+		switch strings.ToLower(value) {
+		case "yes", "ask":
+			o.StrictHostKeyChecking = "yes"
+		case "accept-new":
+			o.StrictHostKeyChecking = "accept-new"
+		case "no", "off":
+			o.StrictHostKeyChecking = "no"
+		default:
+			return fmt.Errorf("unsupported StrictHostKeyChecking value %q", value)
+		}
+	case "identitiesonly":
+		o.IdentitiesOnly = strings.EqualFold(value, "yes")
+	}
+	return nil
+}
+
+var errClientStopped = errors.New("ssh client stopped")
+
+// Client is an in-process SSH connection usable as a tunnel: Start connects,
+// Dial opens direct-tcpip channels, and Done closes when the connection ends.
+type Client struct {
+	cfg  ClientConfig
+	opts ClientOptions
+
+	mu       sync.Mutex
+	conn     *gossh.Client
+	hops     []*gossh.Client
+	agent    net.Conn
+	forwards []net.Listener
+	waitErr  error
+	// stopped is set by Stop; a Start still dialing then drops its
+	// connection instead of keeping it.
+	stopped bool
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func NewClient(cfg ClientConfig) (*Client, error) {
+	cfg.Host = strings.TrimSpace(cfg.Host)
+	cfg.User = strings.TrimSpace(cfg.User)
+	if cfg.Host == "" {
+		return nil, errors.New("host is required")
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid ssh port %d", cfg.Port)
+	}
+	if cfg.User == "" {
+		return nil, errors.New("user is required")
+	}
+	if err := ValidateJumpHosts(cfg.JumpHosts); err != nil {
+		return nil, err
+	}
+	if err := ValidateLocalForwards(cfg.LocalForwards); err != nil {
+		return nil, err
+	}
+	opts, err := ParseClientArgs(cfg.ExtraArgs)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HomeDir == "" {
+		cfg.HomeDir, _ = os.UserHomeDir()
+	}
+	if cfg.AgentSocket == "" {
+		cfg.AgentSocket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 15 * time.Second
+	}
+	if cfg.KeepAliveInterval <= 0 {
+		cfg.KeepAliveInterval = 15 * time.Second
+	}
+	if cfg.KeepAliveCountMax <= 0 {
+		cfg.KeepAliveCountMax = 3
+	}
+	return &Client{cfg: cfg, opts: opts, done: make(chan struct{})}, nil
+}
+
+func (c *Client) addr() string {
+	return net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+}
+
+// Start connects and authenticates, hop by hop when jump hosts are set. The
+// connection is watched with keepalives until Stop or a failure closes Done.
+func (c *Client) Start() error {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return errClientStopped
+	}
+	if c.conn != nil {
+		c.mu.Unlock()
+		return errors.New("ssh client already started")
+	}
+	c.mu.Unlock()
+
+	signers, agentConn, err := c.signers()
+	if err != nil {
+		return err
+	}
+
+	type target struct {
+		addr, user, identity string
+	}
+	var chain []target
+	for _, h := range withHopUsers(c.cfg.JumpHosts, c.cfg.User) {
+		chain = append(chain, target{addr: h.addr(), user: strings.TrimSpace(h.User), identity: strings.TrimSpace(h.IdentityFile)})
+	}
+	chain = append(chain, target{addr: c.addr(), user: c.cfg.User})
+
+	var clients []*gossh.Client
+	fail := func(err error) error {
+		for i := len(clients) - 1; i >= 0; i-- {
+			_ = clients[i].Close()
+		}
+		closeConn(agentConn)
+		return err
+	}
+	for i, t := range chain {
+		hopSigners := signers
+		if t.identity != "" {
+			s, err := loadSigner(c.expandPath(t.identity))
+			if err != nil {
+				return fail(fmt.Errorf("jump host %d: %w", i+1, err))
+			}
+			hopSigners = append([]gossh.Signer{s}, signers...)
+		}
+		if len(hopSigners) == 0 {
+			return fail(errors.New("no usable SSH keys: start ssh-agent or pass -i <key>"))
+		}
+		hostKeys, algos, err := c.hostKeyCallback(t.addr)
+		if err != nil {
+			return fail(err)
+		}
+		clientCfg := &gossh.ClientConfig{
+			User:              t.user,
+			Auth:              []gossh.AuthMethod{gossh.PublicKeys(hopSigners...)},
+			HostKeyCallback:   hostKeys,
+			HostKeyAlgorithms: algos,
+			Timeout:           c.cfg.DialTimeout,
+		}
+
+		var conn net.Conn
+		if i == 0 {
+			conn, err = net.DialTimeout("tcp", t.addr, c.cfg.DialTimeout)
+		} else {
+			conn, err = clients[i-1].Dial("tcp", t.addr)
+		}
+		if err != nil {
+			return fail(fmt.Errorf("ssh %s: %w", t.addr, err))
+		}
+		// Bound the handshake like ConnectTimeout does for OpenSSH.
+		_ = conn.SetDeadline(time.Now().Add(c.cfg.DialTimeout))
+		sc, chans, reqs, err := gossh.NewClientConn(conn, t.addr, clientCfg)
+		if err != nil {
+			_ = conn.Close()
+			return fail(fmt.Errorf("ssh %s: %w", t.addr, err))
+		}
+		_ = conn.SetDeadline(time.Time{})
+		clients = append(clients, gossh.NewClient(sc, chans, reqs))
+	}
+
+	conn := clients[len(clients)-1]
+	// Like ExitOnForwardFailure: a taken local port fails the start.
+	forwards, err := listenForwards(c.cfg.LocalForwards, conn)
+	if err != nil {
+		return fail(err)
+	}
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		closeListeners(forwards)
+		return fail(errClientStopped)
+	}
+	c.conn = conn
+	c.hops = clients[:len(clients)-1]
+	c.agent = agentConn
+	c.forwards = forwards
+	c.mu.Unlock()
+
+	go c.run(conn)
+	return nil
+}
+
+func (c *Client) run(conn *gossh.Client) {
+	waitCh := make(chan error, 1)
+	go func() { waitCh <- conn.Wait() }()
+
+	t := time.NewTicker(c.cfg.KeepAliveInterval)
+	defer t.Stop()
+
+	var err error
+	misses := 0
+loop:
+	for {
+		select {
+		case err = <-waitCh:
+			break loop
+		case <-t.C:
+			if keepAlive(conn, c.cfg.KeepAliveInterval) {
+				misses = 0
+				continue
+			}
+			misses++
+			if misses >= c.cfg.KeepAliveCountMax {
+				_ = conn.Close()
+				<-waitCh
+				err = fmt.Errorf("ssh %s: keepalive timed out", c.addr())
+				break loop
+			}
+		}
+	}
+
+	c.mu.Lock()
+	if c.stopped {
+		err = nil
+	} else if err == nil {
+		err = fmt.Errorf("ssh %s: connection closed", c.addr())
+	}
+	c.waitErr = err
+	agentConn := c.agent
+	hops := c.hops
+	forwards := c.forwards
+	c.agent = nil
+	c.hops = nil
+	c.forwards = nil
+	c.mu.Unlock()
+	// Release the forwarded ports before Done, so a restart can bind them.
+	closeListeners(forwards)
+	for i := len(hops) - 1; i >= 0; i-- {
+		_ = hops[i].Close()
+	}
+	closeConn(agentConn)
+	c.closeDone()
+}
+
+func (c *Client) closeDone() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+func keepAlive(conn *gossh.Client, timeout time.Duration) bool {
+	res := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Dial opens a direct-tcpip channel to addr through the SSH server.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil, errors.New("ssh client not connected")
+	}
+	return conn.Dial(network, addr)
+}
+
+// IsChannelRejected reports whether err is the SSH server refusing a
+// direct-tcpip channel, i.e. the server could not reach the target.
+func IsChannelRejected(err error) bool {
+	var oce *gossh.OpenChannelError
+	return errors.As(err, &oce)
+}
+
+func (c *Client) Done() <-chan struct{} { return c.done }
+
+func (c *Client) Wait() error {
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.waitErr
+}
+
+// Stop closes the connection, waiting up to grace for the watcher to exit.
+// Without a connection, Done closes right away; a Start still dialing
+// closes what it connected.
+func (c *Client) Stop(grace time.Duration) error {
+	c.mu.Lock()
+	c.stopped = true
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		c.closeDone()
+		return nil
+	}
+	_ = conn.Close()
+	select {
+	case <-c.done:
+	case <-time.After(grace):
+	}
+	return nil
+}
+
+func closeConn(c net.Conn) {
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+// signers collects ssh-agent keys (unless IdentitiesOnly) and then the
+// configured identity files, or the default ones when none are configured.
+func (c *Client) signers() ([]gossh.Signer, net.Conn, error) {
+	var (
+		signers   []gossh.Signer
+		agentConn net.Conn
+		skipped   []string
+	)
+	if !c.opts.IdentitiesOnly && c.cfg.AgentSocket != "" {
+		if conn, err := net.Dial("unix", c.cfg.AgentSocket); err == nil {
+			if ss, err := agent.NewClient(conn).Signers(); err == nil && len(ss) > 0 {
+				signers = append(signers, ss...)
+				agentConn = conn
+			} else {
+				_ = conn.Close()
+			}
+		}
+	}
+
+	files := c.opts.IdentityFiles
+	explicit := len(files) > 0
+	if !explicit {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			files = append(files, filepath.Join(c.cfg.HomeDir, ".ssh", name))
+		}
+	}
+	for _, f := range files {
+		path := c.expandPath(f)
+		signer, err := loadSigner(path)
+		if err != nil {
+			if explicit || !errors.Is(err, os.ErrNotExist) {
+				skipped = append(skipped, err.Error())
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	// Jump hosts may bring their own keys; only give up when nothing at all
+	// can authenticate.
+	if len(signers) == 0 && !c.hopsHaveIdentities() {
+		msg := "no usable SSH keys: start ssh-agent or pass -i <key>"
+		if len(skipped) > 0 {
+			msg += " (" + strings.Join(skipped, "; ") + ")"
+		}
+		return nil, nil, errors.New(msg)
+	}
+	return signers, agentConn, nil
+}
+
+func (c *Client) hopsHaveIdentities() bool {
+	for _, h := range c.cfg.JumpHosts {
+		if strings.TrimSpace(h.IdentityFile) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func loadSigner(path string) (gossh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.ParsePrivateKey(b)
+	if err != nil {
+		var missing *gossh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("%s: passphrase-protected (load it into ssh-agent)", path)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// hostKeyCallback verifies the server against known_hosts like OpenSSH in
+// batch mode, and returns the host key algorithms known for the host so the
+// server presents a key we can check.
+func (c *Client) hostKeyCallback(addr string) (gossh.HostKeyCallback, []string, error) {
+	mode := c.opts.StrictHostKeyChecking
+	if mode == "no" {
+		return gossh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	files := append([]string(nil), c.opts.KnownHostsFiles...)
+	if len(files) == 0 {
+		files = []string{filepath.Join(c.cfg.HomeDir, ".ssh", "known_hosts")}
+	}
+	var existing []string
+	for i, f := range files {
+		files[i] = c.expandPath(f)
+		if _, err := os.Stat(files[i]); err == nil {
+			existing = append(existing, files[i])
+		}
+	}
+	if mode == "accept-new" && len(existing) == 0 {
+		if err := os.MkdirAll(filepath.Dir(files[0]), 0o700); err != nil {
+			return nil, nil, err
+		}
+		f, err := os.OpenFile(files[0], os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+		_ = f.Close()
+		existing = files[:1]
+	}
+	if len(existing) == 0 {
+		return nil, nil, fmt.Errorf("no known_hosts file (%s); connect once with ssh or set StrictHostKeyChecking=accept-new", strings.Join(files, ", "))
+	}
+
+	known, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, nil, err
+	}
+	cb := func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 && mode == "accept-new" {
+			return appendKnownHost(existing[0], hostname, remote, key)
+		}
+		if err != nil {
+			return fmt.Errorf("host key verification failed: %w", err)
+		}
+		return nil
+	}
+	return cb, knownHostAlgorithms(known, addr), nil
+}
+
+// knownHostAlgorithms asks the known_hosts callback which keys it holds for
+// addr by presenting a throwaway key.
+func knownHostAlgorithms(known gossh.HostKeyCallback, addr string) []string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	probe, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(known(addr, &net.TCPAddr{}, probe), &keyErr) {
+		return nil
+	}
+	var algos []string
+	seen := map[string]bool{}
+	add := func(a string) {
+		if !seen[a] {
+			seen[a] = true
+			algos = append(algos, a)
+		}
+	}
+	for _, k := range keyErr.Want {
+		if k.Key.Type() == gossh.KeyAlgoRSA {
+			add(gossh.KeyAlgoRSASHA512)
+			add(gossh.KeyAlgoRSASHA256)
+		}
+		add(k.Key.Type())
+	}
+	return algos
+}
+
+func appendKnownHost(path, hostname string, remote net.Addr, key gossh.PublicKey) error {
+	addrs := []string{knownhosts.Normalize(hostname)}
+	if tcp, ok := remote.(*net.TCPAddr); ok && tcp.IP != nil {
+		if ip := knownhosts.Normalize(tcp.String()); ip != addrs[0] {
+			addrs = append(addrs, ip)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, werr := fmt.Fprintln(f, knownhosts.Line(addrs, key))
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	return werr
+}
+
+func (c *Client) expandPath(p string) string {
+	if p == "~" {
+		return c.cfg.HomeDir
+	}
+	if strings.HasPrefix(p, "~/") {
+		return filepath.Join(c.cfg.HomeDir, p[2:])
+	}
+	return p
+}
@@ -0,0 +1,490 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process SSH server that accepts one client key and
+// forwards direct-tcpip channels.
+type testSSHServer struct {
+	ln      net.Listener
+	hostKey gossh.Signer
+
+	mu    sync.Mutex
+	conns []*gossh.ServerConn
+	dests []string
+	wg    sync.WaitGroup
+}
+
+func newTestSigner(t *testing.T) (gossh.Signer, ed25519.PrivateKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	s, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return s, priv
+}
+
+func startTestSSHServer(t *testing.T, clientKey gossh.PublicKey) *testSSHServer {
+	t.Helper()
+	hostKey, _ := newTestSigner(t)
+	cfg := &gossh.ServerConfig{
+		PublicKeyCallback: func(_ gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	cfg.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &testSSHServer{ln: ln, hostKey: hostKey}
+	t.Cleanup(s.Close)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(c, cfg)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(c net.Conn, cfg *gossh.ServerConfig) {
+	sc, chans, reqs, err := gossh.NewServerConn(c, cfg)
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, sc)
+	s.mu.Unlock()
+	go gossh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "direct-tcpip" {
+			_ = nc.Reject(gossh.UnknownChannelType, "unsupported")
+			continue
+		}
+		// RFC 4254 section 7.2: host, port, originator host, originator port.
+		extra := nc.ExtraData()
+		hostLen := binary.BigEndian.Uint32(extra)
+		host := string(extra[4 : 4+hostLen])
+		port := binary.BigEndian.Uint32(extra[4+hostLen:])
+		dest := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		s.mu.Lock()
+		s.dests = append(s.dests, dest)
+		s.mu.Unlock()
+
+		target, err := net.DialTimeout("tcp", dest, time.Second)
+		if err != nil {
+			_ = nc.Reject(gossh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			_ = target.Close()
+			continue
+		}
+		go gossh.DiscardRequests(chReqs)
+		go func() {
+			_, _ = io.Copy(target, ch)
+			_ = target.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(ch, target)
+			_ = ch.Close()
+		}()
+	}
+}
+
+func (s *testSSHServer) Addr() (string, int) {
+	a := s.ln.Addr().(*net.TCPAddr)
+	return a.IP.String(), a.Port
+}
+
+// DropClients closes every server-side connection.
+func (s *testSSHServer) DropClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+func (s *testSSHServer) Close() {
+	_ = s.ln.Close()
+	s.DropClients()
+}
+
+func (s *testSSHServer) KnownHostsLine() string {
+	host, port := s.Addr()
+	return knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(port)))}, s.hostKey.PublicKey())
+}
+
+func writeClientKey(t *testing.T, dir string, priv ed25519.PrivateKey) string {
+	t.Helper()
+	block, err := gossh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	path := filepath.Join(dir, "id_test")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return path
+}
+
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen echo: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func newTestClient(t *testing.T, srv *testSSHServer, args ...string) *Client {
+	t.Helper()
+	host, port := srv.Addr()
+	home := t.TempDir()
+	c, err := NewClient(ClientConfig{
+		Host:      host,
+		Port:      port,
+		User:      "tester",
+		ExtraArgs: args,
+		HomeDir:   home,
+		// Keep the developer's own ssh-agent out of the tests.
+		AgentSocket: filepath.Join(home, "no-agent.sock"),
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+func TestParseClientArgs(t *testing.T) {
+	opts, err := ParseClientArgs([]string{
+		"-i", "~/.ssh/work",
+		"-p", "2222",
+		"-oIdentityFile=/keys/other",
+		"-o", "UserKnownHostsFile /a/known /b/known",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "ServerAliveInterval=30",
+		"-v",
+	})
+	if err != nil {
+		t.Fatalf("ParseClientArgs: %v", err)
+	}
+	want := ClientOptions{
+		IdentityFiles:         []string{"~/.ssh/work", "/keys/other"},
+		KnownHostsFiles:       []string{"/a/known", "/b/known"},
+		StrictHostKeyChecking: "accept-new",
+		IdentitiesOnly:        true,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Fatalf("opts=%+v want %+v", opts, want)
+	}
+
+	if _, err := ParseClientArgs([]string{"-i"}); err == nil {
+		t.Fatalf("expected error for -i without a value")
+	}
+	if _, err := ParseClientArgs([]string{"-o", "StrictHostKeyChecking=maybe"}); err == nil {
+		t.Fatalf("expected error for unknown StrictHostKeyChecking value")
+	}
+}
+
+func TestClientDialsThroughDirectTCPIP(t *testing.T) {
+	signer, priv := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	echo := startEchoServer(t)
+
+	dir := t.TempDir()
+	keyPath := writeClientKey(t, dir, priv)
+	known := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(known, []byte(srv.KnownHostsLine()+"\n"), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	c := newTestClient(t, srv, "-i", keyPath, "-o", "UserKnownHostsFile="+known)
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() { _ = c.Stop(time.Second) }()
+
+	conn, err := c.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo got=%q err=%v", got, err)
+	}
+
+	srv.mu.Lock()
+	dests := append([]string(nil), srv.dests...)
+	srv.mu.Unlock()
+	if len(dests) != 1 || dests[0] != echo {
+		t.Fatalf("server saw direct-tcpip dests %q, want %q", dests, echo)
+	}
+
+	if _, err := c.Dial("tcp", "127.0.0.1:1"); !IsChannelRejected(err) {
+		t.Fatalf("expected a rejected channel for an unreachable target, got %v", err)
+	}
+}
+
+func TestClientUsesSSHAgent(t *testing.T) {
+	signer, priv := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatalf("add agent key: %v", err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(keyring, c)
+			}()
+		}
+	}()
+
+	c := newTestClient(t, srv, "-o", "StrictHostKeyChecking=no")
+	c.cfg.AgentSocket = sock
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start with agent: %v", err)
+	}
+	_ = c.Stop(time.Second)
+	if err := c.Wait(); err != nil {
+		t.Fatalf("Wait after Stop = %v, want nil", err)
+	}
+}
+
+func TestClientRejectsUnknownHostKey(t *testing.T) {
+	signer, priv := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	other := startTestSSHServer(t, signer.PublicKey())
+
+	dir := t.TempDir()
+	keyPath := writeClientKey(t, dir, priv)
+	// Record the other server's key under this server's address.
+	host, port := srv.Addr()
+	line := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(port)))}, other.hostKey.PublicKey())
+	known := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(known, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	c := newTestClient(t, srv, "-i", keyPath, "-o", "UserKnownHostsFile="+known)
+	err := c.Start()
+	if err == nil || !strings.Contains(err.Error(), "host key verification failed") {
+		t.Fatalf("expected host key failure, got %v", err)
+	}
+
+	missing := newTestClient(t, srv, "-i", keyPath, "-o", "UserKnownHostsFile="+filepath.Join(dir, "absent"))
+	if err := missing.Start(); err == nil || !strings.Contains(err.Error(), "no known_hosts file") {
+		t.Fatalf("expected missing known_hosts error, got %v", err)
+	}
+}
+
+func TestClientAcceptNewRecordsHostKey(t *testing.T) {
+	signer, priv := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+
+	dir := t.TempDir()
+	keyPath := writeClientKey(t, dir, priv)
+	known := filepath.Join(dir, "ssh", "known_hosts")
+
+	c := newTestClient(t, srv, "-i", keyPath, "-o", "UserKnownHostsFile="+known, "-o", "StrictHostKeyChecking=accept-new")
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	_ = c.Stop(time.Second)
+
+	b, err := os.ReadFile(known)
+	if err != nil {
+		t.Fatalf("read known_hosts: %v", err)
+	}
+	if !strings.Contains(string(b), strings.TrimSpace(strings.SplitN(srv.KnownHostsLine(), " ", 2)[1])) {
+		t.Fatalf("known_hosts missing server key: %q", b)
+	}
+
+	// The recorded key now verifies in strict mode.
+	strict := newTestClient(t, srv, "-i", keyPath, "-o", "UserKnownHostsFile="+known)
+	if err := strict.Start(); err != nil {
+		t.Fatalf("strict Start after accept-new: %v", err)
+	}
+	_ = strict.Stop(time.Second)
+}
+
+func TestClientDoneClosesWhenServerDrops(t *testing.T) {
+	signer, priv := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	keyPath := writeClientKey(t, t.TempDir(), priv)
+
+	c := newTestClient(t, srv, "-i", keyPath, "-o", "StrictHostKeyChecking=no")
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	srv.DropClients()
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Done not closed after the server dropped the connection")
+	}
+	if err := c.Wait(); err == nil {
+		t.Fatalf("expected an error after an unexpected disconnect")
+	}
+}
+
+func TestClientStopBeforeConnected(t *testing.T) {
+	signer, priv := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	keyPath := writeClientKey(t, t.TempDir(), priv)
+
+	// A relay in front of the server holds the connection until the test
+	// has stopped the client.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan struct{})
+	gate := make(chan struct{})
+	go func() {
+		in, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		close(accepted)
+		<-gate
+		host, port := srv.Addr()
+		out, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			_ = in.Close()
+			return
+		}
+		go func() { _, _ = io.Copy(out, in); _ = out.Close() }()
+		_, _ = io.Copy(in, out)
+		_ = in.Close()
+	}()
+
+	c := newTestClient(t, srv, "-i", keyPath, "-o", "StrictHostKeyChecking=no")
+	c.cfg.Port = ln.Addr().(*net.TCPAddr).Port
+	started := make(chan error, 1)
+	go func() { started <- c.Start() }()
+	<-accepted
+
+	if err := c.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Done not closed by a Stop before the connection was up")
+	}
+	if err := c.Wait(); err != nil {
+		t.Fatalf("Wait after Stop: %v", err)
+	}
+
+	close(gate)
+	if err := <-started; err == nil {
+		t.Fatalf("expected a Start that finished after Stop to fail")
+	}
+	// The connection that came up late is closed, not kept.
+	var conns []*gossh.ServerConn
+	deadline := time.Now().Add(5 * time.Second)
+	for len(conns) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the late connection never reached the server")
+		}
+		time.Sleep(5 * time.Millisecond)
+		srv.mu.Lock()
+		conns = append(conns, srv.conns...)
+		srv.mu.Unlock()
+	}
+	closed := make(chan struct{})
+	go func() { _ = conns[0].Wait(); close(closed) }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection finished after Stop was left open")
+	}
+	if err := c.Start(); err == nil {
+		t.Fatalf("expected a stopped client not to start again")
+	}
+}
+
+func TestClientWithoutKeysFails(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	c := newTestClient(t, srv, "-o", "StrictHostKeyChecking=no")
+	if err := c.Start(); err == nil || !strings.Contains(err.Error(), "no usable SSH keys") {
+		t.Fatalf("expected no-keys error, got %v", err)
+	}
+}
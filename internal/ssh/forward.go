@@ -0,0 +1,139 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// LocalForward is an ssh -L forward: connections to 127.0.0.1:LocalPort are
+// carried through the SSH server to RemoteHost:RemotePort, resolved there.
+type LocalForward struct {
+	LocalPort  int
+	RemoteHost string
+	RemotePort int
+}
+
+// LocalAddr is the loopback address the forward listens on.
+func (f LocalForward) LocalAddr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(f.LocalPort))
+}
+
+// RemoteAddr is the target as seen from the SSH server.
+func (f LocalForward) RemoteAddr() string {
+	return net.JoinHostPort(strings.TrimSpace(f.RemoteHost), strconv.Itoa(f.RemotePort))
+}
+
+// String renders the forward as localPort->host:port.
+func (f LocalForward) String() string {
+	return strconv.Itoa(f.LocalPort) + "->" + f.RemoteAddr()
+}
+
+// arg is the -L specification; IPv6 targets are bracketed like in ssh(1).
+func (f LocalForward) arg() string {
+	host := strings.TrimSpace(f.RemoteHost)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return fmt.Sprintf("127.0.0.1:%d:%s:%d", f.LocalPort, host, f.RemotePort)
+}
+
+// ValidateLocalForwards checks ports and hosts and that no local port is
+// used twice.
+func ValidateLocalForwards(fwds []LocalForward) error {
+	seen := map[int]bool{}
+	for i, f := range fwds {
+		if f.LocalPort <= 0 || f.LocalPort > 65535 {
+			return fmt.Errorf("local forward %d: invalid local port %d", i+1, f.LocalPort)
+		}
+		host := strings.Trim(strings.TrimSpace(f.RemoteHost), "[]")
+		if host == "" || strings.ContainsAny(host, " \t/@") {
+			return fmt.Errorf("local forward %d: invalid remote host %q", i+1, f.RemoteHost)
+		}
+		if f.RemotePort <= 0 || f.RemotePort > 65535 {
+			return fmt.Errorf("local forward %d: invalid remote port %d", i+1, f.RemotePort)
+		}
+		if seen[f.LocalPort] {
+			return fmt.Errorf("local forward %d: local port %d is forwarded twice", i+1, f.LocalPort)
+		}
+		seen[f.LocalPort] = true
+	}
+	return nil
+}
+
+// ForwardArgs returns one -L argument pair per forward. With
+// ExitOnForwardFailure set, ssh exits when a local port cannot be bound.
+func ForwardArgs(fwds []LocalForward) []string {
+	args := make([]string, 0, 2*len(fwds))
+	for _, f := range fwds {
+		args = append(args, "-L", f.arg())
+	}
+	return args
+}
+
+// dialer opens connections through the SSH server.
+type dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// listenForwards binds every forward's local port, failing (and releasing
+// the ports already bound) when one is taken, and serves them through d
+// until the listeners are closed.
+func listenForwards(fwds []LocalForward, d dialer) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, len(fwds))
+	for _, f := range fwds {
+		ln, err := net.Listen("tcp", f.LocalAddr())
+		if err != nil {
+			closeListeners(lns)
+			return nil, fmt.Errorf("local forward %s: %w", f, err)
+		}
+		lns = append(lns, ln)
+		go serveForward(ln, f.RemoteAddr(), d)
+	}
+	return lns, nil
+}
+
+func serveForward(ln net.Listener, remote string, d dialer) {
+	for {
+		local, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer local.Close()
+			upstream, err := d.Dial("tcp", remote)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			pipeConns(local, upstream)
+		}()
+	}
+}
+
+// pipeConns copies both ways, passing on half-closes, until both
+// directions are done; the caller closes the connections.
+func pipeConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyTo := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyTo(a, b)
+	go copyTo(b, a)
+	<-done
+	<-done
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		_ = ln.Close()
+	}
+}
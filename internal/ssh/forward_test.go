@@ -0,0 +1,119 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func freeLocalPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestBuildArgsIncludesLocalForwards(t *testing.T) {
+	args, err := BuildArgs(TunnelConfig{
+		Host:      "bastion",
+		Port:      22,
+		SocksPort: 1080,
+		LocalForwards: []LocalForward{
+			{LocalPort: 5432, RemoteHost: "db.internal", RemotePort: 5432},
+			{LocalPort: 8443, RemoteHost: "fd00::7", RemotePort: 443},
+		},
+	})
+	if err != nil {
+		t.Fatalf("BuildArgs: %v", err)
+	}
+	// The forwards come first: ssh binds them in order, so -D listening
+	// means they are bound.
+	want := []string{
+		"-L", "127.0.0.1:5432:db.internal:5432",
+		"-L", "127.0.0.1:8443:[fd00::7]:443",
+		"-D", "127.0.0.1:1080",
+	}
+	for i, a := range args {
+		if a == "-L" {
+			if got := args[i : i+len(want)]; !reflect.DeepEqual(got, want) {
+				t.Fatalf("forward args=%q want %q", got, want)
+			}
+			return
+		}
+	}
+	t.Fatalf("no -L in %q", args)
+}
+
+func TestValidateLocalForwards(t *testing.T) {
+	ok := LocalForward{LocalPort: 8080, RemoteHost: "api.internal", RemotePort: 80}
+	if err := ValidateLocalForwards([]LocalForward{ok}); err != nil {
+		t.Fatalf("ValidateLocalForwards: %v", err)
+	}
+	if got := ok.String(); got != "8080->api.internal:80" {
+		t.Fatalf("String()=%q", got)
+	}
+	for _, bad := range [][]LocalForward{
+		{{LocalPort: 0, RemoteHost: "h", RemotePort: 1}},
+		{{LocalPort: 1, RemoteHost: " ", RemotePort: 1}},
+		{{LocalPort: 1, RemoteHost: "a b", RemotePort: 1}},
+		{{LocalPort: 1, RemoteHost: "h", RemotePort: 70000}},
+		{ok, {LocalPort: 8080, RemoteHost: "other", RemotePort: 81}},
+	} {
+		if err := ValidateLocalForwards(bad); err == nil {
+			t.Fatalf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestClientServesLocalForwards(t *testing.T) {
+	signer, priv := newTestSigner(t)
+	srv := startTestSSHServer(t, signer.PublicKey())
+	echo := startEchoServer(t)
+	echoHost, echoPort, _ := net.SplitHostPort(echo)
+	keyPath := writeClientKey(t, t.TempDir(), priv)
+
+	port := freeLocalPort(t)
+	fwd := LocalForward{LocalPort: port, RemoteHost: echoHost}
+	fwd.RemotePort, _ = net.LookupPort("tcp", echoPort)
+
+	c := newTestClient(t, srv, "-i", keyPath, "-o", "StrictHostKeyChecking=no")
+	c.cfg.LocalForwards = []LocalForward{fwd}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", fwd.LocalAddr(), time.Second)
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo got=%q err=%v", got, err)
+	}
+	_ = conn.Close()
+
+	// A second client cannot bind the same port while the first holds it.
+	busy := newTestClient(t, srv, "-i", keyPath, "-o", "StrictHostKeyChecking=no")
+	busy.cfg.LocalForwards = []LocalForward{fwd}
+	if err := busy.Start(); err == nil {
+		_ = busy.Stop(time.Second)
+		t.Fatalf("expected a taken forward port to fail the start")
+	}
+
+	// Once stopped, the port is free for the restarted tunnel.
+	_ = c.Stop(time.Second)
+	<-c.Done()
+	ln, err := net.Listen("tcp", fwd.LocalAddr())
+	if err != nil {
+		t.Fatalf("forward port still bound after Done: %v", err)
+	}
+	_ = ln.Close()
+}
@@ -0,0 +1,169 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// JumpHost is one bastion on the way to the tunnel host. Hops are listed in
+// connection order: the first is dialed directly, each later one through the
+// hops before it.
+type JumpHost struct {
+	Host string
+	// Port defaults to 22.
+	Port int
+	// User defaults to the tunnel host's user, with either backend.
+	User string
+	// IdentityFile is an optional private key for this hop only.
+	IdentityFile string
+}
+
+func (h JumpHost) port() int {
+	if h.Port == 0 {
+		return 22
+	}
+	return h.Port
+}
+
+func (h JumpHost) addr() string {
+	return net.JoinHostPort(strings.TrimSpace(h.Host), strconv.Itoa(h.port()))
+}
+
+func (h JumpHost) destination() string {
+	host := strings.TrimSpace(h.Host)
+	if user := strings.TrimSpace(h.User); user != "" {
+		return user + "@" + host
+	}
+	return host
+}
+
+// String renders the hop as [user@]host:port.
+func (h JumpHost) String() string {
+	if user := strings.TrimSpace(h.User); user != "" {
+		return user + "@" + h.addr()
+	}
+	return h.addr()
+}
+
+// withHopUsers returns hops with an empty User set to user, the tunnel
+// host's, so OpenSSH logs into bastions as the native client does.
+func withHopUsers(hops []JumpHost, user string) []JumpHost {
+	user = strings.TrimSpace(user)
+	if len(hops) == 0 || user == "" {
+		return hops
+	}
+	out := make([]JumpHost, len(hops))
+	for i, h := range hops {
+		if strings.TrimSpace(h.User) == "" {
+			h.User = user
+		}
+		out[i] = h
+	}
+	return out
+}
+
+// ValidateJumpHosts checks that every hop has a usable host and port.
+func ValidateJumpHosts(hops []JumpHost) error {
+	for i, h := range hops {
+		host := strings.TrimSpace(h.Host)
+		if host == "" {
+			return fmt.Errorf("jump host %d: host is required", i+1)
+		}
+		if strings.ContainsAny(host, " \t,@") || strings.ContainsAny(h.User, " \t,@:") {
+			return fmt.Errorf("jump host %d: invalid host or user %q", i+1, h.String())
+		}
+		// ssh would take a leading dash as an option, e.g. -oProxyCommand.
+		if strings.HasPrefix(host, "-") || strings.HasPrefix(h.User, "-") {
+			return fmt.Errorf("jump host %d: host and user must not start with '-': %q", i+1, h.String())
+		}
+		if h.Port < 0 || h.Port > 65535 {
+			return fmt.Errorf("jump host %d: invalid port %d", i+1, h.Port)
+		}
+	}
+	return nil
+}
+
+// JumpArgs returns the ssh arguments that route a connection through hops:
+// ProxyJump (-J) when no hop needs its own key, otherwise an equivalent
+// chain of ProxyCommand invocations, since ProxyJump cannot pass -i to the
+// intermediate connections.
+func JumpArgs(hops []JumpHost, batchMode bool) []string {
+	if len(hops) == 0 {
+		return nil
+	}
+	needCommand := false
+	specs := make([]string, 0, len(hops))
+	for _, h := range hops {
+		if strings.TrimSpace(h.IdentityFile) != "" {
+			needCommand = true
+		}
+		specs = append(specs, h.String())
+	}
+	if !needCommand {
+		return []string{"-J", strings.Join(specs, ",")}
+	}
+	return []string{"-o", "ProxyCommand=" + proxyCommand(hops, batchMode)}
+}
+
+// proxyCommand builds `ssh -W %h:%p` to the last hop, itself reached
+// through a nested ProxyCommand for the hops before it. Each nesting level
+// doubles its % signs because every ssh in the chain expands them once.
+func proxyCommand(hops []JumpHost, batchMode bool) string {
+	last := hops[len(hops)-1]
+	args := []string{"ssh"}
+	if batchMode {
+		args = append(args, "-o", "BatchMode=yes")
+	}
+	if id := strings.TrimSpace(last.IdentityFile); id != "" {
+		args = append(args, "-i", id)
+	}
+	args = append(args, "-p", strconv.Itoa(last.port()))
+	if len(hops) > 1 {
+		inner := proxyCommand(hops[:len(hops)-1], batchMode)
+		args = append(args, "-o", "ProxyCommand="+strings.ReplaceAll(inner, "%", "%%"))
+	}
+	args = append(args, "-W", "%h:%p", last.destination())
+
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s for the /bin/sh that runs a ProxyCommand.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ProbeArgs returns ssh arguments that log into hop i of c.JumpHosts through
+// the hops before it and exit, or into the tunnel host itself when i is
+// len(c.JumpHosts). It lets callers find where a chain breaks.
+func ProbeArgs(c TunnelConfig, i int) ([]string, error) {
+	if i < 0 || i > len(c.JumpHosts) {
+		return nil, errors.New("hop index out of range")
+	}
+	if err := ValidateJumpHosts(c.JumpHosts); err != nil {
+		return nil, err
+	}
+	hops := withHopUsers(c.JumpHosts, c.User)
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}
+	args = append(args, JumpArgs(hops[:i], true)...)
+	if i < len(hops) {
+		h := hops[i]
+		args = append(args, "-p", strconv.Itoa(h.port()))
+		if id := strings.TrimSpace(h.IdentityFile); id != "" {
+			args = append(args, "-i", id)
+		}
+		return append(args, h.destination(), "exit"), nil
+	}
+	args = append(args, "-p", strconv.Itoa(c.Port))
+	args = append(args, c.ExtraArgs...)
+	return append(args, c.destination(), "exit"), nil
+}
@@ -0,0 +1,184 @@
+package ssh
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJumpArgsUsesProxyJumpWithoutIdentities(t *testing.T) {
+	got := JumpArgs([]JumpHost{
+		{Host: "bastion1.example", User: "alice"},
+		{Host: "bastion2.example", Port: 2222},
+		{Host: "::1", Port: 22, User: "bob"},
+	}, true)
+	want := []string{"-J", "alice@bastion1.example:22,bastion2.example:2222,bob@[::1]:22"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("JumpArgs=%q want %q", got, want)
+	}
+	if got := JumpArgs(nil, true); got != nil {
+		t.Fatalf("expected no args without hops, got %q", got)
+	}
+}
+
+func TestJumpArgsBuildsNestedProxyCommandForIdentities(t *testing.T) {
+	got := JumpArgs([]JumpHost{
+		{Host: "b1", User: "alice", IdentityFile: "/keys/b1 key"},
+		{Host: "b2", Port: 2222, User: "bob"},
+	}, true)
+	// The inner command is a single shell word with its %-tokens doubled.
+	want := []string{
+		"-o",
+		"ProxyCommand=ssh -o BatchMode=yes -p 2222 " +
+			`-o 'ProxyCommand=ssh -o BatchMode=yes -i '\''/keys/b1 key'\'' -p 22 -W %%h:%%p alice@b1' ` +
+			"-W %h:%p bob@b2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("JumpArgs mismatch\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestBuildArgsIncludesJumpHosts(t *testing.T) {
+	args, err := BuildArgs(TunnelConfig{
+		Host:      "egress.example",
+		Port:      22,
+		User:      "me",
+		SocksPort: 1080,
+		JumpHosts: []JumpHost{{Host: "b1"}, {Host: "b2", User: "ops"}},
+		ExtraArgs: []string{"-i", "/tmp/key"},
+	})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	tail := args[len(args)-5:]
+	want := []string{"-J", "me@b1:22,ops@b2:22", "-i", "/tmp/key", "me@egress.example"}
+	if !reflect.DeepEqual(tail, want) {
+		t.Fatalf("args tail=%q want %q", tail, want)
+	}
+
+	if _, err := BuildArgs(TunnelConfig{Host: "h", Port: 22, SocksPort: 1080, JumpHosts: []JumpHost{{Host: " "}}}); err == nil {
+		t.Fatalf("expected error for a jump host without host")
+	}
+}
+
+func TestValidateJumpHosts(t *testing.T) {
+	tests := []struct {
+		name string
+		hop  JumpHost
+		ok   bool
+	}{
+		{name: "minimal", hop: JumpHost{Host: "b1"}, ok: true},
+		{name: "full", hop: JumpHost{Host: "b1", Port: 2222, User: "u", IdentityFile: "~/.ssh/b1"}, ok: true},
+		{name: "missing host", hop: JumpHost{}, ok: false},
+		{name: "comma in host", hop: JumpHost{Host: "a,b"}, ok: false},
+		{name: "user in host", hop: JumpHost{Host: "u@b1"}, ok: false},
+		{name: "bad port", hop: JumpHost{Host: "b1", Port: 70000}, ok: false},
+		{name: "option as host", hop: JumpHost{Host: "-oProxyCommand=touch /tmp/x"}, ok: false},
+		{name: "option as host without spaces", hop: JumpHost{Host: "-oProxyCommand=id"}, ok: false},
+		{name: "option as user", hop: JumpHost{Host: "b1", User: "-oProxyCommand=id"}, ok: false},
+		{name: "dash inside names", hop: JumpHost{Host: "jump-1.example.com", User: "svc-proxy"}, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJumpHosts([]JumpHost{tt.hop})
+			if (err == nil) != tt.ok {
+				t.Fatalf("ValidateJumpHosts(%+v) err=%v want ok=%v", tt.hop, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProbeArgsWalksTheChain(t *testing.T) {
+	cfg := TunnelConfig{
+		Host:      "egress",
+		Port:      22,
+		User:      "me",
+		JumpHosts: []JumpHost{{Host: "b1", User: "u1"}, {Host: "b2", Port: 2200, IdentityFile: "/k2"}},
+		ExtraArgs: []string{"-i", "/k"},
+	}
+	first, err := ProbeArgs(cfg, 0)
+	if err != nil {
+		t.Fatalf("ProbeArgs(0): %v", err)
+	}
+	if want := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10", "-p", "22", "u1@b1", "exit"}; !reflect.DeepEqual(first, want) {
+		t.Fatalf("hop 1 args=%q want %q", first, want)
+	}
+
+	second, err := ProbeArgs(cfg, 1)
+	if err != nil {
+		t.Fatalf("ProbeArgs(1): %v", err)
+	}
+	if want := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10", "-J", "u1@b1:22", "-p", "2200", "-i", "/k2", "me@b2", "exit"}; !reflect.DeepEqual(second, want) {
+		t.Fatalf("hop 2 args=%q want %q", second, want)
+	}
+
+	final, err := ProbeArgs(cfg, 2)
+	if err != nil {
+		t.Fatalf("ProbeArgs(2): %v", err)
+	}
+	joined := strings.Join(final, " ")
+	if !strings.Contains(joined, "ProxyCommand=") || !strings.HasSuffix(joined, "-p 22 -i /k me@egress exit") {
+		t.Fatalf("final args=%q", final)
+	}
+
+	if _, err := ProbeArgs(cfg, 3); err == nil {
+		t.Fatalf("expected out-of-range error")
+	}
+}
+
+func TestClientConnectsThroughJumpHost(t *testing.T) {
+	signer, priv := newTestSigner(t)
+	bastion := startTestSSHServer(t, signer.PublicKey())
+	egress := startTestSSHServer(t, signer.PublicKey())
+	echo := startEchoServer(t)
+
+	dir := t.TempDir()
+	keyPath := writeClientKey(t, dir, priv)
+	known := filepath.Join(dir, "known_hosts")
+	lines := bastion.KnownHostsLine() + "\n" + egress.KnownHostsLine() + "\n"
+	if err := os.WriteFile(known, []byte(lines), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	bHost, bPort := bastion.Addr()
+	c := newTestClient(t, egress, "-i", keyPath, "-o", "UserKnownHostsFile="+known)
+	c.cfg.JumpHosts = []JumpHost{{Host: bHost, Port: bPort, User: "hop", IdentityFile: keyPath}}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start through jump host: %v", err)
+	}
+	defer func() { _ = c.Stop(time.Second) }()
+
+	conn, err := c.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hop")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 3)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hop" {
+		t.Fatalf("echo got=%q err=%v", got, err)
+	}
+
+	// The bastion only carried the hop to the egress host.
+	bastion.mu.Lock()
+	dests := append([]string(nil), bastion.dests...)
+	bastion.mu.Unlock()
+	eHost, ePort := egress.Addr()
+	if len(dests) != 1 || dests[0] != (JumpHost{Host: eHost, Port: ePort}).addr() {
+		t.Fatalf("bastion forwarded %q", dests)
+	}
+
+	// Dropping the bastion tears down the whole chain.
+	bastion.DropClients()
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Done not closed after the jump host dropped")
+	}
+}
@@ -18,6 +18,12 @@ type TunnelConfig struct {
 	User      string
 	SocksPort int
 
+	// JumpHosts are bastions to pass through, in connection order.
+	JumpHosts []JumpHost
+
+	// LocalForwards are set up alongside the -D listener.
+	LocalForwards []LocalForward
+
 	// ExtraArgs are appended before the destination argument.
 	ExtraArgs []string
 
@@ -50,6 +56,12 @@ func BuildArgs(c TunnelConfig) ([]string, error) {
 	if c.SocksPort <= 0 || c.SocksPort > 65535 {
 		return nil, fmt.Errorf("invalid socks port %d", c.SocksPort)
 	}
+	if err := ValidateJumpHosts(c.JumpHosts); err != nil {
+		return nil, err
+	}
+	if err := ValidateLocalForwards(c.LocalForwards); err != nil {
+		return nil, err
+	}
 
 	args := []string{
 		"-N",
@@ -59,13 +71,17 @@ func BuildArgs(c TunnelConfig) ([]string, error) {
 		"-o", "ServerAliveCountMax=3",
 		"-o", "TCPKeepAlive=yes",
 		"-p", strconv.Itoa(c.Port),
-		"-D", "127.0.0.1:" + strconv.Itoa(c.SocksPort),
 	}
+	// ssh binds forwards in argument order and exits on the first failure,
+	// so the SOCKS port only comes up once every -L port is ours.
+	args = append(args, ForwardArgs(c.LocalForwards)...)
+	args = append(args, "-D", "127.0.0.1:"+strconv.Itoa(c.SocksPort))
 
 	if c.BatchMode {
 		args = append(args, "-o", "BatchMode=yes")
 	}
 
+	args = append(args, JumpArgs(withHopUsers(c.JumpHosts, c.User), c.BatchMode)...)
 	args = append(args, c.ExtraArgs...)
 	args = append(args, c.destination())
 	return args, nil
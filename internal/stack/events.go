@@ -0,0 +1,162 @@
+package stack
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventKind identifies a stack lifecycle transition.
+type EventKind string
+
+const (
+	// EventProxyListening: a local listener (HTTP or SOCKS) accepts
+	// connections on Addr.
+	EventProxyListening EventKind = "proxy-listening"
+	// EventTunnelStarting: a tunnel is being started, Attempt > 0 for
+	// restarts.
+	EventTunnelStarting EventKind = "tunnel-starting"
+	// EventTunnelReady: the tunnel accepts connections, after Elapsed.
+	EventTunnelReady EventKind = "tunnel-ready"
+	// EventTunnelExited: the tunnel exited or failed to come up, with Err.
+	EventTunnelExited EventKind = "tunnel-exited"
+	// EventRestartScheduled: the tunnel restarts after Delay because of Err.
+	EventRestartScheduled EventKind = "restart-scheduled"
+	// EventFailover: the tunnel moved from profile From to Profile.
+	EventFailover EventKind = "failover"
+	// EventGaveUp: the tunnel cannot be brought back and leaves rotation;
+	// once no tunnel is left, the stack reports Err on its fatal channel.
+	EventGaveUp EventKind = "gave-up"
+)
+
+// Event is one stack lifecycle transition. Fields that do not apply to the
+// kind are zero.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+
+	// Tunnel is the index of the parallel tunnel concerned.
+	Tunnel int
+	// Profile is the name of the profile supplying the tunnel.
+	Profile string
+	// From is the abandoned profile of a failover.
+	From string
+
+	// Listener ("http" or "socks") and Addr describe a listening proxy.
+	Listener string
+	Addr     string
+
+	// Attempt numbers the restart within the restart policy's window.
+	Attempt int
+	Delay   time.Duration
+	Elapsed time.Duration
+	Err     error
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case EventProxyListening:
+		return fmt.Sprintf("%s proxy listening on %s", e.Listener, e.Addr)
+	case EventTunnelStarting:
+		if e.Attempt > 0 {
+			return fmt.Sprintf("tunnel %d: restarting via profile %q (attempt %d)", e.Tunnel, e.Profile, e.Attempt)
+		}
+		return fmt.Sprintf("tunnel %d: starting via profile %q", e.Tunnel, e.Profile)
+	case EventTunnelReady:
+		return fmt.Sprintf("tunnel %d: ready via profile %q after %s", e.Tunnel, e.Profile, e.Elapsed.Round(time.Millisecond))
+	case EventTunnelExited:
+		return fmt.Sprintf("tunnel %d: profile %q exited: %v", e.Tunnel, e.Profile, e.Err)
+	case EventRestartScheduled:
+		return fmt.Sprintf("tunnel %d: restart %d in %s", e.Tunnel, e.Attempt, e.Delay)
+	case EventFailover:
+		return fmt.Sprintf("tunnel %d: failover from profile %q to %q: %v", e.Tunnel, e.From, e.Profile, e.Err)
+	case EventGaveUp:
+		return fmt.Sprintf("tunnel %d: giving up: %v", e.Tunnel, e.Err)
+	}
+	return string(e.Kind)
+}
+
+const (
+	// eventHistory is how many recent events a new subscriber is replayed.
+	eventHistory = 64
+	// eventBuffer is how far a subscriber may fall behind before it misses
+	// events.
+	eventBuffer = 64
+)
+
+// eventHub fans events out to subscribers without ever blocking the stack.
+// A nil hub drops everything, for stacks built without Start.
+type eventHub struct {
+	mu      sync.Mutex
+	history []Event
+	subs    map[chan Event]struct{}
+	closed  bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[chan Event]struct{}{}}
+}
+
+func (h *eventHub) publish(e Event) {
+	if h == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	if len(h.history) == eventHistory {
+		copy(h.history, h.history[1:])
+		h.history = h.history[:eventHistory-1]
+	}
+	h.history = append(h.history, e)
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventHistory+eventBuffer)
+	if h == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.history {
+		ch <- e
+	}
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *eventHub) close() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		close(ch)
+	}
+	h.subs = nil
+}
@@ -0,0 +1,144 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+)
+
+func TestEventHubReplaysRecentEvents(t *testing.T) {
+	h := newEventHub()
+	for i := 0; i < eventHistory+5; i++ {
+		h.publish(Event{Kind: EventRestartScheduled, Attempt: i})
+	}
+	ch, cancel := h.subscribe()
+	first := <-ch
+	if first.Attempt != 5 || first.Time.IsZero() {
+		t.Fatalf("expected the replay to start at the oldest kept event, got %+v", first)
+	}
+	for i := 1; i < eventHistory; i++ {
+		<-ch
+	}
+
+	h.publish(Event{Kind: EventGaveUp})
+	if e := <-ch; e.Kind != EventGaveUp {
+		t.Fatalf("expected the live event, got %+v", e)
+	}
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatalf("expected cancel to close the channel")
+	}
+
+	h.close()
+	late, _ := h.subscribe()
+	n := 0
+	for range late {
+		n++
+	}
+	if n != eventHistory {
+		t.Fatalf("late subscriber got %d events, want a closed replay of %d", n, eventHistory)
+	}
+}
+
+func TestEventHubNeverBlocksOnSlowSubscribers(t *testing.T) {
+	h := newEventHub()
+	slow, _ := h.subscribe()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10*eventBuffer; i++ {
+			h.publish(Event{Kind: EventTunnelStarting})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("publish blocked on a subscriber that does not read")
+	}
+	if got := len(slow); got != cap(slow) {
+		t.Fatalf("slow subscriber holds %d events, want a full buffer of %d", got, cap(slow))
+	}
+
+	var nilHub *eventHub
+	nilHub.publish(Event{})
+	if _, ok := <-func() <-chan Event { ch, _ := nilHub.subscribe(); return ch }(); ok {
+		t.Fatalf("expected a closed channel from a nil hub")
+	}
+}
+
+func TestStackPublishesLifecycleEvents(t *testing.T) {
+	var mu sync.Mutex
+	var tunnels []*fakeTunnel
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(localproxy.Dialer, localproxy.Options) httpProxy { return &fakeProxy{startAddr: "127.0.0.1:18080"} },
+		func(config.Profile, int) (tunnel, error) {
+			tun := newFakeTunnel(errors.New("connection reset"))
+			mu.Lock()
+			tunnels = append(tunnels, tun)
+			mu.Unlock()
+			return tun, nil
+		},
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	st, err := Start(config.Profile{Name: "work", Host: "h", Port: 22, User: "u"}, "inst-1", Options{SocksPort: 19090, Restart: RestartPolicy{InitialDelay: 3 * time.Second, Jitter: -1}})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	// Two subscribers attached after Start both see the start-up replayed.
+	a, cancelA := st.Subscribe()
+	b, _ := st.Subscribe()
+	defer cancelA()
+
+	expect := func(ch <-chan Event, kinds ...EventKind) []Event {
+		t.Helper()
+		var got []Event
+		for _, k := range kinds {
+			select {
+			case e := <-ch:
+				if e.Kind != k {
+					t.Fatalf("event %d: got %s (%s), want %s", len(got), e.Kind, e, k)
+				}
+				got = append(got, e)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timeout waiting for %s", k)
+			}
+		}
+		return got
+	}
+	startup := []EventKind{EventProxyListening, EventTunnelStarting, EventTunnelReady}
+	got := expect(a, startup...)
+	expect(b, startup...)
+	if got[0].Addr != "127.0.0.1:18080" || got[1].Profile != "work" || got[2].Attempt != 0 {
+		t.Fatalf("unexpected start-up events: %+v", got)
+	}
+
+	mu.Lock()
+	tunnels[0].exit()
+	mu.Unlock()
+	got = expect(a, EventTunnelExited, EventRestartScheduled, EventTunnelStarting, EventTunnelReady)
+	if got[0].Err == nil || got[1].Delay != 3*time.Second || got[1].Attempt != 1 || got[3].Attempt != 1 {
+		t.Fatalf("unexpected restart events: %+v", got)
+	}
+	if s := got[1].String(); s != "tunnel 0: restart 1 in 3s" {
+		t.Fatalf("String()=%q", s)
+	}
+	if !strings.Contains(got[0].String(), "connection reset") {
+		t.Fatalf("exit event lost its error: %s", got[0])
+	}
+
+	if err := st.Close(context.Background()); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	for range b {
+	}
+}
@@ -0,0 +1,154 @@
+package stack
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+)
+
+// tunnelSlot is one of the stack's parallel tunnels. Each slot has its own
+// backends (ssh -D ports and in-process clients cannot be shared) and
+// follows the failover group on its own.
+type tunnelSlot struct {
+	id int
+
+	mu        sync.Mutex
+	tunnel    tunnel
+	active    *backend
+	activeIdx int
+	backends  []*backend
+	healthy   bool
+	restarts  int
+	// gaveUp is set once the slot cannot be brought back; it stays out of
+	// rotation.
+	gaveUp bool
+	// stopCause is why RestartTunnels stopped the tunnel.
+	stopCause error
+	// lastErr is why the tunnel last exited or failed to start.
+	lastErr   error
+	lastErrAt time.Time
+
+	// conns counts connections dialed through the slot that are still open.
+	conns atomic.Int64
+	dials atomic.Uint64
+}
+
+func (t *tunnelSlot) currentTunnel() tunnel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tunnel
+}
+
+func (t *tunnelSlot) takeStopCause() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.stopCause
+	t.stopCause = nil
+	return err
+}
+
+func (t *tunnelSlot) recordError(err error) {
+	if err == nil {
+		return
+	}
+	t.mu.Lock()
+	t.lastErr = err
+	t.lastErrAt = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *tunnelSlot) setHealthy(ok bool) {
+	t.mu.Lock()
+	t.healthy = ok
+	t.mu.Unlock()
+}
+
+// dialer returns the slot's current dialer, or nil while it is out of
+// rotation.
+func (t *tunnelSlot) dialer() localproxy.Dialer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.healthy || t.active == nil {
+		return nil
+	}
+	return t.active.dialer
+}
+
+func (t *tunnelSlot) status() localproxy.UpstreamStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := localproxy.UpstreamStatus{
+		ID:       t.id,
+		Healthy:  t.healthy,
+		Restarts: t.restarts,
+		Conns:    t.conns.Load(),
+		Dials:    t.dials.Load(),
+	}
+	if t.active != nil {
+		st.Profile = t.active.profile.Name
+	}
+	if t.lastErr != nil {
+		st.LastError = t.lastErr.Error()
+		st.LastErrorAt = t.lastErrAt
+	}
+	return st
+}
+
+// poolDialer spreads dials across the healthy slots, picking the one with
+// the fewest open connections (the lowest id on ties).
+type poolDialer struct {
+	slots []*tunnelSlot
+}
+
+func (p *poolDialer) Dial(network, addr string) (net.Conn, error) {
+	var (
+		best *tunnelSlot
+		d    localproxy.Dialer
+	)
+	for _, slot := range p.slots {
+		sd := slot.dialer()
+		if sd == nil {
+			continue
+		}
+		if best == nil || slot.conns.Load() < best.conns.Load() {
+			best, d = slot, sd
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no healthy tunnel")
+	}
+
+	// Count the dial up front so concurrent dials spread out.
+	best.conns.Add(1)
+	best.dials.Add(1)
+	c, err := d.Dial(network, addr)
+	if err != nil {
+		best.conns.Add(-1)
+		return nil, err
+	}
+	return &slotConn{Conn: c, slot: best}, nil
+}
+
+func (p *poolDialer) statuses() []localproxy.UpstreamStatus {
+	out := make([]localproxy.UpstreamStatus, 0, len(p.slots))
+	for _, slot := range p.slots {
+		out = append(out, slot.status())
+	}
+	return out
+}
+
+// slotConn releases its slot's connection count on the first Close.
+type slotConn struct {
+	net.Conn
+	slot *tunnelSlot
+	once sync.Once
+}
+
+func (c *slotConn) Close() error {
+	c.once.Do(func() { c.slot.conns.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,321 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+)
+
+// pipeDialer hands out one end of a net.Pipe per dial and records its label.
+type pipeDialer struct {
+	label string
+	mu    *sync.Mutex
+	log   *[]string
+}
+
+func (d pipeDialer) Dial(string, string) (net.Conn, error) {
+	d.mu.Lock()
+	*d.log = append(*d.log, d.label)
+	d.mu.Unlock()
+	c, peer := net.Pipe()
+	go func() { _, _ = peer.Read(make([]byte, 1)); _ = peer.Close() }()
+	return c, nil
+}
+
+func newTestSlots(labels ...string) ([]*tunnelSlot, *[]string) {
+	var mu sync.Mutex
+	var log []string
+	slots := make([]*tunnelSlot, len(labels))
+	for i, l := range labels {
+		slots[i] = &tunnelSlot{
+			id:      i,
+			healthy: true,
+			active:  &backend{profile: config.Profile{Name: "p"}, dialer: pipeDialer{label: l, mu: &mu, log: &log}},
+		}
+	}
+	return slots, &log
+}
+
+func TestPoolDialerSpreadsByLeastLoad(t *testing.T) {
+	slots, log := newTestSlots("a", "b", "c")
+	pool := &poolDialer{slots: slots}
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := pool.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatalf("Dial %d: %v", i, err)
+		}
+		conns = append(conns, c)
+	}
+	if got := *log; len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("expected one connection per tunnel, got %q", got)
+	}
+
+	// Closing b's connection makes it the least loaded; closing twice
+	// must not release it twice.
+	_ = conns[1].Close()
+	_ = conns[1].Close()
+	if _, err := pool.Dial("tcp", "example.com:443"); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if got := (*log)[3]; got != "b" {
+		t.Fatalf("expected the least-loaded tunnel b, got %q", got)
+	}
+	if got := slots[1].conns.Load(); got != 1 {
+		t.Fatalf("tunnel b conns=%d want 1", got)
+	}
+
+	// An unhealthy tunnel is skipped even when it is the least loaded.
+	_ = conns[0].Close()
+	slots[0].setHealthy(false)
+	if _, err := pool.Dial("tcp", "example.com:443"); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if got := (*log)[4]; got == "a" {
+		t.Fatalf("unhealthy tunnel a was used")
+	}
+
+	for _, s := range slots {
+		s.setHealthy(false)
+	}
+	if _, err := pool.Dial("tcp", "example.com:443"); err == nil {
+		t.Fatalf("expected an error without healthy tunnels")
+	}
+
+	st := pool.statuses()
+	if len(st) != 3 || st[0].Dials != 1 || st[1].Dials != 3 || st[0].Healthy || st[0].Profile != "p" {
+		t.Fatalf("statuses=%+v", st)
+	}
+}
+
+func TestPoolDialerReleasesFailedDials(t *testing.T) {
+	slot := &tunnelSlot{healthy: true, active: &backend{dialer: fakeDialer{}}}
+	pool := &poolDialer{slots: []*tunnelSlot{slot}}
+	if _, err := pool.Dial("tcp", "example.com:443"); err == nil {
+		t.Fatalf("expected the dial error")
+	}
+	if got := slot.conns.Load(); got != 0 {
+		t.Fatalf("conns=%d after a failed dial", got)
+	}
+}
+
+func TestDialAndRestartOneTunnel(t *testing.T) {
+	slots, log := newTestSlots("a", "b")
+	a, b := newFakeTunnel(nil), newFakeTunnel(nil)
+	slots[0].tunnel, slots[1].tunnel = a, b
+	st := &Stack{slots: slots}
+
+	c, err := st.DialTunnel(1, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("DialTunnel: %v", err)
+	}
+	_ = c.Close()
+	if got := *log; len(got) != 1 || got[0] != "b" {
+		t.Fatalf("expected a dial through tunnel b, got %q", got)
+	}
+	if _, err := st.DialTunnel(2, "tcp", "example.com:443"); err == nil {
+		t.Fatalf("expected an error for a missing tunnel")
+	}
+	slots[0].setHealthy(false)
+	if _, err := st.DialTunnel(0, "tcp", "example.com:443"); err == nil {
+		t.Fatalf("expected an error for a tunnel out of rotation")
+	}
+
+	cause := errors.New("probe failed")
+	st.RestartTunnel(1, cause)
+	if b.stopCount() != 1 || a.stopCount() != 0 {
+		t.Fatalf("expected only tunnel 1 to restart")
+	}
+	if slots[1].stopCause != cause {
+		t.Fatalf("stopCause=%v", slots[1].stopCause)
+	}
+}
+
+func TestStartRunsParallelTunnels(t *testing.T) {
+	var mu sync.Mutex
+	var socksAddrs []string
+	tunnels := map[int]*fakeTunnel{}
+	restartReady := make(chan struct{})
+	var upstreams func() []localproxy.UpstreamStatus
+	var gotDialer localproxy.Dialer
+	withStackTestHooks(
+		t,
+		func(addr string, _ time.Duration) (localproxy.Dialer, error) {
+			mu.Lock()
+			socksAddrs = append(socksAddrs, addr)
+			mu.Unlock()
+			return labelDialer(addr), nil
+		},
+		func(d localproxy.Dialer, opts localproxy.Options) httpProxy {
+			gotDialer = d
+			upstreams = opts.Upstreams
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(_ config.Profile, socksPort int) (tunnel, error) {
+			tun := newFakeTunnel(errors.New("dropped"))
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := tunnels[socksPort]; ok {
+				// A restart: hold it until the test has looked at the pool.
+				return &gatedTunnel{fakeTunnel: tun, gate: restartReady}, nil
+			}
+			tunnels[socksPort] = tun
+			return tun, nil
+		},
+		func(_ string, _ time.Duration, tun tunnel) error {
+			if g, ok := tun.(*gatedTunnel); ok {
+				<-g.gate
+			}
+			return nil
+		},
+	)
+
+	st, err := Start(config.Profile{Name: "work", Host: "h", Port: 22, User: "u"}, "inst-1", Options{SocksPort: 19090, Tunnels: 3})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+
+	mu.Lock()
+	if len(socksAddrs) != 3 || socksAddrs[0] != "127.0.0.1:19090" || socksAddrs[1] == socksAddrs[2] {
+		mu.Unlock()
+		t.Fatalf("expected one SOCKS port per tunnel, got %q", socksAddrs)
+	}
+	second := tunnels[st.slots[1].backends[0].socksPort]
+	mu.Unlock()
+	if st.SocksPort != 19090 {
+		t.Fatalf("SocksPort=%d want the first tunnel's", st.SocksPort)
+	}
+	for _, u := range upstreams() {
+		if !u.Healthy || u.Profile != "work" {
+			t.Fatalf("expected healthy tunnels, got %+v", upstreams())
+		}
+	}
+
+	// While the second tunnel restarts it is out of rotation.
+	second.exit()
+	deadline := time.Now().Add(2 * time.Second)
+	for upstreams()[1].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel 1 stayed in rotation after exiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	secondAddr := "127.0.0.1:" + strconv.Itoa(st.slots[1].backends[0].socksPort)
+	for i := 0; i < 4; i++ {
+		if _, err := gotDialer.Dial("tcp", "example.com:443"); err == nil || err.Error() == secondAddr {
+			t.Fatalf("dial %d went to the restarting tunnel: %v", i, err)
+		}
+	}
+
+	close(restartReady)
+	deadline = time.Now().Add(2 * time.Second)
+	for u := upstreams()[1]; !u.Healthy || u.Restarts != 1; u = upstreams()[1] {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel 1 not back in rotation: %+v", u)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// gatedTunnel lets a test hold a restarted tunnel in its readiness wait.
+type gatedTunnel struct {
+	*fakeTunnel
+	gate chan struct{}
+}
+
+func TestStartKeepsServingWhenOneTunnelGivesUp(t *testing.T) {
+	var mu sync.Mutex
+	tunnels := map[int]*fakeTunnel{}
+	var gotDialer localproxy.Dialer
+	withStackTestHooks(
+		t,
+		func(addr string, _ time.Duration) (localproxy.Dialer, error) { return labelDialer(addr), nil },
+		func(d localproxy.Dialer, _ localproxy.Options) httpProxy {
+			gotDialer = d
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(_ config.Profile, socksPort int) (tunnel, error) {
+			tun := newFakeTunnel(errors.New("dropped"))
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := tunnels[socksPort]; ok {
+				// Restarts never come up.
+				tun.startErr = errors.New("bastion down")
+				return tun, nil
+			}
+			tunnels[socksPort] = tun
+			return tun, nil
+		},
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	st, err := Start(config.Profile{Name: "work", Host: "h", Port: 22, User: "u"}, "inst-1", Options{
+		SocksPort: 19090,
+		Tunnels:   2,
+		Restart:   RestartPolicy{Budget: 1},
+	})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+	events, unsubscribe := st.Subscribe()
+	defer unsubscribe()
+
+	mu.Lock()
+	first := tunnels[st.slots[0].backends[0].socksPort]
+	second := tunnels[st.slots[1].backends[0].socksPort]
+	mu.Unlock()
+
+	waitGaveUp := func(id int) {
+		t.Helper()
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Kind == EventGaveUp && e.Tunnel == id {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for tunnel %d to give up", id)
+			}
+		}
+	}
+
+	second.exit()
+	waitGaveUp(1)
+	select {
+	case err := <-st.Fatal():
+		t.Fatalf("expected the stack to keep serving on tunnel 0, got fatal %v", err)
+	default:
+	}
+	if u := st.Tunnels(); !u[0].Healthy || u[1].Healthy || !strings.Contains(u[1].LastError, "bastion down") {
+		t.Fatalf("expected only tunnel 0 in rotation, got %+v", u)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := gotDialer.Dial("tcp", "example.com:443"); err == nil || err.Error() != "127.0.0.1:19090" {
+			t.Fatalf("dial %d did not go to tunnel 0: %v", i, err)
+		}
+	}
+
+	// Once the last tunnel gives up too, the stack fails.
+	first.exit()
+	waitGaveUp(0)
+	select {
+	case err := <-st.Fatal():
+		if !strings.Contains(err.Error(), "bastion down") {
+			t.Fatalf("unexpected fatal error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for the stack to fail")
+	}
+}
@@ -0,0 +1,136 @@
+package stack
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+)
+
+// RestartPolicy decides how a dropped tunnel is restarted: with an
+// exponentially growing, jittered delay, until Budget restarts fall within
+// one Window, after which the tunnel fails over or the stack gives up.
+// Restarts age out of the window, so a tunnel that drops once a day always
+// restarts after InitialDelay while a flapping one backs off.
+type RestartPolicy struct {
+	// InitialDelay is the wait before the first restart (default 1s).
+	InitialDelay time.Duration
+	// MaxDelay caps the delay (default 1m).
+	MaxDelay time.Duration
+	// Multiplier grows the delay for each restart already in the window
+	// (default 2).
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction either way
+	// (default 0.2); negative disables it.
+	Jitter float64
+	// Budget is how many restarts Window allows (default 5 per 10m).
+	Budget int
+	Window time.Duration
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = time.Second
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = time.Minute
+	}
+	if p.MaxDelay < p.InitialDelay {
+		p.MaxDelay = p.InitialDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter == 0 {
+		p.Jitter = 0.2
+	}
+	if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if p.Budget <= 0 {
+		p.Budget = 5
+	}
+	if p.Window <= 0 {
+		p.Window = 10 * time.Minute
+	}
+	return p
+}
+
+// delay returns the wait before restart n of the window (counting from 1),
+// with r in [0, 1) choosing the jitter.
+func (p RestartPolicy) delay(n int, r float64) time.Duration {
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(n-1))
+	d = math.Min(d, float64(p.MaxDelay))
+	if p.Jitter > 0 {
+		d = math.Min(d*(1+p.Jitter*(2*r-1)), float64(p.MaxDelay))
+	}
+	return time.Duration(d)
+}
+
+// restartWindow counts one tunnel's restarts within the policy's window.
+type restartWindow struct {
+	policy RestartPolicy
+	times  []time.Time
+}
+
+// add records a restart at now and returns its number within the window,
+// or false without recording it once the budget is spent.
+func (w *restartWindow) add(now time.Time) (int, bool) {
+	cutoff := now.Add(-w.policy.Window)
+	kept := w.times[:0]
+	for _, t := range w.times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	w.times = kept
+	if len(w.times) >= w.policy.Budget {
+		return len(w.times), false
+	}
+	w.times = append(w.times, now)
+	return len(w.times), true
+}
+
+func (w *restartWindow) reset() { w.times = w.times[:0] }
+
+// ProfileRestartPolicy converts the profile's restart settings; unset
+// fields keep the defaults.
+func ProfileRestartPolicy(p config.Profile) (RestartPolicy, error) {
+	var out RestartPolicy
+	r := p.Restart
+	if r == nil {
+		return out, nil
+	}
+	for _, d := range []struct {
+		name string
+		in   string
+		out  *time.Duration
+	}{
+		{"initialDelay", r.InitialDelay, &out.InitialDelay},
+		{"maxDelay", r.MaxDelay, &out.MaxDelay},
+		{"window", r.Window, &out.Window},
+	} {
+		if d.in == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.in)
+		if err != nil || v <= 0 {
+			return out, fmt.Errorf("invalid restart %s %q", d.name, d.in)
+		}
+		*d.out = v
+	}
+	if r.Multiplier != 0 && r.Multiplier < 1 {
+		return out, fmt.Errorf("invalid restart multiplier %v (want at least 1)", r.Multiplier)
+	}
+	if r.Jitter > 1 {
+		return out, fmt.Errorf("invalid restart jitter %v (want at most 1)", r.Jitter)
+	}
+	if r.Budget < 0 {
+		return out, fmt.Errorf("invalid restart budget %d", r.Budget)
+	}
+	out.Multiplier = r.Multiplier
+	out.Jitter = r.Jitter
+	out.Budget = r.Budget
+	return out, nil
+}
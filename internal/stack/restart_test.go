@@ -0,0 +1,215 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+)
+
+func TestRestartPolicyDelay(t *testing.T) {
+	base := RestartPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Multiplier: 2, Jitter: -1}.withDefaults()
+	jittered := base
+	jittered.Jitter = 0.5
+	tests := []struct {
+		name   string
+		policy RestartPolicy
+		n      int
+		r      float64
+		want   time.Duration
+	}{
+		{name: "first", policy: base, n: 1, want: time.Second},
+		{name: "doubles", policy: base, n: 3, want: 4 * time.Second},
+		{name: "capped", policy: base, n: 6, want: 10 * time.Second},
+		{name: "jitter low", policy: jittered, n: 2, r: 0, want: time.Second},
+		{name: "jitter mid", policy: jittered, n: 2, r: 0.5, want: 2 * time.Second},
+		{name: "jitter high", policy: jittered, n: 2, r: 0.99, want: 2980 * time.Millisecond},
+		{name: "jitter stays under the cap", policy: jittered, n: 5, r: 0.99, want: 10 * time.Second},
+		{name: "defaults", policy: RestartPolicy{}.withDefaults(), n: 8, r: 0.5, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.delay(tt.n, tt.r); got != tt.want {
+				t.Fatalf("delay(%d, %v)=%s want %s", tt.n, tt.r, got, tt.want)
+			}
+		})
+	}
+}
+
+// tunnelRun scripts one tunnel the monitor starts: it fails to start, or
+// runs for uptime on the fake clock and exits, or stays up.
+type tunnelRun struct {
+	startErr error
+	uptime   time.Duration
+	stay     bool
+}
+
+func TestMonitorRestartPolicy(t *testing.T) {
+	policy := RestartPolicy{InitialDelay: time.Second, MaxDelay: 8 * time.Second, Budget: 5, Window: 10 * time.Minute, Jitter: -1}
+	down := errors.New("bastion down")
+	flap := tunnelRun{uptime: 5 * time.Second}
+	tests := []struct {
+		name       string
+		policy     RestartPolicy
+		runs       []tunnelRun
+		wantSleeps []time.Duration
+		wantFatal  string
+	}{
+		{
+			name:       "flapping tunnel backs off until the budget is spent",
+			policy:     policy,
+			runs:       []tunnelRun{flap, flap, flap, flap, flap},
+			wantSleeps: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second},
+			wantFatal:  "ssh tunnel restarted 5 times within 10m0s",
+		},
+		{
+			name:       "brief outage retries failed starts",
+			policy:     policy,
+			runs:       []tunnelRun{{startErr: down}, {startErr: down}, {stay: true}},
+			wantSleeps: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:       "outage longer than the budget gives up",
+			policy:     RestartPolicy{InitialDelay: time.Second, Budget: 2, Jitter: -1},
+			runs:       []tunnelRun{{startErr: down}, {startErr: down}},
+			wantSleeps: []time.Duration{1 * time.Second, 2 * time.Second},
+			wantFatal:  "bastion down",
+		},
+		{
+			name:   "restarts age out of the window",
+			policy: RestartPolicy{InitialDelay: time.Second, Budget: 2, Window: 10 * time.Minute, Jitter: -1},
+			runs: []tunnelRun{
+				{uptime: 6 * time.Minute},
+				{uptime: 6 * time.Minute},
+				{uptime: 6 * time.Minute},
+				{stay: true},
+			},
+			// The first restart has aged out by the third, which is again
+			// the second within the window.
+			wantSleeps: []time.Duration{1 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				now    = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+				sleeps []time.Duration
+				runs   = tt.runs
+			)
+			stayed := make(chan struct{})
+			withStackTestHooks(t, nil, nil, func(config.Profile, int) (tunnel, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if len(runs) == 0 {
+					t.Errorf("unexpected extra restart")
+					return nil, errors.New("script exhausted")
+				}
+				run := runs[0]
+				runs = runs[1:]
+				tun := newFakeTunnel(errors.New("connection reset"))
+				switch {
+				case run.startErr != nil:
+					tun.startErr = run.startErr
+				case run.stay:
+					close(stayed)
+				default:
+					now = now.Add(run.uptime)
+					tun.exit()
+				}
+				return tun, nil
+			}, func(string, time.Duration, tunnel) error { return nil })
+			sleepForRestart = func(d time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+				sleeps = append(sleeps, d)
+				now = now.Add(d)
+			}
+			nowForRestart = func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+
+			initial := newFakeTunnel(errors.New("connection reset"))
+			initial.exit()
+			s := &Stack{
+				Profile: config.Profile{Host: "h", Port: 22, User: "u"},
+				slots:   []*tunnelSlot{{tunnel: initial}},
+				fatalCh: make(chan error, 1),
+				stopCh:  make(chan struct{}),
+			}
+			done := make(chan struct{})
+			go func() {
+				s.monitor(s.slots[0], Options{Restart: tt.policy})
+				close(done)
+			}()
+			defer func() {
+				_ = s.Close(context.Background())
+				<-done
+			}()
+
+			select {
+			case err := <-s.fatalCh:
+				if tt.wantFatal == "" || !strings.Contains(err.Error(), tt.wantFatal) {
+					t.Fatalf("fatal error %v, want %q", err, tt.wantFatal)
+				}
+			case <-stayed:
+				if tt.wantFatal != "" {
+					t.Fatalf("tunnel recovered, want fatal %q", tt.wantFatal)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timeout")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(sleeps, tt.wantSleeps) {
+				t.Fatalf("sleeps=%v want %v", sleeps, tt.wantSleeps)
+			}
+		})
+	}
+}
+
+func TestProfileRestartPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		restart *config.RestartPolicy
+		want    RestartPolicy
+		wantErr string
+	}{
+		{name: "unset"},
+		{
+			name:    "full",
+			restart: &config.RestartPolicy{InitialDelay: "500ms", MaxDelay: "30s", Multiplier: 3, Jitter: -1, Budget: 10, Window: "1h"},
+			want:    RestartPolicy{InitialDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second, Multiplier: 3, Jitter: -1, Budget: 10, Window: time.Hour},
+		},
+		{name: "bad duration", restart: &config.RestartPolicy{Window: "10"}, wantErr: `invalid restart window "10"`},
+		{name: "negative duration", restart: &config.RestartPolicy{MaxDelay: "-1s"}, wantErr: "invalid restart maxDelay"},
+		{name: "shrinking multiplier", restart: &config.RestartPolicy{Multiplier: 0.5}, wantErr: "invalid restart multiplier"},
+		{name: "jitter above one", restart: &config.RestartPolicy{Jitter: 1.5}, wantErr: "invalid restart jitter"},
+		{name: "negative budget", restart: &config.RestartPolicy{Budget: -1}, wantErr: "invalid restart budget"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := config.Profile{Host: "h", Port: 22, User: "u", Restart: tt.restart}
+			got, err := ProfileRestartPolicy(p)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err=%v want %q", err, tt.wantErr)
+				}
+				if ValidateProfile(p) == nil {
+					t.Fatalf("ValidateProfile accepted the invalid policy")
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %+v, %v want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
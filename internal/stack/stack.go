@@ -4,21 +4,34 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/env"
+	"github.com/baaaaaaaka/claude_code_helper/internal/ids"
 	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+	"github.com/baaaaaaaka/claude_code_helper/internal/manager"
 	"github.com/baaaaaaaka/claude_code_helper/internal/ssh"
 )
 
 type httpProxy interface {
 	Start(listenAddr string) (string, error)
+	Drain(ctx context.Context) localproxy.DrainResult
 	Close(ctx context.Context) error
 }
 
+type socksServer interface {
+	Start(listenAddr string) (string, error)
+	CloseListener() error
+	Close() error
+}
+
 type tunnel interface {
 	Start() error
 	Stop(grace time.Duration) error
@@ -27,11 +40,26 @@ type tunnel interface {
 }
 
 var (
-	newSOCKS5Dialer    = localproxy.NewSOCKS5Dialer
-	newHTTPProxy       = func(d localproxy.Dialer, opts localproxy.Options) httpProxy { return localproxy.NewHTTPProxy(d, opts) }
-	newTunnelForStack  = func(profile config.Profile, socksPort int) (tunnel, error) { return newTunnel(profile, socksPort) }
+	newSOCKS5Dialer = localproxy.NewSOCKS5Dialer
+	newHTTPProxy    = func(d localproxy.Dialer, opts localproxy.Options) httpProxy { return localproxy.NewHTTPProxy(d, opts) }
+	newSOCKSServer  = func(d localproxy.Dialer, opts localproxy.SOCKSOptions) socksServer {
+		return localproxy.NewSOCKSServer(d, opts)
+	}
+	newUpstreamDialer = localproxy.NewHTTPConnectDialer
+	newDirectDialer   = localproxy.NewDirectDialer
+	newTunnelForStack = func(profile config.Profile, socksPort int) (tunnel, error) {
+		if profile.IsHTTPProxy() {
+			return newUpstreamWatch(profile)
+		}
+		if profile.UsesNativeSSH() {
+			return newNativeTunnel(profile)
+		}
+		return newTunnel(profile, socksPort)
+	}
 	waitForTunnelReady = waitForTCPTunnel
 	sleepForRestart    = time.Sleep
+	nowForRestart      = time.Now
+	restartJitter      = rand.Float64
 )
 
 type Options struct {
@@ -40,43 +68,230 @@ type Options struct {
 
 	SocksReadyTimeout time.Duration
 
-	MaxRestarts     int
-	RestartBackoff  time.Duration
+	// ProxyAuthToken reuses an existing listener credential. When empty and
+	// the profile enables ProxyAuth, a random token is generated.
+	ProxyAuthToken string
+
+	// SOCKSListenAddr starts an authenticated local SOCKS5 listener on this
+	// address. When empty, one is started on a free port only if the profile
+	// enables ExposeSOCKS.
+	SOCKSListenAddr string
+	// SOCKSAuthToken reuses an existing SOCKS5 credential. When empty and
+	// the SOCKS5 listener is enabled, a random token is generated.
+	SOCKSAuthToken string
+
+	// AccessLogPath enables the per-connection JSONL access log of the HTTP
+	// proxy at this path, rotated by size.
+	AccessLogPath string
+
+	// Version is reported on the proxy's metrics endpoint.
+	Version string
+
+	// DrainTimeout bounds how long Close waits for open CONNECT tunnels to
+	// finish before force-closing them.
+	DrainTimeout time.Duration
+	// TunnelIdleTimeout closes CONNECT tunnels idle for this long. Zero uses
+	// the profile's TunnelIdleTimeout, which is off by default.
+	TunnelIdleTimeout time.Duration
+
+	// Restart is the policy for restarting a tunnel that drops.
+	Restart         RestartPolicy
 	TunnelStopGrace time.Duration
+
+	// Tunnels is how many tunnels the stack keeps open in parallel (default
+	// 1). The listeners spread new connections across the healthy ones by
+	// least load, and each is monitored and restarted on its own.
+	// http-proxy profiles always use one.
+	Tunnels int
+
+	// Failover lists profiles whose tunnels replace the primary one, in
+	// order, when it cannot start or exhausts its restart budget. They only
+	// supply the tunnel: listener settings (auth, rules, routes, SOCKS) stay
+	// those of the primary profile, so the proxy URL does not change.
+	Failover []config.Profile
+	// OnFailover is called after the stack switches to another profile.
+	OnFailover func(FailoverEvent)
+}
+
+// FailoverEvent records a switch of the stack's tunnel from one profile of
+// its failover group to the next.
+type FailoverEvent struct {
+	// Tunnel is the index of the parallel tunnel that switched.
+	Tunnel int
+	From   config.Profile
+	To     config.Profile
+	// Err is why From was abandoned.
+	Err error
+}
+
+func (e FailoverEvent) String() string {
+	return fmt.Sprintf("tunnel %d: failover from profile %q to %q: %v", e.Tunnel, e.From.Name, e.To.Name, e.Err)
 }
 
 type Stack struct {
 	InstanceID string
 	Profile    config.Profile
 
+	// SocksPort is the primary profile's ssh -D port; 0 for http-proxy
+	// profiles and the native SSH backend. Failover profiles use their own.
 	SocksPort int
 	HTTPAddr  string
 	HTTPPort  int
 
+	// ProxyAuthToken is the listener credential, empty when auth is disabled.
+	ProxyAuthToken string
+
+	// SOCKSListenPort is the local SOCKS5 listener port, 0 when disabled, and
+	// SOCKSAuthToken its credential.
+	SOCKSListenPort int
+	SOCKSAuthToken  string
+
 	mu     sync.Mutex
 	proxy  httpProxy
-	tunnel tunnel
+	socks  socksServer
+	alog   *localproxy.AccessLog
 	closed bool
 
+	metrics *localproxy.Metrics
+
+	drainTimeout time.Duration
+
+	// group is the primary profile followed by its failover profiles.
+	// slots are the parallel tunnels; each follows the group on its own.
+	group      []config.Profile
+	slots      []*tunnelSlot
+	failoverMu sync.Mutex
+	failovers  int
+	onFailover func(FailoverEvent)
+
+	events  *eventHub
 	fatalCh chan error
 	stopCh  chan struct{}
 }
 
 // ValidateProfile returns an error if the profile is missing required fields
-// for starting a proxy stack (host, port, user).
+// for starting a proxy stack (host, port, user for SSH profiles; the upstream
+// URL for http-proxy profiles).
 func ValidateProfile(p config.Profile) error {
-	if p.Host == "" {
-		return errors.New("profile host is required")
+	switch p.Type {
+	case "", config.ProfileTypeSSH:
+		if p.Host == "" {
+			return errors.New("profile host is required")
+		}
+		if p.Port <= 0 {
+			return errors.New("profile port is required")
+		}
+		if p.User == "" {
+			return errors.New("profile user is required")
+		}
+		switch p.SSHBackend {
+		case "", config.SSHBackendOpenSSH, config.SSHBackendNative:
+		default:
+			return fmt.Errorf("unknown sshBackend %q (want openssh or native)", p.SSHBackend)
+		}
+		if err := ssh.ValidateJumpHosts(JumpHosts(p)); err != nil {
+			return err
+		}
+		if err := ssh.ValidateLocalForwards(LocalForwards(p)); err != nil {
+			return err
+		}
+	case config.ProfileTypeHTTPProxy:
+		if len(p.LocalForwards) > 0 {
+			return errors.New("localForwards need an SSH profile")
+		}
+		if p.UpstreamProxy == "" {
+			return errors.New("profile upstreamProxy is required")
+		}
+		if _, err := localproxy.ParseUpstreamProxyURL(p.UpstreamProxy); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown profile type %q", p.Type)
+	}
+	if p.Tunnels < 0 {
+		return fmt.Errorf("invalid tunnels %d", p.Tunnels)
 	}
-	if p.Port <= 0 {
-		return errors.New("profile port is required")
+	if _, err := ProfileRestartPolicy(p); err != nil {
+		return err
 	}
-	if p.User == "" {
-		return errors.New("profile user is required")
+	if _, err := ProfileTunnelIdleTimeout(p); err != nil {
+		return err
+	}
+	rules, err := destinationRules(p)
+	if err != nil {
+		return err
+	}
+	if p.HealthProbe != "" {
+		target, err := manager.ParseProbeTarget(p.HealthProbe)
+		if err != nil {
+			return err
+		}
+		if !rules.Allowed(target.Addr) {
+			return fmt.Errorf("healthProbe %s is blocked by the profile's destination rules", target)
+		}
+	}
+	if _, err := RoutingTable(p); err != nil {
+		return err
 	}
 	return nil
 }
 
+// ProfileTunnelIdleTimeout parses the profile's TunnelIdleTimeout; 0 leaves
+// idle tunnels open.
+func ProfileTunnelIdleTimeout(p config.Profile) (time.Duration, error) {
+	s := strings.TrimSpace(p.TunnelIdleTimeout)
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid tunnelIdleTimeout %q", p.TunnelIdleTimeout)
+	}
+	return d, nil
+}
+
+// RoutingTable compiles the profile's split-routing rules, or returns nil
+// when every destination goes through the tunnel.
+func RoutingTable(p config.Profile) (*localproxy.RoutingTable, error) {
+	if len(p.Routes) == 0 && p.DefaultRoute == "" {
+		return nil, nil
+	}
+	rules := make([]localproxy.RouteRule, 0, len(p.Routes))
+	for _, r := range p.Routes {
+		rules = append(rules, localproxy.RouteRule{Pattern: r.Match, Action: r.Via})
+	}
+	return localproxy.ParseRoutingTable(rules, p.DefaultRoute)
+}
+
+func destinationRules(p config.Profile) (*localproxy.DestinationRules, error) {
+	if len(p.AllowDestinations) == 0 && len(p.DenyDestinations) == 0 {
+		return nil, nil
+	}
+	return localproxy.ParseDestinationRules(p.AllowDestinations, p.DenyDestinations)
+}
+
+// pacBypass lists what /proxy.pac sends DIRECT: the NO_PROXY entries child
+// processes get, plus the leading direct routes whose meaning PAC can express
+// exactly (wildcards, IPs and CIDRs without a port). Collection stops at
+// the first non-direct rule since it may shadow later ones; anything left out
+// still goes direct, via the proxy.
+func pacBypass(routes *localproxy.RoutingTable) []string {
+	out := env.NoProxyEntries(os.Environ())
+	for _, r := range routes.Rules() {
+		if r.Action != localproxy.RouteDirect {
+			break
+		}
+		p := r.Pattern
+		if _, _, err := net.SplitHostPort(p); err == nil {
+			continue
+		}
+		if strings.HasPrefix(p, "*") || strings.Contains(p, "/") || net.ParseIP(strings.Trim(p, "[]")) != nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
 func Start(profile config.Profile, instanceID string, opts Options) (*Stack, error) {
 	if err := ValidateProfile(profile); err != nil {
 		return nil, err
@@ -88,88 +303,274 @@ func Start(profile config.Profile, instanceID string, opts Options) (*Stack, err
 	if opts.HTTPListenAddr == "" {
 		opts.HTTPListenAddr = "127.0.0.1:0"
 	}
-	if opts.MaxRestarts <= 0 {
-		opts.MaxRestarts = 3
-	}
-	if opts.RestartBackoff <= 0 {
-		opts.RestartBackoff = 1 * time.Second
-	}
+	opts.Restart = opts.Restart.withDefaults()
 	if opts.TunnelStopGrace <= 0 {
 		opts.TunnelStopGrace = 2 * time.Second
 	}
 	if opts.SocksReadyTimeout <= 0 {
 		opts.SocksReadyTimeout = 30 * time.Second
 	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = DefaultDrainTimeout
+	}
+	if opts.TunnelIdleTimeout <= 0 {
+		// Already checked by ValidateProfile.
+		opts.TunnelIdleTimeout, _ = ProfileTunnelIdleTimeout(profile)
+	}
+
+	rules, err := destinationRules(profile)
+	if err != nil {
+		return nil, err
+	}
 
-	socksPort := opts.SocksPort
-	if socksPort == 0 {
-		p, err := pickFreePort()
+	for _, p := range opts.Failover {
+		if err := ValidateProfile(p); err != nil {
+			return nil, fmt.Errorf("failover profile %q: %w", p.Name, err)
+		}
+	}
+	if opts.Tunnels <= 0 || profile.IsHTTPProxy() {
+		opts.Tunnels = 1
+	}
+	group := append([]config.Profile{profile}, opts.Failover...)
+	slots := make([]*tunnelSlot, opts.Tunnels)
+	for i := range slots {
+		socksPort := 0
+		if i == 0 {
+			socksPort = opts.SocksPort
+		}
+		primary, err := newBackend(slotProfile(profile, i), socksPort)
 		if err != nil {
 			return nil, err
 		}
-		socksPort = p
+		slots[i] = &tunnelSlot{id: i, backends: make([]*backend, len(group))}
+		slots[i].backends[0] = primary
 	}
+	pool := &poolDialer{slots: slots}
+	var dialer localproxy.Dialer = pool
 
-	socksAddr := fmt.Sprintf("127.0.0.1:%d", socksPort)
-	dialer, err := newSOCKS5Dialer(socksAddr, 10*time.Second)
+	routes, err := RoutingTable(profile)
 	if err != nil {
 		return nil, err
 	}
+	if routes != nil {
+		dialer = localproxy.NewRoutingDialer(routes, dialer, newDirectDialer(10*time.Second))
+	}
+
+	socksEnabled := opts.SOCKSListenAddr != "" || profile.ExposeSOCKS
+	if socksEnabled && opts.SOCKSListenAddr == "" {
+		opts.SOCKSListenAddr = "127.0.0.1:0"
+	}
+
+	authToken := opts.ProxyAuthToken
+	if authToken == "" && profile.ProxyAuth {
+		authToken, err = ids.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+	socksToken := opts.SOCKSAuthToken
+	if socksToken == "" && socksEnabled {
+		socksToken, err = ids.New()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	hp := newHTTPProxy(dialer, localproxy.Options{InstanceID: instanceID})
+	// Both listeners share the counters and the tunnel registry, so that
+	// draining the HTTP proxy also drains SOCKS5 tunnels.
+	var alog *localproxy.AccessLog
+	metrics := localproxy.NewMetrics()
+	conns := localproxy.NewConnRegistry()
+	proxyOpts := localproxy.Options{
+		InstanceID: instanceID,
+		Rules:      rules,
+		AuthToken:  authToken,
+		Metrics:    metrics,
+		Conns:      conns,
+		Version:    opts.Version,
+		PACBypass:  pacBypass(routes),
+		Upstreams:  pool.statuses,
+
+		TunnelIdleTimeout: opts.TunnelIdleTimeout,
+	}
+	if opts.AccessLogPath != "" {
+		alog, err = localproxy.OpenAccessLog(opts.AccessLogPath, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		proxyOpts.AccessLog = alog
+	}
+	closeAccessLog := func() {
+		if alog != nil {
+			_ = alog.Close()
+		}
+	}
+
+	events := newEventHub()
+	hp := newHTTPProxy(dialer, proxyOpts)
 	httpAddr, err := hp.Start(opts.HTTPListenAddr)
 	if err != nil {
+		closeAccessLog()
 		return nil, err
 	}
+	events.publish(Event{Kind: EventProxyListening, Listener: "http", Addr: httpAddr})
 	_, portStr, err := net.SplitHostPort(httpAddr)
 	if err != nil {
 		_ = hp.Close(context.Background())
+		closeAccessLog()
 		return nil, err
 	}
 	httpPort, err := parsePort(portStr)
 	if err != nil {
 		_ = hp.Close(context.Background())
+		closeAccessLog()
 		return nil, err
 	}
 
-	tun, err := newTunnelForStack(profile, socksPort)
-	if err != nil {
-		_ = hp.Close(context.Background())
-		return nil, err
-	}
-	if err := tun.Start(); err != nil {
-		_ = hp.Close(context.Background())
-		return nil, err
+	var ss socksServer
+	socksListenPort := 0
+	if socksEnabled {
+		ss = newSOCKSServer(dialer, localproxy.SOCKSOptions{
+			InstanceID: instanceID,
+			AuthToken:  socksToken,
+			Rules:      rules,
+			AccessLog:  proxyOpts.AccessLog,
+			Metrics:    metrics,
+			Conns:      conns,
+		})
+		socksListenAddr, err := ss.Start(opts.SOCKSListenAddr)
+		if err != nil {
+			_ = hp.Close(context.Background())
+			closeAccessLog()
+			return nil, err
+		}
+		_, portStr, err := net.SplitHostPort(socksListenAddr)
+		if err == nil {
+			socksListenPort, err = parsePort(portStr)
+		}
+		if err != nil {
+			_ = ss.Close()
+			_ = hp.Close(context.Background())
+			closeAccessLog()
+			return nil, err
+		}
+		events.publish(Event{Kind: EventProxyListening, Listener: "socks", Addr: socksListenAddr})
 	}
-	if err := waitForTunnelReady(socksAddr, opts.SocksReadyTimeout, tun); err != nil {
-		_ = tun.Stop(opts.TunnelStopGrace)
+	closeListeners := func() {
+		if ss != nil {
+			_ = ss.Close()
+		}
 		_ = hp.Close(context.Background())
-		return nil, err
+		closeAccessLog()
 	}
 
 	s := &Stack{
-		InstanceID: instanceID,
-		Profile:    profile,
-		SocksPort:  socksPort,
-		HTTPAddr:   httpAddr,
-		HTTPPort:   httpPort,
-		proxy:      hp,
-		tunnel:     tun,
-		fatalCh:    make(chan error, 1),
-		stopCh:     make(chan struct{}),
+		InstanceID:      instanceID,
+		Profile:         profile,
+		SocksPort:       slots[0].backends[0].socksPort,
+		HTTPAddr:        httpAddr,
+		HTTPPort:        httpPort,
+		ProxyAuthToken:  authToken,
+		SOCKSListenPort: socksListenPort,
+		SOCKSAuthToken:  socksToken,
+		proxy:           hp,
+		socks:           ss,
+		alog:            alog,
+		metrics:         metrics,
+		drainTimeout:    opts.DrainTimeout,
+		group:           group,
+		slots:           slots,
+		onFailover:      opts.OnFailover,
+		events:          events,
+		fatalCh:         make(chan error, len(slots)),
+		stopCh:          make(chan struct{}),
 	}
 
-	go s.monitor(opts)
+	// Bring the tunnels up in parallel; any that cannot start (even after
+	// failing over) aborts the stack.
+	var wg sync.WaitGroup
+	startErrs := make([]error, len(slots))
+	for i, slot := range slots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := slot.backends[0]
+			tun, err := s.startBackend(slot, b, 0, opts)
+			if err == nil {
+				if !s.activate(slot, 0, b, tun, opts.TunnelStopGrace) {
+					startErrs[i] = errStackStopped
+				}
+				return
+			}
+			if err = s.failover(slot, opts, err); err != nil && !errors.Is(err, errStackStopped) {
+				s.events.publish(Event{Kind: EventGaveUp, Tunnel: slot.id, Profile: s.activeBackend(slot).profile.Name, Err: err})
+			}
+			startErrs[i] = err
+		}()
+	}
+	wg.Wait()
+	for _, err := range startErrs {
+		if err == nil {
+			continue
+		}
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		close(s.stopCh)
+		for _, slot := range slots {
+			if tun := slot.currentTunnel(); tun != nil {
+				_ = tun.Stop(opts.TunnelStopGrace)
+			}
+		}
+		closeListeners()
+		events.close()
+		return nil, err
+	}
+
+	for _, slot := range slots {
+		go s.monitor(slot, opts)
+	}
 	return s, nil
 }
 
+// HTTPProxyURL returns the listener URL, including credentials when the
+// listener requires them.
 func (s *Stack) HTTPProxyURL() string {
-	return fmt.Sprintf("http://127.0.0.1:%d", s.HTTPPort)
+	return localproxy.ProxyURL(s.HTTPPort, s.ProxyAuthToken)
+}
+
+// SOCKSProxyURL returns the socks5h:// URL of the local SOCKS5 listener, or
+// "" when the stack does not expose one.
+func (s *Stack) SOCKSProxyURL() string {
+	if s.SOCKSListenPort == 0 {
+		return ""
+	}
+	return localproxy.SOCKSProxyURL(s.SOCKSListenPort, s.SOCKSAuthToken)
 }
 
 func (s *Stack) Fatal() <-chan error { return s.fatalCh }
 
+// Subscribe returns a channel of the stack's lifecycle events, starting
+// with a replay of the recent ones so that a subscriber attached after
+// Start still sees the tunnels come up. The channel is closed by Shutdown
+// or by calling cancel. A subscriber that falls behind misses events
+// rather than stalling the stack.
+func (s *Stack) Subscribe() (<-chan Event, func()) {
+	return s.events.subscribe()
+}
+
+// DefaultDrainTimeout is how long Close waits for open tunnels by default.
+const DefaultDrainTimeout = 5 * time.Second
+
 func (s *Stack) Close(ctx context.Context) error {
+	_, err := s.Shutdown(ctx)
+	return err
+}
+
+// Shutdown closes the stack like Close, first draining open CONNECT tunnels
+// (bounded by ctx and the stack's drain timeout) while the tunnel is still
+// up, and reports how many finished versus were force-closed.
+func (s *Stack) Shutdown(ctx context.Context) (localproxy.DrainResult, error) {
 	select {
 	case <-s.stopCh:
 		// already closed
@@ -179,30 +580,64 @@ func (s *Stack) Close(ctx context.Context) error {
 
 	s.mu.Lock()
 	s.closed = true
-	tun := s.tunnel
 	proxy := s.proxy
-	s.tunnel = nil
+	socks := s.socks
+	alog := s.alog
 	s.proxy = nil
+	s.socks = nil
+	s.alog = nil
 	s.mu.Unlock()
 
+	// SOCKS5 tunnels are in the proxy's registry; stop new ones first.
+	if socks != nil {
+		_ = socks.CloseListener()
+	}
+	var drained localproxy.DrainResult
+	if proxy != nil {
+		timeout := s.drainTimeout
+		if timeout <= 0 {
+			timeout = DefaultDrainTimeout
+		}
+		dctx, cancel := context.WithTimeout(ctx, timeout)
+		drained = proxy.Drain(dctx)
+		cancel()
+	}
+
 	var firstErr error
-	if tun != nil {
+	for _, slot := range s.slots {
+		slot.mu.Lock()
+		tun := slot.tunnel
+		slot.tunnel = nil
+		slot.healthy = false
+		slot.mu.Unlock()
+		if tun == nil {
+			continue
+		}
 		if err := tun.Stop(2 * time.Second); err != nil && firstErr == nil {
 			firstErr = err
 		}
 	}
+	if socks != nil {
+		if err := socks.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
 	if proxy != nil {
 		if err := proxy.Close(ctx); err != nil && firstErr == nil {
 			firstErr = err
 		}
 	}
-	return firstErr
+	if alog != nil {
+		_ = alog.Close()
+	}
+	s.events.close()
+	return drained, firstErr
 }
 
-func (s *Stack) monitor(opts Options) {
-	restarts := 0
+func (s *Stack) monitor(slot *tunnelSlot, opts Options) {
+	window := restartWindow{policy: opts.Restart.withDefaults()}
 	for {
-		current := s.currentTunnel()
+		current := slot.currentTunnel()
 		if current == nil {
 			return
 		}
@@ -211,56 +646,355 @@ func (s *Stack) monitor(opts Options) {
 		if s.stopRequested() {
 			return
 		}
+		// Out of rotation until restart brings it back.
+		slot.setHealthy(false)
+		if cause := slot.takeStopCause(); cause != nil {
+			err = cause
+		}
+		slot.recordError(err)
+		s.events.publish(Event{Kind: EventTunnelExited, Tunnel: slot.id, Profile: s.activeBackend(slot).profile.Name, Err: err})
 
-		restarts++
-		if restarts > opts.MaxRestarts {
-			s.fatalCh <- fmt.Errorf("ssh tunnel exited too many times: %w", err)
+		if !s.restart(slot, opts, &window, err) {
 			return
 		}
+	}
+}
 
-		sleepForRestart(opts.RestartBackoff)
+// restart brings the slot's tunnel back after the policy's delay, retrying
+// failed starts, until the window's budget is spent; the slot then fails
+// over. It reports false when the stack stopped or gave up.
+func (s *Stack) restart(slot *tunnelSlot, opts Options, window *restartWindow, cause error) bool {
+	for {
+		b := s.activeBackend(slot)
+		n, ok := window.add(nowForRestart())
+		if !ok {
+			cause = fmt.Errorf("%s restarted %d times within %s: %w", tunnelKind(b.profile), n, window.policy.Window, cause)
+			if err := s.failover(slot, opts, cause); err != nil {
+				if !errors.Is(err, errStackStopped) {
+					s.giveUp(slot, err)
+				}
+				return false
+			}
+			window.reset()
+			return true
+		}
+
+		delay := window.policy.delay(n, restartJitter())
+		s.events.publish(Event{Kind: EventRestartScheduled, Tunnel: slot.id, Profile: b.profile.Name, Attempt: n, Delay: delay, Err: cause})
+		sleepForRestart(delay)
 		if s.stopRequested() {
-			return
+			return false
 		}
 
-		tun, terr := newTunnelForStack(s.Profile, s.SocksPort)
-		if terr != nil {
-			s.fatalCh <- terr
-			return
+		tun, err := s.startBackend(slot, b, n, opts)
+		if errors.Is(err, errStackStopped) {
+			return false
 		}
-		if s.stopRequested() {
-			return
+		if err != nil {
+			cause = err
+			continue
 		}
-		if terr := tun.Start(); terr != nil {
-			s.fatalCh <- terr
-			return
+		slot.mu.Lock()
+		idx := slot.activeIdx
+		slot.restarts++
+		slot.mu.Unlock()
+		if !s.activate(slot, idx, b, tun, opts.TunnelStopGrace) {
+			return false
 		}
-		if s.stopRequested() {
-			_ = tun.Stop(opts.TunnelStopGrace)
-			return
+		if s.metrics != nil {
+			s.metrics.TunnelRestarted()
 		}
-		if terr := waitForTunnelReady(fmt.Sprintf("127.0.0.1:%d", s.SocksPort), opts.SocksReadyTimeout, tun); terr != nil {
+		return true
+	}
+}
+
+var errStackStopped = errors.New("stack stopped")
+
+// startBackend starts a tunnel for the slot's backend b and waits until it
+// is usable; attempt counts restarts for the events. It returns
+// errStackStopped when the stack is closed in the meantime.
+func (s *Stack) startBackend(slot *tunnelSlot, b *backend, attempt int, opts Options) (tunnel, error) {
+	began := time.Now()
+	s.events.publish(Event{Kind: EventTunnelStarting, Tunnel: slot.id, Profile: b.profile.Name, Attempt: attempt})
+	failed := func(err error) (tunnel, error) {
+		slot.recordError(err)
+		s.events.publish(Event{Kind: EventTunnelExited, Tunnel: slot.id, Profile: b.profile.Name, Attempt: attempt, Err: err})
+		return nil, err
+	}
+
+	tun, err := newTunnelForStack(b.profile, b.socksPort)
+	if err != nil {
+		return failed(err)
+	}
+	if s.stopRequested() {
+		return nil, errStackStopped
+	}
+	if err := tun.Start(); err != nil {
+		return failed(err)
+	}
+	if s.stopRequested() {
+		_ = tun.Stop(opts.TunnelStopGrace)
+		return nil, errStackStopped
+	}
+	if err := waitForTunnelReady(b.readyAddr, opts.SocksReadyTimeout, tun); err != nil {
+		_ = tun.Stop(opts.TunnelStopGrace)
+		return failed(err)
+	}
+	for _, f := range LocalForwards(b.profile) {
+		if err := waitForTunnelReady(f.LocalAddr(), opts.SocksReadyTimeout, tun); err != nil {
 			_ = tun.Stop(opts.TunnelStopGrace)
-			s.fatalCh <- terr
-			return
+			return failed(fmt.Errorf("local forward %s: %w", f, err))
 		}
+	}
+	// A forward port answers for another process too; the tunnel exits when
+	// it could not bind one of them itself.
+	select {
+	case <-tun.Done():
+		return failed(fmt.Errorf("ssh tunnel exited while starting: %w", tun.Wait()))
+	default:
+	}
+	s.events.publish(Event{Kind: EventTunnelReady, Tunnel: slot.id, Profile: b.profile.Name, Attempt: attempt, Elapsed: time.Since(began)})
+	return tun, nil
+}
 
-		s.mu.Lock()
-		if s.closed {
-			s.mu.Unlock()
-			_ = tun.Stop(opts.TunnelStopGrace)
+// activate makes tun, started for the slot's backend i, the slot's tunnel
+// and puts the slot back into rotation. It reports false (and stops tun)
+// when the stack was closed meanwhile.
+func (s *Stack) activate(slot *tunnelSlot, i int, b *backend, tun tunnel, grace time.Duration) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		// Stopping can take the whole grace period; Close must not wait on it.
+		_ = tun.Stop(grace)
+		return false
+	}
+	b.native.set(tun)
+	slot.mu.Lock()
+	slot.tunnel = tun
+	slot.active = b
+	slot.activeIdx = i
+	slot.healthy = true
+	slot.mu.Unlock()
+	s.mu.Unlock()
+	return true
+}
+
+// failover moves the slot to the next profile of the group that comes up,
+// trying each other profile once in order (wrapping around to the primary).
+// When none does, or the group has a single profile, it returns cause
+// joined with the failover errors; errStackStopped when the stack stopped.
+func (s *Stack) failover(slot *tunnelSlot, opts Options, cause error) error {
+	slot.mu.Lock()
+	from := slot.activeIdx
+	slot.mu.Unlock()
+	var errs []error
+	for step := 1; step < len(s.group); step++ {
+		i := (from + step) % len(s.group)
+		b, err := s.backend(slot, i)
+		if err == nil {
+			var tun tunnel
+			tun, err = s.startBackend(slot, b, 0, opts)
+			if errors.Is(err, errStackStopped) {
+				return err
+			}
+			if err == nil {
+				if !s.activate(slot, i, b, tun, opts.TunnelStopGrace) {
+					return errStackStopped
+				}
+				s.failoverMu.Lock()
+				s.failovers++
+				if s.onFailover != nil {
+					s.onFailover(FailoverEvent{Tunnel: slot.id, From: s.group[from], To: s.group[i], Err: cause})
+				}
+				s.failoverMu.Unlock()
+				s.events.publish(Event{Kind: EventFailover, Tunnel: slot.id, From: s.group[from].Name, Profile: s.group[i].Name, Err: cause})
+				return nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("profile %q: %w", s.group[i].Name, err))
+	}
+	if len(errs) > 0 {
+		cause = fmt.Errorf("%w; failover failed: %w", cause, errors.Join(errs...))
+	}
+	return cause
+}
+
+// giveUp takes a slot that cannot be brought back out of rotation for
+// good. The other slots keep carrying traffic; only when none is left up
+// or restarting is cause sent on the fatal channel.
+func (s *Stack) giveUp(slot *tunnelSlot, cause error) {
+	slot.recordError(cause)
+	slot.mu.Lock()
+	slot.healthy = false
+	slot.gaveUp = true
+	slot.mu.Unlock()
+	s.events.publish(Event{Kind: EventGaveUp, Tunnel: slot.id, Profile: s.activeBackend(slot).profile.Name, Err: cause})
+
+	s.mu.Lock()
+	slots := s.slots
+	s.mu.Unlock()
+	for _, other := range slots {
+		other.mu.Lock()
+		left := !other.gaveUp
+		other.mu.Unlock()
+		if left {
 			return
 		}
-		s.tunnel = tun
-		s.mu.Unlock()
-		restarts = 0
 	}
+	s.fatalCh <- cause
 }
 
-func (s *Stack) currentTunnel() tunnel {
+// ActiveProfile returns the profile whose tunnel carries traffic, that of
+// the first tunnel when the stack runs several.
+func (s *Stack) ActiveProfile() config.Profile {
+	return s.activeBackend(s.primarySlot()).profile
+}
+
+// RestartTunnels stops every tunnel in rotation so that it is restarted
+// under the restart policy, as if it had exited with cause. It is for
+// tunnels that are up but no longer forward traffic; tunnels already
+// restarting are left alone.
+func (s *Stack) RestartTunnels(cause error) {
+	s.mu.Lock()
+	slots := s.slots
+	s.mu.Unlock()
+	for _, slot := range slots {
+		restartSlot(slot, cause)
+	}
+}
+
+// RestartTunnel is RestartTunnels for tunnel id (as in Tunnels) alone.
+func (s *Stack) RestartTunnel(id int, cause error) {
+	if slot := s.slot(id); slot != nil {
+		restartSlot(slot, cause)
+	}
+}
+
+func restartSlot(slot *tunnelSlot, cause error) {
+	slot.mu.Lock()
+	tun := slot.tunnel
+	if !slot.healthy {
+		tun = nil
+	}
+	if tun != nil {
+		slot.stopCause = cause
+	}
+	slot.mu.Unlock()
+	if tun != nil {
+		_ = tun.Stop(2 * time.Second)
+	}
+}
+
+// DialTunnel dials addr through tunnel id alone, bypassing the listener
+// with its rules and routes, to check that this tunnel forwards traffic.
+func (s *Stack) DialTunnel(id int, network, addr string) (net.Conn, error) {
+	slot := s.slot(id)
+	if slot == nil {
+		return nil, fmt.Errorf("no tunnel %d", id)
+	}
+	d := slot.dialer()
+	if d == nil {
+		return nil, fmt.Errorf("tunnel %d is out of rotation", id)
+	}
+	return d.Dial(network, addr)
+}
+
+func (s *Stack) slot(id int) *tunnelSlot {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.tunnel
+	if id < 0 || id >= len(s.slots) {
+		return nil
+	}
+	return s.slots[id]
+}
+
+// Tunnels reports the state of each parallel tunnel, as on the health
+// endpoint.
+func (s *Stack) Tunnels() []localproxy.UpstreamStatus {
+	s.mu.Lock()
+	slots := s.slots
+	s.mu.Unlock()
+	return (&poolDialer{slots: slots}).statuses()
+}
+
+// ActiveConnects returns how many CONNECT tunnels are open through the
+// listeners.
+func (s *Stack) ActiveConnects() int64 {
+	return s.metrics.ActiveConnects()
+}
+
+// Failovers returns how many times the stack's tunnels switched profiles.
+func (s *Stack) Failovers() int {
+	s.failoverMu.Lock()
+	defer s.failoverMu.Unlock()
+	return s.failovers
+}
+
+// activeBackend returns the slot's current backend, deriving one from
+// Profile and SocksPort for stacks built without Start.
+func (s *Stack) activeBackend(slot *tunnelSlot) *backend {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.active == nil {
+		slot.active = &backend{profile: s.Profile, socksPort: s.SocksPort, readyAddr: fmt.Sprintf("127.0.0.1:%d", s.SocksPort)}
+	}
+	return slot.active
+}
+
+func (s *Stack) backend(slot *tunnelSlot, i int) (*backend, error) {
+	slot.mu.Lock()
+	b := slot.backends[i]
+	slot.mu.Unlock()
+	if b != nil {
+		return b, nil
+	}
+	b, err := newBackend(slotProfile(s.group[i], slot.id), 0)
+	if err != nil {
+		return nil, err
+	}
+	slot.mu.Lock()
+	slot.backends[i] = b
+	slot.mu.Unlock()
+	return b, nil
+}
+
+func (s *Stack) tunnelReadyAddr() string {
+	return s.activeBackend(s.primarySlot()).readyAddr
+}
+
+// primarySlot returns the first tunnel slot, adding an empty one to stacks
+// built without Start.
+func (s *Stack) primarySlot() *tunnelSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.slots) == 0 {
+		s.slots = []*tunnelSlot{{}}
+	}
+	return s.slots[0]
+}
+
+// slotProfile returns p as run by tunnel slot id. Only the first tunnel
+// opens the local forwards, since each local port can be bound once.
+func slotProfile(p config.Profile, id int) config.Profile {
+	if id > 0 {
+		p.LocalForwards = nil
+	}
+	return p
+}
+
+func tunnelKind(p config.Profile) string {
+	if p.IsHTTPProxy() {
+		return "upstream proxy"
+	}
+	return "ssh tunnel"
+}
+
+// currentTunnel returns the first slot's tunnel.
+func (s *Stack) currentTunnel() tunnel {
+	if len(s.slots) == 0 {
+		return nil
+	}
+	return s.slots[0].currentTunnel()
 }
 
 func (s *Stack) stopRequested() bool {
@@ -274,17 +1008,139 @@ func (s *Stack) stopRequested() bool {
 
 func newTunnel(profile config.Profile, socksPort int) (*ssh.Tunnel, error) {
 	return ssh.NewTunnel(ssh.TunnelConfig{
-		Host:      profile.Host,
-		Port:      profile.Port,
-		User:      profile.User,
-		SocksPort: socksPort,
-		ExtraArgs: profile.SSHArgs,
-		BatchMode: true,
-		Stdout:    os.Stderr,
-		Stderr:    os.Stderr,
+		Host:          profile.Host,
+		Port:          profile.Port,
+		User:          profile.User,
+		SocksPort:     socksPort,
+		JumpHosts:     JumpHosts(profile),
+		LocalForwards: LocalForwards(profile),
+		ExtraArgs:     profile.SSHArgs,
+		BatchMode:     true,
+		Stdout:        os.Stderr,
+		Stderr:        os.Stderr,
+	})
+}
+
+func newNativeTunnel(profile config.Profile) (*ssh.Client, error) {
+	return ssh.NewClient(ssh.ClientConfig{
+		Host:          profile.Host,
+		Port:          profile.Port,
+		User:          profile.User,
+		JumpHosts:     JumpHosts(profile),
+		LocalForwards: LocalForwards(profile),
+		ExtraArgs:     profile.SSHArgs,
 	})
 }
 
+// LocalForwards converts the profile's -L forwards for the ssh package.
+func LocalForwards(p config.Profile) []ssh.LocalForward {
+	if len(p.LocalForwards) == 0 {
+		return nil
+	}
+	fwds := make([]ssh.LocalForward, 0, len(p.LocalForwards))
+	for _, f := range p.LocalForwards {
+		fwds = append(fwds, ssh.LocalForward{LocalPort: f.LocalPort, RemoteHost: f.RemoteHost, RemotePort: f.RemotePort})
+	}
+	return fwds
+}
+
+// JumpHosts converts the profile's bastions for the ssh package, defaulting
+// each hop's user to the profile's.
+func JumpHosts(p config.Profile) []ssh.JumpHost {
+	if len(p.JumpHosts) == 0 {
+		return nil
+	}
+	hops := make([]ssh.JumpHost, 0, len(p.JumpHosts))
+	for _, h := range p.JumpHosts {
+		user := h.User
+		if strings.TrimSpace(user) == "" {
+			user = p.User
+		}
+		hops = append(hops, ssh.JumpHost{Host: h.Host, Port: h.Port, User: user, IdentityFile: h.IdentityFile})
+	}
+	return hops
+}
+
+// tunnelDialer dials through the stack's current in-process SSH client, so
+// the listeners keep working across tunnel restarts.
+type tunnelDialer struct {
+	mu  sync.Mutex
+	cur localproxy.Dialer
+}
+
+func (d *tunnelDialer) set(t tunnel) {
+	if d == nil {
+		return
+	}
+	td, _ := t.(localproxy.Dialer)
+	d.mu.Lock()
+	d.cur = td
+	d.mu.Unlock()
+}
+
+func (d *tunnelDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	cur := d.cur
+	d.mu.Unlock()
+	if cur == nil {
+		return nil, errors.New("ssh tunnel not connected")
+	}
+	c, err := cur.Dial(network, addr)
+	if err != nil && ssh.IsChannelRejected(err) {
+		return nil, &localproxy.TargetDialError{Addr: addr, Err: err}
+	}
+	return c, err
+}
+
+// backend is one profile's side of the stack: the address probed after
+// (re)starting its tunnel (the ssh -D port, the upstream proxy for
+// http-proxy profiles, or the SSH server for the native backend) and the
+// dialer that reaches through it.
+type backend struct {
+	profile   config.Profile
+	socksPort int
+	readyAddr string
+	dialer    localproxy.Dialer
+	// native routes dials to the current in-process SSH client, if any.
+	native *tunnelDialer
+}
+
+func newBackend(profile config.Profile, socksPort int) (*backend, error) {
+	b := &backend{profile: profile}
+	switch {
+	case profile.UsesNativeSSH():
+		b.readyAddr = net.JoinHostPort(profile.Host, strconv.Itoa(profile.Port))
+		b.native = &tunnelDialer{}
+		b.dialer = b.native
+	case profile.IsHTTPProxy():
+		upstream, err := localproxy.ParseUpstreamProxyURL(profile.UpstreamProxy)
+		if err != nil {
+			return nil, err
+		}
+		b.readyAddr = upstream.Host
+		b.dialer, err = newUpstreamDialer(profile.UpstreamProxy, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if socksPort == 0 {
+			p, err := pickFreePort()
+			if err != nil {
+				return nil, err
+			}
+			socksPort = p
+		}
+		b.socksPort = socksPort
+		b.readyAddr = fmt.Sprintf("127.0.0.1:%d", socksPort)
+		var err error
+		b.dialer, err = newSOCKS5Dialer(b.readyAddr, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
 func waitForTCP(addr string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	var lastErr error
@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	gossh "golang.org/x/crypto/ssh"
+
 	"github.com/baaaaaaaka/claude_code_helper/internal/config"
 	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
 )
@@ -21,6 +26,10 @@ type fakeProxy struct {
 	startErr   error
 	closeErr   error
 	closeCalls int
+
+	drainCalls  int
+	drainResult localproxy.DrainResult
+	onDrain     func(ctx context.Context)
 }
 
 func (p *fakeProxy) Start(listenAddr string) (string, error) {
@@ -30,11 +39,41 @@ func (p *fakeProxy) Start(listenAddr string) (string, error) {
 	return p.startAddr, nil
 }
 
+func (p *fakeProxy) Drain(ctx context.Context) localproxy.DrainResult {
+	p.drainCalls++
+	if p.onDrain != nil {
+		p.onDrain(ctx)
+	}
+	return p.drainResult
+}
+
 func (p *fakeProxy) Close(context.Context) error {
 	p.closeCalls++
 	return p.closeErr
 }
 
+type fakeSOCKSServer struct {
+	listenAddr     string
+	opts           localproxy.SOCKSOptions
+	listenerClosed bool
+	closeCalls     int
+}
+
+func (s *fakeSOCKSServer) Start(listenAddr string) (string, error) {
+	s.listenAddr = listenAddr
+	return "127.0.0.1:11080", nil
+}
+
+func (s *fakeSOCKSServer) CloseListener() error {
+	s.listenerClosed = true
+	return nil
+}
+
+func (s *fakeSOCKSServer) Close() error {
+	s.closeCalls++
+	return nil
+}
+
 type fakeTunnel struct {
 	mu         sync.Mutex
 	waitErr    error
@@ -103,12 +142,20 @@ func withStackTestHooks(t *testing.T, dialerFn func(string, time.Duration) (loca
 	prevTunnel := newTunnelForStack
 	prevWait := waitForTunnelReady
 	prevSleep := sleepForRestart
+	prevNow := nowForRestart
+	prevJitter := restartJitter
+	prevSOCKS := newSOCKSServer
+	prevUpstream := newUpstreamDialer
 	t.Cleanup(func() {
+		newSOCKSServer = prevSOCKS
+		newUpstreamDialer = prevUpstream
 		newSOCKS5Dialer = prevDialer
 		newHTTPProxy = prevProxy
 		newTunnelForStack = prevTunnel
 		waitForTunnelReady = prevWait
 		sleepForRestart = prevSleep
+		nowForRestart = prevNow
+		restartJitter = prevJitter
 	})
 
 	if dialerFn != nil {
@@ -124,6 +171,8 @@ func withStackTestHooks(t *testing.T, dialerFn func(string, time.Duration) (loca
 		waitForTunnelReady = waitFn
 	}
 	sleepForRestart = func(time.Duration) {}
+	// The midpoint cancels out jitter.
+	restartJitter = func() float64 { return 0.5 }
 }
 
 func TestStartSuccessWithInjectedDependencies(t *testing.T) {
@@ -228,7 +277,7 @@ func TestCloseReturnsFirstError(t *testing.T) {
 	tun.stopErr = errors.New("stop failed")
 	proxy := &fakeProxy{closeErr: errors.New("close failed")}
 	s := &Stack{
-		tunnel: tun,
+		slots:  []*tunnelSlot{{tunnel: tun}},
 		proxy:  proxy,
 		stopCh: make(chan struct{}),
 	}
@@ -245,6 +294,40 @@ func TestCloseReturnsFirstError(t *testing.T) {
 	}
 }
 
+func TestShutdownDrainsBeforeStoppingTunnel(t *testing.T) {
+	tun := newFakeTunnel(nil)
+	proxy := &fakeProxy{drainResult: localproxy.DrainResult{Drained: 2, Killed: 1}}
+	proxy.onDrain = func(ctx context.Context) {
+		if tun.stopCount() != 0 {
+			t.Errorf("tunnel stopped before the proxy drained")
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("expected drain context to carry a deadline")
+		}
+	}
+	s := &Stack{
+		slots:  []*tunnelSlot{{tunnel: tun}},
+		proxy:  proxy,
+		stopCh: make(chan struct{}),
+	}
+
+	res, err := s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+	if res.Drained != 2 || res.Killed != 1 {
+		t.Fatalf("unexpected drain result: %+v", res)
+	}
+	if proxy.drainCalls != 1 || proxy.closeCalls != 1 || tun.stopCount() != 1 {
+		t.Fatalf("drain=%d close=%d stop=%d, want 1 each", proxy.drainCalls, proxy.closeCalls, tun.stopCount())
+	}
+
+	// A second Shutdown is a no-op.
+	if res, err := s.Shutdown(context.Background()); err != nil || res != (localproxy.DrainResult{}) {
+		t.Fatalf("second Shutdown = %+v, %v", res, err)
+	}
+}
+
 func TestMonitorRestartsTunnelAfterExit(t *testing.T) {
 	initial := newFakeTunnel(errors.New("initial exit"))
 	restarted := newFakeTunnel(nil)
@@ -263,14 +346,15 @@ func TestMonitorRestartsTunnelAfterExit(t *testing.T) {
 	s := &Stack{
 		Profile:   config.Profile{Host: "host", Port: 22, User: "user"},
 		SocksPort: 19090,
-		tunnel:    initial,
+		slots:     []*tunnelSlot{{tunnel: initial}},
 		fatalCh:   make(chan error, 1),
 		stopCh:    make(chan struct{}),
+		metrics:   localproxy.NewMetrics(),
 	}
 
 	done := make(chan struct{})
 	go func() {
-		s.monitor(Options{MaxRestarts: 1})
+		s.monitor(s.slots[0], Options{Restart: RestartPolicy{Budget: 1}})
 		close(done)
 	}()
 
@@ -303,6 +387,9 @@ func TestMonitorRestartsTunnelAfterExit(t *testing.T) {
 	if restarted.stopCount() != 1 {
 		t.Fatalf("expected restarted tunnel to be stopped during Close, got %d", restarted.stopCount())
 	}
+	if got := s.metrics.TunnelRestarts(); got != 1 {
+		t.Fatalf("expected 1 tunnel restart in metrics, got %d", got)
+	}
 }
 
 func TestMonitorReportsFatalWhenRestartCreationFails(t *testing.T) {
@@ -319,19 +406,803 @@ func TestMonitorReportsFatalWhenRestartCreationFails(t *testing.T) {
 	s := &Stack{
 		Profile:   config.Profile{Host: "host", Port: 22, User: "user"},
 		SocksPort: 19090,
-		tunnel:    initial,
+		slots:     []*tunnelSlot{{tunnel: initial}},
 		fatalCh:   make(chan error, 1),
 		stopCh:    make(chan struct{}),
 	}
 
-	go s.monitor(Options{MaxRestarts: 1})
+	go s.monitor(s.slots[0], Options{Restart: RestartPolicy{Budget: 1}})
 
 	select {
 	case err := <-s.fatalCh:
-		if err == nil || err.Error() != "restart boom" {
+		if err == nil || err.Error() != "ssh tunnel restarted 1 times within 10m0s: restart boom" {
 			t.Fatalf("expected restart error, got %v", err)
 		}
 	case <-time.After(2 * time.Second):
 		t.Fatalf("timeout waiting for fatal error")
 	}
 }
+
+func TestStartGeneratesProxyAuthTokenWhenProfileRequiresIt(t *testing.T) {
+	var gotOpts localproxy.Options
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(_ localproxy.Dialer, opts localproxy.Options) httpProxy {
+			gotOpts = opts
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(config.Profile, int) (tunnel, error) { return newFakeTunnel(nil), nil },
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	profile := config.Profile{Host: "host", Port: 22, User: "user", ProxyAuth: true}
+	st, err := Start(profile, "inst-1", Options{SocksPort: 19090})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+	if st.ProxyAuthToken == "" || gotOpts.AuthToken != st.ProxyAuthToken {
+		t.Fatalf("expected generated token to reach proxy, stack=%q proxy=%q", st.ProxyAuthToken, gotOpts.AuthToken)
+	}
+	if want := "http://claude-proxy:" + st.ProxyAuthToken + "@127.0.0.1:18080"; st.HTTPProxyURL() != want {
+		t.Fatalf("HTTPProxyURL=%q want %q", st.HTTPProxyURL(), want)
+	}
+
+	st2, err := Start(profile, "inst-2", Options{SocksPort: 19090, ProxyAuthToken: "kept"})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st2.Close(context.Background()) }()
+	if st2.ProxyAuthToken != "kept" {
+		t.Fatalf("expected provided token to be reused, got %q", st2.ProxyAuthToken)
+	}
+}
+
+func TestStartExposesAuthenticatedSOCKSListener(t *testing.T) {
+	proxy := &fakeProxy{startAddr: "127.0.0.1:18080"}
+	var gotHTTPOpts localproxy.Options
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(_ localproxy.Dialer, opts localproxy.Options) httpProxy {
+			gotHTTPOpts = opts
+			return proxy
+		},
+		func(config.Profile, int) (tunnel, error) { return newFakeTunnel(nil), nil },
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+	socks := &fakeSOCKSServer{}
+	newSOCKSServer = func(_ localproxy.Dialer, opts localproxy.SOCKSOptions) socksServer {
+		socks.opts = opts
+		return socks
+	}
+
+	profile := config.Profile{Host: "host", Port: 22, User: "user", ExposeSOCKS: true}
+	st, err := Start(profile, "inst-1", Options{SocksPort: 19090})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if socks.listenAddr != "127.0.0.1:0" {
+		t.Fatalf("expected free-port listen addr, got %q", socks.listenAddr)
+	}
+	if st.SOCKSListenPort != 11080 {
+		t.Fatalf("SOCKSListenPort=%d want 11080", st.SOCKSListenPort)
+	}
+	if st.SOCKSAuthToken == "" || socks.opts.AuthToken != st.SOCKSAuthToken {
+		t.Fatalf("expected a generated SOCKS credential, stack=%q socks=%q", st.SOCKSAuthToken, socks.opts.AuthToken)
+	}
+	if st.ProxyAuthToken != "" || gotHTTPOpts.AuthToken != "" {
+		t.Fatalf("ExposeSOCKS must not turn on HTTP proxy auth, stack=%q http=%q", st.ProxyAuthToken, gotHTTPOpts.AuthToken)
+	}
+	if want := "socks5h://claude-proxy:" + st.SOCKSAuthToken + "@127.0.0.1:11080"; st.SOCKSProxyURL() != want {
+		t.Fatalf("SOCKSProxyURL=%q want %q", st.SOCKSProxyURL(), want)
+	}
+	if socks.opts.Conns == nil || socks.opts.Conns != gotHTTPOpts.Conns || socks.opts.Metrics != gotHTTPOpts.Metrics {
+		t.Fatalf("expected SOCKS to share the HTTP proxy's registry and metrics")
+	}
+
+	proxy.onDrain = func(context.Context) {
+		if !socks.listenerClosed {
+			t.Errorf("expected the SOCKS listener to stop before the drain")
+		}
+	}
+	if err := st.Close(context.Background()); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if socks.closeCalls != 1 {
+		t.Fatalf("expected SOCKS listener to be closed once, got %d", socks.closeCalls)
+	}
+}
+
+func TestStartWithoutSOCKSListener(t *testing.T) {
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(localproxy.Dialer, localproxy.Options) httpProxy { return &fakeProxy{startAddr: "127.0.0.1:18080"} },
+		func(config.Profile, int) (tunnel, error) { return newFakeTunnel(nil), nil },
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+	newSOCKSServer = func(localproxy.Dialer, localproxy.SOCKSOptions) socksServer {
+		t.Fatalf("SOCKS listener should not start")
+		return nil
+	}
+
+	st, err := Start(config.Profile{Host: "host", Port: 22, User: "user"}, "inst-1", Options{SocksPort: 19090})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+	if st.SOCKSListenPort != 0 || st.SOCKSProxyURL() != "" || st.ProxyAuthToken != "" {
+		t.Fatalf("unexpected SOCKS state: port=%d url=%q token=%q", st.SOCKSListenPort, st.SOCKSProxyURL(), st.ProxyAuthToken)
+	}
+}
+
+func TestStartOpensAccessLog(t *testing.T) {
+	var gotOpts localproxy.Options
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(_ localproxy.Dialer, opts localproxy.Options) httpProxy {
+			gotOpts = opts
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(config.Profile, int) (tunnel, error) { return newFakeTunnel(nil), nil },
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	path := filepath.Join(t.TempDir(), "instances", "inst-1.access.log")
+	st, err := Start(config.Profile{Host: "host", Port: 22, User: "user"}, "inst-1", Options{SocksPort: 19090, AccessLogPath: path})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if gotOpts.AccessLog == nil {
+		t.Fatalf("expected access log to be passed to the HTTP proxy")
+	}
+	gotOpts.AccessLog.Log(localproxy.AccessLogEntry{InstanceID: "inst-1", Method: "CONNECT", Destination: "example.com:443"})
+	if err := st.Close(context.Background()); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read access log: %v", err)
+	}
+	if !strings.Contains(string(data), `"destination":"example.com:443"`) {
+		t.Fatalf("unexpected access log: %s", data)
+	}
+}
+
+func TestStartWithHTTPProxyProfileUsesUpstreamDialer(t *testing.T) {
+	var readyAddr string
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) {
+			t.Fatalf("SOCKS5 dialer must not be used for http-proxy profiles")
+			return nil, nil
+		},
+		func(localproxy.Dialer, localproxy.Options) httpProxy { return &fakeProxy{startAddr: "127.0.0.1:18080"} },
+		func(p config.Profile, socksPort int) (tunnel, error) {
+			if !p.IsHTTPProxy() || socksPort != 0 {
+				t.Fatalf("unexpected tunnel args: %#v socksPort=%d", p, socksPort)
+			}
+			return newFakeTunnel(nil), nil
+		},
+		func(addr string, _ time.Duration, _ tunnel) error {
+			readyAddr = addr
+			return nil
+		},
+	)
+	var upstreamURL string
+	newUpstreamDialer = func(u string, _ time.Duration) (localproxy.Dialer, error) {
+		upstreamURL = u
+		return fakeDialer{}, nil
+	}
+
+	profile := config.Profile{Type: config.ProfileTypeHTTPProxy, UpstreamProxy: "http://user:pw@proxy.corp"}
+	st, err := Start(profile, "inst-1", Options{SocksPort: 19090})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+
+	if upstreamURL != profile.UpstreamProxy {
+		t.Fatalf("upstream dialer URL=%q", upstreamURL)
+	}
+	if readyAddr != "proxy.corp:80" || st.tunnelReadyAddr() != "proxy.corp:80" {
+		t.Fatalf("expected readiness probe on upstream proxy, got %q / %q", readyAddr, st.tunnelReadyAddr())
+	}
+	if st.SocksPort != 0 {
+		t.Fatalf("expected no ssh SOCKS port, got %d", st.SocksPort)
+	}
+}
+
+type dialingTunnel struct {
+	*fakeTunnel
+	dialErr error
+
+	mu    sync.Mutex
+	dials []string
+}
+
+func (t *dialingTunnel) Dial(_, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	t.dials = append(t.dials, addr)
+	t.mu.Unlock()
+	return nil, t.dialErr
+}
+
+func (t *dialingTunnel) dialCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.dials)
+}
+
+func TestStartWithNativeSSHDialsThroughCurrentTunnel(t *testing.T) {
+	first := &dialingTunnel{fakeTunnel: newFakeTunnel(errors.New("connection lost")), dialErr: &gossh.OpenChannelError{Reason: gossh.ConnectionFailed, Message: "refused"}}
+	second := &dialingTunnel{fakeTunnel: newFakeTunnel(nil)}
+	tunnels := []*dialingTunnel{first, second}
+
+	var gotDialer localproxy.Dialer
+	var readyAddr string
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) {
+			t.Fatalf("SOCKS5 dialer must not be used for the native backend")
+			return nil, nil
+		},
+		func(d localproxy.Dialer, _ localproxy.Options) httpProxy {
+			gotDialer = d
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(p config.Profile, socksPort int) (tunnel, error) {
+			if !p.UsesNativeSSH() || socksPort != 0 {
+				t.Fatalf("unexpected tunnel args: %#v socksPort=%d", p, socksPort)
+			}
+			next := tunnels[0]
+			tunnels = tunnels[1:]
+			return next, nil
+		},
+		func(addr string, _ time.Duration, _ tunnel) error {
+			readyAddr = addr
+			return nil
+		},
+	)
+
+	profile := config.Profile{Host: "bastion", Port: 2222, User: "me", SSHBackend: config.SSHBackendNative}
+	st, err := Start(profile, "inst-1", Options{})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+
+	if readyAddr != "bastion:2222" || st.SocksPort != 0 {
+		t.Fatalf("readyAddr=%q socksPort=%d", readyAddr, st.SocksPort)
+	}
+
+	_, err = gotDialer.Dial("tcp", "example.com:443")
+	var target *localproxy.TargetDialError
+	if !errors.As(err, &target) {
+		t.Fatalf("expected a rejected channel to surface as TargetDialError, got %v", err)
+	}
+	if first.dialCount() != 1 {
+		t.Fatalf("expected the first tunnel to carry the dial")
+	}
+
+	first.exit()
+	deadline := time.Now().Add(2 * time.Second)
+	for st.currentTunnel() != tunnel(second) {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel was not restarted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := gotDialer.Dial("tcp", "example.com:443"); err != nil {
+		t.Fatalf("dial after restart: %v", err)
+	}
+	if second.dialCount() != 1 {
+		t.Fatalf("expected dials to follow the restarted tunnel")
+	}
+}
+
+func TestUpstreamWatchExitsWhenUpstreamUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	w := &upstreamWatch{
+		addr:     addr,
+		interval: 10 * time.Millisecond,
+		failures: 2,
+		stopCh:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := w.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	select {
+	case <-w.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("watch did not exit for unreachable upstream")
+	}
+	if err := w.Wait(); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Fatalf("expected unreachable error, got %v", err)
+	}
+}
+
+func TestUpstreamWatchStopBeforeStart(t *testing.T) {
+	tun, err := newUpstreamWatch(config.Profile{Type: config.ProfileTypeHTTPProxy, UpstreamProxy: "https://proxy.corp"})
+	if err != nil {
+		t.Fatalf("newUpstreamWatch: %v", err)
+	}
+	if got := tun.(*upstreamWatch).addr; got != "proxy.corp:443" {
+		t.Fatalf("addr=%q want proxy.corp:443", got)
+	}
+	if err := tun.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := tun.Wait(); err != nil {
+		t.Fatalf("Wait after Stop: %v", err)
+	}
+}
+
+func TestStartWrapsDialerWithRoutingTable(t *testing.T) {
+	var gotDialer localproxy.Dialer
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(d localproxy.Dialer, _ localproxy.Options) httpProxy {
+			gotDialer = d
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(config.Profile, int) (tunnel, error) { return newFakeTunnel(nil), nil },
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+	prevDirect := newDirectDialer
+	t.Cleanup(func() { newDirectDialer = prevDirect })
+	var directAddrs []string
+	newDirectDialer = func(time.Duration) localproxy.Dialer {
+		return directDialerFunc(func(network, addr string) (net.Conn, error) {
+			directAddrs = append(directAddrs, addr)
+			return nil, errors.New("direct")
+		})
+	}
+
+	profile := config.Profile{
+		Host: "host", Port: 22, User: "user",
+		Routes: []config.Route{{Match: "registry.npmjs.org", Via: "direct"}},
+	}
+	st, err := Start(profile, "inst-1", Options{SocksPort: 19090})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+
+	if _, err := gotDialer.Dial("tcp", "registry.npmjs.org:443"); err == nil || err.Error() != "direct" {
+		t.Fatalf("expected direct dialer, got %v", err)
+	}
+	if _, err := gotDialer.Dial("tcp", "api.anthropic.com:443"); err == nil || err.Error() != "unused" {
+		t.Fatalf("expected tunnel dialer, got %v", err)
+	}
+	if len(directAddrs) != 1 || directAddrs[0] != "registry.npmjs.org:443" {
+		t.Fatalf("unexpected direct dials: %v", directAddrs)
+	}
+}
+
+func TestValidateProfileRejectsInvalidRoutes(t *testing.T) {
+	profile := config.Profile{Host: "host", Port: 22, User: "user", DefaultRoute: "sideways"}
+	if err := ValidateProfile(profile); err == nil || !strings.Contains(err.Error(), "unknown route action") {
+		t.Fatalf("expected invalid route error, got %v", err)
+	}
+}
+
+func TestStartKeepsIdleTunnelsUnlessTheProfileSetsATimeout(t *testing.T) {
+	var gotOpts localproxy.Options
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(_ localproxy.Dialer, opts localproxy.Options) httpProxy {
+			gotOpts = opts
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(config.Profile, int) (tunnel, error) { return newFakeTunnel(nil), nil },
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	for _, tc := range []struct {
+		timeout string
+		want    time.Duration
+	}{
+		{timeout: "", want: 0},
+		{timeout: "15m", want: 15 * time.Minute},
+	} {
+		profile := config.Profile{Host: "host", Port: 22, User: "user", TunnelIdleTimeout: tc.timeout}
+		st, err := Start(profile, "inst-1", Options{SocksPort: 19090})
+		if err != nil {
+			t.Fatalf("Start error: %v", err)
+		}
+		_ = st.Close(context.Background())
+		if gotOpts.TunnelIdleTimeout != tc.want {
+			t.Fatalf("tunnelIdleTimeout %q: got %v want %v", tc.timeout, gotOpts.TunnelIdleTimeout, tc.want)
+		}
+	}
+
+	profile := config.Profile{Host: "host", Port: 22, User: "user", TunnelIdleTimeout: "soon"}
+	if err := ValidateProfile(profile); err == nil || !strings.Contains(err.Error(), "invalid tunnelIdleTimeout") {
+		t.Fatalf("expected invalid tunnelIdleTimeout error, got %v", err)
+	}
+}
+
+type directDialerFunc func(network, addr string) (net.Conn, error)
+
+func (f directDialerFunc) Dial(network, addr string) (net.Conn, error) { return f(network, addr) }
+
+// labelDialer fails every dial with its label, so tests can tell which
+// backend a listener dialed through.
+type labelDialer string
+
+func (d labelDialer) Dial(string, string) (net.Conn, error) { return nil, errors.New(string(d)) }
+
+func TestStartFailsOverWhenPrimaryCannotStart(t *testing.T) {
+	broken := newFakeTunnel(nil)
+	broken.startErr = errors.New("bastion down")
+	backup := newFakeTunnel(nil)
+
+	var gotDialer localproxy.Dialer
+	var events []FailoverEvent
+	withStackTestHooks(
+		t,
+		func(addr string, _ time.Duration) (localproxy.Dialer, error) { return labelDialer(addr), nil },
+		func(d localproxy.Dialer, _ localproxy.Options) httpProxy {
+			gotDialer = d
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(p config.Profile, _ int) (tunnel, error) {
+			if p.Name == "primary" {
+				return broken, nil
+			}
+			return backup, nil
+		},
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	primary := config.Profile{Name: "primary", Host: "a", Port: 22, User: "u"}
+	secondary := config.Profile{Name: "secondary", Host: "b", Port: 22, User: "u"}
+	st, err := Start(primary, "inst-1", Options{
+		SocksPort:  19090,
+		Failover:   []config.Profile{secondary},
+		OnFailover: func(e FailoverEvent) { events = append(events, e) },
+	})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+
+	if got := st.ActiveProfile().Name; got != "secondary" {
+		t.Fatalf("active profile=%q want secondary", got)
+	}
+	if st.Failovers() != 1 || len(events) != 1 || events[0].From.Name != "primary" || events[0].To.Name != "secondary" {
+		t.Fatalf("failovers=%d events=%+v", st.Failovers(), events)
+	}
+	if !strings.Contains(events[0].String(), "bastion down") {
+		t.Fatalf("event should carry the cause: %s", events[0])
+	}
+	_, err = gotDialer.Dial("tcp", "example.com:443")
+	if err == nil || err.Error() == "127.0.0.1:19090" {
+		t.Fatalf("expected dials through the secondary SOCKS port, got %v", err)
+	}
+	if st.currentTunnel() != tunnel(backup) {
+		t.Fatalf("expected the backup tunnel to be current")
+	}
+}
+
+func TestMonitorFailsOverWhenPrimaryCannotRestart(t *testing.T) {
+	var mu sync.Mutex
+	var primaryTunnels int
+	var firstPrimary *fakeTunnel
+	backup := newFakeTunnel(nil)
+	proxyStarts := 0
+	var gotDialer localproxy.Dialer
+	withStackTestHooks(
+		t,
+		func(addr string, _ time.Duration) (localproxy.Dialer, error) { return labelDialer(addr), nil },
+		func(d localproxy.Dialer, _ localproxy.Options) httpProxy {
+			proxyStarts++
+			gotDialer = d
+			return &fakeProxy{startAddr: "127.0.0.1:18080"}
+		},
+		func(p config.Profile, _ int) (tunnel, error) {
+			if p.Name == "backup" {
+				return backup, nil
+			}
+			mu.Lock()
+			primaryTunnels++
+			first := primaryTunnels == 1
+			mu.Unlock()
+			// The primary comes up once, dies, and cannot be restarted.
+			tun := newFakeTunnel(errors.New("connection reset"))
+			if first {
+				mu.Lock()
+				firstPrimary = tun
+				mu.Unlock()
+			} else {
+				tun.startErr = errors.New("bastion down")
+			}
+			return tun, nil
+		},
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	eventCh := make(chan FailoverEvent, 1)
+	st, err := Start(config.Profile{Name: "main", Host: "a", Port: 22, User: "u"}, "inst-1", Options{
+		SocksPort:  19090,
+		Restart:    RestartPolicy{Budget: 2},
+		Failover:   []config.Profile{{Name: "backup", Host: "b", Port: 22, User: "u"}},
+		OnFailover: func(e FailoverEvent) { eventCh <- e },
+	})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+	mu.Lock()
+	firstPrimary.exit()
+	mu.Unlock()
+
+	select {
+	case e := <-eventCh:
+		if e.From.Name != "main" || e.To.Name != "backup" || !strings.Contains(e.Err.Error(), "bastion down") {
+			t.Fatalf("unexpected event: %s", e)
+		}
+	case err := <-st.Fatal():
+		t.Fatalf("unexpected fatal error: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for failover")
+	}
+	mu.Lock()
+	n := primaryTunnels
+	mu.Unlock()
+	if n != 3 {
+		t.Fatalf("expected two restart attempts on the primary, got %d tunnels", n)
+	}
+	if proxyStarts != 1 {
+		t.Fatalf("failover must keep the HTTP listener, got %d starts", proxyStarts)
+	}
+	if st.HTTPPort != 18080 || st.ActiveProfile().Name != "backup" {
+		t.Fatalf("port=%d active=%q", st.HTTPPort, st.ActiveProfile().Name)
+	}
+	if _, err := gotDialer.Dial("tcp", "example.com:443"); err == nil || err.Error() == "127.0.0.1:19090" {
+		t.Fatalf("expected dials to follow the backup, got %v", err)
+	}
+}
+
+func TestFailoverReportsFatalWhenEveryProfileFails(t *testing.T) {
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(localproxy.Dialer, localproxy.Options) httpProxy { return &fakeProxy{startAddr: "127.0.0.1:18080"} },
+		func(p config.Profile, _ int) (tunnel, error) { return nil, errors.New(p.Name + " unreachable") },
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	_, err := Start(config.Profile{Name: "a", Host: "a", Port: 22, User: "u"}, "inst-1", Options{
+		Failover: []config.Profile{{Name: "b", Host: "b", Port: 22, User: "u"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "a unreachable") || !strings.Contains(err.Error(), `profile "b": b unreachable`) {
+		t.Fatalf("expected both failures, got %v", err)
+	}
+
+	if _, err := Start(config.Profile{Name: "a", Host: "a", Port: 22, User: "u"}, "inst-1", Options{
+		Failover: []config.Profile{{Name: "bad"}},
+	}); err == nil || !strings.Contains(err.Error(), `failover profile "bad"`) {
+		t.Fatalf("expected invalid failover profile error, got %v", err)
+	}
+}
+
+func TestRestartTunnelsRestartsWithCause(t *testing.T) {
+	var mu sync.Mutex
+	var tunnels []*fakeTunnel
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(localproxy.Dialer, localproxy.Options) httpProxy { return &fakeProxy{startAddr: "127.0.0.1:18080"} },
+		func(config.Profile, int) (tunnel, error) {
+			tun := newFakeTunnel(nil)
+			mu.Lock()
+			tunnels = append(tunnels, tun)
+			mu.Unlock()
+			return tun, nil
+		},
+		func(string, time.Duration, tunnel) error { return nil },
+	)
+
+	st, err := Start(config.Profile{Name: "work", Host: "h", Port: 22, User: "u"}, "inst-1", Options{SocksPort: 19090})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+	events, cancel := st.Subscribe()
+	defer cancel()
+
+	st.RestartTunnels(errors.New("probe failed"))
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == EventTunnelExited && (e.Err == nil || e.Err.Error() != "probe failed") {
+				t.Fatalf("exit event err=%v, want the restart cause", e.Err)
+			}
+			if e.Kind != EventTunnelReady || e.Attempt == 0 {
+				continue
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for the restarted tunnel")
+		}
+		break
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tunnels) != 2 || tunnels[0].stopCount() != 1 {
+		t.Fatalf("expected the tunnel to be stopped and replaced, got %d tunnels", len(tunnels))
+	}
+	// The ready event precedes the slot going back into rotation.
+	deadline := time.Now().Add(2 * time.Second)
+	got := st.Tunnels()
+	for (len(got) != 1 || !got[0].Healthy) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		got = st.Tunnels()
+	}
+	if len(got) != 1 || !got[0].Healthy || got[0].Restarts != 1 || got[0].LastError != "probe failed" || got[0].LastErrorAt.IsZero() {
+		t.Fatalf("Tunnels()=%+v, want one healthy restarted tunnel with the cause as last error", got)
+	}
+}
+
+func TestStartWaitsForLocalForwardsOnFirstTunnel(t *testing.T) {
+	var mu sync.Mutex
+	var waits []string
+	forwardsBySocks := map[int]int{}
+	var first *fakeTunnel
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(localproxy.Dialer, localproxy.Options) httpProxy { return &fakeProxy{startAddr: "127.0.0.1:18080"} },
+		func(p config.Profile, socksPort int) (tunnel, error) {
+			tun := newFakeTunnel(errors.New("dropped"))
+			mu.Lock()
+			defer mu.Unlock()
+			forwardsBySocks[socksPort] = len(p.LocalForwards)
+			if socksPort == 19090 && first == nil {
+				first = tun
+			}
+			return tun, nil
+		},
+		func(addr string, _ time.Duration, _ tunnel) error {
+			mu.Lock()
+			waits = append(waits, addr)
+			mu.Unlock()
+			return nil
+		},
+	)
+
+	p := config.Profile{Name: "work", Host: "h", Port: 22, User: "u", LocalForwards: []config.LocalForward{
+		{LocalPort: 15432, RemoteHost: "db.internal", RemotePort: 5432},
+	}}
+	st, err := Start(p, "inst-1", Options{SocksPort: 19090, Tunnels: 2})
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer func() { _ = st.Close(context.Background()) }()
+
+	countForwardWaits := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := 0
+		for _, w := range waits {
+			if w == "127.0.0.1:15432" {
+				n++
+			}
+		}
+		return n
+	}
+	mu.Lock()
+	if forwardsBySocks[19090] != 1 || len(forwardsBySocks) != 2 {
+		mu.Unlock()
+		t.Fatalf("expected only the first tunnel to carry the forward, got %v", forwardsBySocks)
+	}
+	mu.Unlock()
+	if n := countForwardWaits(); n != 1 {
+		t.Fatalf("expected Start to wait for the forward once, got %d", n)
+	}
+
+	// The forward comes back with its tunnel.
+	first.exit()
+	deadline := time.Now().Add(2 * time.Second)
+	for countForwardWaits() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("restart did not wait for the forward again")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStartFailsWhenLocalForwardNeverListens(t *testing.T) {
+	tun := newFakeTunnel(nil)
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(localproxy.Dialer, localproxy.Options) httpProxy { return &fakeProxy{startAddr: "127.0.0.1:18080"} },
+		func(config.Profile, int) (tunnel, error) { return tun, nil },
+		func(addr string, _ time.Duration, _ tunnel) error {
+			if addr == "127.0.0.1:15432" {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+	)
+
+	p := config.Profile{Name: "work", Host: "h", Port: 22, User: "u", LocalForwards: []config.LocalForward{
+		{LocalPort: 15432, RemoteHost: "db.internal", RemotePort: 5432},
+	}}
+	_, err := Start(p, "inst-1", Options{SocksPort: 19090})
+	if err == nil || err.Error() != "local forward 15432->db.internal:5432: connection refused" {
+		t.Fatalf("expected the forward error, got %v", err)
+	}
+	if tun.stopCount() == 0 {
+		t.Fatalf("expected the tunnel to be stopped")
+	}
+}
+
+type slowStopTunnel struct {
+	*fakeTunnel
+	stopping chan struct{}
+	release  chan struct{}
+}
+
+func (t *slowStopTunnel) Stop(grace time.Duration) error {
+	close(t.stopping)
+	<-t.release
+	return t.fakeTunnel.Stop(grace)
+}
+
+func TestActivateAfterCloseStopsTheTunnelWithoutTheStackLock(t *testing.T) {
+	s := &Stack{closed: true}
+	tun := &slowStopTunnel{fakeTunnel: newFakeTunnel(nil), stopping: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan bool, 1)
+	go func() { done <- s.activate(&tunnelSlot{}, 0, &backend{}, tun, time.Second) }()
+
+	<-tun.stopping
+	if !s.mu.TryLock() {
+		close(tun.release)
+		t.Fatalf("expected the stack lock to be free while the late tunnel stops")
+	}
+	s.mu.Unlock()
+	close(tun.release)
+	if <-done {
+		t.Fatalf("expected activate to refuse a closed stack")
+	}
+}
+
+func TestStartFailsWhenTheTunnelExitsWhileForwardsComeUp(t *testing.T) {
+	tun := newFakeTunnel(errors.New("bind [127.0.0.1]:15432: Address already in use"))
+	withStackTestHooks(
+		t,
+		func(string, time.Duration) (localproxy.Dialer, error) { return fakeDialer{}, nil },
+		func(localproxy.Dialer, localproxy.Options) httpProxy { return &fakeProxy{startAddr: "127.0.0.1:18080"} },
+		func(config.Profile, int) (tunnel, error) { return tun, nil },
+		func(addr string, _ time.Duration, _ tunnel) error {
+			// Another process listens on the forward port; ssh gives up on it.
+			if addr == "127.0.0.1:15432" {
+				tun.exit()
+			}
+			return nil
+		},
+	)
+
+	p := config.Profile{Name: "work", Host: "h", Port: 22, User: "u", LocalForwards: []config.LocalForward{
+		{LocalPort: 15432, RemoteHost: "db.internal", RemotePort: 5432},
+	}}
+	_, err := Start(p, "inst-1", Options{SocksPort: 19090})
+	if err == nil || !strings.Contains(err.Error(), "Address already in use") {
+		t.Fatalf("expected the tunnel's exit to fail the start, got %v", err)
+	}
+}
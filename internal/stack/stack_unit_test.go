@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,6 +35,65 @@ func TestValidateProfile(t *testing.T) {
 	}
 }
 
+func TestValidateProfileJumpHosts(t *testing.T) {
+	p := config.Profile{Host: "h", Port: 22, User: "u", JumpHosts: []config.JumpHost{
+		{Host: "b1", User: "ops", IdentityFile: "~/.ssh/b1"},
+		{Host: "b2", Port: 2222},
+	}}
+	if err := ValidateProfile(p); err != nil {
+		t.Fatalf("expected valid profile, got %v", err)
+	}
+	hops := JumpHosts(p)
+	if len(hops) != 2 || hops[0].String() != "ops@b1:22" || hops[1].String() != "u@b2:2222" || hops[0].IdentityFile != "~/.ssh/b1" {
+		t.Fatalf("JumpHosts=%+v", hops)
+	}
+
+	p.LocalForwards = []config.LocalForward{{LocalPort: 8080, RemoteHost: "api.internal", RemotePort: 80}}
+	if err := ValidateProfile(p); err != nil {
+		t.Fatalf("expected valid local forwards, got %v", err)
+	}
+	p.LocalForwards = append(p.LocalForwards, config.LocalForward{LocalPort: 8080, RemoteHost: "other", RemotePort: 81})
+	if err := ValidateProfile(p); err == nil || !strings.Contains(err.Error(), "forwarded twice") {
+		t.Fatalf("expected a duplicate forward error, got %v", err)
+	}
+	p.LocalForwards = nil
+
+	p.JumpHosts = append(p.JumpHosts, config.JumpHost{Host: ""})
+	if err := ValidateProfile(p); err == nil || !strings.Contains(err.Error(), "jump host 3") {
+		t.Fatalf("expected jump host 3 error, got %v", err)
+	}
+}
+
+func TestValidateHTTPProxyProfile(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile config.Profile
+		wantErr string
+	}{
+		{name: "valid", profile: config.Profile{Type: config.ProfileTypeHTTPProxy, UpstreamProxy: "http://proxy.corp:3128"}},
+		{name: "https with auth", profile: config.Profile{Type: config.ProfileTypeHTTPProxy, UpstreamProxy: "https://u:p@proxy.corp"}},
+		{name: "missing url", profile: config.Profile{Type: config.ProfileTypeHTTPProxy}, wantErr: "upstreamProxy is required"},
+		{name: "bad scheme", profile: config.Profile{Type: config.ProfileTypeHTTPProxy, UpstreamProxy: "socks5://proxy.corp"}, wantErr: "http:// or https://"},
+		{name: "missing host", profile: config.Profile{Type: config.ProfileTypeHTTPProxy, UpstreamProxy: "http://"}, wantErr: "missing a host"},
+		{name: "local forwards", profile: config.Profile{Type: config.ProfileTypeHTTPProxy, UpstreamProxy: "http://proxy.corp:3128", LocalForwards: []config.LocalForward{{LocalPort: 1, RemoteHost: "h", RemotePort: 1}}}, wantErr: "need an SSH profile"},
+		{name: "unknown type", profile: config.Profile{Type: "ftp"}, wantErr: "unknown profile type"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateProfile(tc.profile)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected valid profile, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
 func TestStartValidationErrors(t *testing.T) {
 	profile := config.Profile{Host: "", Port: 22, User: "u"}
 	if _, err := Start(profile, "id", Options{}); err == nil {
@@ -145,12 +205,12 @@ func TestMonitorReportsFatalOnImmediateExit(t *testing.T) {
 	s := &Stack{
 		Profile:   config.Profile{Host: "example.com", Port: 22, User: "alice"},
 		SocksPort: 12345,
-		tunnel:    tun,
+		slots:     []*tunnelSlot{{tunnel: tun}},
 		fatalCh:   make(chan error, 1),
 		stopCh:    make(chan struct{}),
 	}
 
-	go s.monitor(Options{MaxRestarts: 0, RestartBackoff: 5 * time.Millisecond})
+	go s.monitor(s.slots[0], Options{Restart: RestartPolicy{Budget: 1, InitialDelay: 5 * time.Millisecond}})
 
 	select {
 	case err := <-s.fatalCh:
@@ -161,3 +221,49 @@ func TestMonitorReportsFatalOnImmediateExit(t *testing.T) {
 		t.Fatalf("timeout waiting for fatal error")
 	}
 }
+
+func TestValidateProfileRejectsInvalidDestinationRules(t *testing.T) {
+	p := config.Profile{Host: "h", Port: 22, User: "u", AllowDestinations: []string{"10.0.0.0/99"}}
+	if err := ValidateProfile(p); err == nil {
+		t.Fatalf("expected invalid allow rule error")
+	}
+	p = config.Profile{Host: "h", Port: 22, User: "u", DenyDestinations: []string{"*.example.com:443"}}
+	if err := ValidateProfile(p); err != nil {
+		t.Fatalf("expected valid deny rule, got %v", err)
+	}
+}
+
+func TestValidateProfileRejectsABlockedHealthProbe(t *testing.T) {
+	p := config.Profile{Host: "h", Port: 22, User: "u", HealthProbe: "tls://api.example.com:443", AllowDestinations: []string{"*.corp.example"}}
+	if err := ValidateProfile(p); err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Fatalf("expected a blocked probe error, got %v", err)
+	}
+	p.AllowDestinations = []string{"api.example.com:443"}
+	if err := ValidateProfile(p); err != nil {
+		t.Fatalf("expected an allowed probe, got %v", err)
+	}
+}
+
+func TestPACBypassIncludesNoProxyAndLeadingDirectRoutes(t *testing.T) {
+	t.Setenv("NO_PROXY", "corp.example")
+	t.Setenv("no_proxy", "")
+	routes, err := RoutingTable(config.Profile{Routes: []config.Route{
+		{Match: "*.npmjs.org", Via: "direct"},
+		{Match: "10.0.0.0/8", Via: "direct"},
+		{Match: "git.internal", Via: "direct"},
+		{Match: "*.pypi.org:443", Via: "direct"},
+		{Match: "api.example.com", Via: "tunnel"},
+		{Match: "*.example.com", Via: "direct"},
+	}})
+	if err != nil {
+		t.Fatalf("RoutingTable: %v", err)
+	}
+	got := strings.Join(pacBypass(routes), ",")
+	want := "corp.example,localhost,127.0.0.1,::1,*.npmjs.org,10.0.0.0/8"
+	if got != want {
+		t.Fatalf("pacBypass=%q want %q", got, want)
+	}
+	if got := strings.Join(pacBypass(nil), ","); got != "corp.example,localhost,127.0.0.1,::1" {
+		t.Fatalf("pacBypass(nil)=%q", got)
+	}
+}
@@ -1,5 +1,7 @@
 package stack
 
+import "github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+
 // NewStackForTest returns a minimal Stack for tests without SSH.
 func NewStackForTest(httpPort, socksPort int) *Stack {
 	return &Stack{
@@ -7,6 +9,7 @@ func NewStackForTest(httpPort, socksPort int) *Stack {
 		SocksPort: socksPort,
 		fatalCh:   make(chan error),
 		stopCh:    make(chan struct{}),
+		events:    newEventHub(),
 	}
 }
 
@@ -20,5 +23,22 @@ func NewStackWithFatalForTest(httpPort, socksPort int, fatalCh chan error) *Stac
 		SocksPort: socksPort,
 		fatalCh:   fatalCh,
 		stopCh:    make(chan struct{}),
+		events:    newEventHub(),
 	}
 }
+
+// PublishForTest emits e to the stack's event subscribers.
+func (s *Stack) PublishForTest(e Event) {
+	s.events.publish(e)
+}
+
+// SetTunnelDialerForTest puts a first tunnel dialing through d into
+// rotation.
+func (s *Stack) SetTunnelDialerForTest(d localproxy.Dialer) {
+	slot := s.primarySlot()
+	b := s.activeBackend(slot)
+	slot.mu.Lock()
+	b.dialer = d
+	slot.healthy = true
+	slot.mu.Unlock()
+}
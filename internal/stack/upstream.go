@@ -0,0 +1,94 @@
+package stack
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/baaaaaaaka/claude_code_helper/internal/config"
+	"github.com/baaaaaaaka/claude_code_helper/internal/localproxy"
+)
+
+var (
+	upstreamWatchInterval = 5 * time.Second
+	upstreamWatchFailures = 3
+)
+
+// upstreamWatch takes the place of the ssh process for http-proxy profiles.
+// It probes the upstream proxy's TCP port and exits after several consecutive
+// failures, so monitor applies the same restart budget as for ssh tunnels.
+type upstreamWatch struct {
+	addr     string
+	interval time.Duration
+	failures int
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+func newUpstreamWatch(profile config.Profile) (tunnel, error) {
+	u, err := localproxy.ParseUpstreamProxyURL(profile.UpstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamWatch{
+		addr:     u.Host,
+		interval: upstreamWatchInterval,
+		failures: upstreamWatchFailures,
+		stopCh:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func (w *upstreamWatch) Start() error {
+	w.startOnce.Do(func() { go w.run() })
+	return nil
+}
+
+func (w *upstreamWatch) run() {
+	defer close(w.done)
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+
+	misses := 0
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-t.C:
+		}
+		c, err := net.DialTimeout("tcp", w.addr, w.interval)
+		if err == nil {
+			_ = c.Close()
+			misses = 0
+			continue
+		}
+		misses++
+		if misses >= w.failures {
+			w.err = fmt.Errorf("upstream proxy %s unreachable: %w", w.addr, err)
+			return
+		}
+	}
+}
+
+func (w *upstreamWatch) Stop(grace time.Duration) error {
+	w.stopOnce.Do(func() { close(w.stopCh) })
+	// Stopping before Start leaves nothing to wait for.
+	w.startOnce.Do(func() { close(w.done) })
+	select {
+	case <-w.done:
+	case <-time.After(grace):
+	}
+	return nil
+}
+
+func (w *upstreamWatch) Wait() error {
+	<-w.done
+	return w.err
+}
+
+func (w *upstreamWatch) Done() <-chan struct{} { return w.done }